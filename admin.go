@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requireAdmin checks the request's bearer token against ADMIN_TOKEN and writes an error response if it doesn't match.
+// Admin endpoints are disabled entirely while ADMIN_TOKEN is unset.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "Invalid admin token")
+		return false
+	}
+
+	return true
+}
+
+// CacheStatsHandler returns the entry, hit, miss and eviction counts of each cache
+func CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, allCacheStats())
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchCities is the largest number of cities accepted in one batch
+const maxBatchCities = 20
+
+// maxPipelineSeconds is the longest run time a request can cap the pipeline at
+const maxPipelineSeconds = 600
+
+// BatchPlaylistRequest is the body of a batch playlist request
+type BatchPlaylistRequest struct {
+	Cities []string `json:"cities"`
+	Public bool     `json:"public"`
+	// Mood is used for every city instead of the mood of its weather, if set
+	Mood string `json:"mood,omitempty"`
+	// Genre narrows the mood of every city to an available genre seed, if set
+	Genre string `json:"genre,omitempty"`
+	// Market is the country code used for market-aware Spotify calls, if set
+	Market string `json:"market,omitempty"`
+	// BlendWith is a playlist ID or link whose tracks are interleaved with every new playlist, if set
+	BlendWith string `json:"blendWith,omitempty"`
+	// Profile is the name of a saved profile to create every playlist with, if set
+	Profile string `json:"profile,omitempty"`
+	// TargetMinutes fills every playlist to about this many minutes instead of a number of tracks, if set
+	TargetMinutes int `json:"targetMinutes,omitempty"`
+	// Limits override pipeline limits by name, such as {"maxSongsPerArtist": 3}
+	Limits map[string]int `json:"limits,omitempty"`
+	// InstrumentalOnly keeps only tracks without vocals in every playlist, whatever the mood
+	InstrumentalOnly bool `json:"instrumentalOnly,omitempty"`
+	// MaxSeconds caps the whole batch at this many seconds, after which each playlist is made from the tracks
+	// found until then, if set
+	MaxSeconds int `json:"maxSeconds,omitempty"`
+}
+
+// InvalidMoodResponse is the error response for an unknown mood, listing the valid moods
+type InvalidMoodResponse struct {
+	Error      string   `json:"error"`
+	ValidMoods []string `json:"validMoods"`
+}
+
+// BatchPlaylistResult is the outcome for a single city of a batch
+type BatchPlaylistResult struct {
+	City     string          `json:"city"`
+	Playlist *PlaylistResult `json:"playlist,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// writeJSON writes value as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		fmt.Printf("Failed to write JSON response: %v\n", err)
+	}
+}
+
+// writeJSONError writes an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// MoodFromWeatherResponse is the mood chosen for weather data, the rule that chose it and a readable reason
+type MoodFromWeatherResponse struct {
+	Mood   string `json:"mood"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// MoodFromWeatherHandler returns the mood for a Weather-shaped JSON body without calling OpenWeatherMap,
+// which makes it possible to check the weather to mood mapping with made up weather
+func MoodFromWeatherHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var weather Weather
+	if err := json.NewDecoder(r.Body).Decode(&weather); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid weather data: "+err.Error())
+		return
+	}
+
+	mood, rule := MatchWeatherMood(&weather)
+	writeJSON(w, http.StatusOK, MoodFromWeatherResponse{Mood: mood, Rule: rule, Reason: WeatherMoodReason(&weather, mood)})
+}
+
+// LastPlaylistHandler returns the playlist most recently shown to the logged in user, so its link isn't lost
+// with the page it was shown on
+func LastPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	shownResults.Lock()
+	result := shownResults.last[authenticatedUserID]
+	shownResults.Unlock()
+	if result == nil {
+		writeJSONError(w, http.StatusNotFound, "No playlist created yet")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// PreviewRequest asks what a weather playlist for a city or postal code would be like, without creating it
+type PreviewRequest struct {
+	City  string `json:"city"`
+	Mood  string `json:"mood,omitempty"`
+	Genre string `json:"genre,omitempty"`
+	// Limits override pipeline limits by name, such as {"maxSongsPerArtist": 3}
+	Limits map[string]int `json:"limits,omitempty"`
+}
+
+// MoodPreviewResponse is the weather of a city and the mood a playlist for it would get
+type MoodPreviewResponse struct {
+	City    string          `json:"city"`
+	Weather *WeatherSummary `json:"weather"`
+	Mood    string          `json:"mood"`
+	Reason  string          `json:"reason"`
+}
+
+// PlaylistPreview is what a playlist would contain, as a dry run of creating it
+type PlaylistPreview struct {
+	MoodPreviewResponse
+	Tracks []PlaylistTrack `json:"tracks"`
+}
+
+// decodePreviewRequest reads and validates a preview request, writing an error response if it's invalid
+func decodePreviewRequest(w http.ResponseWriter, r *http.Request) (PreviewRequest, bool) {
+	var req PreviewRequest
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return req, false
+	}
+
+	req.City = strings.TrimSpace(req.City)
+	req.Mood = strings.ToLower(strings.TrimSpace(req.Mood))
+	if req.City == "" {
+		writeJSONError(w, http.StatusBadRequest, "No city given")
+		return req, false
+	}
+	if req.Mood != "" {
+		if err := ValidateMood(req.Mood); err != nil {
+			writeJSON(w, http.StatusBadRequest, InvalidMoodResponse{Error: err.Error(), ValidMoods: Moods})
+			return req, false
+		}
+	}
+	if _, err := applyLimits(recommenderConfig, req.Limits); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid limit: "+err.Error())
+		return req, false
+	}
+	return req, true
+}
+
+// previewMood fetches the weather for the request's city and picks the mood a playlist would get
+func previewMood(req PreviewRequest) (*MoodPreviewResponse, error) {
+	weather, err := GetWeatherWithRetry(func() (*Weather, error) { return GetWeatherForInput(req.City) })
+	if err != nil {
+		return nil, err
+	}
+	if len(weather.Weather) == 0 {
+		return nil, fmt.Errorf("no weather data available for %s", req.City)
+	}
+
+	mood, _ := MatchWeatherMood(weather)
+	reason := WeatherMoodReason(weather, mood)
+	if req.Mood != "" {
+		reason = fmt.Sprintf("you chose %s over %s", req.Mood, reason)
+		mood = req.Mood
+	}
+
+	city := weather.Name
+	if city == "" {
+		city = req.City
+	}
+	return &MoodPreviewResponse{City: city, Weather: summarizeWeather(weather), Mood: mood, Reason: reason}, nil
+}
+
+// MoodPreviewHandler returns the weather of a city and the mood a playlist for it would get
+func MoodPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodePreviewRequest(w, r)
+	if !ok {
+		return
+	}
+
+	preview, err := previewMood(req)
+	if err != nil {
+		writeJSONError(w, weatherErrorStatus(err), "Failed to get the weather: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+// PlaylistPreviewHandler returns the tracks a weather playlist for a city would have, without creating it.
+// The tracks are picked anew for every playlist, so a created playlist won't have exactly the same ones.
+func PlaylistPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	req, ok := decodePreviewRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Genre != "" && !isAvailableGenre(req.Genre) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unknown genre %q", req.Genre))
+		return
+	}
+
+	preview, err := previewMood(req)
+	if err != nil {
+		writeJSONError(w, weatherErrorStatus(err), "Failed to get the weather: "+err.Error())
+		return
+	}
+
+	cfg, _ := applyLimits(recommenderConfig, req.Limits)
+	cfg.Genre = req.Genre
+	cfg.DryRun = true
+	tracks, _, err := personalizedRecommendations(preview.Mood, authenticatedClient, cfg)
+	if err != nil {
+		status, message := errorResponse(err, "Failed to pick tracks")
+		writeJSONError(w, status, message)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, PlaylistPreview{MoodPreviewResponse: *preview, Tracks: playlistTracks(tracks)})
+}
+
+// BatchPlaylistsHandler creates one weather mood playlist per city.
+// A failing city doesn't fail the batch; its error is reported in its result instead.
+func BatchPlaylistsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	var req BatchPlaylistRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+
+	if len(req.Cities) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No cities given")
+		return
+	}
+	if len(req.Cities) > maxBatchCities {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("At most %d cities can be given", maxBatchCities))
+		return
+	}
+	if req.Mood != "" {
+		if err := ValidateMood(req.Mood); err != nil {
+			writeJSON(w, http.StatusBadRequest, InvalidMoodResponse{Error: err.Error(), ValidMoods: Moods})
+			return
+		}
+	}
+	if req.Market != "" && !validMarket(req.Market) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Market %q is not a two letter country code", req.Market))
+		return
+	}
+	if req.Genre != "" && !isAvailableGenre(req.Genre) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unknown genre %q", req.Genre))
+		return
+	}
+	if req.BlendWith != "" {
+		if _, err := ParsePlaylistID(req.BlendWith); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid playlist to blend with: "+err.Error())
+			return
+		}
+	}
+
+	if req.TargetMinutes < 0 || req.TargetMinutes > maxTargetMinutes {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The target length must be from 1 to %d minutes", maxTargetMinutes))
+		return
+	}
+
+	if req.MaxSeconds < 0 || req.MaxSeconds > maxPipelineSeconds {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The maximum run time must be from 1 to %d seconds, or 0 for no cap", maxPipelineSeconds))
+		return
+	}
+
+	if _, err := applyLimits(recommenderConfig, req.Limits); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid limit: "+err.Error())
+		return
+	}
+
+	opts := PlaylistOptions{
+		Public:           req.Public,
+		Mood:             req.Mood,
+		Genre:            req.Genre,
+		Market:           strings.ToUpper(req.Market),
+		BlendWith:        req.BlendWith,
+		TargetMinutes:    req.TargetMinutes,
+		Limits:           req.Limits,
+		InstrumentalOnly: req.InstrumentalOnly,
+	}
+	// One deadline for the whole batch, so playlists waiting for their turn don't each get the full time
+	if req.MaxSeconds > 0 {
+		opts.Deadline = time.Now().Add(time.Duration(req.MaxSeconds) * time.Second)
+	}
+	if err := opts.useProfile(req.Profile); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid profile: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, createBatchPlaylists(req.Cities, opts))
+}
+
+// createBatchPlaylists creates the playlists of a batch, at most recommenderConfig.BatchConcurrency at a time.
+// Results are returned in the order of the requested cities.
+func createBatchPlaylists(cities []string, opts PlaylistOptions) []BatchPlaylistResult {
+	results := make([]BatchPlaylistResult, len(cities))
+	semaphore := make(chan struct{}, recommenderConfig.BatchConcurrency)
+
+	var wg sync.WaitGroup
+	for i, city := range cities {
+		city = strings.TrimSpace(city)
+		results[i].City = city
+
+		if city == "" {
+			results[i].Error = "city is empty"
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, city string) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			if !opts.Deadline.IsZero() && time.Now().After(opts.Deadline) {
+				results[i].Error = fmt.Sprintf("%v before this playlist was started", ErrOutOfTime)
+				return
+			}
+
+			playlist, err := createCityPlaylist(city, opts)
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].Playlist = playlist
+			rememberResult(playlist)
+		}(i, city)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// createCityPlaylist creates a weather mood playlist for the best match of a city name, or for a postal code
+func createCityPlaylist(city string, opts PlaylistOptions) (*PlaylistResult, error) {
+	if isZip(city) {
+		if recommenderConfig.PlaylistNameTemplate == "" {
+			opts.Name = fmt.Sprintf("VibeCast %s Weather Mood Playlist - %s", city, time.Now().Format("Jan 02 15:04"))
+		}
+		return createPlaylistForZip(city, opts)
+	}
+
+	locations, err := GeocodeCity(city)
+	if errors.Is(err, ErrWeatherCircuitOpen) {
+		// The weather service is down, so the weather of the city couldn't be fetched either
+		opts.NameVars.City = city
+		return createPlaylistWithoutWeather(authenticatedClient, err, opts)
+	}
+	if errors.Is(err, ErrCityNotFound) && len(recommenderConfig.FallbackCities) > 0 {
+		return createPlaylistForFallbackCity(city, err, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up city: %w", err)
+	}
+
+	opts.NameVars.City = locations[0].Name
+
+	// Without a name template, still tell the playlists of the batch apart by city
+	if recommenderConfig.PlaylistNameTemplate == "" {
+		opts.Name = fmt.Sprintf("VibeCast %s Weather Mood Playlist - %s", locations[0].Name, time.Now().Format("Jan 02 15:04"))
+	}
+	return createPlaylistForCoords(locations[0].Lat, locations[0].Lon, opts)
+}
@@ -22,16 +22,39 @@ func GetSpotifyClient() *spotify.Client {
 func Auth() *spotifyauth.Authenticator {
 	auth = spotifyauth.New(
 		spotifyauth.WithRedirectURL("http://localhost:8081/callback"),
-		spotifyauth.WithScopes(
-			spotifyauth.ScopeUserReadPrivate,
-			spotifyauth.ScopeUserReadEmail,
-			spotifyauth.ScopePlaylistModifyPrivate,
-			spotifyauth.ScopePlaylistModifyPublic,
-			spotifyauth.ScopeUserTopRead,
-			spotifyauth.ScopeUserLibraryRead,
-		),
+		spotifyauth.WithScopes(append(requiredScopes(recommenderConfig), scopeGrants.extra()...)...),
 		spotifyauth.WithClientID(os.Getenv("SPOTIFY_CLIENT_ID")),
 		spotifyauth.WithClientSecret(os.Getenv("SPOTIFY_CLIENT_SECRET")),
 	)
 	return auth
 }
+
+// requiredScopes returns the scopes the enabled features need, so users of a deployment that leaves
+// features off are asked for less access
+func requiredScopes(cfg RecommenderConfig) []string {
+	// Every playlist is made from the user's liked songs for their country, and can be public or private
+	scopes := []string{
+		spotifyauth.ScopeUserReadPrivate,
+		spotifyauth.ScopeUserLibraryRead,
+		spotifyauth.ScopePlaylistModifyPrivate,
+		spotifyauth.ScopePlaylistModifyPublic,
+	}
+
+	// The user's top artists and tracks seed the recommendations, and the top artists' genres bias the picks
+	if cfg.HasStage(StageRecommendations) || cfg.TopGenreWeight > 0 {
+		scopes = append(scopes, spotifyauth.ScopeUserTopRead)
+	}
+
+	if cfg.UseFollowedArtists {
+		scopes = append(scopes, spotifyauth.ScopeUserFollowRead)
+	}
+
+	if cfg.RecentlyPlayedWeight > 0 {
+		scopes = append(scopes, spotifyauth.ScopeUserReadRecentlyPlayed)
+	}
+
+	if cfg.UseCurrentlyPlaying {
+		scopes = append(scopes, spotifyauth.ScopeUserReadPlaybackState, spotifyauth.ScopeUserReadCurrentlyPlaying)
+	}
+	return scopes
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// maxBlendedTracks is the most tracks a blended playlist gets
+const maxBlendedTracks = 100
+
+// blendStage is the provenance of the tracks that come from the playlist a new playlist is blended with
+const blendStage = "blend"
+
+// ParsePlaylistID reads a playlist ID from an ID, a spotify:playlist: URI or an open.spotify.com link
+func ParsePlaylistID(value string) (spotify.ID, error) {
+	return parseSpotifyID(value, "playlist")
+}
+
+// parseSpotifyID reads the ID of a kind of Spotify item, such as "playlist", from an ID, a URI or a link
+func parseSpotifyID(value, kind string) (spotify.ID, error) {
+	value = strings.TrimSpace(value)
+	if id, ok := strings.CutPrefix(value, "spotify:"+kind+":"); ok {
+		value = id
+	} else if parsed, err := url.Parse(value); err == nil && parsed.Host != "" {
+		id, ok := strings.CutPrefix(parsed.Path, "/"+kind+"/")
+		if !ok {
+			return "", fmt.Errorf("%q isn't a link to a %s", value, kind)
+		}
+		value = id
+	}
+
+	if value == "" || strings.ContainsAny(value, "/:?# ") {
+		return "", fmt.Errorf("%q isn't a %s ID or link", value, kind)
+	}
+	return spotify.ID(value), nil
+}
+
+// getPlaylistTracks returns up to maxBlendedTracks tracks of a playlist, leaving out podcast episodes
+func getPlaylistTracks(client *spotify.Client, playlistID spotify.ID) ([]spotify.FullTrack, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	items, err := client.GetPlaylistItems(ctx, playlistID, spotify.Limit(maxBlendedTracks))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the tracks of playlist %s: %v", playlistID, err)
+	}
+
+	var tracks []spotify.FullTrack
+	for _, item := range items.Items {
+		if item.Track.Track != nil {
+			tracks = append(tracks, *item.Track.Track)
+		}
+	}
+	return tracks, nil
+}
+
+// BlendTracks interleaves the mood tracks with the tracks of an existing playlist, starting with a mood track.
+// Tracks that are in both are only kept once, and the blend is cut off at limit tracks.
+func BlendTracks(moodTracks, existing []spotify.FullTrack, limit int) []spotify.FullTrack {
+	blended := make([]spotify.FullTrack, 0, min(len(moodTracks)+len(existing), limit))
+	seen := make(map[spotify.ID]bool)
+	add := func(track spotify.FullTrack) {
+		if len(blended) < limit && !seen[track.ID] {
+			seen[track.ID] = true
+			blended = append(blended, track)
+		}
+	}
+
+	for i := 0; i < len(moodTracks) || i < len(existing); i++ {
+		if i < len(moodTracks) {
+			add(moodTracks[i])
+		}
+		if i < len(existing) {
+			add(existing[i])
+		}
+	}
+	return blended
+}
+
+// blendWithPlaylist blends the mood tracks with the tracks of the playlist, recording which tracks came from it
+func blendWithPlaylist(client *spotify.Client, tracks []spotify.FullTrack, blendWith string, report *pipelineReport) ([]spotify.FullTrack, error) {
+	playlistID, err := ParsePlaylistID(blendWith)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := getPlaylistTracks(client, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	if kept, err := FilterNeverPlayTracks(existing); err != nil {
+		fmt.Printf("Warning: couldn't leave the tracks on your never play list out of the blend: %v\n", err)
+	} else {
+		existing = kept
+	}
+
+	isMoodTrack := make(map[spotify.ID]bool, len(tracks))
+	for _, track := range tracks {
+		isMoodTrack[track.ID] = true
+	}
+
+	blended := BlendTracks(tracks, existing, maxBlendedTracks)
+	if report != nil {
+		for _, track := range blended {
+			if !isMoodTrack[track.ID] {
+				report.TrackStages[track.ID] = blendStage
+			}
+		}
+	}
+
+	fmt.Printf("Blended %d mood tracks with %d tracks of playlist %s into %d tracks\n", len(tracks), len(existing), playlistID, len(blended))
+	return blended, nil
+}
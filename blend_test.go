@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestBlendTracks(t *testing.T) {
+	tracks := func(ids ...string) []spotify.FullTrack {
+		var tracks []spotify.FullTrack
+		for _, id := range ids {
+			var track spotify.FullTrack
+			track.ID = spotify.ID(id)
+			tracks = append(tracks, track)
+		}
+		return tracks
+	}
+	ids := func(tracks []spotify.FullTrack) []spotify.ID {
+		var ids []spotify.ID
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+		return ids
+	}
+
+	moodTracks := tracks("m1", "shared", "m2", "m3")
+	existing := tracks("e1", "shared", "e2")
+
+	got := ids(BlendTracks(moodTracks, existing, 100))
+	want := []spotify.ID{"m1", "e1", "shared", "m2", "e2", "m3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BlendTracks = %v, want %v", got, want)
+	}
+
+	if got := BlendTracks(moodTracks, existing, 3); len(got) != 3 {
+		t.Errorf("BlendTracks with a limit of 3 returned %d tracks", len(got))
+	}
+}
+
+func TestParsePlaylistID(t *testing.T) {
+	valid := map[string]spotify.ID{
+		"37i9dQZF1DXcBWIGoYBM5M":                                          "37i9dQZF1DXcBWIGoYBM5M",
+		"spotify:playlist:37i9dQZF1DXcBWIGoYBM5M":                         "37i9dQZF1DXcBWIGoYBM5M",
+		"https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M?si=abc": "37i9dQZF1DXcBWIGoYBM5M",
+	}
+	for input, want := range valid {
+		if got, err := ParsePlaylistID(input); err != nil || got != want {
+			t.Errorf("ParsePlaylistID(%q) = %q, %v, want %q", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"", "https://open.spotify.com/track/abc", "spotify:track:abc"} {
+		if _, err := ParsePlaylistID(input); err == nil {
+			t.Errorf("ParsePlaylistID(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestBlendWithPlaylistLeavesOutNeverPlayTracks(t *testing.T) {
+	t.Setenv("PREFERENCES_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+	if err := addNeverPlayTracks([]spotify.ID{"banned"}); err != nil {
+		t.Fatal(err)
+	}
+	client, _ := newFakePlaylist(t, "other", []string{"kept", "banned"})
+
+	var mood spotify.FullTrack
+	mood.ID = "mood"
+	blended, err := blendWithPlaylist(client, []spotify.FullTrack{mood}, "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range blended {
+		if track.ID == "banned" {
+			t.Errorf("blend has %s, which is on the never play list", track.ID)
+		}
+	}
+	if len(blended) != 2 {
+		t.Errorf("blend has %d tracks, want the mood track and the kept one", len(blended))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// States of the weather circuit breaker
+const (
+	// BreakerClosed lets weather requests through
+	BreakerClosed = "closed"
+	// BreakerOpen fails weather requests right away, as the weather API kept failing
+	BreakerOpen = "open"
+	// BreakerHalfOpen lets a single weather request through to find out if the weather API is back
+	BreakerHalfOpen = "half-open"
+)
+
+// weatherBreaker stops calling the weather API for a while after it failed too many times in a row, so playlist
+// requests fall back to the neutral mood right away during an outage instead of waiting on failing calls
+var weatherBreaker = &circuitBreaker{}
+
+// circuitBreaker counts consecutive failures of a service and opens once they reach the configured threshold
+type circuitBreaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+	// probing is set while the single request of the half-open state is in flight
+	probing bool
+}
+
+// BreakerStatus describes the state of a circuit breaker for the health endpoint
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenUntil           *time.Time `json:"openUntil,omitempty"`
+}
+
+// state returns the state of the breaker at now. The caller must hold the lock.
+func (b *circuitBreaker) state(now time.Time) string {
+	switch {
+	case b.openUntil.IsZero():
+		return BreakerClosed
+	case now.Before(b.openUntil):
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// allow reports whether a request may be made. Once the cooldown has passed, only one request is let through
+// until it's known whether it succeeded.
+func (b *circuitBreaker) allow() error {
+	if recommenderConfig.WeatherBreakerCooldown == 0 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state(time.Now()) {
+	case BreakerOpen:
+		return fmt.Errorf("%w: skipping it until %s after %d failures in a row",
+			ErrWeatherCircuitOpen, b.openUntil.Format(time.Kitchen), b.failures)
+	case BreakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w: waiting to find out if it's back", ErrWeatherCircuitOpen)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record closes the breaker after a success, and counts a failure, opening the breaker when there are too many
+// in a row. Errors that aren't the service's fault, such as an unknown city, don't count.
+func (b *circuitBreaker) record(err error) {
+	if recommenderConfig.WeatherBreakerCooldown == 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if err == nil || permanentWeatherError(err) {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	b.failures++
+	if b.failures >= recommenderConfig.WeatherBreakerThreshold {
+		b.openUntil = time.Now().Add(recommenderConfig.WeatherBreakerCooldown)
+		fmt.Printf("Weather API failed %d times in a row, not calling it again until %s\n",
+			b.failures, b.openUntil.Format(time.Kitchen))
+	}
+}
+
+// status returns the state of the breaker
+func (b *circuitBreaker) status() BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+
+	status := BreakerStatus{State: b.state(time.Now()), ConsecutiveFailures: b.failures}
+	if status.State == BreakerOpen {
+		openUntil := b.openUntil
+		status.OpenUntil = &openUntil
+	}
+	return status
+}
+
+// HealthResponse is the state of the app and the services it depends on
+type HealthResponse struct {
+	Status         string        `json:"status"`
+	WeatherBreaker BreakerStatus `json:"weatherBreaker"`
+}
+
+// HealthHandler reports that the app is up, along with the state of the weather circuit breaker. The app is
+// degraded while the breaker is open, as playlists then get the neutral mood instead of one from the weather.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	response := HealthResponse{Status: "ok", WeatherBreaker: weatherBreaker.status()}
+	if response.WeatherBreaker.State == BreakerOpen {
+		response.Status = "degraded"
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// errCallBudgetExhausted is returned for Spotify requests made after the call budget ran out
+var errCallBudgetExhausted = errors.New("spotify call budget exhausted")
+
+// callBudget limits the number of Spotify API calls made on behalf of a single playlist.
+// It's safe for concurrent use.
+type callBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// spend takes a call from the budget, reporting false if none are left
+func (b *callBudget) spend() bool {
+	if b.used.Add(1) > b.limit {
+		b.used.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Used returns the number of calls made so far
+func (b *callBudget) Used() int {
+	return int(b.used.Load())
+}
+
+// Exhausted reports whether the budget has run out
+func (b *callBudget) Exhausted() bool {
+	return b.used.Load() >= b.limit
+}
+
+type callBudgetKey struct{}
+
+// withCallBudget returns a context whose Spotify requests are limited to limit calls
+func withCallBudget(ctx context.Context, limit int) (context.Context, *callBudget) {
+	budget := &callBudget{limit: int64(limit)}
+	return context.WithValue(ctx, callBudgetKey{}, budget), budget
+}
+
+// callBudgetTransport enforces the call budget of a request's context, if it has one.
+// It wraps the transport the Spotify client sends requests through, so retries count against the budget too.
+type callBudgetTransport struct {
+	base http.RoundTripper
+}
+
+func (t *callBudgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if budget, ok := req.Context().Value(callBudgetKey{}).(*callBudget); ok && !budget.spend() {
+		return nil, errCallBudgetExhausted
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -18,7 +18,8 @@ $spotifyClientSecret = $envVars["SPOTIFY_CLIENT_SECRET"]
 $weatherAPIKey = $envVars["WEATHER_API_KEY"]
 
 # Verify we have all required values
-if (-not $spotifyClientID -or -not $spotifyClientSecret -or -not $weatherAPIKey) {
+# The weather API key is optional: without it, the weather comes from Open-Meteo
+if (-not $spotifyClientID -or -not $spotifyClientSecret) {
     Write-Error "Missing required environment variables in .env file"
     exit 1
 }
@@ -0,0 +1,56 @@
+package main
+
+import "sync/atomic"
+
+// CacheStats reports how well a cache is doing
+type CacheStats struct {
+	Entries   int64 `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// cacheCounters tracks the statistics of a cache. It's safe for concurrent use.
+type cacheCounters struct {
+	entries   atomic.Int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// stats returns a snapshot of the counters
+func (c *cacheCounters) stats() CacheStats {
+	return CacheStats{
+		Entries:   c.entries.Load(),
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// genreSeedCacheCounters tracks the available genre seeds cache. Each seed counts as an entry.
+var genreSeedCacheCounters cacheCounters
+
+// artistGenreCacheCounters tracks the artist genre caches of pipeline runs.
+// Each run starts with an empty cache, so entries is the size of the most recent run's cache.
+var artistGenreCacheCounters cacheCounters
+
+// pipelineResultCacheCounters tracks the cache of pipeline candidates. Each pipeline run counts as an entry.
+var pipelineResultCacheCounters cacheCounters
+
+// geocodeCacheCounters tracks the cache of geocoded city names. Each normalized city counts as an entry.
+var geocodeCacheCounters cacheCounters
+
+// tasteStatsCacheCounters tracks the cache of the taste statistics, which holds those of the current library
+var tasteStatsCacheCounters cacheCounters
+
+// allCacheStats returns the statistics of every cache by name
+func allCacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"genreSeeds":      genreSeedCacheCounters.stats(),
+		"artistGenres":    artistGenreCacheCounters.stats(),
+		"pipelineResults": pipelineResultCacheCounters.stats(),
+		"geocoding":       geocodeCacheCounters.stats(),
+		"tasteStats":      tasteStatsCacheCounters.stats(),
+	}
+}
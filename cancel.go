@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errCreationCancelled is returned when a playlist creation is cancelled through POST /cancel
+var errCreationCancelled = errors.New("playlist creation was cancelled")
+
+// errCreationInProgress is returned when playlists are requested while MaxConcurrentCreations requests are
+// already creating them
+var errCreationInProgress = errors.New("a playlist is already being created, wait for it to finish or cancel it")
+
+// creationRequests counts the requests creating playlists. Pressing the create button again while a playlist is
+// being made would otherwise run another pipeline against the same rate limit and make a duplicate playlist.
+var creationRequests = struct {
+	sync.Mutex
+	running int
+}{}
+
+// claimCreation claims one of the MaxConcurrentCreations slots for a request that creates playlists, and returns
+// the function that frees it. It returns errCreationInProgress if they're all taken.
+func claimCreation() (func(), error) {
+	creationRequests.Lock()
+	defer creationRequests.Unlock()
+
+	if creationRequests.running >= recommenderConfig.MaxConcurrentCreations {
+		return nil, errCreationInProgress
+	}
+	creationRequests.running++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			creationRequests.Lock()
+			defer creationRequests.Unlock()
+			creationRequests.running--
+		})
+	}, nil
+}
+
+// oneCreationAtATime turns down POST requests to next with 409 Conflict while MaxConcurrentCreations other
+// requests are creating playlists
+func oneCreationAtATime(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			next(w, r)
+			return
+		}
+
+		release, err := claimCreation()
+		if err != nil {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeJSONError(w, http.StatusConflict, err.Error())
+			} else {
+				http.Error(w, err.Error(), http.StatusConflict)
+			}
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
+
+// creations tracks the playlist creations in progress. They share a context, so cancelling cancels all of them;
+// with a single logged in user, those are the creations of their session.
+var creations = struct {
+	sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running int
+}{}
+
+// beginCreation returns the context of a playlist creation that POST /cancel can cancel,
+// and a function to call when the creation is done
+func beginCreation() (context.Context, func()) {
+	creations.Lock()
+	defer creations.Unlock()
+
+	if creations.ctx == nil {
+		creations.ctx, creations.cancel = context.WithCancel(context.Background())
+	}
+	creations.running++
+	ctx := creations.ctx
+
+	return ctx, func() {
+		creations.Lock()
+		defer creations.Unlock()
+
+		// Cancelled creations were forgotten along with their context
+		if creations.ctx != ctx {
+			return
+		}
+
+		creations.running--
+		if creations.running == 0 {
+			creations.cancel()
+			creations.ctx, creations.cancel = nil, nil
+		}
+	}
+}
+
+// cancelCreations cancels the playlist creations in progress and reports whether there were any.
+// Creations started afterwards get a new context.
+func cancelCreations() bool {
+	creations.Lock()
+	defer creations.Unlock()
+
+	if creations.running == 0 {
+		return false
+	}
+	creations.cancel()
+	creations.ctx, creations.cancel, creations.running = nil, nil, 0
+	return true
+}
+
+// CancelHandler cancels the playlist creation in progress
+func CancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	if !cancelCreations() {
+		writeJSONError(w, http.StatusConflict, "No playlist is being created")
+		return
+	}
+
+	logger.Info("cancelled playlist creation", "user", authenticatedUserID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled"})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClaimCreation(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.MaxConcurrentCreations = 1
+
+	release, err := claimCreation()
+	if err != nil {
+		t.Fatalf("first claim: %v", err)
+	}
+	if _, err := claimCreation(); !errors.Is(err, errCreationInProgress) {
+		t.Errorf("second claim: err = %v, want errCreationInProgress", err)
+	}
+
+	// Releasing twice frees a single slot
+	release()
+	release()
+	again, err := claimCreation()
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+	if _, err := claimCreation(); !errors.Is(err, errCreationInProgress) {
+		t.Errorf("claim after a double release: err = %v, want errCreationInProgress", err)
+	}
+	again()
+}
+
+func TestLoadLikedSongsStopsWhenCancelled(t *testing.T) {
+	var pages atomic.Int32
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages.Add(1)
+		w.Write([]byte(`{"items": [{"added_at": "2024-01-02T03:04:05Z", "track": {"id": "liked"}}], "total": 1000}`))
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := loadLikedSongs(ctx, client, recommenderConfig); !errors.Is(err, errCreationCancelled) {
+		t.Errorf("loading liked songs after cancelling returned %v, want errCreationCancelled", err)
+	}
+	if pages.Load() != 0 {
+		t.Errorf("fetched %d pages of liked songs after cancelling", pages.Load())
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// Size of a summary card, the aspect ratio link previews use
+const (
+	cardWidth  = 1200
+	cardHeight = 630
+)
+
+// moodCardColors are the background colors of summary cards for each mood
+var moodCardColors = map[string]color.RGBA{
+	"energetic":  {0xe9, 0x6a, 0x23, 0xff},
+	"relaxed":    {0x2d, 0x8c, 0xc4, 0xff},
+	"intense":    {0xb0, 0x23, 0x3a, 0xff},
+	"thoughtful": {0x4a, 0x4e, 0x8c, 0xff},
+	"neutral":    {0x1d, 0xb9, 0x54, 0xff},
+}
+
+// cardTextColor is the color of all text and icons on a summary card
+var cardTextColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+
+// RenderSummaryCard draws a shareable PNG summarizing a playlist: its mood, city, weather and top 3 artists
+func RenderSummaryCard(result *PlaylistResult) ([]byte, error) {
+	if result == nil {
+		return nil, fmt.Errorf("no playlist to summarize")
+	}
+
+	background, ok := moodCardColors[result.Mood]
+	if !ok {
+		background = moodCardColors["neutral"]
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	drawText(img, 60, 60, 4, "VIBECAST")
+	mood := result.Mood
+	if mood == "" {
+		mood = "vibes"
+	}
+	drawText(img, 60, 130, 12, mood)
+
+	var place []string
+	if result.City != "" {
+		place = append(place, result.City)
+	}
+	if result.Weather != nil {
+		place = append(place, fmt.Sprintf("%s, %.0f°C", result.Weather.Description, result.Weather.Temp))
+		drawWeatherIcon(img, cardWidth-200, 70, result.Weather.Description)
+	}
+	if len(place) > 0 {
+		drawText(img, 60, 260, 5, strings.Join(place, " - "))
+	}
+
+	if artists := topArtists(result.Tracks, 3); len(artists) > 0 {
+		drawText(img, 60, 360, 4, "Top artists")
+		for i, artist := range artists {
+			drawText(img, 60, 410+i*60, 6, fmt.Sprintf("%d. %s", i+1, artist))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode summary card: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// topArtists returns up to count artists with the most tracks in the playlist, counting only each track's first artist.
+// Ties are broken by the artist that appears first.
+func topArtists(tracks []PlaylistTrack, count int) []string {
+	counts := make(map[string]int)
+	var artists []string
+	for _, track := range tracks {
+		if len(track.Artists) == 0 {
+			continue
+		}
+		artist := track.Artists[0]
+		if counts[artist] == 0 {
+			artists = append(artists, artist)
+		}
+		counts[artist]++
+	}
+
+	sort.SliceStable(artists, func(i, j int) bool {
+		return counts[artists[i]] > counts[artists[j]]
+	})
+	if len(artists) > count {
+		artists = artists[:count]
+	}
+	return artists
+}
+
+// drawWeatherIcon draws a simple icon for a weather description in the 140x140 square at x, y
+func drawWeatherIcon(img *image.RGBA, x, y int, description string) {
+	description = strings.ToLower(description)
+
+	switch {
+	case strings.Contains(description, "clear"):
+		fillCircle(img, x+70, y+70, 45)
+		for i := 0; i < 4; i++ {
+			fillRect(img, x+66, y+i*42/3, 8, 10)
+			fillRect(img, x+i*42/3, y+66, 10, 8)
+			fillRect(img, x+66, y+130-i*42/3, 8, 10)
+			fillRect(img, x+130-i*42/3, y+66, 10, 8)
+		}
+	case strings.Contains(description, "mist"), strings.Contains(description, "fog"), strings.Contains(description, "haze"):
+		for i := 0; i < 4; i++ {
+			fillRect(img, x+10+(i%2)*20, y+25+i*28, 110, 12)
+		}
+	default:
+		// Everything else starts with a cloud
+		fillCircle(img, x+50, y+60, 30)
+		fillCircle(img, x+85, y+50, 38)
+		fillRect(img, x+20, y+60, 110, 30)
+
+		switch {
+		case strings.Contains(description, "thunder"):
+			fillRect(img, x+70, y+95, 10, 20)
+			fillRect(img, x+60, y+112, 20, 8)
+			fillRect(img, x+60, y+118, 10, 20)
+		case strings.Contains(description, "rain"), strings.Contains(description, "drizzle"):
+			for i := 0; i < 4; i++ {
+				fillRect(img, x+30+i*25, y+105+(i%2)*12, 6, 22)
+			}
+		case strings.Contains(description, "snow"):
+			for i := 0; i < 4; i++ {
+				fillCircle(img, x+33+i*25, y+112+(i%2)*15, 6)
+			}
+		}
+	}
+}
+
+// fillRect fills a w by h rectangle with the card text color
+func fillRect(img *image.RGBA, x, y, w, h int) {
+	draw.Draw(img, image.Rect(x, y, x+w, y+h), &image.Uniform{cardTextColor}, image.Point{}, draw.Src)
+}
+
+// fillCircle fills a circle with the card text color
+func fillCircle(img *image.RGBA, cx, cy, r int) {
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if x*x+y*y <= r*r {
+				img.SetRGBA(cx+x, cy+y, cardTextColor)
+			}
+		}
+	}
+}
+
+// drawText draws text in the built-in bitmap font with its top left corner at x, y, each font pixel scaled to a
+// scale by scale square. Text is drawn in upper case and characters the font doesn't have are drawn as '?'.
+// Text that doesn't fit on the card is cut off with "..".
+func drawText(img *image.RGBA, x, y, scale int, text string) {
+	advance := (glyphWidth + 1) * scale
+	fits := (cardWidth - 60 - x) / advance
+
+	runes := []rune(strings.ToUpper(accentFolder.Replace(text)))
+	if len(runes) > fits {
+		runes = append(runes[:fits-2], '.', '.')
+	}
+
+	for i, r := range runes {
+		glyph, ok := cardFont[r]
+		if !ok {
+			glyph = cardFont['?']
+		}
+		for row, line := range glyph {
+			for col, pixel := range line {
+				if pixel == '#' {
+					fillRect(img, x+i*advance+col*scale, y+row*scale, scale, scale)
+				}
+			}
+		}
+	}
+}
+
+// accentFolder replaces common accented letters, which cardFont doesn't have, by their plain letter
+var accentFolder = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ä", "a", "ã", "a", "å", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "ö", "o", "õ", "o", "ø", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n", "ý", "y", "ß", "ss",
+	"Á", "A", "À", "A", "Â", "A", "Ä", "A", "Ã", "A", "Å", "A",
+	"É", "E", "È", "E", "Ê", "E", "Ë", "E",
+	"Í", "I", "Ì", "I", "Î", "I", "Ï", "I",
+	"Ó", "O", "Ò", "O", "Ô", "O", "Ö", "O", "Õ", "O", "Ø", "O",
+	"Ú", "U", "Ù", "U", "Û", "U", "Ü", "U",
+	"Ç", "C", "Ñ", "N", "Ý", "Y",
+)
+
+// glyphWidth is the width of every glyph of cardFont in font pixels
+const glyphWidth = 5
+
+// cardFont is a 5x7 bitmap font for the characters used on summary cards
+var cardFont = map[rune][7]string{
+	'A':  {" ### ", "#   #", "#   #", "#####", "#   #", "#   #", "#   #"},
+	'B':  {"#### ", "#   #", "#   #", "#### ", "#   #", "#   #", "#### "},
+	'C':  {" ### ", "#   #", "#    ", "#    ", "#    ", "#   #", " ### "},
+	'D':  {"#### ", "#   #", "#   #", "#   #", "#   #", "#   #", "#### "},
+	'E':  {"#####", "#    ", "#    ", "#### ", "#    ", "#    ", "#####"},
+	'F':  {"#####", "#    ", "#    ", "#### ", "#    ", "#    ", "#    "},
+	'G':  {" ### ", "#   #", "#    ", "# ###", "#   #", "#   #", " ####"},
+	'H':  {"#   #", "#   #", "#   #", "#####", "#   #", "#   #", "#   #"},
+	'I':  {" ### ", "  #  ", "  #  ", "  #  ", "  #  ", "  #  ", " ### "},
+	'J':  {"  ###", "   # ", "   # ", "   # ", "   # ", "#  # ", " ##  "},
+	'K':  {"#   #", "#  # ", "# #  ", "##   ", "# #  ", "#  # ", "#   #"},
+	'L':  {"#    ", "#    ", "#    ", "#    ", "#    ", "#    ", "#####"},
+	'M':  {"#   #", "## ##", "# # #", "# # #", "#   #", "#   #", "#   #"},
+	'N':  {"#   #", "#   #", "##  #", "# # #", "#  ##", "#   #", "#   #"},
+	'O':  {" ### ", "#   #", "#   #", "#   #", "#   #", "#   #", " ### "},
+	'P':  {"#### ", "#   #", "#   #", "#### ", "#    ", "#    ", "#    "},
+	'Q':  {" ### ", "#   #", "#   #", "#   #", "# # #", "#  # ", " ## #"},
+	'R':  {"#### ", "#   #", "#   #", "#### ", "# #  ", "#  # ", "#   #"},
+	'S':  {" ####", "#    ", "#    ", " ### ", "    #", "    #", "#### "},
+	'T':  {"#####", "  #  ", "  #  ", "  #  ", "  #  ", "  #  ", "  #  "},
+	'U':  {"#   #", "#   #", "#   #", "#   #", "#   #", "#   #", " ### "},
+	'V':  {"#   #", "#   #", "#   #", "#   #", "#   #", " # # ", "  #  "},
+	'W':  {"#   #", "#   #", "#   #", "# # #", "# # #", "# # #", " # # "},
+	'X':  {"#   #", "#   #", " # # ", "  #  ", " # # ", "#   #", "#   #"},
+	'Y':  {"#   #", "#   #", " # # ", "  #  ", "  #  ", "  #  ", "  #  "},
+	'Z':  {"#####", "    #", "   # ", "  #  ", " #   ", "#    ", "#####"},
+	'0':  {" ### ", "#   #", "#  ##", "# # #", "##  #", "#   #", " ### "},
+	'1':  {"  #  ", " ##  ", "  #  ", "  #  ", "  #  ", "  #  ", " ### "},
+	'2':  {" ### ", "#   #", "    #", "   # ", "  #  ", " #   ", "#####"},
+	'3':  {"#####", "   # ", "  #  ", "   # ", "    #", "#   #", " ### "},
+	'4':  {"   # ", "  ## ", " # # ", "#  # ", "#####", "   # ", "   # "},
+	'5':  {"#####", "#    ", "#### ", "    #", "    #", "#   #", " ### "},
+	'6':  {"  ## ", " #   ", "#    ", "#### ", "#   #", "#   #", " ### "},
+	'7':  {"#####", "    #", "   # ", "  #  ", " #   ", " #   ", " #   "},
+	'8':  {" ### ", "#   #", "#   #", " ### ", "#   #", "#   #", " ### "},
+	'9':  {" ### ", "#   #", "#   #", " ####", "    #", "   # ", " ##  "},
+	' ':  {"     ", "     ", "     ", "     ", "     ", "     ", "     "},
+	'.':  {"     ", "     ", "     ", "     ", "     ", " ##  ", " ##  "},
+	',':  {"     ", "     ", "     ", "     ", " ##  ", "  #  ", " #   "},
+	'-':  {"     ", "     ", "     ", "#####", "     ", "     ", "     "},
+	'\'': {"  #  ", "  #  ", " #   ", "     ", "     ", "     ", "     "},
+	'&':  {" ##  ", "#  # ", "# #  ", " #   ", "# # #", "#  # ", " ## #"},
+	'!':  {"  #  ", "  #  ", "  #  ", "  #  ", "  #  ", "     ", "  #  "},
+	'?':  {" ### ", "#   #", "    #", "   # ", "  #  ", "     ", "  #  "},
+	':':  {"     ", " ##  ", " ##  ", "     ", " ##  ", " ##  ", "     "},
+	'/':  {"     ", "    #", "   # ", "  #  ", " #   ", "#    ", "     "},
+	'(':  {"   # ", "  #  ", " #   ", " #   ", " #   ", "  #  ", "   # "},
+	')':  {" #   ", "  #  ", "   # ", "   # ", "   # ", "  #  ", " #   "},
+	'+':  {"     ", "  #  ", "  #  ", "#####", "  #  ", "  #  ", "     "},
+	'°':  {" ##  ", "#  # ", " ##  ", "     ", "     ", "     ", "     "},
+}
+
+// shownResults are the playlist results shown since the server started, so their summary cards can be rendered
+var shownResults = struct {
+	sync.Mutex
+	results map[spotify.ID]*PlaylistResult
+	// last is the most recently shown result of each logged in user
+	last map[string]*PlaylistResult
+}{results: make(map[spotify.ID]*PlaylistResult), last: make(map[string]*PlaylistResult)}
+
+// rememberResult keeps a shown result for its summary card
+func rememberResult(result *PlaylistResult) {
+	shownResults.Lock()
+	defer shownResults.Unlock()
+	shownResults.results[result.ID] = result
+	shownResults.last[authenticatedUserID] = result
+}
+
+// SummaryCardHandler serves the summary card of a playlist shown since the server started
+func SummaryCardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shownResults.Lock()
+	result := shownResults.results[spotify.ID(r.URL.Query().Get("playlist"))]
+	shownResults.Unlock()
+	if result == nil {
+		http.Error(w, "Playlist not found", http.StatusNotFound)
+		return
+	}
+
+	card, err := RenderSummaryCard(result)
+	if err != nil {
+		http.Error(w, "Failed to render summary card: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(card)
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// Names of the recommendation pipeline stages
+const (
+	StageAudioFeatures      = "audio-features"
+	StageGenres             = "genres"
+	StageMoodPlaylists      = "mood-playlists"
+	StageRecommendations    = "recommendations"
+	StageArtistTopTracks    = "artist-top-tracks"
+	StageFollowedPlaylists  = "followed-playlists"
+	StageEditorialPlaylists = "editorial-playlists"
+	StageOnRepeat           = "on-repeat"
+	StageNeighbors          = "neighbors"
+)
+
+// Orders the final playlist can be put in
+const (
+	OrderShuffle    = "shuffle"
+	OrderArtist     = "artist"
+	OrderRelease    = "release"
+	OrderPopularity = "popularity"
+	OrderTitle      = "title"
+	// OrderBalanced alternates the tracks that fit the mood best with tracks by another artist and of another
+	// genre than the one before
+	OrderBalanced = "balanced"
+)
+
+// playlistOrders are the valid values of RecommenderConfig.Order
+var playlistOrders = []string{OrderShuffle, OrderArtist, OrderRelease, OrderPopularity, OrderTitle, OrderBalanced}
+
+// Ways the candidates are sampled when there are more than fit in the playlist
+const (
+	// SamplingRandom keeps a random sample, ranked if RankTracks is set
+	SamplingRandom = "random"
+	// SamplingTopScored keeps the candidates that fit the mood best
+	SamplingTopScored = "top-scored"
+	// SamplingStratified keeps candidates from as many genres and artists as it can
+	SamplingStratified = "stratified"
+)
+
+// samplingStrategies are the valid values of RecommenderConfig.Sampling
+var samplingStrategies = []string{SamplingRandom, SamplingTopScored, SamplingStratified}
+
+// Ways the OpenWeatherMap API keys take turns when WEATHER_API_KEY has more than one
+const (
+	// KeyRotationRoundRobin uses the next key for every request
+	KeyRotationRoundRobin = "round-robin"
+	// KeyRotationFailover keeps using a key until it's rate limited
+	KeyRotationFailover = "failover"
+)
+
+// keyRotations are the valid values of RecommenderConfig.WeatherKeyRotation
+var keyRotations = []string{KeyRotationRoundRobin, KeyRotationFailover}
+
+// Ways an artist's genre can match a genre associated with a mood
+const (
+	GenreMatchExact    = "exact"
+	GenreMatchPrefix   = "prefix"
+	GenreMatchToken    = "token"
+	GenreMatchContains = "contains"
+)
+
+// genreMatchModes are the valid values of RecommenderConfig.GenreMatch, strictest first
+var genreMatchModes = []string{GenreMatchExact, GenreMatchPrefix, GenreMatchToken, GenreMatchContains}
+
+// RecommenderConfig controls how GetPersonalizedRecommendations builds a playlist
+type RecommenderConfig struct {
+	// Stages lists the enabled stages in the order they run. Stages not listed are disabled.
+	Stages []string
+	// TargetSize is the number of tracks after which no further stages are run
+	TargetSize int
+	// PlaylistSize is how many tracks a playlist gets, including the cooldown
+	PlaylistSize int
+	// MaxSongsPerArtist is how many songs an artist may have in a playlist
+	MaxSongsPerArtist int
+	// StageTrackLimit is the number of tracks after which the genre and mood playlist stages stop adding tracks
+	StageTrackLimit int
+	// RecommendationLimit is how many tracks are asked of Spotify's recommendations at a time, at most 100
+	RecommendationLimit int
+	// MoodPlaylistSearchLimit is how many playlists each search of the mood playlist stage looks at
+	MoodPlaylistSearchLimit int
+	// MoodPlaylistTrackBudget is how many tracks the mood playlist stage collects from playlists before it stops
+	// searching for more
+	MoodPlaylistTrackBudget int
+	// TopItems is how many of the user's top artists and top tracks are fetched to pick recommendation seeds from
+	TopItems int
+	// DiverseTopItems is TopItems with DiverseSeeds, which samples the seeds from all of them
+	DiverseTopItems int
+	// LibraryOnly only lets tracks from the user's liked songs into playlists, unless a stage explicitly allows them
+	LibraryOnly bool
+	// MinLibrarySize is how many liked songs a library needs for LibraryOnly. Smaller libraries also get tracks
+	// from outside the liked songs that match the mood, with a warning, instead of failing to fill a playlist.
+	// 0 never relaxes LibraryOnly.
+	MinLibrarySize int
+	// MoodStrict only lets tracks matching the mood into playlists. Without it, liked songs of any mood are added
+	// after the stages, and playlists of only liked songs are a shuffle of the library.
+	MoodStrict bool
+	// GenreMatch is how artist genres are matched to the genres of the mood, one of the GenreMatch constants
+	GenreMatch string
+	// UseFollowedArtists counts the artists the user follows as liked artists, and lets them seed recommendations
+	// when the top artists leave room. It needs access to the followed artists.
+	UseFollowedArtists bool
+	// RequireLikedSeedArtists only lets top artists seed recommendations if they're in the user's liked artists.
+	// Recommendations are limited to the user's liked songs either way.
+	RequireLikedSeedArtists bool
+	// DiverseSeeds picks recommendation seeds at random from the user's top DiverseTopItems artists and tracks and
+	// the mood's genres, instead of always the top 2 artists and top tracks, for more varied recommendations
+	DiverseSeeds bool
+	// SeedTracks are used first when seeding Spotify recommendations, e.g. the currently playing track.
+	// It's set per playlist rather than loaded from the environment.
+	SeedTracks []spotify.ID
+	// PreviousMood is the mood of the last weather playlist, which MoodMemory eases a new mood in from.
+	// It's set per playlist rather than loaded from the environment.
+	PreviousMood string
+	// RecentLikedTracks limits the audio-features stage to the most recently liked songs. 0 analyzes all of them.
+	RecentLikedTracks int
+	// Genre narrows the mood to a genre seed, e.g. energetic electronic music. It's set per playlist.
+	Genre string
+	// Temperature is the temperature in °C the playlist is made for, if it's for the weather. It's set per playlist.
+	Temperature *float64
+	// DryRun picks the tracks without saving anything, such as the history of recent playlists starting over.
+	// It's set per request, for previews.
+	DryRun bool
+	// TemperatureIntensity is how far extreme temperatures push the energy of recommendations, up to 1: with 0.3,
+	// the energy targets are 30% higher in a heatwave and 30% lower in a freeze. 0 disables it.
+	TemperatureIntensity float64
+	// ComfortableTemperature is the temperature in °C that doesn't push the energy of recommendations either way
+	ComfortableTemperature float64
+	// UseCurrentlyPlaying seeds weather playlists with the track the user is listening to, and lets it steer the mood
+	UseCurrentlyPlaying bool
+	// MaxTopTrackArtists is how many of the user's most liked artists the artist-top-tracks stage looks at
+	MaxTopTrackArtists int
+	// NeighborSeedTracks is how many of the best mood matches the neighbors stage asks recommendations for
+	NeighborSeedTracks int
+	// MaxFollowedPlaylists is how many of the user's playlists the followed-playlists stage scans, at most 50
+	MaxFollowedPlaylists int
+	// FilterAlternateVersions removes live, remixed and remastered versions of songs from playlists
+	FilterAlternateVersions bool
+	// StudioOnly keeps only studio versions: it filters alternate versions and leaves out the tracks of live albums
+	StudioOnly bool
+	// PrimaryArtistOnly counts a track only toward its first artist's limit of songs per playlist, so collaborations
+	// don't use up the songs of every featured artist
+	PrimaryArtistOnly bool
+	// AlternateVersionKeywords are the words in the version part of a track name that mark it as an alternate version
+	AlternateVersionKeywords []string
+	// PlaylistNameTemplate names playlists by expanding {mood}, {city}, {date}, {temp} and {weather}.
+	// Empty keeps the built-in names.
+	PlaylistNameTemplate string
+	// Order is the order of the final playlist, one of the Order constants
+	Order string
+	// Sampling is how the candidates that make the cut are picked when there are too many, one of the Sampling constants
+	Sampling string
+	// AvoidRecentPlaylists leaves tracks of the last this many playlists out of new playlists until too few are left.
+	// 0 disables it.
+	AvoidRecentPlaylists int
+	// CooldownTracks is how many calmer tracks are added after the mood section to wind the playlist down, at most 20.
+	// 0 disables the cooldown.
+	CooldownTracks int
+	// TargetDuration fills the playlist to this length instead of a number of tracks, and leaves out the cooldown.
+	// It's set per playlist; 0 limits the playlist to 50 tracks.
+	TargetDuration time.Duration
+	// DurationTolerance is how far a playlist with a TargetDuration may be off from it
+	DurationTolerance time.Duration
+	// AllWeatherConditions picks the mood from every condition the weather has, such as mist and rain, by the
+	// priority of the mood rules. Otherwise only the main condition is used.
+	AllWeatherConditions bool
+	// RankTracks picks the best tracks for the mood instead of a random selection, ranking them by a weighted blend
+	// of their mood fit, popularity and release recency. Without audio features, the selection stays random.
+	RankTracks bool
+	// MoodFitWeight, PopularityWeight and RecencyWeight weigh the parts of the ranking against each other
+	MoodFitWeight    float64
+	PopularityWeight float64
+	RecencyWeight    float64
+	// LikedRecencyWeight favors tracks the user liked recently, as they say more about their current taste.
+	// With RankTracks, it weighs when tracks were liked in the ranking; without, recently liked tracks are more
+	// likely to be picked. 0 turns it off.
+	LikedRecencyWeight float64
+	// RecentlyPlayedWeight holds back tracks the user played in the last RecentlyPlayedWindow, the more the more
+	// recently they were played, so playlists aren't the same rotation. With RankTracks, it's subtracted in the
+	// ranking; without, recently played tracks are less likely to be picked. 0 turns it off.
+	RecentlyPlayedWeight float64
+	RecentlyPlayedWindow time.Duration
+	// TopGenreWeight favors tracks in the user's top genres, those of their top artists, that match the mood's
+	// genres. With RankTracks, it's added in the ranking; without, such tracks are more likely to be picked.
+	// 0 turns it off.
+	TopGenreWeight float64
+	// MoodMemory smooths sharp changes of the weather's mood between playlists created within MoodMemoryWindow of
+	// each other, by easing the new mood's audio feature thresholds towards the previous mood's by this factor.
+	// 0 turns it off.
+	MoodMemory       float64
+	MoodMemoryWindow time.Duration
+	// MoodWeights override how much each audio feature counts towards the mood score of a mood, by mood name.
+	// Features an override leaves at 0 keep their default weight.
+	MoodWeights map[string]FeatureWeights
+	// MaxEditorialShare is the largest fraction of a playlist that may come from playlists curated by others, found
+	// by the mood-playlists and editorial-playlists stages, so they can't crowd out the user's own taste.
+	// 1 doesn't cap them.
+	MaxEditorialShare float64
+	// FilterExplicit removes tracks with explicit lyrics from playlists
+	FilterExplicit bool
+	// MinDuration and MaxDuration leave shorter tracks, such as interludes and skits, and longer tracks out of
+	// playlists. Zero doesn't limit the duration.
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	// VerifyPlayable re-checks right before creating a playlist that its tracks are playable in the user's country
+	VerifyPlayable bool
+	// VerifyPlaylist fetches a playlist after creating it, and reports the stats of the tracks that actually
+	// ended up in it
+	VerifyPlaylist bool
+	// TagPlaylists ends the description of created playlists with a marker, so IsVibecastPlaylist can find them
+	TagPlaylists bool
+	// TruncateAtPlaylistCap leaves out the tracks that don't fit when a playlist would get more than the 10,000
+	// tracks Spotify allows, instead of refusing to change it
+	TruncateAtPlaylistCap bool
+	// MoodCheckAllStages also checks the audio features of the tracks the other stages found against the mood,
+	// as they only matched it by genre or playlist. It takes a Spotify call per 100 tracks.
+	MoodCheckAllStages bool
+	// EstimateFeatures estimates the audio features of liked songs from their artists' genres when Spotify won't
+	// give out the real ones, so the audio features stage can still match songs to the mood
+	EstimateFeatures bool
+	// InstrumentalOnly keeps only instrumental tracks in playlists: those with at least MinInstrumentalness and at
+	// most MaxSpeechiness, or without audio features, those by artists with instrumental genres such as classical
+	InstrumentalOnly    bool
+	MinInstrumentalness float64
+	MaxSpeechiness      float64
+	// EnergeticMinEnergy is the least energy a track of an energetic playlist may have, on top of the mood's
+	// thresholds, so the playlist never has a lull. 0 turns it off.
+	EnergeticMinEnergy float64
+	// RelaxedMaxEnergy is the most energy a track of a relaxed playlist may have. 0 turns it off.
+	RelaxedMaxEnergy float64
+	// CallBudget is the most Spotify calls the recommendation stages may make for a single playlist
+	CallBudget int
+	// LibraryTimeout bounds loading the details of all liked songs before the stages run
+	LibraryTimeout time.Duration
+	// PipelineTimeout bounds the stages for a small library. It grows by pipelineTimeoutPerThousandSongs
+	// for every thousand liked songs, as the stages go through all of them.
+	PipelineTimeout time.Duration
+	// MaxPipelineTime caps the whole pipeline run, loading the liked songs included. When it's hit, the playlist is
+	// made from the tracks found until then. Zero leaves it uncapped.
+	MaxPipelineTime time.Duration
+	// ResultCacheTTL is how long the candidates of a pipeline run are reused by runs for the same user, mood
+	// and options, as long as the liked songs haven't changed. Zero turns the cache off.
+	ResultCacheTTL time.Duration
+	// SpotifyTimeout bounds single Spotify requests made outside the pipeline, such as searches
+	SpotifyTimeout time.Duration
+	// DefaultCountry is the ISO 3166 country code of postal codes entered without a country
+	DefaultCountry string
+	// Market is the ISO 3166 country code used for market-aware Spotify calls instead of the user's country.
+	// Empty uses the user's country, or the market of the access token if that's unknown.
+	Market string
+	// DefaultCity is used for weather playlists created without a city when there's no terminal to ask for one
+	DefaultCity string
+	// FallbackCities are tried in order when the weather of the entered city can't be found
+	FallbackCities []string
+	// WeatherAlerts fetches the active weather alerts from the One Call API along with the weather
+	WeatherAlerts bool
+	// AlertMood is the mood used while a weather alert is active, one of Moods
+	AlertMood string
+	// WeatherRetries is how many times a failed weather request is retried before falling back to the neutral mood
+	WeatherRetries int
+	// WeatherRetryDelay is the wait before the first weather retry, doubling for every further retry
+	WeatherRetryDelay time.Duration
+	// WeatherBreakerThreshold is how many weather requests in a row may fail before the weather API isn't called
+	// for WeatherBreakerCooldown. 0 cooldown always calls it.
+	WeatherBreakerThreshold int
+	WeatherBreakerCooldown  time.Duration
+	// WeatherKeyRotation is how the OpenWeatherMap API keys take turns, one of the KeyRotation constants.
+	// Either way, a rate limited request is tried again with the next key.
+	WeatherKeyRotation string
+	// PageDelay is the pause between page requests when paging through the user's library
+	PageDelay time.Duration
+	// SampleSize is the number of liked songs to randomly sample from libraries larger than it. 0 disables sampling.
+	SampleSize int
+	// DetailedSuccessPage shows the tracklist, mood and weather on the page shown after creating a playlist
+	DetailedSuccessPage bool
+	// LogRequests logs every request the server handles, with its status and duration
+	LogRequests bool
+	// SpotifyTrace logs every Spotify call as JSON, with its endpoint, parameters, status, duration and retries
+	SpotifyTrace bool
+	// ReplayDir answers Spotify and weather API calls with the responses recorded in it instead of calling the
+	// live APIs, so the app runs offline and the same way every time
+	ReplayDir string
+	// ReplayRecord calls the live APIs and records their responses in ReplayDir, for replaying later
+	ReplayRecord bool
+	// BatchConcurrency is how many playlists of a batch are created at the same time
+	BatchConcurrency int
+	// GenreSeedFallback fills a playlist that would be empty with recommendations seeded by the mood's genres
+	// alone, from outside the library, as a last resort for libraries too niche for the mood
+	GenreSeedFallback bool
+	// MaxConcurrentCreations is how many requests to create playlists may be handled at the same time. Further
+	// requests are turned down until one is done.
+	MaxConcurrentCreations int
+}
+
+// recommenderConfig is the configuration used by the server, loaded at startup
+var recommenderConfig = DefaultRecommenderConfig()
+
+// DefaultRecommenderConfig returns the configuration matching the original pipeline behavior
+func DefaultRecommenderConfig() RecommenderConfig {
+	return RecommenderConfig{
+		Stages: []string{
+			StageAudioFeatures,
+			StageGenres,
+			StageMoodPlaylists,
+			StageRecommendations,
+		},
+		TargetSize:               50,
+		PlaylistSize:             50,
+		MaxSongsPerArtist:        5,
+		StageTrackLimit:          100,
+		RecommendationLimit:      100,
+		MoodPlaylistSearchLimit:  5,
+		MoodPlaylistTrackBudget:  200,
+		TopItems:                 5,
+		DiverseTopItems:          20,
+		LibraryOnly:              true,
+		MinLibrarySize:           30,
+		MoodStrict:               true,
+		Order:                    OrderShuffle,
+		Sampling:                 SamplingRandom,
+		GenreMatch:               GenreMatchContains,
+		AllWeatherConditions:     true,
+		AlternateVersionKeywords: defaultAlternateVersionKeywords,
+		RequireLikedSeedArtists:  true,
+		UseCurrentlyPlaying:      true,
+		MaxTopTrackArtists:       20,
+		NeighborSeedTracks:       5,
+		MaxFollowedPlaylists:     10,
+		VerifyPlayable:           true,
+		TagPlaylists:             true,
+		CallBudget:               150,
+		LibraryTimeout:           5 * time.Minute,
+		PipelineTimeout:          60 * time.Second,
+		MinDuration:              60 * time.Second,
+		DurationTolerance:        2 * time.Minute,
+		MinInstrumentalness:      0.8,
+		MaxSpeechiness:           0.2,
+		ResultCacheTTL:           5 * time.Minute,
+		ComfortableTemperature:   20,
+		MoodFitWeight:            0.6,
+		PopularityWeight:         0.25,
+		RecencyWeight:            0.15,
+		SpotifyTimeout:           10 * time.Second,
+		DefaultCountry:           "US",
+		AlertMood:                "intense",
+		WeatherRetries:           2,
+		WeatherRetryDelay:        500 * time.Millisecond,
+		WeatherBreakerThreshold:  5,
+		WeatherBreakerCooldown:   time.Minute,
+		WeatherKeyRotation:       KeyRotationRoundRobin,
+		PageDelay:                100 * time.Millisecond,
+		BatchConcurrency:         3,
+		MaxConcurrentCreations:   1,
+		RecentlyPlayedWindow:     48 * time.Hour,
+		MoodMemoryWindow:         12 * time.Hour,
+		MaxEditorialShare:        1,
+		LogRequests:              true,
+		DetailedSuccessPage:      true,
+	}
+}
+
+// LoadRecommenderConfig builds the configuration from environment variables, using defaults for anything unset
+func LoadRecommenderConfig() RecommenderConfig {
+	cfg := DefaultRecommenderConfig()
+
+	// PIPELINE_STAGES is a comma separated, ordered list of the stages to run
+	if value := os.Getenv("PIPELINE_STAGES"); value != "" {
+		stages, err := ParseStages(value)
+		if err != nil {
+			fmt.Printf("Warning: ignoring PIPELINE_STAGES: %v\n", err)
+		} else {
+			cfg.Stages = stages
+		}
+	}
+
+	cfg.LibraryOnly = envBool("LIBRARY_ONLY", cfg.LibraryOnly)
+	cfg.MinLibrarySize = envOptionalInt("MIN_LIBRARY_SIZE", cfg.MinLibrarySize)
+	cfg.MoodStrict = envBool("MOOD_STRICT", cfg.MoodStrict)
+	cfg.RecentLikedTracks = envInt("RECENT_LIKED_TRACKS", cfg.RecentLikedTracks)
+	cfg.UseCurrentlyPlaying = envBool("USE_CURRENTLY_PLAYING", cfg.UseCurrentlyPlaying)
+	cfg.RequireLikedSeedArtists = envBool("REQUIRE_LIKED_SEED_ARTISTS", cfg.RequireLikedSeedArtists)
+	cfg.UseFollowedArtists = envBool("USE_FOLLOWED_ARTISTS", cfg.UseFollowedArtists)
+
+	// PLAYLIST_ORDER is the order of the final playlist
+	if value := os.Getenv("PLAYLIST_ORDER"); value != "" {
+		order, err := ParseOrder(value)
+		if err != nil {
+			fmt.Printf("Warning: ignoring PLAYLIST_ORDER: %v\n", err)
+		} else {
+			cfg.Order = order
+		}
+	}
+
+	// SAMPLING is how the candidates that make the cut are picked
+	if value := os.Getenv("SAMPLING"); value != "" {
+		sampling, err := ParseSampling(value)
+		if err != nil {
+			fmt.Printf("Warning: ignoring SAMPLING: %v\n", err)
+		} else {
+			cfg.Sampling = sampling
+		}
+	}
+
+	// WEATHER_KEY_ROTATION is how the weather API keys take turns
+	if value := os.Getenv("WEATHER_KEY_ROTATION"); value != "" {
+		rotation, err := ParseKeyRotation(value)
+		if err != nil {
+			fmt.Printf("Warning: ignoring WEATHER_KEY_ROTATION: %v\n", err)
+		} else {
+			cfg.WeatherKeyRotation = rotation
+		}
+	}
+
+	loadPipelineLimits(&cfg)
+
+	// GENRE_MATCH is how strictly artist genres must match the genres of the mood
+	if value := os.Getenv("GENRE_MATCH"); value != "" {
+		mode, err := ParseGenreMatch(value)
+		if err != nil {
+			fmt.Printf("Warning: ignoring GENRE_MATCH: %v\n", err)
+		} else {
+			cfg.GenreMatch = mode
+		}
+	}
+
+	cfg.PlaylistNameTemplate = os.Getenv("PLAYLIST_NAME_TEMPLATE")
+	cfg.FilterAlternateVersions = envBool("FILTER_ALTERNATE_VERSIONS", cfg.FilterAlternateVersions)
+	cfg.StudioOnly = envBool("STUDIO_ONLY", cfg.StudioOnly)
+	cfg.PrimaryArtistOnly = envBool("PRIMARY_ARTIST_ONLY", cfg.PrimaryArtistOnly)
+	if value := os.Getenv("ALTERNATE_VERSION_KEYWORDS"); value != "" {
+		var keywords []string
+		for _, keyword := range strings.Split(value, ",") {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				keywords = append(keywords, keyword)
+			}
+		}
+		cfg.AlternateVersionKeywords = keywords
+	}
+
+	cfg.AvoidRecentPlaylists = envInt("AVOID_RECENT_PLAYLISTS", cfg.AvoidRecentPlaylists)
+	cfg.CooldownTracks = min(envInt("COOLDOWN_TRACKS", cfg.CooldownTracks), 20)
+	cfg.DurationTolerance = envDuration("DURATION_TOLERANCE", cfg.DurationTolerance)
+	cfg.TemperatureIntensity = math.Min(envWeight("TEMPERATURE_INTENSITY", cfg.TemperatureIntensity), 1)
+	cfg.ComfortableTemperature = envFloat("COMFORTABLE_TEMPERATURE", cfg.ComfortableTemperature)
+	cfg.DiverseSeeds = envBool("DIVERSE_SEEDS", cfg.DiverseSeeds)
+	cfg.RankTracks = envBool("RANK_TRACKS", cfg.RankTracks)
+	cfg.MoodFitWeight = envWeight("MOOD_FIT_WEIGHT", cfg.MoodFitWeight)
+	cfg.PopularityWeight = envWeight("POPULARITY_WEIGHT", cfg.PopularityWeight)
+	cfg.RecencyWeight = envWeight("RECENCY_WEIGHT", cfg.RecencyWeight)
+	cfg.LikedRecencyWeight = envWeight("LIKED_RECENCY_WEIGHT", cfg.LikedRecencyWeight)
+	cfg.TopGenreWeight = envWeight("TOP_GENRE_WEIGHT", cfg.TopGenreWeight)
+	cfg.MoodMemory = math.Min(envWeight("MOOD_MEMORY", cfg.MoodMemory), 1)
+	cfg.MoodMemoryWindow = envDuration("MOOD_MEMORY_WINDOW", cfg.MoodMemoryWindow)
+	if value := os.Getenv("MOOD_WEIGHTS"); value != "" {
+		if weights, err := ParseMoodWeights(value); err != nil {
+			fmt.Printf("Warning: ignoring MOOD_WEIGHTS: %v\n", err)
+		} else {
+			cfg.MoodWeights = weights
+		}
+	}
+	cfg.MaxEditorialShare = math.Min(envWeight("MAX_EDITORIAL_SHARE", cfg.MaxEditorialShare), 1)
+	cfg.RecentlyPlayedWeight = math.Min(envWeight("RECENTLY_PLAYED_WEIGHT", cfg.RecentlyPlayedWeight), 1)
+	cfg.RecentlyPlayedWindow = envDuration("RECENTLY_PLAYED_WINDOW", cfg.RecentlyPlayedWindow)
+	cfg.FilterExplicit = envBool("FILTER_EXPLICIT", cfg.FilterExplicit)
+	cfg.MinDuration = envOptionalDuration("MIN_DURATION", cfg.MinDuration)
+	cfg.MaxDuration = envOptionalDuration("MAX_DURATION", cfg.MaxDuration)
+	cfg.VerifyPlayable = envBool("VERIFY_PLAYABLE", cfg.VerifyPlayable)
+	cfg.VerifyPlaylist = envBool("VERIFY_PLAYLIST", cfg.VerifyPlaylist)
+	cfg.TagPlaylists = envBool("TAG_PLAYLISTS", cfg.TagPlaylists)
+	cfg.TruncateAtPlaylistCap = envBool("TRUNCATE_AT_PLAYLIST_CAP", cfg.TruncateAtPlaylistCap)
+	cfg.MoodCheckAllStages = envBool("MOOD_CHECK_ALL_STAGES", cfg.MoodCheckAllStages)
+	cfg.EstimateFeatures = envBool("ESTIMATE_FEATURES", cfg.EstimateFeatures)
+	cfg.EnergeticMinEnergy = math.Min(envWeight("ENERGETIC_MIN_ENERGY", cfg.EnergeticMinEnergy), 1)
+	cfg.RelaxedMaxEnergy = math.Min(envWeight("RELAXED_MAX_ENERGY", cfg.RelaxedMaxEnergy), 1)
+	cfg.InstrumentalOnly = envBool("INSTRUMENTAL_ONLY", cfg.InstrumentalOnly)
+	cfg.MinInstrumentalness = math.Min(envWeight("MIN_INSTRUMENTALNESS", cfg.MinInstrumentalness), 1)
+	cfg.MaxSpeechiness = math.Min(envWeight("MAX_SPEECHINESS", cfg.MaxSpeechiness), 1)
+	cfg.CallBudget = envInt("CALL_BUDGET", cfg.CallBudget)
+	cfg.LibraryTimeout = envDuration("LIBRARY_TIMEOUT", cfg.LibraryTimeout)
+	cfg.PipelineTimeout = envDuration("PIPELINE_TIMEOUT", cfg.PipelineTimeout)
+	cfg.MaxPipelineTime = envOptionalDuration("MAX_PIPELINE_TIME", cfg.MaxPipelineTime)
+	cfg.ResultCacheTTL = envOptionalDuration("RESULT_CACHE_TTL", cfg.ResultCacheTTL)
+	cfg.SpotifyTimeout = envDuration("SPOTIFY_TIMEOUT", cfg.SpotifyTimeout)
+	if value := strings.TrimSpace(os.Getenv("DEFAULT_COUNTRY")); value != "" {
+		cfg.DefaultCountry = strings.ToUpper(value)
+	}
+	cfg.DefaultCity = strings.TrimSpace(os.Getenv("DEFAULT_CITY"))
+	cfg.FallbackCities = ParseCityList(os.Getenv("FALLBACK_CITIES"))
+	if value := strings.TrimSpace(os.Getenv("MARKET")); value != "" {
+		if validMarket(value) {
+			cfg.Market = strings.ToUpper(value)
+		} else {
+			fmt.Printf("Warning: ignoring MARKET: %q is not a two letter country code\n", value)
+		}
+	}
+	cfg.WeatherAlerts = envBool("WEATHER_ALERTS", cfg.WeatherAlerts)
+	if value := os.Getenv("WEATHER_ALERT_MOOD"); value != "" {
+		mood := strings.ToLower(strings.TrimSpace(value))
+		if err := ValidateMood(mood); err != nil {
+			fmt.Printf("Warning: ignoring WEATHER_ALERT_MOOD: %v\n", err)
+		} else {
+			cfg.AlertMood = mood
+		}
+	}
+	cfg.AllWeatherConditions = envBool("ALL_WEATHER_CONDITIONS", cfg.AllWeatherConditions)
+	cfg.WeatherRetries = envOptionalInt("WEATHER_RETRIES", cfg.WeatherRetries)
+	cfg.WeatherRetryDelay = envDuration("WEATHER_RETRY_DELAY", cfg.WeatherRetryDelay)
+	cfg.WeatherBreakerThreshold = envInt("WEATHER_BREAKER_THRESHOLD", cfg.WeatherBreakerThreshold)
+	cfg.WeatherBreakerCooldown = envOptionalDuration("WEATHER_BREAKER_COOLDOWN", cfg.WeatherBreakerCooldown)
+	cfg.PageDelay = envOptionalDuration("PAGE_DELAY", cfg.PageDelay)
+	cfg.SampleSize = envInt("SAMPLE_SIZE", cfg.SampleSize)
+	cfg.DetailedSuccessPage = envBool("DETAILED_SUCCESS_PAGE", cfg.DetailedSuccessPage)
+	cfg.LogRequests = envBool("LOG_REQUESTS", cfg.LogRequests)
+	cfg.SpotifyTrace = envBool("SPOTIFY_TRACE", cfg.SpotifyTrace)
+	cfg.ReplayDir = strings.TrimSpace(os.Getenv("REPLAY_DIR"))
+	cfg.ReplayRecord = envBool("REPLAY_RECORD", cfg.ReplayRecord)
+	cfg.BatchConcurrency = envInt("BATCH_CONCURRENCY", cfg.BatchConcurrency)
+	cfg.GenreSeedFallback = envBool("GENRE_SEED_FALLBACK", cfg.GenreSeedFallback)
+	cfg.MaxConcurrentCreations = envInt("MAX_CONCURRENT_CREATIONS", cfg.MaxConcurrentCreations)
+
+	// INCLUDE_ARTIST_TOP_TRACKS is a shortcut for adding the artist-top-tracks stage to the end of the stages
+	if envBool("INCLUDE_ARTIST_TOP_TRACKS", false) && !cfg.HasStage(StageArtistTopTracks) {
+		cfg.Stages = append(cfg.Stages, StageArtistTopTracks)
+	}
+
+	// INCLUDE_FOLLOWED_PLAYLISTS adds the followed-playlists stage to the end of the stages
+	if envBool("INCLUDE_FOLLOWED_PLAYLISTS", false) && !cfg.HasStage(StageFollowedPlaylists) {
+		cfg.Stages = append(cfg.Stages, StageFollowedPlaylists)
+	}
+	// INCLUDE_EDITORIAL_PLAYLISTS adds the editorial-playlists stage to the end of the stages
+	if envBool("INCLUDE_EDITORIAL_PLAYLISTS", false) && !cfg.HasStage(StageEditorialPlaylists) {
+		cfg.Stages = append(cfg.Stages, StageEditorialPlaylists)
+	}
+	// INCLUDE_NEIGHBORS adds the neighbors stage to the end of the stages
+	if envBool("INCLUDE_NEIGHBORS", false) && !cfg.HasStage(StageNeighbors) {
+		cfg.Stages = append(cfg.Stages, StageNeighbors)
+	}
+	cfg.NeighborSeedTracks = min(envInt("NEIGHBOR_SEED_TRACKS", cfg.NeighborSeedTracks), 25)
+	// INCLUDE_ON_REPEAT adds the on-repeat stage to the start of the stages, as it reflects what the user plays most
+	if envBool("INCLUDE_ON_REPEAT", false) && !cfg.HasStage(StageOnRepeat) {
+		cfg.Stages = append([]string{StageOnRepeat}, cfg.Stages...)
+	}
+	cfg.MaxFollowedPlaylists = min(envInt("MAX_FOLLOWED_PLAYLISTS", cfg.MaxFollowedPlaylists), 50)
+
+	return cfg
+}
+
+// HasStage reports whether the named stage is enabled
+func (cfg RecommenderConfig) HasStage(name string) bool {
+	for _, stage := range cfg.Stages {
+		if stage == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validMarket reports whether market looks like an ISO 3166 country code, such as "NL"
+func validMarket(market string) bool {
+	if len(market) != 2 {
+		return false
+	}
+	for _, c := range strings.ToUpper(market) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// envValue reads an environment variable with parse, returning fallback if it's unset or invalid
+func envValue[T any](name string, fallback T, parse func(string) (T, error)) T {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := parse(value)
+	if err != nil {
+		fmt.Printf("Warning: ignoring %s: %v\n", name, err)
+		return fallback
+	}
+	return parsed
+}
+
+// envBool reads a boolean environment variable, returning fallback if it's unset or invalid
+func envBool(name string, fallback bool) bool {
+	return envValue(name, fallback, parseBool)
+}
+
+// envInt reads a positive integer environment variable, returning fallback if it's unset or invalid
+func envInt(name string, fallback int) int {
+	return envValue(name, fallback, parseInt)
+}
+
+// envOptionalInt is envInt for options that zero turns off
+func envOptionalInt(name string, fallback int) int {
+	return envValue(name, fallback, parseOptionalInt)
+}
+
+// envFloat reads a number environment variable, returning fallback if it's unset or invalid
+func envFloat(name string, fallback float64) float64 {
+	return envValue(name, fallback, parseFloat)
+}
+
+// envWeight reads a non-negative number environment variable, returning fallback if it's unset or invalid
+func envWeight(name string, fallback float64) float64 {
+	return envValue(name, fallback, parseWeight)
+}
+
+// envDuration reads a duration environment variable such as "15s", returning fallback if it's unset or invalid
+func envDuration(name string, fallback time.Duration) time.Duration {
+	return envValue(name, fallback, parseDuration)
+}
+
+// envOptionalDuration is envDuration for options that zero turns off
+func envOptionalDuration(name string, fallback time.Duration) time.Duration {
+	return envValue(name, fallback, parseOptionalDuration)
+}
+
+// parseBool parses a boolean option
+func parseBool(value string) (bool, error) {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a boolean", value)
+	}
+	return parsed, nil
+}
+
+// parseInt parses a positive integer option
+func parseInt(value string) (int, error) {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%q is not a positive integer", value)
+	}
+	return parsed, nil
+}
+
+// parseOptionalInt parses a non-negative integer option, for options that zero turns off
+func parseOptionalInt(value string) (int, error) {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative integer", value)
+	}
+	return parsed, nil
+}
+
+// parseFloat parses a number option
+func parseFloat(value string) (float64, error) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+	return parsed, nil
+}
+
+// parseWeight parses a non-negative number option
+func parseWeight(value string) (float64, error) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%q is not a non-negative number", value)
+	}
+	return parsed, nil
+}
+
+// parseDuration parses a positive duration option such as "15s"
+func parseDuration(value string) (time.Duration, error) {
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration", value)
+	}
+	return parsed, nil
+}
+
+// parseOptionalDuration parses a duration option that zero turns off
+func parseOptionalDuration(value string) (time.Duration, error) {
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%q is not a positive duration or 0", value)
+	}
+	return parsed, nil
+}
+
+// ParseOrder parses the name of a playlist order
+func ParseOrder(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, order := range playlistOrders {
+		if value == order {
+			return order, nil
+		}
+	}
+	return "", fmt.Errorf("unknown order %q, expected one of %s", value, strings.Join(playlistOrders, ", "))
+}
+
+// ParseSampling parses the name of a sampling strategy
+func ParseSampling(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, sampling := range samplingStrategies {
+		if value == sampling {
+			return sampling, nil
+		}
+	}
+	return "", fmt.Errorf("unknown sampling %q, expected one of %s", value, strings.Join(samplingStrategies, ", "))
+}
+
+// ParseKeyRotation parses the name of a weather API key rotation
+func ParseKeyRotation(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, rotation := range keyRotations {
+		if value == rotation {
+			return rotation, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key rotation %q, expected one of %s", value, strings.Join(keyRotations, ", "))
+}
+
+// ParseGenreMatch parses the name of a genre match mode
+func ParseGenreMatch(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, mode := range genreMatchModes {
+		if value == mode {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown genre match mode %q, expected one of %s", value, strings.Join(genreMatchModes, ", "))
+}
+
+// ParseMoodWeights parses feature weights by mood, such as "energetic:energy=4,tempo=1;thoughtful:valence=2".
+// Moods are separated by semicolons, and each lists comma separated weights of its audio features.
+func ParseMoodWeights(value string) (map[string]FeatureWeights, error) {
+	moodWeights := make(map[string]FeatureWeights)
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		mood, list, ok := strings.Cut(entry, ":")
+		mood = strings.ToLower(strings.TrimSpace(mood))
+		if !ok {
+			return nil, fmt.Errorf("expected a mood and its weights in %q", entry)
+		}
+		if err := ValidateMood(mood); err != nil {
+			return nil, err
+		}
+
+		weights := moodWeights[mood]
+		for _, pair := range strings.Split(list, ",") {
+			name, number, _ := strings.Cut(pair, "=")
+			field := weights.field(strings.ToLower(strings.TrimSpace(name)))
+			if field == nil {
+				return nil, fmt.Errorf("unknown audio feature %q, expected one of %s", strings.TrimSpace(name), strings.Join(featureNames, ", "))
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("the weight of %s must be a positive number, got %q", strings.TrimSpace(name), strings.TrimSpace(number))
+			}
+			*field = parsed
+		}
+		moodWeights[mood] = weights
+	}
+	return moodWeights, nil
+}
+
+// ParseStages parses a comma separated list of stage names, keeping their order
+func ParseStages(value string) ([]string, error) {
+	var stages []string
+	seen := make(map[string]bool)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if _, ok := pipelineStages[name]; !ok {
+			return nil, fmt.Errorf("unknown stage %q", name)
+		}
+
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		stages = append(stages, name)
+	}
+
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("no stages enabled")
+	}
+
+	return stages, nil
+}
@@ -4,7 +4,8 @@ package main
 var (
 	spotifyClientID     = "default"
 	spotifyClientSecret = "default"
-	weatherAPIKey       = "default"
+	// weatherAPIKey is left empty without a key, so the weather comes from Open-Meteo
+	weatherAPIKey = ""
 )
 
 // LoadEnvVars loads environment variables from build flags or returns defaults
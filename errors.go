@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Errors callers can match with errors.Is. They're wrapped with the details of what went wrong, so their
+// messages are only the start of the message of the returned error.
+var (
+	// ErrNoLikedSongs is returned when the user's library has no liked songs to pick from
+	ErrNoLikedSongs = errors.New("no liked songs found")
+	// ErrNoMoodMatches is returned when none of the songs the stages found are left for the playlist
+	ErrNoMoodMatches = errors.New("no songs match the mood")
+	// ErrAudioFeaturesUnavailable is returned when Spotify won't give out the audio features of tracks
+	ErrAudioFeaturesUnavailable = errors.New("audio features unavailable")
+	// ErrPlaylistFull is returned when adding tracks would take a playlist past the most tracks Spotify allows
+	ErrPlaylistFull = errors.New("the playlist can't have more tracks")
+	// ErrNoTopItems is returned when the user doesn't have top artists or tracks yet, as their account is too new
+	ErrNoTopItems = errors.New("no listening history for top artists and tracks yet")
+	// ErrSpotifyClientNil is returned when there's no Spotify client, usually because no one is logged in
+	ErrSpotifyClientNil = errors.New("spotify client is nil")
+	// ErrCityNotFound is returned when the weather API doesn't know a city or postal code
+	ErrCityNotFound = errors.New("city not found")
+	// ErrWeatherAPIKey is returned when WEATHER_API_KEY isn't set
+	ErrWeatherAPIKey = errors.New("WEATHER_API_KEY environment variable not set")
+	// ErrWeatherCircuitOpen is returned instead of calling the weather API while it's failing
+	ErrWeatherCircuitOpen = errors.New("the weather API is down")
+	// ErrOutOfTime is returned when the pipeline ran out of time before it found any tracks for the playlist
+	ErrOutOfTime = errors.New("ran out of time")
+)
+
+// weatherErrorStatus returns the status code for a failure to get the weather, which is the weather API's fault
+// unless the city doesn't exist or the API isn't configured
+func weatherErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrCityNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrWeatherAPIKey), errors.Is(err, ErrWeatherCircuitOpen):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// errorResponse returns the status code and message an HTTP handler should respond with for err.
+// Errors without a status of their own are internal server errors, their message starting with failure.
+func errorResponse(err error, failure string) (int, string) {
+	switch {
+	case errors.Is(err, errNoCity):
+		return http.StatusBadRequest, "Please enter a city or postal code"
+	case errors.Is(err, ErrCityNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, errCreationCancelled):
+		return http.StatusConflict, "Playlist creation was cancelled"
+	case errors.Is(err, ErrSpotifyClientNil):
+		return http.StatusUnauthorized, "Not logged in"
+	case insufficientScope(err):
+		return http.StatusForbidden, "Spotify needs more access for this: log in again at /login to grant it"
+	case errors.Is(err, ErrNoLikedSongs), errors.Is(err, ErrNoMoodMatches), errors.Is(err, ErrPlaylistFull):
+		return http.StatusUnprocessableEntity, err.Error()
+	case errors.Is(err, ErrOutOfTime):
+		return http.StatusGatewayTimeout, err.Error()
+	case errors.Is(err, ErrAudioFeaturesUnavailable):
+		return http.StatusBadGateway, failure + ": " + err.Error()
+	case errors.Is(err, ErrWeatherAPIKey):
+		return http.StatusServiceUnavailable, "The weather API isn't configured: set WEATHER_API_KEY"
+	}
+	return http.StatusInternalServerError, failure + ": " + err.Error()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Names of the experimental features
+const (
+	FeatureScoring     = "scoring"
+	FeatureConcurrency = "concurrency"
+)
+
+// Features are experimental pipeline behaviors that are off unless switched on, so they can be tried
+// and compared without rebuilding
+type Features struct {
+	// Scoring lets tracks match a mood when they meet most of its audio feature bounds, instead of all of them
+	Scoring bool `json:"scoring"`
+	// Concurrency fetches the audio features of a large number of tracks with several requests at a time
+	Concurrency bool `json:"concurrency"`
+}
+
+// features are the experimental features used by the server, loaded at startup.
+// Branch points check this value rather than reading the environment themselves.
+var features Features
+
+// featureFlags maps the name of each feature to its flag
+func (f *Features) featureFlags() map[string]*bool {
+	return map[string]*bool{
+		FeatureScoring:     &f.Scoring,
+		FeatureConcurrency: &f.Concurrency,
+	}
+}
+
+// LoadFeatures switches on the features listed in FEATURES, a comma separated list such as "scoring,concurrency",
+// and those set to true in the JSON object in the file FEATURES_FILE. Unknown features are ignored with a warning.
+func LoadFeatures() Features {
+	var f Features
+
+	if path := os.Getenv("FEATURES_FILE"); path != "" {
+		if err := f.loadFile(path); err != nil {
+			fmt.Printf("Warning: ignoring FEATURES_FILE: %v\n", err)
+		}
+	}
+
+	for _, unknown := range f.Enable(os.Getenv("FEATURES")) {
+		fmt.Printf("Warning: ignoring unknown feature %q in FEATURES\n", unknown)
+	}
+
+	if enabled := f.Enabled(); len(enabled) > 0 {
+		fmt.Printf("Experimental features enabled: %s\n", strings.Join(enabled, ", "))
+	}
+	return f
+}
+
+// Enable switches on the features in a comma separated list and returns the names it doesn't know
+func (f *Features) Enable(list string) (unknown []string) {
+	flags := f.featureFlags()
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		flag, ok := flags[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		*flag = true
+	}
+	return unknown
+}
+
+// Enabled returns the names of the switched on features, sorted
+func (f *Features) Enabled() []string {
+	var enabled []string
+	for name, flag := range f.featureFlags() {
+		if *flag {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
+
+// loadFile switches on the features set to true in a JSON file
+func (f *Features) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]bool
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	flags := f.featureFlags()
+	for name, value := range values {
+		flag, ok := flags[strings.ToLower(name)]
+		if !ok {
+			fmt.Printf("Warning: ignoring unknown feature %q in %s\n", name, path)
+			continue
+		}
+		*flag = value
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// genreFeatureProfiles are the typical audio features of broad genres, by a word that appears in the names of
+// their subgenres, such as "rock" in "indie rock". They're coarse, but they still tell a ballad from a banger
+// when Spotify doesn't hand out the audio features of tracks.
+var genreFeatureProfiles = map[string]spotify.AudioFeatures{
+	"metal":      {Energy: 0.9, Danceability: 0.4, Valence: 0.35, Tempo: 130, Acousticness: 0.02, Instrumentalness: 0.1},
+	"punk":       {Energy: 0.9, Danceability: 0.45, Valence: 0.55, Tempo: 160, Acousticness: 0.03, Instrumentalness: 0.02},
+	"rock":       {Energy: 0.75, Danceability: 0.5, Valence: 0.5, Tempo: 125, Acousticness: 0.1, Instrumentalness: 0.05},
+	"edm":        {Energy: 0.85, Danceability: 0.7, Valence: 0.5, Tempo: 128, Acousticness: 0.03, Instrumentalness: 0.3},
+	"house":      {Energy: 0.8, Danceability: 0.8, Valence: 0.6, Tempo: 124, Acousticness: 0.03, Instrumentalness: 0.4},
+	"techno":     {Energy: 0.85, Danceability: 0.7, Valence: 0.3, Tempo: 130, Acousticness: 0.02, Instrumentalness: 0.8},
+	"dance":      {Energy: 0.8, Danceability: 0.8, Valence: 0.65, Tempo: 122, Acousticness: 0.05, Instrumentalness: 0.05},
+	"electronic": {Energy: 0.7, Danceability: 0.65, Valence: 0.45, Tempo: 120, Acousticness: 0.05, Instrumentalness: 0.5},
+	"hip hop":    {Energy: 0.65, Danceability: 0.8, Valence: 0.5, Tempo: 100, Acousticness: 0.15, Instrumentalness: 0.01},
+	"rap":        {Energy: 0.65, Danceability: 0.8, Valence: 0.45, Tempo: 105, Acousticness: 0.15, Instrumentalness: 0.01},
+	"trap":       {Energy: 0.65, Danceability: 0.75, Valence: 0.35, Tempo: 140, Acousticness: 0.1, Instrumentalness: 0.01},
+	"pop":        {Energy: 0.65, Danceability: 0.7, Valence: 0.6, Tempo: 118, Acousticness: 0.2, Instrumentalness: 0.01},
+	"latin":      {Energy: 0.75, Danceability: 0.8, Valence: 0.7, Tempo: 110, Acousticness: 0.2, Instrumentalness: 0.01},
+	"reggae":     {Energy: 0.55, Danceability: 0.8, Valence: 0.75, Tempo: 90, Acousticness: 0.2, Instrumentalness: 0.02},
+	"funk":       {Energy: 0.7, Danceability: 0.8, Valence: 0.8, Tempo: 110, Acousticness: 0.15, Instrumentalness: 0.05},
+	"disco":      {Energy: 0.75, Danceability: 0.8, Valence: 0.8, Tempo: 118, Acousticness: 0.1, Instrumentalness: 0.05},
+	"r&b":        {Energy: 0.5, Danceability: 0.7, Valence: 0.45, Tempo: 100, Acousticness: 0.25, Instrumentalness: 0.01},
+	"soul":       {Energy: 0.5, Danceability: 0.6, Valence: 0.55, Tempo: 105, Acousticness: 0.35, Instrumentalness: 0.02},
+	"blues":      {Energy: 0.5, Danceability: 0.55, Valence: 0.5, Tempo: 110, Acousticness: 0.4, Instrumentalness: 0.05},
+	"country":    {Energy: 0.6, Danceability: 0.6, Valence: 0.6, Tempo: 120, Acousticness: 0.3, Instrumentalness: 0.01},
+	"folk":       {Energy: 0.35, Danceability: 0.5, Valence: 0.45, Tempo: 110, Acousticness: 0.75, Instrumentalness: 0.05},
+	"acoustic":   {Energy: 0.3, Danceability: 0.5, Valence: 0.45, Tempo: 110, Acousticness: 0.85, Instrumentalness: 0.05},
+	"singer":     {Energy: 0.35, Danceability: 0.5, Valence: 0.4, Tempo: 110, Acousticness: 0.7, Instrumentalness: 0.02},
+	"indie":      {Energy: 0.55, Danceability: 0.55, Valence: 0.45, Tempo: 118, Acousticness: 0.3, Instrumentalness: 0.1},
+	"jazz":       {Energy: 0.35, Danceability: 0.55, Valence: 0.5, Tempo: 110, Acousticness: 0.7, Instrumentalness: 0.5},
+	"lo-fi":      {Energy: 0.3, Danceability: 0.65, Valence: 0.45, Tempo: 85, Acousticness: 0.6, Instrumentalness: 0.8},
+	"ambient":    {Energy: 0.15, Danceability: 0.25, Valence: 0.2, Tempo: 90, Acousticness: 0.8, Instrumentalness: 0.9},
+	"classical":  {Energy: 0.15, Danceability: 0.25, Valence: 0.25, Tempo: 100, Acousticness: 0.95, Instrumentalness: 0.9},
+	"piano":      {Energy: 0.15, Danceability: 0.35, Valence: 0.3, Tempo: 100, Acousticness: 0.95, Instrumentalness: 0.85},
+	"soundtrack": {Energy: 0.3, Danceability: 0.3, Valence: 0.25, Tempo: 105, Acousticness: 0.6, Instrumentalness: 0.8},
+}
+
+// genreProfiles returns the feature profiles of the broad genres the given genres belong to
+func genreProfiles(genres []string) []spotify.AudioFeatures {
+	var profiles []spotify.AudioFeatures
+	for _, genre := range genres {
+		genre = strings.ToLower(genre)
+		for word, profile := range genreFeatureProfiles {
+			if strings.Contains(genre, word) {
+				profiles = append(profiles, profile)
+			}
+		}
+	}
+	return profiles
+}
+
+// estimateFeaturesFromGenres estimates audio features from genres, as the average profile of the broad genres
+// they belong to. Genres without a known profile are ignored; if none has one, all features are zero.
+func estimateFeaturesFromGenres(genres []string) spotify.AudioFeatures {
+	profiles := genreProfiles(genres)
+
+	var estimate spotify.AudioFeatures
+	if len(profiles) == 0 {
+		return estimate
+	}
+	for _, profile := range profiles {
+		estimate.Energy += profile.Energy
+		estimate.Danceability += profile.Danceability
+		estimate.Valence += profile.Valence
+		estimate.Tempo += profile.Tempo
+		estimate.Acousticness += profile.Acousticness
+		estimate.Instrumentalness += profile.Instrumentalness
+	}
+
+	n := float32(len(profiles))
+	estimate.Energy /= n
+	estimate.Danceability /= n
+	estimate.Valence /= n
+	estimate.Tempo /= n
+	estimate.Acousticness /= n
+	estimate.Instrumentalness /= n
+	return estimate
+}
+
+// estimatedFeatureStage adds liked songs whose audio features, as estimated from their artists' genres, match
+// the mood. It stands in for the audio features stage when Spotify won't give out the features of tracks.
+func (p *recommendationPipeline) estimatedFeatureStage(candidateIDs []spotify.ID) {
+	fmt.Println("Estimating the audio features of your liked songs from their genres...")
+
+	isCandidate := make(map[spotify.ID]bool, len(candidateIDs))
+	for _, id := range candidateIDs {
+		isCandidate[id] = true
+	}
+
+	var candidates []spotify.FullTrack
+	for _, track := range p.userLikedSongs {
+		if isCandidate[track.ID] && !p.seenTrackIDs[track.ID.String()] {
+			candidates = append(candidates, track)
+		}
+	}
+	p.prefetchGenres(candidates)
+
+	thresholds := p.moodThresholds()
+	added := 0
+	for _, track := range candidates {
+		var genres []string
+		for _, artist := range track.Artists {
+			genres = append(genres, p.artistGenres[artist.ID.String()]...)
+		}
+		if len(genreProfiles(genres)) == 0 {
+			continue
+		}
+
+		estimate := estimateFeaturesFromGenres(genres)
+		estimate.ID = track.ID
+		if trackMatchesMood(&estimate, thresholds) && p.addCandidate(track) {
+			added++
+		}
+	}
+
+	fmt.Printf("Added %d tracks whose genres sound like the '%s' mood\n", added, p.mood)
+}
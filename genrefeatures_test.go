@@ -0,0 +1,25 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateFeaturesFromGenres(t *testing.T) {
+	estimate := estimateFeaturesFromGenres([]string{"deep house", "ambient", "vaporwave"})
+	house, ambient := genreFeatureProfiles["house"], genreFeatureProfiles["ambient"]
+	if want := (house.Energy + ambient.Energy) / 2; math.Abs(float64(estimate.Energy-want)) > 1e-6 {
+		t.Errorf("estimated energy = %v, want the average %v of house and ambient", estimate.Energy, want)
+	}
+
+	if unknown := estimateFeaturesFromGenres([]string{"vaporwave"}); unknown.Energy != 0 || unknown.Tempo != 0 {
+		t.Errorf("estimate for unknown genres = %+v, want zero features", unknown)
+	}
+
+	// Calm genres are estimated to be calmer than loud ones
+	calm := estimateFeaturesFromGenres([]string{"classical", "ambient"})
+	loud := estimateFeaturesFromGenres([]string{"death metal"})
+	if calm.Energy >= loud.Energy || calm.Acousticness <= loud.Acousticness {
+		t.Errorf("classical and ambient %+v should be calmer and more acoustic than metal %+v", calm, loud)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// genreSeedTTL is how long the available genre seeds are cached before they're refreshed
+const genreSeedTTL = 24 * time.Hour
+
+// genreSeedCache holds the genre seeds Spotify accepts for recommendations
+var genreSeedCache struct {
+	sync.Mutex
+	seeds     []string
+	fetchedAt time.Time
+}
+
+// AvailableGenreSeeds returns the genre seeds Spotify accepts, fetching them at most once per genreSeedTTL
+func AvailableGenreSeeds(client *spotify.Client) ([]string, error) {
+	// Holding the lock while fetching makes concurrent callers wait for a single request
+	genreSeedCache.Lock()
+	defer genreSeedCache.Unlock()
+
+	if genreSeedCache.seeds != nil && time.Since(genreSeedCache.fetchedAt) < genreSeedTTL {
+		genreSeedCacheCounters.hits.Add(1)
+		return genreSeedCache.seeds, nil
+	}
+	genreSeedCacheCounters.misses.Add(1)
+
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	seeds, err := client.GetAvailableGenreSeeds(ctx)
+	if err != nil {
+		// A stale list is better than none, so keep serving it until a refresh succeeds
+		if genreSeedCache.seeds != nil {
+			fmt.Printf("Warning: failed to refresh genre seeds, using cached list: %v\n", err)
+			return genreSeedCache.seeds, nil
+		}
+		return nil, fmt.Errorf("failed to get available genre seeds: %v", err)
+	}
+
+	if genreSeedCache.seeds != nil {
+		genreSeedCacheCounters.evictions.Add(int64(len(genreSeedCache.seeds)))
+	}
+	genreSeedCache.seeds = seeds
+	genreSeedCache.fetchedAt = time.Now()
+	genreSeedCacheCounters.entries.Store(int64(len(seeds)))
+
+	fmt.Printf("Cached %d available genre seeds\n", len(seeds))
+	return seeds, nil
+}
+
+// filterGenreSeeds splits genres into the ones that are available genre seeds and the ones that aren't
+func filterGenreSeeds(genres, available []string) (kept, dropped []string) {
+	for _, genre := range genres {
+		if slices.Contains(available, genre) {
+			kept = append(kept, genre)
+		} else {
+			dropped = append(dropped, genre)
+		}
+	}
+	return kept, dropped
+}
+
+// genreMatches reports whether an artist's genre matches a genre associated with a mood. Both must be lower case.
+//   - exact: the genres are the same
+//   - prefix: the artist's genre starts with the mood genre as whole words, so "pop rock" matches "pop"
+//     but "art pop" doesn't
+//   - token: the mood genre appears as whole words anywhere, so "art pop" matches "pop" but "trap" doesn't match "rap"
+//   - contains: the mood genre appears anywhere, even inside a word
+func genreMatches(artistGenre, moodGenre, mode string) bool {
+	switch mode {
+	case GenreMatchExact:
+		return artistGenre == moodGenre
+	case GenreMatchPrefix:
+		artistTokens, moodTokens := genreTokens(artistGenre), genreTokens(moodGenre)
+		return len(moodTokens) > 0 && len(moodTokens) <= len(artistTokens) &&
+			slices.Equal(artistTokens[:len(moodTokens)], moodTokens)
+	case GenreMatchToken:
+		artistTokens, moodTokens := genreTokens(artistGenre), genreTokens(moodGenre)
+		for i := 0; len(moodTokens) > 0 && i+len(moodTokens) <= len(artistTokens); i++ {
+			if slices.Equal(artistTokens[i:i+len(moodTokens)], moodTokens) {
+				return true
+			}
+		}
+		return false
+	default:
+		return strings.Contains(artistGenre, moodGenre)
+	}
+}
+
+// genreTokens splits a genre into its words, treating hyphens as spaces so "hip-hop" and "hip hop" are the same
+func genreTokens(genre string) []string {
+	return strings.Fields(strings.ReplaceAll(genre, "-", " "))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGenreMatches(t *testing.T) {
+	tests := []struct {
+		artistGenre, moodGenre string
+		want                   map[string]bool
+	}{
+		// Substrings inside a word are false positives for every mode but contains
+		{"trap", "rap", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: false, GenreMatchToken: false, GenreMatchContains: true}},
+		{"glasshouse", "house", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: false, GenreMatchToken: false, GenreMatchContains: true}},
+		// A qualifier in front changes the genre, so only the looser modes match it
+		{"art pop", "pop", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: false, GenreMatchToken: true, GenreMatchContains: true}},
+		{"pop rock", "pop", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: true, GenreMatchToken: true, GenreMatchContains: true}},
+		{"dance pop", "dance pop", map[string]bool{GenreMatchExact: true, GenreMatchPrefix: true, GenreMatchToken: true, GenreMatchContains: true}},
+		// Hyphens separate words like spaces
+		{"hip-hop", "hip hop", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: true, GenreMatchToken: true, GenreMatchContains: false}},
+		{"alt-rock", "rock", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: false, GenreMatchToken: true, GenreMatchContains: true}},
+		// Multi-word mood genres must appear as consecutive words
+		{"indie folk pop", "indie pop", map[string]bool{GenreMatchExact: false, GenreMatchPrefix: false, GenreMatchToken: false, GenreMatchContains: false}},
+	}
+
+	for _, tt := range tests {
+		for _, mode := range genreMatchModes {
+			if got := genreMatches(tt.artistGenre, tt.moodGenre, mode); got != tt.want[mode] {
+				t.Errorf("%s: genreMatches(%q, %q) = %v, want %v", mode, tt.artistGenre, tt.moodGenre, got, tt.want[mode])
+			}
+		}
+	}
+}
+
+func TestParseGenreMatch(t *testing.T) {
+	if mode, err := ParseGenreMatch(" Token "); err != nil || mode != GenreMatchToken {
+		t.Errorf("ParseGenreMatch(\" Token \") = %q, %v, want %q", mode, err, GenreMatchToken)
+	}
+	if _, err := ParseGenreMatch("fuzzy"); err == nil {
+		t.Error("ParseGenreMatch(\"fuzzy\") should fail")
+	}
+}
+
+func TestGenrePlaylistKeepsToTheLimits(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.VerifyPlayable, recommenderConfig.VerifyPlaylist = false, false
+	recommenderConfig.AvoidRecentPlaylists = 0
+	recommenderConfig.MinDuration, recommenderConfig.MaxDuration = 0, 0
+	t.Setenv("PREFERENCES_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+	t.Setenv("PLAN_DIR", t.TempDir())
+
+	var mu sync.Mutex
+	var recommendationLimit string
+	var added []string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var body interface{}
+		switch {
+		case r.URL.Path == "/recommendations":
+			recommendationLimit = r.URL.Query().Get("limit")
+			// Every track is by the same artist
+			var tracks []map[string]interface{}
+			for _, id := range []string{"a", "b", "c", "d"} {
+				track := fakeTrack(id)
+				track["artists"] = []map[string]interface{}{{"id": "artist", "name": "Artist"}}
+				tracks = append(tracks, track)
+			}
+			body = map[string]interface{}{"tracks": tracks}
+		case r.URL.Path == "/me":
+			body = map[string]interface{}{"id": "user"}
+		case r.URL.Path == "/users/user/playlists":
+			body = map[string]interface{}{"id": "created", "name": "Created"}
+		case r.URL.Path == "/playlists/created/tracks" && r.Method == "POST":
+			var request struct {
+				URIs []string `json:"uris"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			for _, uri := range request.URIs {
+				added = append(added, strings.TrimPrefix(uri, "spotify:track:"))
+			}
+			body = map[string]string{"snapshot_id": "snapshot"}
+		case r.URL.Path == "/playlists/created/tracks":
+			var items []map[string]interface{}
+			for _, id := range added {
+				items = append(items, map[string]interface{}{"track": fakeTrack(id)})
+			}
+			body = map[string]interface{}{"items": items, "total": len(added)}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+
+	opts := PlaylistOptions{Limits: map[string]int{"playlistSize": 3, "maxSongsPerArtist": 2}}
+	if _, err := CreateGenrePlaylist(client, "jazz", 0, false, opts); err != nil {
+		t.Fatalf("CreateGenrePlaylist returned error: %v", err)
+	}
+
+	if recommendationLimit != "3" {
+		t.Errorf("asked for %s recommendations, want the playlist size of 3", recommendationLimit)
+	}
+	if len(added) != 2 {
+		t.Errorf("added %v, want 2 tracks of the artist", added)
+	}
+}
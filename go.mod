@@ -2,14 +2,19 @@ module vibecast
 
 go 1.23.3
 
+require (
+	github.com/zmb3/spotify/v2 v2.4.3
+	golang.org/x/oauth2 v0.0.0-20210810183815-faf39c7919d5
+	golang.org/x/term v0.18.0
+)
+
 require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/zmb3/spotify v1.3.0 // indirect
-	github.com/zmb3/spotify/v2 v2.4.3 // indirect
 	golang.org/x/net v0.23.0 // indirect
-	golang.org/x/oauth2 v0.0.0-20210810183815-faf39c7919d5 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// maxImportLines is the largest number of lines accepted by a single import
+const maxImportLines = 200
+
+// UnresolvedTracksError lists the lines ResolveTracksByName couldn't find a track for
+type UnresolvedTracksError struct {
+	Lines []string
+}
+
+func (e *UnresolvedTracksError) Error() string {
+	return fmt.Sprintf("no tracks found for %d lines: %s", len(e.Lines), strings.Join(e.Lines, "; "))
+}
+
+// ResolveTracksByName searches for each "Title - Artist" query and returns the top match of each.
+// Queries without an artist are searched as they are. If some queries can't be resolved, the tracks that were
+// found are returned together with an *UnresolvedTracksError listing the others.
+func ResolveTracksByName(client *spotify.Client, queries []string) ([]spotify.FullTrack, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+
+	var tracks []spotify.FullTrack
+	var unresolved []string
+	seen := make(map[spotify.ID]bool)
+
+	for _, query := range queries {
+		query = strings.TrimSpace(query)
+		if query == "" {
+			continue
+		}
+
+		track, err := resolveTrack(client, query)
+		if err != nil {
+			fmt.Printf("Couldn't resolve %q: %v\n", query, err)
+			unresolved = append(unresolved, query)
+			continue
+		}
+
+		if !seen[track.ID] {
+			seen[track.ID] = true
+			tracks = append(tracks, *track)
+		}
+	}
+
+	fmt.Printf("Resolved %d tracks, %d lines couldn't be found\n", len(tracks), len(unresolved))
+
+	if len(unresolved) > 0 {
+		return tracks, &UnresolvedTracksError{Lines: unresolved}
+	}
+	return tracks, nil
+}
+
+// resolveTrack returns the top search result for a "Title - Artist" query
+func resolveTrack(client *spotify.Client, query string) (*spotify.FullTrack, error) {
+	searchQuery := query
+	if title, artist, ok := strings.Cut(query, " - "); ok {
+		searchQuery = fmt.Sprintf("track:%s artist:%s", strings.TrimSpace(title), strings.TrimSpace(artist))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	results, err := client.Search(ctx, searchQuery, spotify.SearchTypeTrack, spotify.Limit(1), spotify.Market(spotifyMarket("")))
+	if err != nil {
+		return nil, err
+	}
+
+	if results.Tracks == nil || len(results.Tracks.Tracks) == 0 {
+		return nil, fmt.Errorf("no matching track")
+	}
+	return &results.Tracks.Tracks[0], nil
+}
+
+// ImportHandler shows a form for pasting a list of songs, and creates a playlist from the submitted list
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if authenticatedClient == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		renderPage(w, "import.html", nil)
+	case "POST":
+		lines := strings.Split(r.FormValue("tracks"), "\n")
+		if len(lines) > maxImportLines {
+			http.Error(w, fmt.Sprintf("At most %d lines can be imported at once", maxImportLines), http.StatusBadRequest)
+			return
+		}
+
+		tracks, err := ResolveTracksByName(authenticatedClient, lines)
+		var unresolved *UnresolvedTracksError
+		if err != nil && !errors.As(err, &unresolved) {
+			http.Error(w, "Failed to find tracks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(tracks) == 0 {
+			http.Error(w, "None of the songs could be found", http.StatusBadRequest)
+			return
+		}
+
+		opts := playlistOptionsFromForm(r)
+		if opts.NameTemplate == "" && recommenderConfig.PlaylistNameTemplate == "" {
+			opts.Name = fmt.Sprintf("VibeCast Import - %s", time.Now().Format("Jan 02 15:04"))
+		}
+
+		result, err := CreatePlaylistAndAddTracks(authenticatedClient, tracks, opts)
+		if err != nil {
+			http.Error(w, "Failed to create playlist: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if unresolved != nil {
+			for _, line := range unresolved.Lines {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("No track found for %q", line))
+			}
+		}
+		savePlaylistPlan(result)
+
+		renderPlaylistCreated(w, "imported", result)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
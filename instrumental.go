@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// instrumentalGenres are the words in the names of genres whose tracks are instrumental, used to tell
+// instrumental tracks apart when their audio features are unknown
+var instrumentalGenres = []string{"classical", "ambient", "post-rock", "soundtrack", "instrumental"}
+
+// isInstrumental reports whether audio features describe an instrumental track
+func isInstrumental(features *spotify.AudioFeatures, cfg RecommenderConfig) bool {
+	return float64(features.Instrumentalness) >= cfg.MinInstrumentalness && float64(features.Speechiness) <= cfg.MaxSpeechiness
+}
+
+// hasInstrumentalGenre reports whether one of the artists of a track has an instrumental genre
+func (p *recommendationPipeline) hasInstrumentalGenre(track spotify.FullTrack) bool {
+	for _, artist := range track.Artists {
+		for _, genre := range p.artistGenres[artist.ID.String()] {
+			genre = strings.ToLower(genre)
+			for _, instrumental := range instrumentalGenres {
+				if strings.Contains(genre, instrumental) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// filterInstrumental keeps only the instrumental tracks, whatever the mood. Tracks without audio features, and
+// all tracks if audio features aren't available, are kept only if one of their artists has an instrumental genre.
+func (p *recommendationPipeline) filterInstrumental(ctx context.Context, tracks []spotify.FullTrack, cfg RecommenderConfig) []spotify.FullTrack {
+	instrumental := make(map[spotify.ID]bool)
+	known := make(map[spotify.ID]bool)
+	for start := 0; start < len(tracks); start += maxAudioFeaturesPerRequest {
+		var ids []spotify.ID
+		for _, track := range tracks[start:min(start+maxAudioFeaturesPerRequest, len(tracks))] {
+			ids = append(ids, track.ID)
+		}
+
+		audioFeatures, err := p.client.GetAudioFeatures(ctx, ids...)
+		if err != nil {
+			fmt.Printf("Warning: picking instrumental tracks by their genres, audio features unavailable: %v\n", err)
+			known = nil
+			break
+		}
+		for _, trackFeatures := range audioFeatures {
+			if trackFeatures == nil {
+				continue
+			}
+			known[trackFeatures.ID] = true
+			instrumental[trackFeatures.ID] = isInstrumental(trackFeatures, cfg)
+		}
+	}
+
+	var unknown []spotify.FullTrack
+	for _, track := range tracks {
+		if !known[track.ID] {
+			unknown = append(unknown, track)
+		}
+	}
+	p.prefetchGenres(unknown)
+	for _, track := range unknown {
+		instrumental[track.ID] = p.hasInstrumentalGenre(track)
+	}
+
+	kept := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if instrumental[track.ID] {
+			kept = append(kept, track)
+		}
+	}
+	if removed := len(tracks) - len(kept); removed > 0 {
+		fmt.Printf("Removed %d tracks with vocals for an instrumental only playlist\n", removed)
+	}
+	return kept
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestIsInstrumental(t *testing.T) {
+	cfg := DefaultRecommenderConfig()
+	cfg.MinInstrumentalness = 0.5
+	cfg.MaxSpeechiness = 0.25
+
+	tests := []struct {
+		name                          string
+		instrumentalness, speechiness float32
+		want                          bool
+	}{
+		{"instrumental", 0.9, 0.05, true},
+		{"at both bounds", 0.5, 0.25, true},
+		{"vocals", 0.1, 0.05, false},
+		{"spoken word over a beat", 0.9, 0.6, false},
+		{"just under the instrumentalness", 0.49, 0.05, false},
+	}
+	for _, tt := range tests {
+		features := &spotify.AudioFeatures{Instrumentalness: tt.instrumentalness, Speechiness: tt.speechiness}
+		if got := isInstrumental(features, cfg); got != tt.want {
+			t.Errorf("%s: isInstrumental = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newInstrumentalSpotify returns a client whose audio features make the tracks with "inst" in their ID
+// instrumental and leave out those with "unknown" in it
+func newInstrumentalSpotify(t *testing.T, featuresAvailable bool) *spotify.Client {
+	t.Helper()
+
+	return newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/audio-features" || !featuresAvailable {
+			http.Error(w, `{"error": {"status": 403, "message": "Forbidden"}}`, http.StatusForbidden)
+			return
+		}
+
+		var features []interface{}
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			switch {
+			case strings.Contains(id, "unknown"):
+				features = append(features, nil)
+			case strings.Contains(id, "inst"):
+				features = append(features, map[string]interface{}{"id": id, "instrumentalness": 0.9, "speechiness": 0.04, "energy": 0.2, "acousticness": 0.8, "tempo": 80})
+			default:
+				features = append(features, map[string]interface{}{"id": id, "instrumentalness": 0.01, "speechiness": 0.1, "energy": 0.2, "acousticness": 0.8, "tempo": 80})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"audio_features": features})
+	}))
+}
+
+func TestFilterInstrumental(t *testing.T) {
+	tests := []struct {
+		name              string
+		featuresAvailable bool
+		tracks            []string
+		want              []string
+	}{
+		{"by audio features", true, []string{"inst1", "vocal1", "inst2"}, []string{"inst1", "inst2"}},
+		{"unknown features fall back to the genres", true, []string{"vocal1", "unknown-ambient", "unknown-pop"}, []string{"unknown-ambient"}},
+		{"without audio features only the genres count", false, []string{"inst1", "unknown-ambient", "vocal1"}, []string{"unknown-ambient"}},
+		{"no instrumental tracks", true, []string{"vocal1", "vocal2"}, nil},
+	}
+
+	for _, tt := range tests {
+		client := newInstrumentalSpotify(t, tt.featuresAvailable)
+		p := newTestPipeline(client, tt.tracks, nil)
+		for _, id := range tt.tracks {
+			genre := "pop"
+			if strings.HasSuffix(id, "ambient") {
+				genre = "dark ambient"
+			}
+			p.artistGenres["artist-"+id] = []string{genre}
+		}
+
+		var got []string
+		for _, track := range p.filterInstrumental(p.ctx, p.userLikedSongs, p.cfg) {
+			got = append(got, track.ID.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: filterInstrumental kept %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCooldownTracksStayInstrumental(t *testing.T) {
+	liked := []string{"inst1", "vocal1", "inst2", "vocal2", "vocal3"}
+	p := newTestPipeline(newInstrumentalSpotify(t, true), liked, nil)
+	p.cfg.InstrumentalOnly = true
+
+	cooldown := p.cooldownTracks(nil, 4)
+	if len(cooldown) != 2 {
+		t.Fatalf("cooldown has %d tracks, want the 2 instrumental ones", len(cooldown))
+	}
+	for _, track := range cooldown {
+		if !strings.HasPrefix(track.ID.String(), "inst") {
+			t.Errorf("cooldown of an instrumental only playlist has %s", track.ID)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pipelineLimit is a number the pipeline is tuned with, such as how many songs an artist may have in a playlist.
+// It can be set with an environment variable and overridden per request, within bounds.
+type pipelineLimit struct {
+	// Name is the name of the limit in query parameters and the limits of JSON requests
+	Name string
+	// Env is the environment variable that sets it, if it's a plain number
+	Env      string
+	Min, Max int
+	// field returns the limit in a config
+	field func(cfg *RecommenderConfig) *int
+	// duration returns the limit in a config instead of field for durations, which are overridden in seconds
+	duration func(cfg *RecommenderConfig) *time.Duration
+}
+
+// pipelineLimits are the limits that can be tuned
+var pipelineLimits = []pipelineLimit{
+	{"playlistSize", "PLAYLIST_SIZE", 1, 100, func(cfg *RecommenderConfig) *int { return &cfg.PlaylistSize }, nil},
+	{"maxSongsPerArtist", "MAX_SONGS_PER_ARTIST", 1, 50, func(cfg *RecommenderConfig) *int { return &cfg.MaxSongsPerArtist }, nil},
+	{"targetSize", "TARGET_SIZE", 1, 1000, func(cfg *RecommenderConfig) *int { return &cfg.TargetSize }, nil},
+	{"stageTrackLimit", "STAGE_TRACK_LIMIT", 1, 2000, func(cfg *RecommenderConfig) *int { return &cfg.StageTrackLimit }, nil},
+	{"recommendationLimit", "RECOMMENDATION_LIMIT", 1, 100, func(cfg *RecommenderConfig) *int { return &cfg.RecommendationLimit }, nil},
+	{"moodPlaylistSearchLimit", "MOOD_PLAYLIST_SEARCH_LIMIT", 1, 50, func(cfg *RecommenderConfig) *int { return &cfg.MoodPlaylistSearchLimit }, nil},
+	{"moodPlaylistTrackBudget", "MOOD_PLAYLIST_TRACK_BUDGET", 1, 2000, func(cfg *RecommenderConfig) *int { return &cfg.MoodPlaylistTrackBudget }, nil},
+	// Spotify returns at most 50 top artists or top tracks at a time
+	{"topItems", "TOP_ITEMS", 1, 50, func(cfg *RecommenderConfig) *int { return &cfg.TopItems }, nil},
+	{"diverseTopItems", "DIVERSE_TOP_ITEMS", 1, 50, func(cfg *RecommenderConfig) *int { return &cfg.DiverseTopItems }, nil},
+	// MIN_DURATION and MAX_DURATION are durations such as "90s", so they're read with the other options
+	{"minDuration", "", 0, 3600, nil, func(cfg *RecommenderConfig) *time.Duration { return &cfg.MinDuration }},
+	{"maxDuration", "", 0, 3600, nil, func(cfg *RecommenderConfig) *time.Duration { return &cfg.MaxDuration }},
+}
+
+// get returns the limit in cfg
+func (l pipelineLimit) get(cfg *RecommenderConfig) int {
+	if l.duration != nil {
+		return int(*l.duration(cfg) / time.Second)
+	}
+	return *l.field(cfg)
+}
+
+// set sets the limit in cfg
+func (l pipelineLimit) set(cfg *RecommenderConfig, value int) {
+	if l.duration != nil {
+		*l.duration(cfg) = time.Duration(value) * time.Second
+		return
+	}
+	*l.field(cfg) = value
+}
+
+// check returns an error if value is out of the bounds of the limit
+func (l pipelineLimit) check(value int) error {
+	if value < l.Min || value > l.Max {
+		return fmt.Errorf("%s must be from %d to %d, got %d", l.Name, l.Min, l.Max, value)
+	}
+	return nil
+}
+
+// loadPipelineLimits sets the limits of cfg from their environment variables, ignoring values out of bounds
+func loadPipelineLimits(cfg *RecommenderConfig) {
+	for _, limit := range pipelineLimits {
+		if limit.Env == "" {
+			continue
+		}
+		value := os.Getenv(limit.Env)
+		if value == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err == nil {
+			err = limit.check(parsed)
+		}
+		if err != nil {
+			fmt.Printf("Warning: ignoring %s: %q is not a whole number from %d to %d\n", limit.Env, value, limit.Min, limit.Max)
+			continue
+		}
+		limit.set(cfg, parsed)
+	}
+}
+
+// applyLimits returns cfg with the limits overridden by name, or an error for an unknown limit or one out of bounds
+func applyLimits(cfg RecommenderConfig, overrides map[string]int) (RecommenderConfig, error) {
+	// Sort the names so the same overrides always fail on the same one
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		limit, ok := findPipelineLimit(name)
+		if !ok {
+			return cfg, fmt.Errorf("unknown limit %q, expected one of %s", name, strings.Join(pipelineLimitNames(), ", "))
+		}
+		if err := limit.check(overrides[name]); err != nil {
+			return cfg, err
+		}
+		limit.set(&cfg, overrides[name])
+	}
+	return cfg, nil
+}
+
+// findPipelineLimit returns the limit with the given name
+func findPipelineLimit(name string) (pipelineLimit, bool) {
+	for _, limit := range pipelineLimits {
+		if limit.Name == name {
+			return limit, true
+		}
+	}
+	return pipelineLimit{}, false
+}
+
+// pipelineLimitNames returns the names of the limits
+func pipelineLimitNames() []string {
+	names := make([]string, len(pipelineLimits))
+	for i, limit := range pipelineLimits {
+		names[i] = limit.Name
+	}
+	return names
+}
+
+// limitsFromForm reads the limits given as form values or query parameters. A value that isn't a whole number is
+// kept as -1, which is out of the bounds of every limit, so applyLimits rejects it.
+func limitsFromForm(values func(string) string) map[string]int {
+	var overrides map[string]int
+	for _, limit := range pipelineLimits {
+		value := strings.TrimSpace(values(limit.Name))
+		if value == "" {
+			continue
+		}
+
+		if overrides == nil {
+			overrides = make(map[string]int)
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			parsed = -1
+		}
+		overrides[limit.Name] = parsed
+	}
+	return overrides
+}
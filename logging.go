@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// logger is the structured logger for server events
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logRequests logs the method, path, status and duration of every request handled by next,
+// along with the ID of the logged in user, if any
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", time.Since(start),
+		}
+		if authenticatedUserID != "" {
+			attrs = append(attrs, "user", authenticatedUserID)
+		}
+		logger.Info("request", attrs...)
+	})
+}
+
+// traceLogger writes the Spotify call trace as JSON, one object per call
+var traceLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// traceRetryWindow is how long a rate limited call is remembered for counting its retries. The Spotify client
+// gives up on calls it would have to wait longer for, so older ones won't be retried anymore.
+const traceRetryWindow = 5 * time.Minute
+
+// traceTransport logs every Spotify call with its endpoint, parameters, status, duration and how many times it
+// was retried. The Spotify client builds a new request for every retry, so retries are recognized by their
+// method and URL.
+type traceTransport struct {
+	base http.RoundTripper
+	// log is where calls are logged, traceLogger if nil
+	log *slog.Logger
+
+	mu sync.Mutex
+	// rateLimited are the calls that were rate limited, by method and URL, which the client may still retry
+	rateLimited map[string]rateLimitedCall
+}
+
+// rateLimitedCall counts how many times in a row a call was rate limited, and when it last was
+type rateLimitedCall struct {
+	count int
+	at    time.Time
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	log := t.log
+	if log == nil {
+		log = traceLogger
+	}
+
+	key := req.Method + " " + req.URL.String()
+	t.mu.Lock()
+	if t.rateLimited == nil {
+		t.rateLimited = make(map[string]rateLimitedCall)
+	}
+	// Calls that were given up on after being rate limited are forgotten
+	for other, call := range t.rateLimited {
+		if time.Since(call.at) > traceRetryWindow {
+			delete(t.rateLimited, other)
+		}
+	}
+	retries := t.rateLimited[key].count
+	t.mu.Unlock()
+
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+
+	attrs := []any{
+		"method", req.Method,
+		"endpoint", req.URL.Path,
+		"params", req.URL.Query(),
+		"duration", time.Since(start),
+		"retries", retries,
+	}
+	// The token is added by the transport below, but a request could carry one of its own
+	if req.Header.Get("Authorization") != "" {
+		attrs = append(attrs, "authorization", "[redacted]")
+	}
+
+	// The Spotify client only retries rate limited calls, so the count is only kept for those
+	rateLimited := false
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	} else {
+		attrs = append(attrs, "status", resp.StatusCode)
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			attrs = append(attrs, "retryAfter", retryAfter)
+		}
+		rateLimited = resp.StatusCode == http.StatusTooManyRequests
+	}
+	t.mu.Lock()
+	if rateLimited {
+		t.rateLimited[key] = rateLimitedCall{count: retries + 1, at: time.Now()}
+	} else {
+		delete(t.rateLimited, key)
+	}
+	t.mu.Unlock()
+
+	log.Info("spotify call", attrs...)
+	return resp, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceTransportCountsRetries(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	var out bytes.Buffer
+	transport := &traceTransport{log: slog.New(slog.NewJSONHandler(&out, nil))}
+
+	// Send the call twice, building the request again as the Spotify client does when it retries
+	for range 2 {
+		req, _ := http.NewRequest("GET", server.URL+"/v1/me/tracks?limit=50", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("trace contains the token: %s", out.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d trace lines, want 2", len(lines))
+	}
+	for i, line := range lines {
+		var call struct {
+			Endpoint string
+			Status   int
+			Retries  int
+		}
+		if err := json.Unmarshal([]byte(line), &call); err != nil {
+			t.Fatal(err)
+		}
+		if call.Endpoint != "/v1/me/tracks" || call.Retries != i {
+			t.Errorf("call %d: endpoint %s with %d retries, want /v1/me/tracks with %d", i, call.Endpoint, call.Retries, i)
+		}
+	}
+	if len(transport.rateLimited) != 0 {
+		t.Errorf("%d calls kept after they succeeded", len(transport.rateLimited))
+	}
+}
+
+func TestTraceTransportForgetsCallsThatFailedForGood(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	transport := &traceTransport{log: slog.New(slog.NewJSONHandler(io.Discard, nil))}
+	transport.rateLimited = map[string]rateLimitedCall{
+		"GET given-up": {count: 1, at: time.Now().Add(-2 * traceRetryWindow)},
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/v1/audio-features", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Server errors aren't retried, and a rate limited call given up on is forgotten
+	if len(transport.rateLimited) != 0 {
+		t.Errorf("kept %v, want no calls", transport.rateLimited)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net/http"
 	"os"
 
 	spotifyauth "github.com/zmb3/spotify/v2/auth"
@@ -13,17 +14,29 @@ func main() {
 	// Load environment variables from build-time values
 	envVars := LoadEnvVars()
 
-	// Set environment variables for the application
+	// Set environment variables for the application, keeping the environment's values for those not built in
 	for key, value := range envVars {
-		os.Setenv(key, value)
+		if value != "" {
+			os.Setenv(key, value)
+		}
 	}
 
+	// Load the recommendation pipeline configuration
+	recommenderConfig = LoadRecommenderConfig()
+	features = LoadFeatures()
+
 	auth = Auth()
-	StartServer()
-}
 
-func handleError(err error) {
-	if err != nil {
-		log.Fatal(err)
+	// Replay or record the weather API calls along with the Spotify ones
+	weatherHTTPClient = &http.Client{Transport: newReplayTransport(http.DefaultTransport)}
+	if replaying() {
+		if err := startReplaySession(); err != nil {
+			log.Fatal("Replay error:", err)
+		}
+	}
+
+	// Errors while handling requests are returned to the caller; only failing to serve at all is fatal
+	if err := StartServer(); err != nil {
+		log.Fatal("Server error:", err)
 	}
 }
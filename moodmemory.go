@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// loosestMaxTempo is the maximum tempo that constrains no track, which a mood without one is eased towards
+const loosestMaxTempo = 250
+
+// RememberedMood is the mood of the last weather playlist, which the next one eases in from
+type RememberedMood struct {
+	Mood string    `json:"mood"`
+	At   time.Time `json:"at"`
+}
+
+// blendThresholds eases the current mood's thresholds towards the previous mood's by factor, from 0, which keeps
+// the current thresholds, to 1. Bounds the previous mood doesn't have are eased towards no bound at all, so a
+// sharp change of mood starts out looser rather than picking up the previous mood's constraints. Bounds only the
+// previous mood has are left out.
+func blendThresholds(current, previous AudioFeatureThresholds, factor float64) AudioFeatureThresholds {
+	f := float32(factor)
+	blend := func(cur, prev *float32, loosest float32) *float32 {
+		if cur == nil {
+			return nil
+		}
+		if prev != nil {
+			loosest = *prev
+		}
+		return bound(*cur*(1-f) + loosest*f)
+	}
+
+	blended := current
+	blended.MinEnergy = blend(current.MinEnergy, previous.MinEnergy, 0)
+	blended.MaxEnergy = blend(current.MaxEnergy, previous.MaxEnergy, 1)
+	blended.MinDanceability = blend(current.MinDanceability, previous.MinDanceability, 0)
+	blended.MaxDanceability = blend(current.MaxDanceability, previous.MaxDanceability, 1)
+	blended.MinValence = blend(current.MinValence, previous.MinValence, 0)
+	blended.MaxValence = blend(current.MaxValence, previous.MaxValence, 1)
+	blended.MinTempo = blend(current.MinTempo, previous.MinTempo, 0)
+	blended.MaxTempo = blend(current.MaxTempo, previous.MaxTempo, loosestMaxTempo)
+	blended.MinAcousticness = blend(current.MinAcousticness, previous.MinAcousticness, 0)
+	blended.MaxAcousticness = blend(current.MaxAcousticness, previous.MaxAcousticness, 1)
+	blended.MinInstrumentalness = blend(current.MinInstrumentalness, previous.MinInstrumentalness, 0)
+	blended.MaxInstrumentalness = blend(current.MaxInstrumentalness, previous.MaxInstrumentalness, 1)
+	return blended
+}
+
+// moodThresholds returns the audio feature thresholds for the mood, weighted by cfg.MoodWeights and eased in from
+// cfg.PreviousMood by cfg.MoodMemory if the mood changed
+func moodThresholds(mood string, cfg RecommenderConfig) AudioFeatureThresholds {
+	thresholds := moodBounds(mood)
+	thresholds.Weights = moodWeights(mood, cfg.MoodWeights)
+	if cfg.MoodMemory <= 0 || cfg.PreviousMood == "" || cfg.PreviousMood == mood {
+		return thresholds
+	}
+	return blendThresholds(thresholds, GetMoodThresholds(cfg.PreviousMood), cfg.MoodMemory)
+}
+
+// moodThresholds returns the audio feature thresholds for the pipeline's mood
+func (p *recommendationPipeline) moodThresholds() AudioFeatureThresholds {
+	return moodThresholds(p.mood, p.cfg)
+}
+
+// previousWeatherMood returns the mood of the last weather playlist, if it was created within window
+func previousWeatherMood(window time.Duration) string {
+	prefs, err := loadPreferences()
+	if err != nil {
+		fmt.Printf("Warning: not easing in from the last mood: %v\n", err)
+		return ""
+	}
+	if prefs.LastMood == nil || time.Since(prefs.LastMood.At) > window {
+		return ""
+	}
+	return prefs.LastMood.Mood
+}
+
+// rememberWeatherMood records the mood of a new weather playlist for the next one to ease in from
+func rememberWeatherMood(mood string) error {
+	return updatePreferences(func(prefs *Preferences) {
+		prefs.LastMood = &RememberedMood{Mood: mood, At: time.Now()}
+	})
+}
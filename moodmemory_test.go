@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlendThresholds(t *testing.T) {
+	relaxed, intense := GetMoodThresholds("relaxed"), GetMoodThresholds("intense")
+	blended := blendThresholds(intense, relaxed, 0.5)
+
+	near := func(got *float32, want float32) bool {
+		return got != nil && math.Abs(float64(*got-want)) < 1e-6
+	}
+
+	// Relaxed has no minimum energy, so intense's is halfway to none at all
+	if !near(blended.MinEnergy, 0.4) {
+		t.Errorf("MinEnergy = %v, want 0.4", blended.MinEnergy)
+	}
+	// Both have a maximum valence, so it's halfway between them
+	if !near(blended.MaxValence, 0.6) {
+		t.Errorf("MaxValence = %v, want 0.6", blended.MaxValence)
+	}
+	// Relaxed's maximum energy isn't picked up
+	if blended.MaxEnergy != nil {
+		t.Errorf("MaxEnergy = %v, want no bound", *blended.MaxEnergy)
+	}
+	if blended.Weights != intense.Weights {
+		t.Errorf("Weights = %+v, want intense's", blended.Weights)
+	}
+
+	cfg := DefaultRecommenderConfig()
+	cfg.MoodMemory, cfg.PreviousMood = 0.5, "intense"
+	if got := moodThresholds("intense", cfg); !near(got.MinEnergy, 0.8) {
+		t.Errorf("moodThresholds for an unchanged mood eased MinEnergy to %v, want 0.8", got.MinEnergy)
+	}
+}
+
+func TestPreviousWeatherMood(t *testing.T) {
+	t.Setenv("PREFERENCES_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+
+	if mood := previousWeatherMood(time.Hour); mood != "" {
+		t.Errorf("previousWeatherMood without a remembered mood = %q, want none", mood)
+	}
+
+	if err := rememberWeatherMood("relaxed"); err != nil {
+		t.Fatal(err)
+	}
+	if mood := previousWeatherMood(time.Hour); mood != "relaxed" {
+		t.Errorf("previousWeatherMood = %q, want relaxed", mood)
+	}
+	if mood := previousWeatherMood(0); mood != "" {
+		t.Errorf("previousWeatherMood outside the window = %q, want none", mood)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Moods are the moods playlists can be created for
+var Moods = []string{"energetic", "relaxed", "intense", "thoughtful", "neutral"}
+
+// InvalidMoodError is returned for a mood that isn't one of Moods
+type InvalidMoodError struct {
+	Mood string
+}
+
+func (e *InvalidMoodError) Error() string {
+	return fmt.Sprintf("unknown mood %q, expected one of %s", e.Mood, strings.Join(Moods, ", "))
+}
+
+// ValidateMood returns an *InvalidMoodError if mood isn't one of Moods.
+// Internal functions treat unknown moods as neutral, so entry points taking a mood from users should check it first.
+func ValidateMood(mood string) error {
+	for _, valid := range Moods {
+		if mood == valid {
+			return nil
+		}
+	}
+	return &InvalidMoodError{Mood: mood}
+}
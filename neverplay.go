@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// ParseTrackID reads a track ID from an ID, a spotify:track: URI or an open.spotify.com track link
+func ParseTrackID(value string) (spotify.ID, error) {
+	return parseSpotifyID(value, "track")
+}
+
+// FilterNeverPlayTracks removes the tracks on the user's never play list
+func FilterNeverPlayTracks(tracks []spotify.FullTrack) ([]spotify.FullTrack, error) {
+	never, err := neverPlaySet()
+	if err != nil || len(never) == 0 {
+		return tracks, err
+	}
+
+	kept := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if !never[track.ID] {
+			kept = append(kept, track)
+		}
+	}
+
+	if removed := len(tracks) - len(kept); removed > 0 {
+		fmt.Printf("Left out %d tracks on your never play list\n", removed)
+	}
+	return kept, nil
+}
+
+// neverPlaySet returns the tracks on the user's never play list
+func neverPlaySet() (map[spotify.ID]bool, error) {
+	prefs, err := loadPreferences()
+	if err != nil {
+		return nil, err
+	}
+
+	never := make(map[spotify.ID]bool, len(prefs.NeverPlay))
+	for _, id := range prefs.NeverPlay {
+		never[id] = true
+	}
+	return never, nil
+}
+
+// addNeverPlayTracks puts the tracks on the never play list, skipping those already on it
+func addNeverPlayTracks(ids []spotify.ID) error {
+	return updatePreferences(func(prefs *Preferences) {
+		listed := make(map[spotify.ID]bool, len(prefs.NeverPlay))
+		for _, id := range prefs.NeverPlay {
+			listed[id] = true
+		}
+		for _, id := range ids {
+			if !listed[id] {
+				listed[id] = true
+				prefs.NeverPlay = append(prefs.NeverPlay, id)
+			}
+		}
+	})
+}
+
+// removeNeverPlayTracks takes the tracks off the never play list
+func removeNeverPlayTracks(ids []spotify.ID) error {
+	return updatePreferences(func(prefs *Preferences) {
+		removed := make(map[spotify.ID]bool, len(ids))
+		for _, id := range ids {
+			removed[id] = true
+		}
+
+		var kept []spotify.ID
+		for _, id := range prefs.NeverPlay {
+			if !removed[id] {
+				kept = append(kept, id)
+			}
+		}
+		prefs.NeverPlay = kept
+	})
+}
+
+// NeverPlayRequest names the tracks to put on or take off the never play list
+type NeverPlayRequest struct {
+	// Tracks are track IDs, URIs or links
+	Tracks []string `json:"tracks,omitempty"`
+	// LastPlaylist are the positions of tracks in the last created playlist, starting at 0
+	LastPlaylist []int `json:"lastPlaylist,omitempty"`
+}
+
+// trackIDs returns the IDs of the tracks the request names, or an error for the first one it can't find
+func (req NeverPlayRequest) trackIDs() ([]spotify.ID, error) {
+	var ids []spotify.ID
+	for _, track := range req.Tracks {
+		id, err := ParseTrackID(track)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if len(req.LastPlaylist) == 0 {
+		return ids, nil
+	}
+
+	shownResults.Lock()
+	last := shownResults.last[authenticatedUserID]
+	shownResults.Unlock()
+	if last == nil {
+		return nil, fmt.Errorf("no playlist created yet")
+	}
+	for _, position := range req.LastPlaylist {
+		if position < 0 || position >= len(last.Tracks) {
+			return nil, fmt.Errorf("the last playlist has no track at position %d", position)
+		}
+		ids = append(ids, last.Tracks[position].ID)
+	}
+	return ids, nil
+}
+
+// NeverPlayHandler lists the tracks on the never play list on GET. POST puts the tracks of the body on it, and
+// DELETE takes them off; both respond with the updated list.
+func NeverPlayHandler(w http.ResponseWriter, r *http.Request) {
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var req NeverPlayRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+
+		ids, err := req.trackIDs()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			err = addNeverPlayTracks(ids)
+		} else {
+			err = removeNeverPlayTracks(ids)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	prefs, err := loadPreferences()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tracks := prefs.NeverPlay
+	if tracks == nil {
+		tracks = []spotify.ID{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]spotify.ID{"tracks": tracks})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// openMeteo gets the weather from Open-Meteo, which needs no API key. It has no weather alerts, so those
+// still need an OpenWeatherMap key.
+type openMeteo struct{}
+
+// wmoDescriptions describe the WMO weather codes Open-Meteo returns the way OpenWeatherMap describes the same
+// weather, so the mood rules work for both providers
+var wmoDescriptions = map[int]string{
+	0:  "clear sky",
+	1:  "few clouds",
+	2:  "scattered clouds",
+	3:  "overcast clouds",
+	45: "fog",
+	48: "fog",
+	51: "light intensity drizzle",
+	53: "drizzle",
+	55: "heavy intensity drizzle",
+	56: "freezing drizzle",
+	57: "freezing drizzle",
+	61: "light rain",
+	63: "moderate rain",
+	65: "heavy intensity rain",
+	66: "freezing rain",
+	67: "freezing rain",
+	71: "light snow",
+	73: "snow",
+	75: "heavy snow",
+	77: "snow",
+	80: "light intensity shower rain",
+	81: "shower rain",
+	82: "heavy intensity shower rain",
+	85: "light shower snow",
+	86: "heavy shower snow",
+	95: "thunderstorm",
+	96: "thunderstorm with hail",
+	99: "thunderstorm with hail",
+}
+
+// wmoDescription describes a WMO weather code, e.g. "light rain" for 61
+func wmoDescription(code int) string {
+	if description, ok := wmoDescriptions[code]; ok {
+		return description
+	}
+	return fmt.Sprintf("unknown weather (WMO code %d)", code)
+}
+
+// openMeteoPlace is a place returned by the Open-Meteo geocoding API
+type openMeteoPlace struct {
+	Name        string  `json:"name"`
+	Admin1      string  `json:"admin1"`
+	CountryCode string  `json:"country_code"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+}
+
+// CurrentWeather gets the current weather at the coordinates in params, or at the best match for its city
+// name or postal code
+func (o openMeteo) CurrentWeather(params url.Values) (*Weather, error) {
+	var name string
+	var lat, lon float64
+
+	if params.Get("lat") != "" {
+		var latErr, lonErr error
+		lat, latErr = strconv.ParseFloat(params.Get("lat"), 64)
+		lon, lonErr = strconv.ParseFloat(params.Get("lon"), 64)
+		if latErr != nil || lonErr != nil {
+			return nil, fmt.Errorf("invalid coordinates %s, %s", params.Get("lat"), params.Get("lon"))
+		}
+	} else {
+		// Both "Paris,FR" and the postal codes' "10115,DE" end with the country
+		query, country := params.Get("q"), ""
+		if zip := params.Get("zip"); zip != "" {
+			query = zip
+		}
+		if i := strings.LastIndex(query, ","); i >= 0 && len(strings.TrimSpace(query[i+1:])) == 2 {
+			query, country = strings.TrimSpace(query[:i]), strings.TrimSpace(query[i+1:])
+		}
+
+		places, err := o.search(query, country, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(places) == 0 {
+			return nil, fmt.Errorf("%w: the weather API doesn't know %s", ErrCityNotFound, weatherLocation(params))
+		}
+		name, lat, lon = places[0].Name, places[0].Latitude, places[0].Longitude
+	}
+
+	forecast := url.Values{
+		"latitude":  {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"longitude": {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"current":   {"temperature_2m,weather_code"},
+	}
+
+	resp, err := weatherHTTPClient.Get("https://api.open-meteo.com/v1/forecast?" + forecast.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open-meteo API returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Current struct {
+			Temperature float64 `json:"temperature_2m"`
+			WeatherCode int     `json:"weather_code"`
+		} `json:"current"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	weather := &Weather{Name: name, Weather: []WeatherCondition{{Description: wmoDescription(result.Current.WeatherCode)}}}
+	weather.Coord.Lat, weather.Coord.Lon = lat, lon
+	weather.Main.Temp = result.Current.Temperature
+	return weather, nil
+}
+
+// Geocode looks up the locations matching a city name with the Open-Meteo geocoding API
+func (o openMeteo) Geocode(query string) ([]Location, error) {
+	city, country := normalizeCity(query)
+	places, err := o.search(city, country, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := make([]Location, len(places))
+	for i, place := range places {
+		locations[i] = Location{
+			Name:    place.Name,
+			State:   place.Admin1,
+			Country: place.CountryCode,
+			Lat:     place.Latitude,
+			Lon:     place.Longitude,
+		}
+	}
+	return locations, nil
+}
+
+// search finds up to count places matching a name or postal code, in the given country if it isn't empty
+func (o openMeteo) search(query, country string, count int) ([]openMeteoPlace, error) {
+	params := url.Values{
+		"name":  {query},
+		"count": {strconv.Itoa(count)},
+	}
+	if country != "" {
+		params.Set("countryCode", strings.ToUpper(country))
+	}
+
+	resp, err := weatherHTTPClient.Get("https://geocoding-api.open-meteo.com/v1/search?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open-meteo geocoding API returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Results []openMeteoPlace `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
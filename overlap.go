@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// maxPlaylistItemsPerRequest is the most items GetPlaylistItems returns in a single call
+const maxPlaylistItemsPerRequest = 100
+
+// maxLibraryChecksPerRequest is the most tracks UserHasTracks checks in a single call
+const maxLibraryChecksPerRequest = 50
+
+// overlapStage is the provenance of the tracks of a playlist made from the overlap with another playlist
+const overlapStage = "playlist-overlap"
+
+// getAllPlaylistTracks returns every track of a playlist, paging through large ones, leaving out podcast episodes
+// and local files
+func getAllPlaylistTracks(ctx context.Context, client *spotify.Client, playlistID spotify.ID) ([]spotify.FullTrack, error) {
+	var tracks []spotify.FullTrack
+	err := paginateOffset(ctx, maxPlaylistItemsPerRequest, maxPlaylistItems, recommenderConfig.PageDelay, func(limit, offset int) (int, bool, error) {
+		page, err := client.GetPlaylistItems(ctx, playlistID, spotify.Limit(limit), spotify.Offset(offset))
+		if err != nil {
+			return 0, false, err
+		}
+		for _, item := range page.Items {
+			if item.Track.Track != nil && !item.IsLocal {
+				tracks = append(tracks, *item.Track.Track)
+			}
+		}
+		return len(page.Items), page.Next == "", nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the tracks of playlist %s: %w", playlistID, err)
+	}
+	return tracks, nil
+}
+
+// uniqueTracks returns the tracks without repeats, keeping the first of each
+func uniqueTracks(tracks []spotify.FullTrack) []spotify.FullTrack {
+	seen := make(map[spotify.ID]bool, len(tracks))
+	unique := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if !seen[track.ID] {
+			seen[track.ID] = true
+			unique = append(unique, track)
+		}
+	}
+	return unique
+}
+
+// keepLikedTracks keeps the tracks that are in the user's liked songs. It asks Spotify about the tracks instead
+// of loading the whole library, which takes far fewer calls for a playlist than for most libraries.
+func keepLikedTracks(ctx context.Context, client *spotify.Client, tracks []spotify.FullTrack) ([]spotify.FullTrack, error) {
+	var liked []spotify.FullTrack
+	for start := 0; start < len(tracks); start += maxLibraryChecksPerRequest {
+		batch := tracks[start:min(start+maxLibraryChecksPerRequest, len(tracks))]
+		ids := make([]spotify.ID, len(batch))
+		for i, track := range batch {
+			ids[i] = track.ID
+		}
+
+		inLibrary, err := client.UserHasTracks(ctx, ids...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check your liked songs: %w", err)
+		}
+		for i, ok := range inLibrary {
+			if ok && i < len(batch) {
+				liked = append(liked, batch[i])
+			}
+		}
+	}
+	return liked, nil
+}
+
+// CreateOverlapPlaylist creates a playlist from the tracks of another playlist, such as one a friend shared, that
+// are in the user's liked songs and match the mood, by their audio features or else their artists' genres
+func CreateOverlapPlaylist(client *spotify.Client, fromPlaylist, mood string, opts PlaylistOptions) (*PlaylistResult, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+	if err := ValidateMood(mood); err != nil {
+		return nil, err
+	}
+	playlistID, err := ParsePlaylistID(fromPlaylist)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.PipelineTimeout)
+	defer cancel()
+
+	tracks, err := getAllPlaylistTracks(ctx, client, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Found %d tracks in playlist %s\n", len(tracks), playlistID)
+
+	tracks, err = keepLikedTracks(ctx, client, uniqueTracks(tracks))
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("%w: none of the songs of playlist %s are in your liked songs", ErrNoMoodMatches, playlistID)
+	}
+	fmt.Printf("%d of them are in your liked songs\n", len(tracks))
+
+	// The mood is the point of the overlap, so it's checked whatever MOOD_STRICT says
+	cfg := opts.config()
+	cfg.MoodStrict = true
+	p := &recommendationPipeline{
+		ctx:          ctx,
+		client:       client,
+		mood:         mood,
+		cfg:          cfg,
+		artistGenres: make(map[string][]string),
+	}
+	tracks = p.filterByMood(tracks)
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("%w: none of your liked songs in playlist %s are %s", ErrNoMoodMatches, playlistID, mood)
+	}
+
+	// The same filters apply as to playlists from the whole library
+	if tracks, err = filterTrackDetails(client, tracks, cfg); err != nil {
+		return nil, err
+	}
+	if tracks, err = p.filterForPlaylist(ctx, tracks); err != nil {
+		return nil, err
+	}
+
+	tracks = LimitSongsPerArtist(shuffled(tracks), cfg.MaxSongsPerArtist, cfg.PrimaryArtistOnly)
+	if len(tracks) > cfg.PlaylistSize {
+		tracks = tracks[:cfg.PlaylistSize]
+	}
+	p.orderTracks(tracks)
+
+	opts.NameVars.Mood = mood
+	opts.pickedWith = &cfg
+	result, err := CreatePlaylistAndAddTracks(client, tracks, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Mood = mood
+	for i := range result.Tracks {
+		result.Tracks[i].Stage = overlapStage
+	}
+	savePlaylistPlan(result)
+	return result, nil
+}
+
+// CreatePlaylistHandlerFromPlaylist creates a playlist from the overlap of the fromPlaylist playlist, the user's
+// liked songs and the mood
+func CreatePlaylistHandlerFromPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authenticatedClient == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	fromPlaylist := strings.TrimSpace(r.FormValue("fromPlaylist"))
+	if _, err := ParsePlaylistID(fromPlaylist); err != nil {
+		http.Error(w, "Invalid playlist: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The mood is required here, so it's taken out of the options rather than overriding another mood
+	opts := playlistOptionsFromForm(r)
+	mood := opts.Mood
+	if err := ValidateMood(mood); err != nil {
+		http.Error(w, "Invalid mood: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := CreateOverlapPlaylist(authenticatedClient, fromPlaylist, mood, opts)
+	if err != nil {
+		if reconsent(w, r) {
+			return
+		}
+		status, message := errorResponse(err, "Failed to create playlist")
+		http.Error(w, message, status)
+		return
+	}
+
+	renderPlaylistCreated(w, "overlap-based", result)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestOverlapKeepsLikedTracksOfThePlaylist(t *testing.T) {
+	liked := []string{"liked1", "liked2"}
+	client := newFakeSpotify(t, liked)
+	ctx := context.Background()
+
+	tracks, err := getAllPlaylistTracks(ctx, client, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 5 {
+		t.Fatalf("got %d tracks of the playlist, want 5", len(tracks))
+	}
+
+	// A playlist can have a track more than once
+	tracks = uniqueTracks(append(tracks, tracks[0]))
+	kept, err := keepLikedTracks(ctx, client, tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []spotify.ID
+	for _, track := range kept {
+		got = append(got, track.ID)
+	}
+	if len(got) != 2 || got[0] != "liked1" || got[1] != "liked2" {
+		t.Errorf("kept %v, want [liked1 liked2]", got)
+	}
+}
+
+func TestOverlapLeavesOutNeverPlayTracks(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	// The fake tracks have no duration
+	recommenderConfig.MinDuration, recommenderConfig.MaxDuration = 0, 0
+
+	t.Setenv("PREFERENCES_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+	if err := addNeverPlayTracks([]spotify.ID{"liked1", "liked2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := CreateOverlapPlaylist(newFakeSpotify(t, []string{"liked1", "liked2"}), "shared", "energetic", PlaylistOptions{})
+	if !errors.Is(err, ErrNoMoodMatches) || !strings.Contains(err.Error(), "never play") {
+		t.Errorf("overlap of tracks on the never play list returned %v, want ErrNoMoodMatches for the never play list", err)
+	}
+}
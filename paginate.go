@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maxPageRetries is how many times a failed page request is retried before pagination gives up
+const maxPageRetries = 2
+
+// pageRetryDelay is the wait before the first retry of a failed page, doubling for every further retry
+const pageRetryDelay = 500 * time.Millisecond
+
+// paginateOffset calls fetch for consecutive pages of an offset based endpoint until it reports that it's done,
+// returns a short page or maxItems have been fetched. maxItems 0 means no cap. fetch returns the number of
+// items in the page. A failing page is retried with a doubling delay, and delay is waited between pages.
+func paginateOffset(ctx context.Context, pageSize, maxItems int, delay time.Duration, fetch func(limit, offset int) (count int, done bool, err error)) error {
+	for offset := 0; maxItems == 0 || offset < maxItems; offset += pageSize {
+		limit := pageSize
+		if maxItems > 0 {
+			limit = min(limit, maxItems-offset)
+		}
+
+		count, done, err := fetch(limit, offset)
+		retryDelay := pageRetryDelay
+		for attempt := 1; err != nil && attempt <= maxPageRetries; attempt++ {
+			fmt.Printf("Page request failed (%v), retrying in %s (%d/%d)\n", err, retryDelay, attempt, maxPageRetries)
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return err
+			}
+			retryDelay *= 2
+
+			count, done, err = fetch(limit, offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		// A short page is the last one
+		if done || count < limit {
+			return nil
+		}
+
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sleepContext waits for d, returning early with the context's error if it's canceled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
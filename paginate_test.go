@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPaginateOffsetStopsAtShortPage(t *testing.T) {
+	total := 120
+	var offsets []int
+
+	err := paginateOffset(context.Background(), 50, 0, 0, func(limit, offset int) (int, bool, error) {
+		offsets = append(offsets, offset)
+		return min(limit, total-offset), false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{0, 50, 100}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("fetched offsets %v, want %v", offsets, want)
+	}
+}
+
+func TestPaginateOffsetCapsItems(t *testing.T) {
+	var limits []int
+
+	err := paginateOffset(context.Background(), 50, 120, 0, func(limit, offset int) (int, bool, error) {
+		limits = append(limits, limit)
+		return limit, false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{50, 50, 20}; !reflect.DeepEqual(limits, want) {
+		t.Errorf("fetched limits %v, want %v", limits, want)
+	}
+}
+
+func TestPaginateOffsetRetriesFailedPages(t *testing.T) {
+	calls := 0
+	err := paginateOffset(context.Background(), 50, 0, 0, func(limit, offset int) (int, bool, error) {
+		calls++
+		if calls == 1 {
+			return 0, false, errors.New("temporary failure")
+		}
+		return 0, true, nil
+	})
+	if err != nil {
+		t.Fatalf("a page that fails once should be retried, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("fetch called %d times, want 2", calls)
+	}
+}
+
+func TestPaginateOffsetStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := paginateOffset(ctx, 50, 0, 0, func(limit, offset int) (int, bool, error) {
+		calls++
+		return limit, false, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("fetch called %d times after cancellation, want 1", calls)
+	}
+}
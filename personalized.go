@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	spotify "github.com/zmb3/spotify/v2"
@@ -19,10 +23,19 @@ func min(x, y int) int {
 	return y
 }
 
-// GetUserTopArtists retrieves the user's top artists from Spotify
-func GetUserTopArtists(client *spotify.Client) ([]spotify.FullArtist, error) {
+// topItemsLimit returns how many top artists and top tracks to fetch with cfg
+func topItemsLimit(cfg RecommenderConfig) int {
+	if cfg.DiverseSeeds {
+		return cfg.DiverseTopItems
+	}
+	return cfg.TopItems
+}
+
+// GetUserTopArtists retrieves up to limit of the user's top artists from Spotify. A user without top artists
+// gets an empty slice and ErrNoTopItems, to tell them apart from a failing request.
+func GetUserTopArtists(client *spotify.Client, limit int) ([]spotify.FullArtist, error) {
 	if client == nil {
-		return nil, fmt.Errorf("spotify client is nil")
+		return nil, ErrSpotifyClientNil
 	}
 
 	// Create a context with timeout
@@ -32,25 +45,26 @@ func GetUserTopArtists(client *spotify.Client) ([]spotify.FullArtist, error) {
 	// Get user's top artists
 	topArtists, err := client.CurrentUsersTopArtists(
 		ctx,
-		spotify.Limit(5),
+		spotify.Limit(limit),
 		spotify.Timerange("medium_term"),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user's top artists: %v", err)
+		return nil, fmt.Errorf("failed to get user's top artists: %w", err)
 	}
 
 	if topArtists == nil || len(topArtists.Artists) == 0 {
-		return nil, fmt.Errorf("no top artists found for user")
+		return []spotify.FullArtist{}, ErrNoTopItems
 	}
 
 	fmt.Printf("Found %d top artists\n", len(topArtists.Artists))
 	return topArtists.Artists, nil
 }
 
-// GetUserTopTracks retrieves the user's top tracks from Spotify
-func GetUserTopTracks(client *spotify.Client) ([]spotify.FullTrack, error) {
+// GetUserTopTracks retrieves up to limit of the user's top tracks from Spotify. A user without top tracks gets
+// an empty slice and ErrNoTopItems, to tell them apart from a failing request.
+func GetUserTopTracks(client *spotify.Client, limit int) ([]spotify.FullTrack, error) {
 	if client == nil {
-		return nil, fmt.Errorf("spotify client is nil")
+		return nil, ErrSpotifyClientNil
 	}
 
 	// Create a context with timeout
@@ -60,444 +74,683 @@ func GetUserTopTracks(client *spotify.Client) ([]spotify.FullTrack, error) {
 	// Get user's top tracks
 	topTracks, err := client.CurrentUsersTopTracks(
 		ctx,
-		spotify.Limit(5),
+		spotify.Limit(limit),
 		spotify.Timerange("medium_term"),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user's top tracks: %v", err)
+		return nil, fmt.Errorf("failed to get user's top tracks: %w", err)
 	}
 
 	if topTracks == nil || len(topTracks.Tracks) == 0 {
-		return nil, fmt.Errorf("no top tracks found for user")
+		return []spotify.FullTrack{}, ErrNoTopItems
 	}
 
 	fmt.Printf("Found %d top tracks\n", len(topTracks.Tracks))
 	return topTracks.Tracks, nil
 }
 
-// GetPersonalizedRecommendations gets recommendations based on user's top tracks and artists
-func GetPersonalizedRecommendations(mood string, client *spotify.Client) ([]spotify.FullTrack, error) {
+// maxFollowedArtistsPerRequest is the most followed artists Spotify returns at a time
+const maxFollowedArtistsPerRequest = 50
+
+// GetFollowedArtists retrieves all artists the user follows on Spotify
+func GetFollowedArtists(client *spotify.Client) ([]spotify.FullArtist, error) {
 	if client == nil {
-		return nil, fmt.Errorf("spotify client is nil")
+		return nil, ErrSpotifyClientNil
 	}
 
-	// Get user's liked songs - this is critical for strict filtering
-	likedTracks, likedTracksErr := GetUserLikedTracks(client)
-	if likedTracksErr != nil {
-		return nil, fmt.Errorf("failed to get liked songs: %v", likedTracksErr)
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	if len(likedTracks) == 0 {
-		return nil, fmt.Errorf("no liked songs found - please like some songs on Spotify first")
+	// Followed artists are paged with a cursor, the ID of the last artist of the previous page
+	var artists []spotify.FullArtist
+	opts := []spotify.RequestOption{spotify.Limit(maxFollowedArtistsPerRequest)}
+	for {
+		page, err := client.CurrentUsersFollowedArtists(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the artists you follow: %w", err)
+		}
+		artists = append(artists, page.Artists...)
+		if page.Cursor.After == "" || len(page.Artists) == 0 {
+			break
+		}
+		opts = []spotify.RequestOption{spotify.Limit(maxFollowedArtistsPerRequest), spotify.After(page.Cursor.After)}
 	}
 
-	fmt.Println("STRICT FILTERING: Only songs you've explicitly liked will be included in the playlist")
-	fmt.Printf("MOOD ACCURACY: Using audio analysis to ensure songs match the '%s' mood\n", mood)
+	fmt.Printf("Found %d artists you follow\n", len(artists))
+	return artists, nil
+}
 
-	// Get user's liked artists for additional filtering
-	likedArtists, _ := GetUserLikedArtists(client)
+// maxRecentlyPlayed is the most recently played tracks Spotify returns, and remembers
+const maxRecentlyPlayed = 50
 
-	// Get user's top artists and tracks for recommendation seeds
-	topArtists, _ := GetUserTopArtists(client)
-	topTracks, _ := GetUserTopTracks(client)
+// GetRecentlyPlayed returns when the user last played each of the tracks they played within window, by track ID
+func GetRecentlyPlayed(client *spotify.Client, window time.Duration) (map[string]time.Time, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// We'll collect tracks from multiple sources to ensure we have enough
-	var allTracks []spotify.FullTrack
+	items, err := client.PlayerRecentlyPlayedOpt(ctx, &spotify.RecentlyPlayedOptions{
+		Limit:        maxRecentlyPlayed,
+		AfterEpochMs: time.Now().Add(-window).UnixMilli(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get your recently played tracks: %w", err)
+	}
 
-	// Track IDs we've already seen to avoid duplicates
-	seenTrackIDs := make(map[string]bool)
-
-	// Function to add unique tracks to our collection
-	addUniqueTracks := func(tracks []spotify.FullTrack) {
-		for _, track := range tracks {
-			trackID := track.ID.String()
-			if !seenTrackIDs[trackID] && likedTracks[trackID] {
-				// Only add if the track is in the user's liked songs
-				allTracks = append(allTracks, track)
-				seenTrackIDs[trackID] = true
-			}
+	playedAt := make(map[string]time.Time, len(items))
+	for _, item := range items {
+		trackID := item.Track.ID.String()
+		if item.PlayedAt.After(playedAt[trackID]) {
+			playedAt[trackID] = item.PlayedAt
 		}
 	}
 
-	fmt.Println("Creating personalized recommendations based on your music taste and current mood...")
-	fmt.Println("Only including songs you've explicitly liked that match the current mood!")
+	fmt.Printf("Found %d tracks you played in the last %s\n", len(playedAt), window)
+	return playedAt, nil
+}
 
-	// 1. First, directly add all liked songs that match the mood
-	fmt.Println("Analyzing your liked songs to find ones that match the current mood...")
+// userTopItems gets up to limit of the user's top artists and tracks to seed recommendations with. Both are
+// left empty for a user without listening history, and either is left empty if getting it fails.
+func userTopItems(client *spotify.Client, limit int) ([]spotify.FullArtist, []spotify.FullTrack) {
+	topArtists, err := GetUserTopArtists(client, limit)
+	if errors.Is(err, ErrNoTopItems) {
+		// Top artists and tracks come from the same listening history, so there are no top tracks either
+		fmt.Println("No top artists and tracks yet, so they won't seed the recommendations")
+		return nil, nil
+	}
+	if err != nil {
+		fmt.Printf("Warning: couldn't get your top artists: %v\n", err)
+	}
 
-	// Get all the user's liked songs
-	var userLikedSongs []spotify.FullTrack
-	var likedTrackIDs []spotify.ID
-
-	// Get tracks in batches of 20 (API limit)
-	var trackIDs []spotify.ID
-	for trackID := range likedTracks {
-		trackIDs = append(trackIDs, spotify.ID(trackID))
-		likedTrackIDs = append(likedTrackIDs, spotify.ID(trackID))
-
-		// Process in batches of 20
-		if len(trackIDs) >= 20 {
-			tracks, err := client.GetTracks(ctx, trackIDs)
-			if err == nil && len(tracks) > 0 {
-				for _, track := range tracks {
-					if track != nil {
-						userLikedSongs = append(userLikedSongs, *track)
-					}
-				}
-			}
-			trackIDs = nil // Reset for next batch
-		}
+	topTracks, err := GetUserTopTracks(client, limit)
+	if err != nil && !errors.Is(err, ErrNoTopItems) {
+		fmt.Printf("Warning: couldn't get your top tracks: %v\n", err)
 	}
+	return topArtists, topTracks
+}
 
-	// Process any remaining tracks
-	if len(trackIDs) > 0 {
-		tracks, err := client.GetTracks(ctx, trackIDs)
-		if err == nil && len(tracks) > 0 {
-			for _, track := range tracks {
-				if track != nil {
-					userLikedSongs = append(userLikedSongs, *track)
-				}
-			}
+// GetPersonalizedRecommendations gets recommendations based on user's top tracks and artists
+func GetPersonalizedRecommendations(mood string, client *spotify.Client, cfg RecommenderConfig) ([]spotify.FullTrack, error) {
+	if err := ValidateMood(mood); err != nil {
+		return nil, err
+	}
+
+	tracks, _, err := personalizedRecommendations(mood, client, cfg)
+	return tracks, err
+}
+
+// pipelineReport describes how the pipeline found its tracks
+type pipelineReport struct {
+	// TrackStages is the name of the stage that found each track
+	TrackStages map[spotify.ID]string
+	// APICalls is the number of Spotify calls the stages made
+	APICalls int
+	// BudgetExhausted is set if the stages ran out of Spotify calls
+	BudgetExhausted bool
+	// OutsideLibrary is set if none of the liked songs matched and the tracks are recommendations from outside
+	// the library instead
+	OutsideLibrary bool
+	// Partial is set if the pipeline ran out of time, so the tracks are those found until then
+	Partial bool
+	// StagesRun are the stages that ran, in order
+	StagesRun []string
+}
+
+// personalizedRecommendations gets recommendations like GetPersonalizedRecommendations,
+// along with a report of how they were found
+func personalizedRecommendations(mood string, client *spotify.Client, cfg RecommenderConfig) ([]spotify.FullTrack, *pipelineReport, error) {
+	var tracks []spotify.FullTrack
+	var report *pipelineReport
+	err := withCandidatePool(mood, client, cfg, func(pool *candidatePool) error {
+		tracks, report = pool.pick()
+		return nil
+	})
+	return tracks, report, err
+}
+
+// candidatePool is the filtered candidates of a pipeline run, which playlists are picked from
+type candidatePool struct {
+	p      *recommendationPipeline
+	tracks []spotify.FullTrack
+	mood   string
+	cfg    RecommenderConfig
+	ctx    context.Context
+	budget *callBudget
+	// creationCtx is the context of the whole creation, which the steps of each pick get their own time from
+	creationCtx context.Context
+}
+
+// withCandidatePool runs the stages of the pipeline for a mood and calls use with the candidates they found.
+// The pool can only be used until use returns.
+func withCandidatePool(mood string, client *spotify.Client, cfg RecommenderConfig, use func(pool *candidatePool) error) error {
+	if client == nil {
+		return ErrSpotifyClientNil
+	}
+
+	// The creation can be cancelled through POST /cancel
+	creationCtx, done := beginCreation()
+	defer done()
+
+	// A cap on the whole run makes do with the tracks found by then instead of failing
+	runCtx := creationCtx
+	if cfg.MaxPipelineTime > 0 {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithTimeout(creationCtx, cfg.MaxPipelineTime)
+		defer cancelRun()
+	}
+
+	// Reuse the candidates of a recent run with the same mood and configuration if the library hasn't changed
+	key := pipelineCacheKey(mood, cfg)
+	var library string
+	if cfg.ResultCacheTTL > 0 {
+		library = libraryFingerprint(client)
+	}
+	p, filteredTracks, ok := cachedCandidates(key, library, cfg.ResultCacheTTL)
+
+	// The liked songs are loaded with their own timeout, so a large library doesn't eat into the stages' time
+	var liked *likedLibrary
+	var librarySize int
+	if ok {
+		librarySize = len(p.likedTrackIDs)
+	} else {
+		var err error
+		liked, err = loadLikedSongs(runCtx, client, cfg)
+		if err != nil {
+			return err
 		}
+		librarySize = len(liked.trackIDs)
 	}
 
-	fmt.Printf("Found %d liked songs in your library\n", len(userLikedSongs))
+	// Reused candidates skip loading the liked songs, but a small library is relaxed for them all the same
+	cfg = relaxForSmallLibrary(cfg, librarySize)
 
-	// 2. Analyze audio features to find tracks that match the mood
-	fmt.Println("Analyzing audio features of your liked songs to match the mood...")
+	// Create a context with a timeout that grows with the library, as the stages go through the liked songs
+	ctx, cancel := context.WithTimeout(runCtx, pipelineTimeout(cfg, librarySize))
+	defer cancel()
 
-	// Get matching track IDs based on audio features
-	matchingTrackIDs, err := AnalyzeAudioFeaturesForMood(client, likedTrackIDs, mood)
-	if err != nil {
-		fmt.Printf("Warning: Error analyzing audio features: %v\n", err)
-		fmt.Println("Falling back to genre-based and playlist-based mood matching...")
+	// The stages share a budget of Spotify calls, so a huge library can't make them run away
+	stageCtx, budget := withCallBudget(ctx, cfg.CallBudget)
 
-		// Since we can't use audio features, we'll rely more heavily on genre matching
-		// and mood-based playlists to ensure accurate mood matching
+	if ok {
+		fmt.Printf("Reusing the %d candidate tracks found for the '%s' mood in the last %s\n", len(filteredTracks), mood, cfg.ResultCacheTTL)
+		p.ctx = stageCtx
 	} else {
-		fmt.Printf("Found %d tracks that match the '%s' mood based on audio features\n", len(matchingTrackIDs), mood)
+		var err error
+		p, filteredTracks, err = collectCandidates(ctx, stageCtx, mood, client, cfg, liked)
+		if err != nil {
+			return err
+		}
+		// The candidates of a run that ran out of time are incomplete, so they aren't reused
+		if cfg.ResultCacheTTL > 0 && library != "" && ctx.Err() == nil {
+			storeCandidates(key, library, cfg.ResultCacheTTL, p, filteredTracks)
+		}
+	}
 
-		// Create a map for quick lookup
-		matchingTrackIDMap := make(map[string]bool)
-		for _, id := range matchingTrackIDs {
-			matchingTrackIDMap[id.String()] = true
+	// Recent playlists can change between runs, so cached candidates are filtered again
+	if cfg.AvoidRecentPlaylists > 0 {
+		var err error
+		filteredTracks, err = FilterRecentTracks(filteredTracks, cfg.DryRun)
+		if err != nil {
+			fmt.Printf("Warning: couldn't leave out recent tracks: %v\n", err)
 		}
+	}
 
-		// Add matching tracks to our collection
-		for _, track := range userLikedSongs {
-			if matchingTrackIDMap[track.ID.String()] {
-				if !seenTrackIDs[track.ID.String()] {
-					allTracks = append(allTracks, track)
-					seenTrackIDs[track.ID.String()] = true
-				}
-			}
+	// The stages may have used up the run's time, which would fail the Spotify calls of the steps after them
+	finishCtx, cancelFinish := finishContext(creationCtx, budget)
+	defer cancelFinish()
+	p.ctx = finishCtx
+	filteredTracks, err := p.filterForPlaylist(finishCtx, filteredTracks)
+	if err != nil {
+		return err
+	}
+
+	// Limit the number of songs per artist to ensure variety
+	filteredTracks = LimitSongsPerArtist(filteredTracks, cfg.MaxSongsPerArtist, cfg.PrimaryArtistOnly)
+
+	// Tracks the user just heard are held back in the ranking or the shuffle below
+	if cfg.RecentlyPlayedWeight > 0 {
+		playedAt, err := GetRecentlyPlayed(client, cfg.RecentlyPlayedWindow)
+		if askForScope(err) {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("Warning: not holding back recently played tracks: %v\n", err)
 		}
+		p.playedAt = playedAt
+	}
+
+	// Seeded once for the pool, so every pick from it shuffles differently
+	rand.Seed(shuffleSeed())
+	return use(&candidatePool{p: p, tracks: filteredTracks, mood: mood, cfg: cfg, ctx: ctx, budget: budget, creationCtx: creationCtx})
+}
+
+// finishTimeout is how long the steps after the stages, such as ranking the tracks and picking the cooldown,
+// may take for a playlist
+const finishTimeout = 20 * time.Second
+
+// finishContext returns a context for the steps after the stages, which gets its own time even when the stages
+// ran out of theirs, spending the same call budget. It's still cancelled along with the creation.
+func finishContext(creationCtx context.Context, budget *callBudget) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(creationCtx, finishTimeout)
+	return context.WithValue(ctx, callBudgetKey{}, budget), cancel
+}
+
+// pick picks the tracks of a playlist from the pool, along with a report of how they were found.
+// Every pick shuffles the candidates anew, so picks can differ.
+func (pool *candidatePool) pick() ([]spotify.FullTrack, *pipelineReport) {
+	p, mood, cfg, ctx, budget := pool.p, pool.mood, pool.cfg, pool.ctx, pool.budget
+	filteredTracks := slices.Clone(pool.tracks)
+
+	finishCtx, cancelFinish := finishContext(pool.creationCtx, budget)
+	defer cancelFinish()
+	p.ctx = finishCtx
+
+	// Shuffle the tracks for variety
+	rand.Shuffle(len(filteredTracks), func(i, j int) {
+		filteredTracks[i], filteredTracks[j] = filteredTracks[j], filteredTracks[i]
+	})
 
-		fmt.Printf("Added %d tracks that match the mood based on audio features\n", len(allTracks))
+	// Put the best tracks for the mood first, keeping the shuffled order between equally ranked tracks.
+	// Without a ranking, recent likes and top genres can still be made more likely to make the cut, and recent plays
+	// less likely.
+	if cfg.RankTracks || cfg.Sampling == SamplingTopScored {
+		p.rankTracks(filteredTracks)
+	} else if cfg.LikedRecencyWeight > 0 || cfg.RecentlyPlayedWeight > 0 || cfg.TopGenreWeight > 0 {
+		favorFreshTracks(filteredTracks, p.likedAt, p.playedAt, p.topGenreFit(filteredTracks), cfg)
 	}
 
-	// 3. Try with genre-based filtering if we don't have enough tracks
-	if len(allTracks) < 50 {
-		fmt.Println("Using enhanced genre-based filtering to find mood-matching tracks...")
+	// Spread the cut over the genres and artists instead of the first tracks of the shuffle or ranking
+	if cfg.Sampling == SamplingStratified && cfg.TargetDuration == 0 && len(filteredTracks) > cfg.PlaylistSize {
+		p.stratifyTracks(filteredTracks)
+	}
 
-		// Get genres that match the mood
-		moodGenres := GetMoodMatchingGenres(mood)
-		fmt.Printf("Using %d genres associated with the '%s' mood\n", len(moodGenres), mood)
+	// The tracks the user has on repeat outweigh everything else
+	preferStage(filteredTracks, p.trackStages, StageOnRepeat)
 
-		// Create a map for quick genre lookup
-		moodGenreMap := make(map[string]bool)
-		for _, genre := range moodGenres {
-			moodGenreMap[strings.ToLower(genre)] = true
+	// Keep playlists curated by others from crowding out the user's own taste
+	mainSize := max(cfg.PlaylistSize-cfg.CooldownTracks, 1)
+	if cfg.MaxEditorialShare < 1 {
+		size := mainSize
+		if cfg.TargetDuration > 0 {
+			size = len(filteredTracks)
+		}
+		before := len(filteredTracks)
+		filteredTracks = capStageShare(filteredTracks, p.trackStages, editorialStages, cfg.MaxEditorialShare, size)
+		if dropped := before - len(filteredTracks); dropped > 0 {
+			fmt.Printf("Left out %d tracks from mood and editorial playlists to keep them under %.0f%% of the playlist\n",
+				dropped, cfg.MaxEditorialShare*100)
 		}
+	}
 
-		// Track artist genres to avoid repeated API calls
-		artistGenreCache := make(map[string][]string)
+	// Fill the target duration if there is one, and otherwise limit the playlist size, leaving room for the cooldown
+	if cfg.TargetDuration > 0 {
+		filteredTracks = fitDuration(filteredTracks, cfg.TargetDuration, cfg.DurationTolerance)
+	} else if len(filteredTracks) > mainSize {
+		filteredTracks = filteredTracks[:mainSize]
+	}
 
-		// Filter tracks by genre
-		for _, track := range userLikedSongs {
-			// Skip tracks we've already added
-			if seenTrackIDs[track.ID.String()] {
-				continue
-			}
+	// Put the chosen tracks in the configured order, which keeps them shuffled by default
+	p.orderTracks(filteredTracks)
 
-			// Try to get the track's genres through its artists
-			trackMatchesMood := false
+	// Wind down with calmer tracks after the mood section, unless they'd make a timed playlist run over
+	if cfg.CooldownTracks > 0 && cfg.TargetDuration == 0 {
+		cooldown := p.cooldownTracks(filteredTracks, cfg.CooldownTracks)
+		fmt.Printf("Added %d calmer tracks to wind down the playlist\n", len(cooldown))
+		filteredTracks = append(filteredTracks, cooldown...)
+	}
 
-			for _, artist := range track.Artists {
-				artistID := artist.ID.String()
+	fmt.Printf("Final playlist will contain %d tracks, all from your liked songs that match the '%s' mood, with no artist having more than %d songs\n",
+		len(filteredTracks), mood, cfg.MaxSongsPerArtist)
+	fmt.Printf("Pipeline made %d of its %d Spotify calls\n", budget.Used(), cfg.CallBudget)
+	partial := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if partial {
+		fmt.Println("Warning: the pipeline ran out of time, the playlist is made from the tracks found until then")
+	}
+	return filteredTracks, &pipelineReport{
+		TrackStages:     p.trackStages,
+		APICalls:        budget.Used(),
+		BudgetExhausted: budget.Exhausted(),
+		OutsideLibrary:  p.outsideLibrary,
+		Partial:         partial,
+		StagesRun:       p.stagesRun,
+	}
+}
 
-				// Check if we've already cached this artist's genres
-				var artistGenres []string
-				var ok bool
-
-				if artistGenres, ok = artistGenreCache[artistID]; !ok {
-					// Not in cache, fetch from API
-					artistInfo, err := client.GetArtist(ctx, artist.ID)
-					if err != nil {
-						continue
-					}
-
-					artistGenres = artistInfo.Genres
-					artistGenreCache[artistID] = artistGenres
-				}
-
-				// Check if any of the artist's genres match our mood genres
-				for _, artistGenre := range artistGenres {
-					artistGenreLower := strings.ToLower(artistGenre)
-
-					// Direct match
-					if moodGenreMap[artistGenreLower] {
-						trackMatchesMood = true
-						break
-					}
-
-					// Partial match (genre contains a mood genre keyword)
-					for moodGenre := range moodGenreMap {
-						if strings.Contains(artistGenreLower, moodGenre) {
-							trackMatchesMood = true
-							break
-						}
-					}
-
-					if trackMatchesMood {
-						break
-					}
-				}
-
-				if trackMatchesMood {
-					break
-				}
-			}
+// noMatchesError explains why the stages found no tracks for the playlist, and suggests what to change
+func (p *recommendationPipeline) noMatchesError() error {
+	budget, _ := p.ctx.Value(callBudgetKey{}).(*callBudget)
 
-			if trackMatchesMood {
-				allTracks = append(allTracks, track)
-				seenTrackIDs[track.ID.String()] = true
+	var why []string
+	if len(p.stagesRun) > 0 {
+		why = append(why, "tried "+strings.Join(p.stagesRun, ", "))
+	}
+	for _, feature := range p.unavailable {
+		why = append(why, feature+" were unavailable")
+	}
+	if budget != nil && budget.Exhausted() {
+		why = append(why, fmt.Sprintf("ran out of its %d Spotify calls", budget.limit))
+	}
 
-				if len(allTracks) >= 100 {
-					break
-				}
-			}
+	var suggestions []string
+	switch {
+	case len(p.likedTrackIDs) < p.cfg.MinLibrarySize:
+		suggestions = append(suggestions, "like more songs on Spotify")
+	case slices.Contains(p.unavailable, "audio features") && !p.cfg.EstimateFeatures:
+		suggestions = append(suggestions, "set ESTIMATE_FEATURES=true to estimate the audio features from genres")
+	}
+	if p.cfg.GenreMatch != GenreMatchContains {
+		suggestions = append(suggestions, "a looser GENRE_MATCH such as contains")
+	}
+	var disabled []string
+	for name := range pipelineStages {
+		if !p.cfg.HasStage(name) {
+			disabled = append(disabled, name)
 		}
-
-		fmt.Printf("Added %d tracks based on enhanced genre matching\n", len(allTracks))
 	}
+	if len(disabled) > 0 {
+		sort.Strings(disabled)
+		suggestions = append(suggestions, "more stages in PIPELINE_STAGES, such as "+strings.Join(disabled, " or "))
+	}
+	if budget != nil && budget.Exhausted() {
+		suggestions = append(suggestions, "a higher CALL_BUDGET")
+	}
+	if p.cfg.MoodStrict {
+		suggestions = append(suggestions, "MOOD_STRICT=false to also use liked songs of other moods")
+	}
+	if !p.cfg.GenreSeedFallback {
+		suggestions = append(suggestions, "GENRE_SEED_FALLBACK=true to get recommendations from outside your library instead")
+	}
+	suggestions = append(suggestions, "a different mood")
 
-	// 4. Try with mood-based playlists if we still don't have enough tracks
-	if len(allTracks) < 50 {
-		fmt.Println("Looking for tracks in popular mood-based playlists...")
+	message := fmt.Sprintf("your library has %d liked songs but none match the '%s' mood", len(p.likedTrackIDs), p.mood)
+	if len(why) > 0 {
+		message += " (" + strings.Join(why, "; ") + ")"
+	}
+	return fmt.Errorf("%w: %s - try %s", ErrNoMoodMatches, message, strings.Join(suggestions, ", "))
+}
 
-		// Try to get tracks from multiple mood-based playlists
-		var moodPlaylistTracks []spotify.FullTrack
+// pipelineTimeoutPerThousandSongs is how much longer the stages may take for every thousand liked songs
+const pipelineTimeoutPerThousandSongs = 15 * time.Second
 
-		// Try different search queries for the mood
-		searchQueries := getMoodPlaylistSearchQueries(mood)
+// pipelineTimeout returns how long the stages may take for a library of librarySize liked songs
+func pipelineTimeout(cfg RecommenderConfig, librarySize int) time.Duration {
+	return cfg.PipelineTimeout + time.Duration(librarySize/1000)*pipelineTimeoutPerThousandSongs
+}
 
-		for _, query := range searchQueries {
-			if len(moodPlaylistTracks) >= 200 {
-				break
-			}
+// relaxForSmallLibrary lets tracks from outside the liked songs into the playlist when the library has fewer
+// than cfg.MinLibrarySize songs, as so few liked songs rarely have enough that match the mood
+func relaxForSmallLibrary(cfg RecommenderConfig, librarySize int) RecommenderConfig {
+	if !cfg.LibraryOnly || librarySize >= cfg.MinLibrarySize {
+		return cfg
+	}
 
-			fmt.Printf("Searching for '%s' playlists...\n", query)
+	fmt.Printf("Warning: you only have %d liked songs, fewer than the %d needed to only use liked songs. "+
+		"Also using tracks from mood playlists and recommendations that match the mood.\n", librarySize, cfg.MinLibrarySize)
+	cfg.LibraryOnly = false
+	if !cfg.HasStage(StageMoodPlaylists) {
+		cfg.Stages = append(append([]string(nil), cfg.Stages...), StageMoodPlaylists)
+	}
+	return cfg
+}
 
-			results, err := client.Search(ctx, query, spotify.SearchTypePlaylist, spotify.Limit(5))
-			if err != nil || results == nil || results.Playlists == nil || len(results.Playlists.Playlists) == 0 {
-				continue
-			}
+// likedLibrary holds the user's liked songs, when they were liked and their full details
+type likedLibrary struct {
+	likedAt  map[string]time.Time
+	trackIDs []spotify.ID
+	songs    []spotify.FullTrack
+	// partial is set if the details of some songs weren't loaded in time, so they're missing from songs
+	partial bool
+}
 
-			// Get tracks from each playlist
-			for _, playlist := range results.Playlists.Playlists {
-				if len(moodPlaylistTracks) >= 200 {
-					break
-				}
-
-				fmt.Printf("Checking playlist: %s\n", playlist.Name)
-
-				playlistTracks, err := client.GetPlaylistItems(ctx, playlist.ID)
-				if err != nil {
-					continue
-				}
-
-				// Extract full tracks
-				for _, item := range playlistTracks.Items {
-					if item.Track.Track != nil {
-						// Convert PlaylistTrack to FullTrack
-						track := item.Track.Track
-						moodPlaylistTracks = append(moodPlaylistTracks, *track)
-					}
-				}
-			}
-		}
+// loadLikedSongs gets the user's liked songs and their full details, taking at most cfg.LibraryTimeout
+// for the details. Each page of liked songs has its own timeout.
+func loadLikedSongs(creationCtx context.Context, client *spotify.Client, cfg RecommenderConfig) (*likedLibrary, error) {
+	// Get user's liked songs - this is critical for strict filtering
+	likedAt, likedTracksErr := getUserLikedTracks(creationCtx, client, cfg)
+	switch {
+	case errors.Is(creationCtx.Err(), context.Canceled):
+		return nil, errCreationCancelled
+	case errors.Is(creationCtx.Err(), context.DeadlineExceeded):
+		return nil, fmt.Errorf("%w loading your liked songs", ErrOutOfTime)
+	}
+	if likedTracksErr != nil {
+		return nil, fmt.Errorf("failed to get liked songs: %w", likedTracksErr)
+	}
+	if len(likedAt) == 0 {
+		return nil, fmt.Errorf("%w - please like some songs on Spotify first", ErrNoLikedSongs)
+	}
 
-		fmt.Printf("Found %d tracks from mood-based playlists\n", len(moodPlaylistTracks))
+	// Load the full details of all liked songs so the stages can analyze them
+	fmt.Println("Analyzing your liked songs to find ones that match the current mood...")
+	ctx, cancel := context.WithTimeout(creationCtx, cfg.LibraryTimeout)
+	defer cancel()
 
-		// Filter to only include tracks in the user's library
-		for _, track := range moodPlaylistTracks {
-			if likedTracks[track.ID.String()] && !seenTrackIDs[track.ID.String()] {
-				allTracks = append(allTracks, track)
-				seenTrackIDs[track.ID.String()] = true
+	liked := &likedLibrary{likedAt: likedAt}
+	for trackID := range likedAt {
+		liked.trackIDs = append(liked.trackIDs, spotify.ID(trackID))
+	}
+	liked.songs = getTracksInBatches(ctx, client, liked.trackIDs, spotify.Market(spotifyMarket(cfg.Market)))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		liked.partial = true
+		fmt.Printf("Warning: only loaded %d of your %d liked songs within %s - raise LIBRARY_TIMEOUT to load them all\n",
+			len(liked.songs), len(liked.trackIDs), cfg.LibraryTimeout)
+	}
+	if errors.Is(creationCtx.Err(), context.Canceled) {
+		return nil, errCreationCancelled
+	}
 
-				if len(allTracks) >= 100 {
-					break
-				}
-			}
-		}
+	fmt.Printf("Found %d liked songs in your library\n", len(liked.songs))
+	return liked, nil
+}
 
-		fmt.Printf("Added tracks from mood-based playlists, now have %d tracks\n", len(allTracks))
+// collectCandidates runs the stages over the liked songs and filters their tracks, returning the pipeline
+// along with the candidates for the playlist
+func collectCandidates(ctx, stageCtx context.Context, mood string, client *spotify.Client, cfg RecommenderConfig, liked *likedLibrary) (*recommendationPipeline, []spotify.FullTrack, error) {
+	likedTracks := make(map[string]bool, len(liked.likedAt))
+	for trackID := range liked.likedAt {
+		likedTracks[trackID] = true
 	}
 
-	// 5. If we still don't have enough tracks, try with recommendations
-	if len(allTracks) < 50 {
-		fmt.Println("Using Spotify recommendations to find more tracks...")
+	fmt.Println("STRICT FILTERING: Only songs you've explicitly liked will be included in the playlist")
+	fmt.Printf("MOOD ACCURACY: Using audio analysis to ensure songs match the '%s' mood\n", mood)
 
-		// Create seed artists and tracks
-		var seedArtists []spotify.ID
-		var seedTracks []spotify.ID
+	// Get user's liked artists for additional filtering
+	likedArtists, _ := GetUserLikedArtists(client)
 
-		// Prioritize artists that are in the user's liked artists
-		if len(topArtists) > 0 && len(likedArtists) > 0 {
-			for i := 0; i < min(2, len(topArtists)); i++ {
-				if likedArtists[topArtists[i].ID.String()] {
-					seedArtists = append(seedArtists, topArtists[i].ID)
-					fmt.Printf("Using top artist as seed: %s (in your liked artists)\n", topArtists[i].Name)
-				}
-			}
+	// Following an artist says as much about the user's taste as liking their songs
+	var followedArtists []spotify.FullArtist
+	if cfg.UseFollowedArtists {
+		var err error
+		followedArtists, err = GetFollowedArtists(client)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
 		}
-
-		// Add some top tracks if we have room
-		if len(topTracks) > 0 && len(seedArtists) < 5 {
-			for i := 0; i < min(5-len(seedArtists), len(topTracks)); i++ {
-				// Only use tracks that are in the user's liked songs
-				if likedTracks[topTracks[i].ID.String()] {
-					seedTracks = append(seedTracks, topTracks[i].ID)
-					fmt.Printf("Using top track as seed: %s by %s (in your liked songs)\n",
-						topTracks[i].Name, topTracks[i].Artists[0].Name)
-				}
-			}
+		if likedArtists == nil {
+			likedArtists = make(map[string]bool, len(followedArtists))
+		}
+		for _, artist := range followedArtists {
+			likedArtists[artist.ID.String()] = true
 		}
+	}
 
-		// Define mood-based attributes
-		attrs := spotify.NewTrackAttributes()
-
-		switch mood {
-		case "energetic":
-			attrs = attrs.MinEnergy(0.7).MinDanceability(0.6).TargetValence(0.8)
-		case "relaxed":
-			attrs = attrs.MaxEnergy(0.5).MinValence(0.3).TargetAcousticness(0.8)
-		case "intense":
-			attrs = attrs.MinEnergy(0.8).MaxValence(0.4).TargetLoudness(0.8)
-		case "thoughtful":
-			attrs = attrs.MaxEnergy(0.6).TargetInstrumentalness(0.5).TargetValence(0.5)
-		default:
-			attrs = attrs.TargetEnergy(0.6).TargetDanceability(0.6)
-		}
-
-		// Create seeds
-		seeds := spotify.Seeds{
-			Artists: seedArtists,
-			Tracks:  seedTracks,
-		}
-
-		// Add genre seeds if we have room (max 5 seeds total)
-		if len(seedArtists)+len(seedTracks) < 5 {
-			// Get more genres per mood
-			switch mood {
-			case "energetic":
-				seeds.Genres = []string{"pop", "dance", "edm", "party", "house"}[:min(5-len(seedArtists)-len(seedTracks), 5)]
-			case "relaxed":
-				seeds.Genres = []string{"chill", "acoustic", "ambient", "jazz", "lofi"}[:min(5-len(seedArtists)-len(seedTracks), 5)]
-			case "intense":
-				seeds.Genres = []string{"rock", "metal", "punk", "hard-rock", "alt-rock"}[:min(5-len(seedArtists)-len(seedTracks), 5)]
-			case "thoughtful":
-				seeds.Genres = []string{"indie", "folk", "classical", "singer-songwriter", "ambient"}[:min(5-len(seedArtists)-len(seedTracks), 5)]
-			default:
-				seeds.Genres = []string{"pop", "indie", "alternative", "rock", "electronic"}[:min(5-len(seedArtists)-len(seedTracks), 5)]
-			}
+	// Get user's top artists and tracks for recommendation seeds, which the user only allowed
+	// access to if the recommendations stage is enabled
+	var topArtists []spotify.FullArtist
+	var topTracks []spotify.FullTrack
+	if cfg.HasStage(StageRecommendations) {
+		topArtists, topTracks = userTopItems(client, topItemsLimit(cfg))
+	} else if cfg.TopGenreWeight > 0 {
+		var err error
+		topArtists, err = GetUserTopArtists(client, topItemsLimit(cfg))
+		switch {
+		case askForScope(err):
+			return nil, nil, err
+		case err != nil && !errors.Is(err, ErrNoTopItems):
+			fmt.Printf("Warning: not favoring your top genres: %v\n", err)
 		}
+	}
 
-		// Get recommendations
-		fmt.Printf("Getting recommendations with %d artist seeds, %d track seeds, and %d genre seeds\n",
-			len(seeds.Artists), len(seeds.Tracks), len(seeds.Genres))
+	p := &recommendationPipeline{
+		ctx:             stageCtx,
+		client:          client,
+		mood:            mood,
+		cfg:             cfg,
+		likedTracks:     likedTracks,
+		likedAt:         liked.likedAt,
+		likedTrackIDs:   liked.trackIDs,
+		userLikedSongs:  liked.songs,
+		partialLibrary:  liked.partial,
+		likedArtists:    likedArtists,
+		topArtists:      topArtists,
+		topTracks:       topTracks,
+		followedArtists: followedArtists,
+		artistGenres:    make(map[string][]string),
+		allowedTracks:   make(map[string]bool),
+		seenTrackIDs:    make(map[string]bool),
+		trackStages:     make(map[spotify.ID]string),
+	}
 
-		recommendations, err := client.GetRecommendations(
-			ctx,
-			seeds,
-			attrs,
-			spotify.Limit(100), // Request more tracks to have enough after filtering
-		)
+	fmt.Println("Creating personalized recommendations based on your music taste and current mood...")
+	fmt.Println("Only including songs you've explicitly liked that match the current mood!")
 
-		if err == nil && recommendations != nil && len(recommendations.Tracks) > 0 {
-			fmt.Printf("Found %d initial recommendations\n", len(recommendations.Tracks))
+	// Run the enabled stages in order until we have enough tracks.
+	// Without a mood to match, a playlist of liked songs doesn't need them.
+	if cfg.MoodStrict || !cfg.LibraryOnly {
+		fmt.Printf("Running stages: %s\n", strings.Join(cfg.Stages, ", "))
+		p.run()
+	}
+	if !cfg.MoodStrict {
+		p.addLibraryTracks()
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return nil, nil, errCreationCancelled
+	}
 
-			// Get the IDs of the recommended tracks
-			recTrackIDs := make([]spotify.ID, 0, len(recommendations.Tracks))
-			for _, track := range recommendations.Tracks {
-				recTrackIDs = append(recTrackIDs, track.ID)
-			}
+	allTracks := p.allTracks
+	fmt.Printf("After all searches, found %d tracks\n", len(allTracks))
+
+	// Final filtering to ensure we only have liked songs (or tracks a stage explicitly allowed)
+	filteredTracks := allTracks
+	if cfg.LibraryOnly {
+		filteredTracks = FilterTracksByLikedSongs(allTracks, p.libraryTracks())
+	}
+
+	// As a last resort, fill the playlist from outside the library rather than leave it empty
+	if len(filteredTracks) == 0 && cfg.GenreSeedFallback && !errors.Is(ctx.Err(), context.Canceled) {
+		p.genreSeedFallback()
+		filteredTracks = p.allTracks[len(allTracks):]
+	}
 
-			// Get the full tracks in batches of 20 (API limit)
-			var fullTracks []spotify.FullTrack
-
-			for i := 0; i < len(recTrackIDs); i += 20 {
-				end := i + 20
-				if end > len(recTrackIDs) {
-					end = len(recTrackIDs)
-				}
-
-				batchIDs := recTrackIDs[i:end]
-				tracks, err := client.GetTracks(ctx, batchIDs)
-				if err == nil && len(tracks) > 0 {
-					// Convert []*FullTrack to []FullTrack
-					for _, track := range tracks {
-						if track != nil {
-							fullTracks = append(fullTracks, *track)
-						}
-					}
-				}
+	if len(filteredTracks) == 0 {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			tried := "before any stage ran"
+			if len(p.stagesRun) > 0 {
+				tried = "after trying " + strings.Join(p.stagesRun, ", ")
 			}
+			return nil, nil, fmt.Errorf("%w before any tracks were found, %s - allow more time with maxSeconds, MAX_PIPELINE_TIME or PIPELINE_TIMEOUT",
+				ErrOutOfTime, tried)
+		}
+		return nil, nil, p.noMatchesError()
+	}
 
-			// Add these tracks to our collection
-			addUniqueTracks(fullTracks)
-			fmt.Printf("Added %d tracks from personalized recommendations (only those in your liked songs)\n", len(allTracks))
+	filteredTracks, err := filterTrackDetails(client, filteredTracks, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.MoodCheckAllStages && cfg.MoodStrict {
+		filteredTracks = p.checkMoodOfAllStages(filteredTracks)
+		if len(filteredTracks) == 0 {
+			return nil, nil, fmt.Errorf("%w: none of the tracks the stages found have audio features that match the mood - disable MOOD_CHECK_ALL_STAGES to include them", ErrNoMoodMatches)
 		}
 	}
 
-	fmt.Printf("After all searches, found %d tracks from your liked songs that match the mood\n", len(allTracks))
+	return p, filteredTracks, nil
+}
 
-	// Final filtering to ensure we only have tracks by liked artists
-	filteredTracks := FilterTracksByLikedSongs(allTracks, likedTracks)
+// energyBounds returns the energy the tracks of a playlist for the mood must have at least and at most:
+// cfg.EnergeticMinEnergy for energetic playlists and cfg.RelaxedMaxEnergy for relaxed ones.
+// Other moods, and bounds left at 0, allow any energy.
+func energyBounds(mood string, cfg RecommenderConfig) (minEnergy, maxEnergy float64) {
+	minEnergy, maxEnergy = 0, 1
+	switch {
+	case mood == "energetic" && cfg.EnergeticMinEnergy > 0:
+		minEnergy = cfg.EnergeticMinEnergy
+	case mood == "relaxed" && cfg.RelaxedMaxEnergy > 0:
+		maxEnergy = cfg.RelaxedMaxEnergy
+	}
+	return minEnergy, maxEnergy
+}
 
-	if len(filteredTracks) == 0 {
-		return nil, fmt.Errorf("no tracks found in your liked songs that match the criteria - please like more songs on Spotify")
+// filterByEnergy leaves out the tracks whose energy is outside the bounds. Tracks without audio features are kept,
+// and so are all tracks if audio features aren't available. The audio features the stages fetched are reused,
+// also for candidates from the result cache.
+func (p *recommendationPipeline) filterByEnergy(ctx context.Context, tracks []spotify.FullTrack, minEnergy, maxEnergy float64) []spotify.FullTrack {
+	ids := make([]spotify.ID, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.ID
+	}
+	audioFeatures, err := p.trackFeatures(ctx, ids)
+	if err != nil {
+		fmt.Printf("Warning: not checking the energy of the tracks, audio features unavailable: %v\n", err)
+		return tracks
 	}
 
-	// Limit the number of songs per artist to ensure variety
-	const maxSongsPerArtist = 5
-	filteredTracks = LimitSongsPerArtist(filteredTracks, maxSongsPerArtist)
+	kept := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		trackFeatures := audioFeatures[track.ID]
+		if trackFeatures == nil || (float64(trackFeatures.Energy) >= minEnergy && float64(trackFeatures.Energy) <= maxEnergy) {
+			kept = append(kept, track)
+		}
+	}
+	if removed := len(tracks) - len(kept); removed > 0 {
+		fmt.Printf("Removed %d tracks with an energy outside %.2f to %.2f\n", removed, minEnergy, maxEnergy)
+	}
+	return kept
+}
 
-	// Shuffle the tracks for variety
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(filteredTracks), func(i, j int) {
-		filteredTracks[i], filteredTracks[j] = filteredTracks[j], filteredTracks[i]
-	})
+// checkMoodOfAllStages leaves out the tracks whose audio features don't match the mood. Only the audio features
+// stage checks them, so the tracks of the other stages only matched the mood by their genre or playlist.
+// If audio features aren't available, all tracks are kept. Checking them spends the call budget of the stages.
+func (p *recommendationPipeline) checkMoodOfAllStages(tracks []spotify.FullTrack) []spotify.FullTrack {
+	var unchecked []spotify.ID
+	for _, track := range tracks {
+		if p.trackStages[track.ID] != StageAudioFeatures {
+			unchecked = append(unchecked, track.ID)
+		}
+	}
+	if len(unchecked) == 0 {
+		return tracks
+	}
 
-	// Limit to 50 tracks for the playlist
-	if len(filteredTracks) > 50 {
-		filteredTracks = filteredTracks[:50]
+	audioFeatures, err := p.trackFeatures(p.ctx, unchecked)
+	if err != nil {
+		fmt.Printf("Warning: keeping the tracks of all stages, their audio features couldn't be checked: %v\n", err)
+		return tracks
 	}
 
-	fmt.Printf("Final playlist will contain %d tracks, all from your liked songs that match the '%s' mood, with no artist having more than %d songs\n",
-		len(filteredTracks), mood, maxSongsPerArtist)
-	return filteredTracks, nil
+	matches := make(map[spotify.ID]bool, len(unchecked))
+	for _, id := range tracksMatchingMood(unchecked, audioFeatures, p.moodThresholds()) {
+		matches[id] = true
+	}
+
+	kept := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if p.trackStages[track.ID] == StageAudioFeatures || matches[track.ID] {
+			kept = append(kept, track)
+		}
+	}
+	fmt.Printf("Removed %d tracks of other stages whose audio features don't match the mood\n", len(tracks)-len(kept))
+	return kept
 }
 
 // GetSearchBasedRecommendations gets recommendations based on search queries
 func GetSearchBasedRecommendations(mood string, client *spotify.Client) ([]spotify.FullTrack, error) {
 	if client == nil {
-		return nil, fmt.Errorf("spotify client is nil")
+		return nil, ErrSpotifyClientNil
 	}
 
 	// Create a context with timeout
@@ -527,6 +780,7 @@ func GetSearchBasedRecommendations(mood string, client *spotify.Client) ([]spoti
 		searchQuery,
 		spotify.SearchTypeTrack,
 		spotify.Limit(20),
+		spotify.Market(spotifyMarket("")),
 	)
 
 	if err != nil {
@@ -545,57 +799,28 @@ func GetSearchBasedRecommendations(mood string, client *spotify.Client) ([]spoti
 // GetUserLikedArtists retrieves the user's liked songs and extracts unique artists
 func GetUserLikedArtists(client *spotify.Client) (map[string]bool, error) {
 	if client == nil {
-		return nil, fmt.Errorf("spotify client is nil")
+		return nil, ErrSpotifyClientNil
 	}
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	// Get user's saved tracks (liked songs)
-	limit := 50 // Maximum allowed by Spotify API
-	offset := 0
 	likedArtists := make(map[string]bool)
 
 	fmt.Println("Fetching your liked songs to identify your preferred artists...")
 
-	// Keep track of how many tracks we've processed
 	totalProcessed := 0
-
-	for {
-		savedTracks, err := client.CurrentUsersTracks(ctx, spotify.Limit(limit), spotify.Offset(offset))
-		if err != nil {
-			return nil, fmt.Errorf("failed to get user's liked songs: %v", err)
-		}
-
-		if savedTracks == nil || len(savedTracks.Tracks) == 0 {
-			break // No more tracks
-		}
-
+	err := forEachSavedTracksPage(context.Background(), client, recommenderConfig, func(page []spotify.SavedTrack) {
 		// Extract artists from each track
-		for _, item := range savedTracks.Tracks {
+		for _, item := range page {
 			for _, artist := range item.FullTrack.Artists {
 				likedArtists[artist.ID.String()] = true
 			}
 		}
 
-		totalProcessed += len(savedTracks.Tracks)
+		totalProcessed += len(page)
 		fmt.Printf("Processed %d liked songs, found %d unique artists so far...\n",
 			totalProcessed, len(likedArtists))
-
-		// If we got fewer tracks than requested, we've reached the end
-		if len(savedTracks.Tracks) < limit {
-			break
-		}
-
-		// Move to the next page
-		offset += limit
-
-		// Limit to 1000 tracks (20 pages) to avoid rate limiting
-		if offset >= 1000 {
-			fmt.Println("Reached the limit of 1000 tracks. If you have more liked songs, not all artists may be included.")
-			break
-		}
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	if len(likedArtists) == 0 {
@@ -637,8 +862,150 @@ func FilterTracksByLikedArtists(tracks []spotify.FullTrack, likedArtists map[str
 	return filteredTracks
 }
 
-// LimitSongsPerArtist ensures no artist has more than the specified maximum number of songs
-func LimitSongsPerArtist(tracks []spotify.FullTrack, maxSongsPerArtist int) []spotify.FullTrack {
+// filterTrackDetails removes the tracks ruled out by their details: explicit lyrics, their duration and alternate
+// versions, as configured. It fails with ErrNoMoodMatches if no tracks are left.
+func filterTrackDetails(client *spotify.Client, tracks []spotify.FullTrack, cfg RecommenderConfig) ([]spotify.FullTrack, error) {
+	if cfg.FilterExplicit {
+		tracks = FilterExplicitTracks(tracks)
+		if len(tracks) == 0 {
+			return nil, fmt.Errorf("%w: all tracks that match the criteria have explicit lyrics - disable the explicit filter to include them", ErrNoMoodMatches)
+		}
+	}
+
+	if cfg.MinDuration > 0 || cfg.MaxDuration > 0 {
+		tracks = FilterByDuration(tracks, int(cfg.MinDuration.Milliseconds()), int(cfg.MaxDuration.Milliseconds()))
+		if len(tracks) == 0 {
+			return nil, fmt.Errorf("%w: all tracks that match the criteria are too short or too long - change MIN_DURATION or MAX_DURATION to include them", ErrNoMoodMatches)
+		}
+	}
+
+	if cfg.FilterAlternateVersions || cfg.StudioOnly {
+		tracks = FilterAlternateVersions(client, tracks, cfg.AlternateVersionKeywords)
+		if cfg.StudioOnly {
+			tracks = FilterLiveAlbums(tracks)
+		}
+		if len(tracks) == 0 {
+			return nil, fmt.Errorf("%w: all tracks that match the criteria are live, remixed or remastered versions - disable the version filter to include them", ErrNoMoodMatches)
+		}
+	}
+	return tracks, nil
+}
+
+// filterForPlaylist removes the candidates that don't belong in the playlist: those on the never play list,
+// those outside the mood's energy bounds and, with InstrumentalOnly, those with vocals. It fails with
+// ErrNoMoodMatches if no tracks are left.
+func (p *recommendationPipeline) filterForPlaylist(ctx context.Context, tracks []spotify.FullTrack) ([]spotify.FullTrack, error) {
+	// Tracks the user never wants to hear are left out of every playlist
+	if neverPlayed, err := FilterNeverPlayTracks(tracks); err != nil {
+		fmt.Printf("Warning: couldn't leave out the tracks on your never play list: %v\n", err)
+	} else if len(neverPlayed) == 0 {
+		return nil, fmt.Errorf("%w: all tracks that match the criteria are on your never play list", ErrNoMoodMatches)
+	} else {
+		tracks = neverPlayed
+	}
+
+	// Energetic playlists shouldn't have a lull, nor relaxed ones a burst of energy
+	if minEnergy, maxEnergy := energyBounds(p.mood, p.cfg); minEnergy > 0 || maxEnergy < 1 {
+		tracks = p.filterByEnergy(ctx, tracks, minEnergy, maxEnergy)
+		if len(tracks) == 0 {
+			return nil, fmt.Errorf("%w: none of the tracks have an energy between %.2f and %.2f", ErrNoMoodMatches, minEnergy, maxEnergy)
+		}
+	}
+
+	// Deep work playlists have no vocals at all, whatever the mood
+	if p.cfg.InstrumentalOnly {
+		tracks = p.filterInstrumental(ctx, tracks, p.cfg)
+		if len(tracks) == 0 {
+			return nil, fmt.Errorf("%w: none of the tracks are instrumental", ErrNoMoodMatches)
+		}
+	}
+	return tracks, nil
+}
+
+// FilterExplicitTracks removes tracks with explicit lyrics
+func FilterExplicitTracks(tracks []spotify.FullTrack) []spotify.FullTrack {
+	filteredTracks := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if !track.Explicit {
+			filteredTracks = append(filteredTracks, track)
+		}
+	}
+
+	fmt.Printf("Filtered out %d tracks with explicit lyrics\n", len(tracks)-len(filteredTracks))
+	return filteredTracks
+}
+
+// FilterByDuration removes tracks shorter than minMs or longer than maxMs milliseconds. Zero doesn't limit the duration.
+func FilterByDuration(tracks []spotify.FullTrack, minMs, maxMs int) []spotify.FullTrack {
+	filteredTracks := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		duration := int(track.Duration)
+		if duration >= minMs && (maxMs == 0 || duration <= maxMs) {
+			filteredTracks = append(filteredTracks, track)
+		}
+	}
+
+	limits := fmt.Sprintf("shorter than %s", time.Duration(minMs)*time.Millisecond)
+	if maxMs > 0 {
+		limits += fmt.Sprintf(" or longer than %s", time.Duration(maxMs)*time.Millisecond)
+	}
+	fmt.Printf("Filtered out %d tracks %s\n", len(tracks)-len(filteredTracks), limits)
+	return filteredTracks
+}
+
+// OrderTracks sorts the tracks in place by the given order. Tracks are left as they are for OrderShuffle, and for
+// OrderBalanced, which needs the pipeline's mood and genres: see recommendationPipeline.orderTracks.
+func OrderTracks(tracks []spotify.FullTrack, order string) {
+	var less func(a, b spotify.FullTrack) bool
+
+	switch order {
+	case OrderArtist:
+		less = func(a, b spotify.FullTrack) bool {
+			return strings.ToLower(firstArtistName(a)) < strings.ToLower(firstArtistName(b))
+		}
+	case OrderRelease:
+		// Newest first
+		less = func(a, b spotify.FullTrack) bool {
+			return a.Album.ReleaseDateTime().After(b.Album.ReleaseDateTime())
+		}
+	case OrderPopularity:
+		// Most popular first
+		less = func(a, b spotify.FullTrack) bool {
+			return a.Popularity > b.Popularity
+		}
+	case OrderTitle:
+		less = func(a, b spotify.FullTrack) bool {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+	default:
+		return
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return less(tracks[i], tracks[j])
+	})
+}
+
+// firstArtistName returns the name of the track's main artist
+func firstArtistName(track spotify.FullTrack) string {
+	if len(track.Artists) == 0 {
+		return ""
+	}
+	return track.Artists[0].Name
+}
+
+// countedArtists returns the artists of a track that count toward the per-artist limit: all of them,
+// or only the primary artist so features and collaborations don't use up the featured artists' songs
+func countedArtists(track spotify.FullTrack, primaryOnly bool) []spotify.SimpleArtist {
+	if primaryOnly && len(track.Artists) > 1 {
+		return track.Artists[:1]
+	}
+	return track.Artists
+}
+
+// LimitSongsPerArtist ensures no artist has more than the specified maximum number of songs.
+// With primaryOnly, a track only counts toward the limit of its first artist.
+func LimitSongsPerArtist(tracks []spotify.FullTrack, maxSongsPerArtist int, primaryOnly bool) []spotify.FullTrack {
 	if len(tracks) == 0 || maxSongsPerArtist <= 0 {
 		return tracks
 	}
@@ -654,7 +1021,7 @@ func LimitSongsPerArtist(tracks []spotify.FullTrack, maxSongsPerArtist int) []sp
 
 	// First pass: count songs per artist
 	for _, track := range tracks {
-		for _, artist := range track.Artists {
+		for _, artist := range countedArtists(track, primaryOnly) {
 			artistID := artist.ID.String()
 			artistSongCount[artistID]++
 		}
@@ -674,7 +1041,7 @@ func LimitSongsPerArtist(tracks []spotify.FullTrack, maxSongsPerArtist int) []sp
 
 		// Check if any artist of this track has reached the limit
 		exceedsLimit := false
-		for _, artist := range track.Artists {
+		for _, artist := range countedArtists(track, primaryOnly) {
 			artistID := artist.ID.String()
 			if artistSongCount[artistID] > maxSongsPerArtist {
 				exceedsLimit = true
@@ -690,7 +1057,7 @@ func LimitSongsPerArtist(tracks []spotify.FullTrack, maxSongsPerArtist int) []sp
 			processedTrackIDs[trackID] = true
 
 			// Reduce the count for all artists in this track
-			for _, artist := range track.Artists {
+			for _, artist := range countedArtists(track, primaryOnly) {
 				artistID := artist.ID.String()
 				artistSongCount[artistID]--
 			}
@@ -730,63 +1097,140 @@ func printTopArtistCounts(artistCounts map[string]int, topN int) {
 
 // GetUserLikedTracks retrieves the user's liked songs and creates a map for quick lookup
 func GetUserLikedTracks(client *spotify.Client) (map[string]bool, error) {
-	if client == nil {
-		return nil, fmt.Errorf("spotify client is nil")
+	likedAt, err := getUserLikedTracks(context.Background(), client, recommenderConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	likedTracks := make(map[string]bool, len(likedAt))
+	for trackID := range likedAt {
+		likedTracks[trackID] = true
+	}
+	return likedTracks, nil
+}
 
-	// Get user's saved tracks (liked songs)
-	limit := 50 // Maximum allowed by Spotify API
-	offset := 0
-	likedTracks := make(map[string]bool)
+// getUserLikedTracks returns the IDs of the user's liked songs along with when each was liked, or of a sample of
+// them if cfg.SampleSize is set. Paging stops when ctx is done.
+func getUserLikedTracks(ctx context.Context, client *spotify.Client, cfg RecommenderConfig) (map[string]time.Time, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+
+	likedTracks := make(map[string]time.Time)
 
 	fmt.Println("Fetching your liked songs...")
 
-	// Keep track of how many tracks we've processed
 	totalProcessed := 0
+	addPage := func(page []spotify.SavedTrack) {
+		// Add each track ID to the map. A missing or malformed date sorts as liked long ago.
+		for _, item := range page {
+			addedAt, _ := time.Parse(spotify.TimestampLayout, item.AddedAt)
+			likedTracks[item.FullTrack.ID.String()] = addedAt
+		}
+
+		totalProcessed += len(page)
+		fmt.Printf("Processed %d liked songs...\n", totalProcessed)
+	}
+
+	var err error
+	if cfg.SampleSize > 0 {
+		err = sampleSavedTracksPages(ctx, client, cfg, addPage)
+	} else {
+		err = forEachSavedTracksPage(ctx, client, cfg, addPage)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(likedTracks) == 0 {
+		return nil, fmt.Errorf("%w in your library", ErrNoLikedSongs)
+	}
+
+	fmt.Printf("Found %d liked songs in your library\n", len(likedTracks))
+	return likedTracks, nil
+}
+
+// forEachSavedTracksPage pages through all of the user's liked songs, calling fn for every page.
+// It waits cfg.PageDelay between pages so large libraries don't trip Spotify's rate limits,
+// and gives every page its own cfg.SpotifyTimeout so paging a large library can't time out as a whole.
+// Paging stops when ctx is done.
+func forEachSavedTracksPage(ctx context.Context, client *spotify.Client, cfg RecommenderConfig, fn func(page []spotify.SavedTrack)) error {
+	const limit = 50 // Maximum allowed by Spotify API
+
+	err := paginateOffset(ctx, limit, 0, cfg.PageDelay, func(limit, offset int) (int, bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, cfg.SpotifyTimeout)
+		defer cancel()
 
-	for {
 		savedTracks, err := client.CurrentUsersTracks(ctx, spotify.Limit(limit), spotify.Offset(offset))
 		if err != nil {
-			return nil, fmt.Errorf("failed to get user's liked songs: %v", err)
+			return 0, false, err
 		}
 
 		if savedTracks == nil || len(savedTracks.Tracks) == 0 {
-			break // No more tracks
+			return 0, true, nil // No more tracks
 		}
 
-		// Add each track ID to the map
-		for _, item := range savedTracks.Tracks {
-			likedTracks[item.FullTrack.ID.String()] = true
-		}
+		fn(savedTracks.Tracks)
+		return len(savedTracks.Tracks), false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get user's liked songs: %w", err)
+	}
+	return nil
+}
 
-		totalProcessed += len(savedTracks.Tracks)
-		fmt.Printf("Processed %d liked songs...\n", totalProcessed)
+// sampleSavedTracksPages reads a random sample of cfg.SampleSize liked songs if the library is larger than that,
+// and the whole library otherwise. The sample is spread over the library by reading one page from each of
+// evenly sized slices of it, so old and new liked songs are both represented. Paging stops when ctx is done.
+func sampleSavedTracksPages(ctx context.Context, client *spotify.Client, cfg RecommenderConfig, fn func(page []spotify.SavedTrack)) error {
+	limit := 50 // Maximum allowed by Spotify API
 
-		// If we got fewer tracks than requested, we've reached the end
-		if len(savedTracks.Tracks) < limit {
-			break
+	// Only the total is needed, so ask for a single track
+	probeCtx, cancel := context.WithTimeout(ctx, cfg.SpotifyTimeout)
+	probe, err := client.CurrentUsersTracks(probeCtx, spotify.Limit(1))
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to get user's liked songs: %w", err)
+	}
+
+	total := int(probe.Total)
+	if total <= cfg.SampleSize {
+		return forEachSavedTracksPage(ctx, client, cfg, fn)
+	}
+
+	fmt.Printf("Sampling %d of your %d liked songs\n", cfg.SampleSize, total)
+
+	pages := (cfg.SampleSize + limit - 1) / limit
+	stride := total / pages
+	remaining := cfg.SampleSize
+
+	for i := 0; i < pages && remaining > 0; i++ {
+		pageSize := min(limit, remaining)
+
+		// Pick a random page within this slice of the library
+		offset := i * stride
+		if stride > pageSize {
+			offset += rand.Intn(stride - pageSize + 1)
 		}
 
-		// Move to the next page
-		offset += limit
+		pageCtx, cancel := context.WithTimeout(ctx, cfg.SpotifyTimeout)
+		savedTracks, err := client.CurrentUsersTracks(pageCtx, spotify.Limit(pageSize), spotify.Offset(offset))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to get user's liked songs: %w", err)
+		}
 
-		// Limit to 1000 tracks (20 pages) to avoid rate limiting
-		if offset >= 1000 {
-			fmt.Println("Reached the limit of 1000 tracks. If you have more liked songs, not all may be included.")
-			break
+		if len(savedTracks.Tracks) > 0 {
+			fn(savedTracks.Tracks)
+			remaining -= len(savedTracks.Tracks)
 		}
-	}
 
-	if len(likedTracks) == 0 {
-		return nil, fmt.Errorf("no liked songs found in your library")
+		if err := sleepContext(ctx, cfg.PageDelay); err != nil {
+			return fmt.Errorf("failed to get user's liked songs: %w", err)
+		}
 	}
 
-	fmt.Printf("Found %d liked songs in your library\n", len(likedTracks))
-	return likedTracks, nil
+	return nil
 }
 
 // FilterTracksByLikedSongs filters tracks to only include those that are in the user's liked songs
@@ -811,91 +1255,178 @@ func FilterTracksByLikedSongs(tracks []spotify.FullTrack, likedTracks map[string
 	return filteredTracks
 }
 
-// AudioFeatureThresholds defines the thresholds for different moods
+// AudioFeatureThresholds defines the thresholds for different moods.
+// A nil bound is unconstrained, so a bound of 0 is a real limit.
 type AudioFeatureThresholds struct {
-	MinEnergy           float32
-	MaxEnergy           float32
-	MinDanceability     float32
-	MaxDanceability     float32
-	MinValence          float32
-	MaxValence          float32
-	MinTempo            float32
-	MaxTempo            float32
-	MinAcousticness     float32
-	MaxAcousticness     float32
-	MinInstrumentalness float32
-	MaxInstrumentalness float32
-}
-
-// GetMoodThresholds returns the audio feature thresholds for a specific mood
+	MinEnergy           *float32
+	MaxEnergy           *float32
+	MinDanceability     *float32
+	MaxDanceability     *float32
+	MinValence          *float32
+	MaxValence          *float32
+	MinTempo            *float32
+	MaxTempo            *float32
+	MinAcousticness     *float32
+	MaxAcousticness     *float32
+	MinInstrumentalness *float32
+	MaxInstrumentalness *float32
+	// Weights are how much each constrained feature counts towards the mood score
+	Weights FeatureWeights
+}
+
+// FeatureWeights are how much each audio feature counts towards the mood score, so a mood can emphasize the
+// features that define it. A weight of 0 is unset and counts as 1, so every constrained feature counts equally
+// unless a mood says otherwise.
+type FeatureWeights struct {
+	Energy           float64
+	Danceability     float64
+	Valence          float64
+	Tempo            float64
+	Acousticness     float64
+	Instrumentalness float64
+}
+
+// defaultMoodWeights are the feature weights of the moods that don't count every feature equally. The thresholds
+// only say where a mood's bounds lie, not which of them define it, so these are set by hand rather than derived:
+// a feature a mood bounds counts 1 unless it's weighted here.
+var defaultMoodWeights = map[string]FeatureWeights{
+	// Mostly about energy and something to dance to
+	"energetic": {Energy: 3, Danceability: 3, Tempo: 2},
+	"relaxed":   {Energy: 3, Acousticness: 2, Tempo: 2},
+	"intense":   {Energy: 3, Valence: 2},
+	// Mostly about quiet, instrumental tracks
+	"thoughtful": {Instrumentalness: 3, Acousticness: 2, Energy: 2},
+}
+
+// moodWeights returns the feature weights of a mood: its default weights, with the ones set in overrides replacing them
+func moodWeights(mood string, overrides map[string]FeatureWeights) FeatureWeights {
+	weights := defaultMoodWeights[mood]
+	override, ok := overrides[mood]
+	if !ok {
+		return weights
+	}
+	for _, name := range featureNames {
+		if value := *override.field(name); value > 0 {
+			*weights.field(name) = value
+		}
+	}
+	return weights
+}
+
+// featureNames are the names of the audio features that can be weighted, as MOOD_WEIGHTS takes them
+var featureNames = []string{"energy", "danceability", "valence", "tempo", "acousticness", "instrumentalness"}
+
+// field returns the weight of the named feature, or nil if there's no such feature
+func (w *FeatureWeights) field(name string) *float64 {
+	switch name {
+	case "energy":
+		return &w.Energy
+	case "danceability":
+		return &w.Danceability
+	case "valence":
+		return &w.Valence
+	case "tempo":
+		return &w.Tempo
+	case "acousticness":
+		return &w.Acousticness
+	case "instrumentalness":
+		return &w.Instrumentalness
+	}
+	return nil
+}
+
+// weight returns value, or 1 if it's unset
+func weight(value float64) float64 {
+	if value <= 0 {
+		return 1
+	}
+	return value
+}
+
+// bound returns a pointer to value, for setting an AudioFeatureThresholds bound
+func bound(value float32) *float32 {
+	return &value
+}
+
+// GetMoodThresholds returns the audio feature thresholds for a specific mood, weighted by the configured weights
 func GetMoodThresholds(mood string) AudioFeatureThresholds {
+	thresholds := moodBounds(mood)
+	thresholds.Weights = moodWeights(mood, recommenderConfig.MoodWeights)
+	return thresholds
+}
+
+// moodBounds returns the bounds of the audio features of a mood, without their weights
+func moodBounds(mood string) AudioFeatureThresholds {
 	switch mood {
 	case "energetic":
 		return AudioFeatureThresholds{
-			MinEnergy:           0.7,
-			MaxEnergy:           1.0,
-			MinDanceability:     0.6,
-			MaxDanceability:     1.0,
-			MinValence:          0.5, // Moderately positive to very positive
-			MaxValence:          1.0,
-			MinTempo:            120, // Faster tempo
-			MaxTempo:            300,
-			MaxAcousticness:     0.4, // Less acoustic
-			MaxInstrumentalness: 0.3, // Mostly with vocals
+			MinEnergy:           bound(0.7),
+			MinDanceability:     bound(0.6),
+			MinValence:          bound(0.5), // Moderately positive to very positive
+			MinTempo:            bound(120), // Faster tempo
+			MaxAcousticness:     bound(0.4), // Less acoustic
+			MaxInstrumentalness: bound(0.3), // Mostly with vocals
 		}
 	case "relaxed":
 		return AudioFeatureThresholds{
-			MinEnergy:           0.0,
-			MaxEnergy:           0.5,
-			MinDanceability:     0.0,
-			MaxDanceability:     0.6,
-			MinValence:          0.0,
-			MaxValence:          0.7,
-			MinTempo:            0,
-			MaxTempo:            110,
-			MinAcousticness:     0.4, // More acoustic
-			MaxInstrumentalness: 1.0, // Can be instrumental
+			MaxEnergy:       bound(0.5),
+			MaxDanceability: bound(0.6),
+			MaxValence:      bound(0.7),
+			MaxTempo:        bound(110),
+			MinAcousticness: bound(0.4), // More acoustic, and can be instrumental
 		}
 	case "intense":
 		return AudioFeatureThresholds{
-			MinEnergy:           0.8,
-			MaxEnergy:           1.0,
-			MinDanceability:     0.0,
-			MaxDanceability:     1.0,
-			MinValence:          0.0,
-			MaxValence:          0.5, // Less positive, more serious
-			MinTempo:            100,
-			MaxTempo:            300,
-			MaxAcousticness:     0.3, // Less acoustic
-			MaxInstrumentalness: 0.5,
+			MinEnergy:           bound(0.8),
+			MaxValence:          bound(0.5), // Less positive, more serious
+			MinTempo:            bound(100),
+			MaxAcousticness:     bound(0.3), // Less acoustic
+			MaxInstrumentalness: bound(0.5),
 		}
 	case "thoughtful":
 		return AudioFeatureThresholds{
-			MinEnergy:           0.0,
-			MaxEnergy:           0.6,
-			MinDanceability:     0.0,
-			MaxDanceability:     0.5,
-			MinValence:          0.0,
-			MaxValence:          0.6,
-			MinTempo:            0,
-			MaxTempo:            120,
-			MinAcousticness:     0.3,
-			MinInstrumentalness: 0.2,
+			MaxEnergy:           bound(0.6),
+			MaxDanceability:     bound(0.5),
+			MaxValence:          bound(0.6),
+			MaxTempo:            bound(120),
+			MinAcousticness:     bound(0.3),
+			MinInstrumentalness: bound(0.2),
 		}
 	default: // neutral
-		return AudioFeatureThresholds{
-			MinEnergy:       0.0,
-			MaxEnergy:       1.0,
-			MinDanceability: 0.0,
-			MaxDanceability: 1.0,
-			MinValence:      0.0,
-			MaxValence:      1.0,
-			MinTempo:        0,
-			MaxTempo:        300,
-		}
+		return AudioFeatureThresholds{}
+	}
+}
+
+// moodTrackAttributes returns the recommendation attributes that steer Spotify towards a mood.
+// The energy bounds are multiplied by intensity, so above 1 asks for more energetic tracks and below 1 for calmer ones.
+func moodTrackAttributes(mood string, intensity float64) *spotify.TrackAttributes {
+	attrs := spotify.NewTrackAttributes()
+	energy := func(value float64) float64 { return math.Min(value*intensity, 1) }
+
+	switch mood {
+	case "energetic":
+		return attrs.MinEnergy(energy(0.7)).MinDanceability(0.6).TargetValence(0.8)
+	case "relaxed":
+		return attrs.MaxEnergy(energy(0.5)).MinValence(0.3).TargetAcousticness(0.8)
+	case "intense":
+		return attrs.MinEnergy(energy(0.8)).MaxValence(0.4).TargetLoudness(0.8)
+	case "thoughtful":
+		return attrs.MaxEnergy(energy(0.6)).TargetInstrumentalness(0.5).TargetValence(0.5)
+	default:
+		return attrs.TargetEnergy(energy(0.6)).TargetDanceability(0.6)
 	}
 }
 
+// temperatureIntensitySpan is how many °C from the comfortable temperature the full TemperatureIntensity applies
+const temperatureIntensitySpan = 20.0
+
+// temperatureIntensity returns the energy multiplier for a temperature: 1 at the comfortable temperature, rising
+// towards 1 + cfg.TemperatureIntensity in the heat and falling towards 1 - cfg.TemperatureIntensity in the cold
+func temperatureIntensity(temp float64, cfg RecommenderConfig) float64 {
+	distance := (temp - cfg.ComfortableTemperature) / temperatureIntensitySpan
+	return 1 + cfg.TemperatureIntensity*math.Max(-1, math.Min(distance, 1))
+}
+
 // GetMoodMatchingGenres returns genres that match a specific mood
 func GetMoodMatchingGenres(mood string) []string {
 	switch mood {
@@ -928,6 +1459,31 @@ func GetMoodMatchingGenres(mood string) []string {
 	}
 }
 
+// GetMoodGenresForGenre narrows the genres of a mood to those compatible with a chosen genre, where either one
+// contains the other, such as "electro" for "electronic". If none are, the chosen genre is the only one.
+// Without a chosen genre, it returns all genres of the mood.
+func GetMoodGenresForGenre(mood, genre string) []string {
+	moodGenres := GetMoodMatchingGenres(mood)
+	if genre == "" {
+		return moodGenres
+	}
+
+	normalize := func(g string) string { return strings.ReplaceAll(strings.ToLower(g), "-", " ") }
+	chosen := normalize(genre)
+
+	var compatible []string
+	for _, moodGenre := range moodGenres {
+		if normalized := normalize(moodGenre); strings.Contains(normalized, chosen) || strings.Contains(chosen, normalized) {
+			compatible = append(compatible, moodGenre)
+		}
+	}
+
+	if len(compatible) == 0 {
+		return []string{genre}
+	}
+	return compatible
+}
+
 func GetMoodFromGenre(genre string) string {
 	moodMap := map[string]string{}
 
@@ -952,106 +1508,161 @@ func GetMoodFromGenre(genre string) string {
 
 // AnalyzeAudioFeaturesForMood analyzes audio features for a batch of tracks and returns those that match the mood
 func AnalyzeAudioFeaturesForMood(client *spotify.Client, trackIDs []spotify.ID, mood string) ([]spotify.ID, error) {
+	return analyzeAudioFeaturesForMood(context.Background(), client, trackIDs, GetMoodThresholds(mood))
+}
+
+// analyzeAudioFeaturesForMood is AnalyzeAudioFeaturesForMood with the requests made under ctx, for the mood's thresholds
+func analyzeAudioFeaturesForMood(ctx context.Context, client *spotify.Client, trackIDs []spotify.ID, thresholds AudioFeatureThresholds) ([]spotify.ID, error) {
+	audioFeatures, err := fetchAudioFeatures(ctx, client, trackIDs)
+	if err != nil {
+		return nil, err
+	}
+	return tracksMatchingMood(trackIDs, audioFeatures, thresholds), nil
+}
+
+// tracksMatchingMood returns the tracks whose audio features match the thresholds, in the order of trackIDs.
+// Tracks without audio features don't match.
+func tracksMatchingMood(trackIDs []spotify.ID, audioFeatures map[spotify.ID]*spotify.AudioFeatures, thresholds AudioFeatureThresholds) []spotify.ID {
+	var matchingTrackIDs []spotify.ID
+	for _, id := range trackIDs {
+		if trackFeatures := audioFeatures[id]; trackFeatures != nil && trackMatchesMood(trackFeatures, thresholds) {
+			matchingTrackIDs = append(matchingTrackIDs, id)
+		}
+	}
+	return matchingTrackIDs
+}
+
+// fetchAudioFeatures gets the audio features of the tracks, by track. Tracks Spotify has no audio features for
+// are nil, and those of batches that failed are left out.
+func fetchAudioFeatures(ctx context.Context, client *spotify.Client, trackIDs []spotify.ID) (map[spotify.ID]*spotify.AudioFeatures, error) {
 	if len(trackIDs) == 0 {
 		return nil, fmt.Errorf("no tracks to analyze")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
-	// Get audio features for tracks in batches of 100 (API limit)
-	var matchingTrackIDs []spotify.ID
-	thresholds := GetMoodThresholds(mood)
-
 	// Try with a small batch first to check if we have access
-	if len(trackIDs) > 0 {
-		testBatch := trackIDs[:min(5, len(trackIDs))]
-		_, testErr := client.GetAudioFeatures(ctx, testBatch...)
-
-		if testErr != nil {
-			// If we get a 403 error, we don't have permission to access audio features
-			return nil, fmt.Errorf("cannot access audio features API: %v", testErr)
-		}
+	testBatch := trackIDs[:min(5, len(trackIDs))]
+	if _, testErr := client.GetAudioFeatures(ctx, testBatch...); testErr != nil {
+		// If we get a 403 error, we don't have permission to access audio features
+		return nil, fmt.Errorf("%w: %v", ErrAudioFeaturesUnavailable, testErr)
 	}
 
-	for i := 0; i < len(trackIDs); i += 100 {
-		end := i + 100
-		if end > len(trackIDs) {
-			end = len(trackIDs)
-		}
+	// Get audio features for tracks in batches of 100 (API limit), each batch keeping its own
+	batches := make([][]*spotify.AudioFeatures, (len(trackIDs)+maxAudioFeaturesPerRequest-1)/maxAudioFeaturesPerRequest)
+	fetchBatch := func(batch int) {
+		start := batch * maxAudioFeaturesPerRequest
+		end := min(start+maxAudioFeaturesPerRequest, len(trackIDs))
 
-		batchIDs := trackIDs[i:end]
-		audioFeatures, err := client.GetAudioFeatures(ctx, batchIDs...)
+		audioFeatures, err := client.GetAudioFeatures(ctx, trackIDs[start:end]...)
 		if err != nil {
-			fmt.Printf("Error getting audio features for batch %d-%d: %v\n", i, end, err)
-			continue
+			fmt.Printf("Error getting audio features for batch %d-%d: %v\n", start, end, err)
+			return
 		}
+		batches[batch] = audioFeatures
+	}
+
+	if features.Concurrency {
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, maxConcurrentAudioFeatureRequests)
+		for batch := range batches {
+			wg.Add(1)
+			go func(batch int) {
+				defer wg.Done()
+				semaphore <- struct{}{}
+				defer func() { <-semaphore }()
+				fetchBatch(batch)
+			}(batch)
+		}
+		wg.Wait()
+	} else {
+		for batch := range batches {
+			fetchBatch(batch)
+		}
+	}
 
-		for j, features := range audioFeatures {
-			if features == nil {
-				continue
-			}
-
-			// Check if the track matches the mood based on audio features
-			if matchesMood(features, thresholds) {
-				matchingTrackIDs = append(matchingTrackIDs, batchIDs[j])
+	audioFeatures := make(map[spotify.ID]*spotify.AudioFeatures, len(trackIDs))
+	for batch, batchFeatures := range batches {
+		start := batch * maxAudioFeaturesPerRequest
+		for j, trackFeatures := range batchFeatures {
+			if start+j < len(trackIDs) {
+				audioFeatures[trackIDs[start+j]] = trackFeatures
 			}
 		}
 	}
-
-	return matchingTrackIDs, nil
+	return audioFeatures, nil
 }
 
-// matchesMood checks if a track's audio features match the mood thresholds
-func matchesMood(features *spotify.AudioFeatures, thresholds AudioFeatureThresholds) bool {
-	// Energy check
-	if thresholds.MinEnergy > 0 && features.Energy < thresholds.MinEnergy {
-		return false
-	}
-	if thresholds.MaxEnergy < 1.0 && features.Energy > thresholds.MaxEnergy {
-		return false
-	}
-
-	// Danceability check
-	if thresholds.MinDanceability > 0 && features.Danceability < thresholds.MinDanceability {
-		return false
-	}
-	if thresholds.MaxDanceability < 1.0 && features.Danceability > thresholds.MaxDanceability {
-		return false
+// minMoodScore is the moodScore a track needs to match a mood with the scoring feature
+const minMoodScore = 0.75
+
+// maxConcurrentAudioFeatureRequests is how many audio features requests are made at a time with the concurrency feature
+const maxConcurrentAudioFeatureRequests = 4
+
+// moodScore returns the weighted fraction of the mood's constrained audio features that are within their bounds.
+// A mood without constraints, such as neutral, gives every track a score of 1.
+func moodScore(features *spotify.AudioFeatures, thresholds AudioFeatureThresholds) float64 {
+	weights := thresholds.Weights
+	checks := []struct {
+		value    float32
+		min, max *float32
+		weight   float64
+	}{
+		{features.Energy, thresholds.MinEnergy, thresholds.MaxEnergy, weights.Energy},
+		{features.Danceability, thresholds.MinDanceability, thresholds.MaxDanceability, weights.Danceability},
+		{features.Valence, thresholds.MinValence, thresholds.MaxValence, weights.Valence},
+		{features.Tempo, thresholds.MinTempo, thresholds.MaxTempo, weights.Tempo},
+		{features.Acousticness, thresholds.MinAcousticness, thresholds.MaxAcousticness, weights.Acousticness},
+		{features.Instrumentalness, thresholds.MinInstrumentalness, thresholds.MaxInstrumentalness, weights.Instrumentalness},
+	}
+
+	constrained, met := 0.0, 0.0
+	for _, check := range checks {
+		if check.min == nil && check.max == nil {
+			continue
+		}
+		constrained += weight(check.weight)
+		if withinBounds(check.value, check.min, check.max) {
+			met += weight(check.weight)
+		}
 	}
 
-	// Valence check (positivity/happiness)
-	if thresholds.MinValence > 0 && features.Valence < thresholds.MinValence {
-		return false
-	}
-	if thresholds.MaxValence < 1.0 && features.Valence > thresholds.MaxValence {
-		return false
+	if constrained == 0 {
+		return 1
 	}
+	return met / constrained
+}
 
-	// Tempo check
-	if thresholds.MinTempo > 0 && features.Tempo < thresholds.MinTempo {
-		return false
-	}
-	if thresholds.MaxTempo < 300 && features.Tempo > thresholds.MaxTempo {
-		return false
-	}
+// matchesMood checks if a track's audio features match the mood thresholds
+func matchesMood(features *spotify.AudioFeatures, thresholds AudioFeatureThresholds) bool {
+	return withinBounds(features.Energy, thresholds.MinEnergy, thresholds.MaxEnergy) &&
+		withinBounds(features.Danceability, thresholds.MinDanceability, thresholds.MaxDanceability) &&
+		// Valence is positivity/happiness
+		withinBounds(features.Valence, thresholds.MinValence, thresholds.MaxValence) &&
+		withinBounds(features.Tempo, thresholds.MinTempo, thresholds.MaxTempo) &&
+		// Acousticness is checked for the sake of variety
+		withinBounds(features.Acousticness, thresholds.MinAcousticness, thresholds.MaxAcousticness) &&
+		withinBounds(features.Instrumentalness, thresholds.MinInstrumentalness, thresholds.MaxInstrumentalness)
+}
 
-	// Acousticness check for the sake of variety
-	if thresholds.MinAcousticness > 0 && features.Acousticness < thresholds.MinAcousticness {
-		return false
-	}
-	if thresholds.MaxAcousticness < 1.0 && features.Acousticness > thresholds.MaxAcousticness {
-		return false
+// trackMatchesMood reports whether a track matches the mood by its audio features,
+// scoring it instead of requiring every bound with the scoring feature
+func trackMatchesMood(trackFeatures *spotify.AudioFeatures, thresholds AudioFeatureThresholds) bool {
+	if features.Scoring {
+		return moodScore(trackFeatures, thresholds) >= minMoodScore
 	}
+	return matchesMood(trackFeatures, thresholds)
+}
 
-	// Instrumentalness check
-	if thresholds.MinInstrumentalness > 0 && features.Instrumentalness < thresholds.MinInstrumentalness {
+// withinBounds reports whether value lies between the bounds, inclusive. Nil bounds are unconstrained.
+func withinBounds(value float32, min, max *float32) bool {
+	if min != nil && value < *min {
 		return false
 	}
-	if thresholds.MaxInstrumentalness < 1.0 && features.Instrumentalness > thresholds.MaxInstrumentalness {
+	if max != nil && value > *max {
 		return false
 	}
-
 	return true
 }
 
@@ -1075,7 +1686,7 @@ func GetMoodBasedPlaylistTracks(client *spotify.Client, mood string) ([]spotify.
 		searchQuery = "mood"
 	}
 
-	results, err := client.Search(ctx, searchQuery, spotify.SearchTypePlaylist, spotify.Limit(5))
+	results, err := client.Search(ctx, searchQuery, spotify.SearchTypePlaylist, spotify.Limit(5), spotify.Market(spotifyMarket("")))
 	if err != nil {
 		return nil, fmt.Errorf("failed to search for mood playlists: %v", err)
 	}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestMatchesMoodZeroIsARealBound(t *testing.T) {
+	thresholds := AudioFeatureThresholds{MaxEnergy: bound(0)}
+
+	if !matchesMood(&spotify.AudioFeatures{Energy: 0}, thresholds) {
+		t.Error("energy 0 should match a max energy of 0")
+	}
+	if matchesMood(&spotify.AudioFeatures{Energy: 0.1}, thresholds) {
+		t.Error("energy 0.1 should not match a max energy of 0")
+	}
+}
+
+func TestMatchesMoodNilIsUnconstrained(t *testing.T) {
+	features := []spotify.AudioFeatures{
+		{},
+		{Energy: 1, Danceability: 1, Valence: 1, Tempo: 400, Acousticness: 1, Instrumentalness: 1},
+	}
+
+	for _, f := range features {
+		if !matchesMood(&f, AudioFeatureThresholds{}) {
+			t.Errorf("%+v should match unconstrained thresholds", f)
+		}
+	}
+}
+
+func TestMatchesMoodBoundsAreInclusive(t *testing.T) {
+	thresholds := AudioFeatureThresholds{MinTempo: bound(100), MaxTempo: bound(120)}
+
+	tests := []struct {
+		tempo float32
+		want  bool
+	}{
+		{99, false},
+		{100, true},
+		{110, true},
+		{120, true},
+		{121, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesMood(&spotify.AudioFeatures{Tempo: tt.tempo}, thresholds); got != tt.want {
+			t.Errorf("tempo %v: matchesMood = %v, want %v", tt.tempo, got, tt.want)
+		}
+	}
+}
+
+func TestGetMoodThresholds(t *testing.T) {
+	upbeat := spotify.AudioFeatures{Energy: 0.9, Danceability: 0.8, Valence: 0.9, Tempo: 128, Acousticness: 0.1}
+	calm := spotify.AudioFeatures{Energy: 0.2, Danceability: 0.3, Valence: 0.4, Tempo: 80, Acousticness: 0.9}
+
+	tests := []struct {
+		mood       string
+		upbeatWant bool
+		calmWant   bool
+	}{
+		{"energetic", true, false},
+		{"relaxed", false, true},
+		{"neutral", true, true},
+		{"unknown", true, true},
+	}
+
+	for _, tt := range tests {
+		thresholds := GetMoodThresholds(tt.mood)
+		if got := matchesMood(&upbeat, thresholds); got != tt.upbeatWant {
+			t.Errorf("%s: upbeat track matches = %v, want %v", tt.mood, got, tt.upbeatWant)
+		}
+		if got := matchesMood(&calm, thresholds); got != tt.calmWant {
+			t.Errorf("%s: calm track matches = %v, want %v", tt.mood, got, tt.calmWant)
+		}
+	}
+}
+
+func TestMoodScore(t *testing.T) {
+	thresholds := AudioFeatureThresholds{MinEnergy: bound(0.5), MaxTempo: bound(120), MinValence: bound(0.5), MaxAcousticness: bound(0.5)}
+
+	tests := []struct {
+		features spotify.AudioFeatures
+		want     float64
+	}{
+		{spotify.AudioFeatures{Energy: 0.6, Tempo: 100, Valence: 0.6, Acousticness: 0.1}, 1},
+		{spotify.AudioFeatures{Energy: 0.6, Tempo: 130, Valence: 0.6, Acousticness: 0.1}, 0.75},
+		{spotify.AudioFeatures{Energy: 0.1, Tempo: 130, Valence: 0.1, Acousticness: 0.9}, 0},
+	}
+
+	for _, tt := range tests {
+		if got := moodScore(&tt.features, thresholds); got != tt.want {
+			t.Errorf("%+v: moodScore = %v, want %v", tt.features, got, tt.want)
+		}
+	}
+
+	if got := moodScore(&spotify.AudioFeatures{}, AudioFeatureThresholds{}); got != 1 {
+		t.Errorf("unconstrained thresholds: moodScore = %v, want 1", got)
+	}
+
+	// Missing the heavily weighted energy costs more than missing the tempo
+	thresholds.Weights = FeatureWeights{Energy: 3}
+	lowEnergy := spotify.AudioFeatures{Energy: 0.1, Tempo: 100, Valence: 0.6, Acousticness: 0.1}
+	if got := moodScore(&lowEnergy, thresholds); got != 0.5 {
+		t.Errorf("low energy: moodScore = %v, want 0.5", got)
+	}
+	fast := spotify.AudioFeatures{Energy: 0.6, Tempo: 130, Valence: 0.6, Acousticness: 0.1}
+	if got := moodScore(&fast, thresholds); got != 5.0/6 {
+		t.Errorf("fast: moodScore = %v, want %v", got, 5.0/6)
+	}
+}
+
+func TestParseMoodWeights(t *testing.T) {
+	weights, err := ParseMoodWeights("energetic: energy=4, tempo=1; Thoughtful:valence=2.5")
+	if err != nil {
+		t.Fatalf("ParseMoodWeights failed: %v", err)
+	}
+	want := map[string]FeatureWeights{
+		"energetic":  {Energy: 4, Tempo: 1},
+		"thoughtful": {Valence: 2.5},
+	}
+	if !reflect.DeepEqual(weights, want) {
+		t.Errorf("ParseMoodWeights = %+v, want %+v", weights, want)
+	}
+
+	for _, value := range []string{"energetic", "sunny:energy=2", "energetic:loudness=2", "energetic:energy=-1", "energetic:energy"} {
+		if _, err := ParseMoodWeights(value); err == nil {
+			t.Errorf("ParseMoodWeights(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestMoodWeightsKeepTheDefaultsOfFeaturesLeftOut(t *testing.T) {
+	got := moodWeights("energetic", map[string]FeatureWeights{"energetic": {Energy: 5, Valence: 2}})
+	want := FeatureWeights{Energy: 5, Danceability: 3, Valence: 2, Tempo: 2}
+	if got != want {
+		t.Errorf("moodWeights = %+v, want %+v", got, want)
+	}
+
+	if got := moodWeights("relaxed", nil); got != defaultMoodWeights["relaxed"] {
+		t.Errorf("moodWeights without overrides = %+v, want the defaults %+v", got, defaultMoodWeights["relaxed"])
+	}
+}
+
+func TestTemperatureIntensity(t *testing.T) {
+	cfg := DefaultRecommenderConfig()
+	cfg.ComfortableTemperature = 20
+	cfg.TemperatureIntensity = 0.3
+
+	tests := []struct {
+		temp float64
+		want float64
+	}{
+		{20, 1},
+		{30, 1.15},
+		{40, 1.3},
+		{50, 1.3},
+		{0, 0.7},
+		{-15, 0.7},
+	}
+	for _, tt := range tests {
+		if got := temperatureIntensity(tt.temp, cfg); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("temperatureIntensity(%v) = %v, want %v", tt.temp, got, tt.want)
+		}
+	}
+
+	// A profile's intensity applies, whatever the global configuration says
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.TemperatureIntensity = 0
+	if got := temperatureIntensity(40, cfg); math.Abs(got-1.3) > 1e-9 {
+		t.Errorf("temperatureIntensity(40) = %v with the global intensity off, want 1.3 from the given config", got)
+	}
+}
+
+func TestLimitSongsPerArtistPrimaryOnly(t *testing.T) {
+	artist := func(id string) spotify.SimpleArtist { return spotify.SimpleArtist{ID: spotify.ID(id)} }
+	track := func(id string, artists ...spotify.SimpleArtist) spotify.FullTrack {
+		return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(id), Artists: artists}}
+	}
+
+	// A featured artist on most tracks, each with a different primary artist
+	tracks := []spotify.FullTrack{
+		track("1", artist("a"), artist("feat")),
+		track("2", artist("b"), artist("feat")),
+		track("3", artist("c"), artist("feat")),
+		track("4", artist("feat")),
+	}
+
+	ids := func(tracks []spotify.FullTrack) []spotify.ID {
+		var ids []spotify.ID
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+		return ids
+	}
+
+	if got := ids(LimitSongsPerArtist(tracks, 2, false)); len(got) != 2 {
+		t.Errorf("counting all artists kept %v, want only 2 tracks of the featured artist", got)
+	}
+	if got := ids(LimitSongsPerArtist(tracks, 2, true)); len(got) != len(tracks) {
+		t.Errorf("counting primary artists kept %v, want all %d tracks", got, len(tracks))
+	}
+
+	// The primary artist is still limited
+	solo := []spotify.FullTrack{
+		track("1", artist("a"), artist("feat")),
+		track("2", artist("a"), artist("other")),
+		track("3", artist("a")),
+	}
+	if got := ids(LimitSongsPerArtist(solo, 2, true)); len(got) != 2 {
+		t.Errorf("counting primary artists kept %v, want 2 tracks of the primary artist", got)
+	}
+}
+
+func TestFitDuration(t *testing.T) {
+	track := func(id string, minutes float64) spotify.FullTrack {
+		return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(id), Duration: spotify.Numeric(minutes * 60000)}}
+	}
+
+	// After 12 minutes, the 25 minute track doesn't fit the 23 left, so the 4 minute ones fill up to 28 and
+	// the 7 minute track that ends the playlist on time is preferred over the 3 minute one before it
+	tracks := []spotify.FullTrack{
+		track("1", 4), track("2", 4), track("3", 4), track("long", 25),
+		track("4", 4), track("5", 4), track("6", 4), track("7", 4), track("short", 3), track("end", 7),
+	}
+
+	fitted := fitDuration(tracks, 35*time.Minute, time.Minute)
+	var total time.Duration
+	for _, track := range fitted {
+		total += track.TimeDuration()
+		if track.ID == "long" || track.ID == "short" {
+			t.Errorf("picked %s, which doesn't fit the time left", track.ID)
+		}
+	}
+	if total < 34*time.Minute || total > 36*time.Minute {
+		t.Errorf("fitted tracks last %s, want 35m ± 1m", total)
+	}
+	if last := fitted[len(fitted)-1].ID; last != "end" {
+		t.Errorf("the last picked track is %s, want the one that ends the playlist on time", last)
+	}
+}
+
+func TestFilterByDuration(t *testing.T) {
+	tracks := []spotify.FullTrack{
+		{SimpleTrack: spotify.SimpleTrack{ID: "skit", Duration: 30000}},
+		{SimpleTrack: spotify.SimpleTrack{ID: "minute", Duration: 60000}},
+		{SimpleTrack: spotify.SimpleTrack{ID: "song", Duration: 210000}},
+		{SimpleTrack: spotify.SimpleTrack{ID: "epic", Duration: 900000}},
+	}
+
+	tests := []struct {
+		name         string
+		minMs, maxMs int
+		want         []spotify.ID
+	}{
+		{"no limits", 0, 0, []spotify.ID{"skit", "minute", "song", "epic"}},
+		{"minimum only, inclusive", 60000, 0, []spotify.ID{"minute", "song", "epic"}},
+		{"maximum only, inclusive", 0, 210000, []spotify.ID{"skit", "minute", "song"}},
+		{"both", 60000, 600000, []spotify.ID{"minute", "song"}},
+		{"nothing fits", 300000, 600000, []spotify.ID{}},
+	}
+
+	for _, tt := range tests {
+		ids := []spotify.ID{}
+		for _, track := range FilterByDuration(tracks, tt.minMs, tt.maxMs) {
+			ids = append(ids, track.ID)
+		}
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("%s: FilterByDuration kept %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestNoMatchesError(t *testing.T) {
+	cfg := DefaultRecommenderConfig()
+	cfg.Stages = []string{StageAudioFeatures, StageGenres}
+	p := &recommendationPipeline{
+		ctx:           context.Background(),
+		mood:          "intense",
+		cfg:           cfg,
+		likedTrackIDs: make([]spotify.ID, 800),
+		stagesRun:     []string{StageAudioFeatures, StageGenres},
+		unavailable:   []string{"audio features"},
+	}
+
+	err := p.noMatchesError()
+	if !errors.Is(err, ErrNoMoodMatches) {
+		t.Fatalf("noMatchesError = %v, want ErrNoMoodMatches", err)
+	}
+	for _, want := range []string{"800 liked songs", "'intense'", "tried audio-features, genres", "audio features were unavailable", "ESTIMATE_FEATURES", StageMoodPlaylists} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("noMatchesError = %q, want it to mention %q", err, want)
+		}
+	}
+}
+
+func TestStratify(t *testing.T) {
+	track := func(id string) spotify.FullTrack {
+		return spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(id)}}
+	}
+	groups := map[string][]spotify.FullTrack{
+		"genre:rock": {track("rock1"), track("rock2"), track("rock3")},
+		"genre:jazz": {track("jazz1")},
+		"artist:a":   {track("a1"), track("a2")},
+	}
+
+	var got []string
+	for _, track := range stratify([]string{"genre:rock", "genre:jazz", "artist:a"}, groups) {
+		got = append(got, track.ID.String())
+	}
+	want := []string{"rock1", "jazz1", "a1", "rock2", "a2", "rock3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("stratify = %v, want %v", got, want)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	track := func(id, artist string) spotify.FullTrack {
+		var track spotify.FullTrack
+		track.ID = spotify.ID(id)
+		track.Artists = []spotify.SimpleArtist{{ID: spotify.ID(artist)}}
+		return track
+	}
+	tracks := []spotify.FullTrack{track("jazz1", "z"), track("rock3", "y"), track("rock2", "x"), track("rock1", "x")}
+	fit := map[spotify.ID]float64{"rock1": 1, "rock2": 0.9, "rock3": 0.8, "jazz1": 0.1}
+	genre := func(track spotify.FullTrack) string { return track.ID.String()[:4] }
+
+	var got []string
+	for _, track := range balance(tracks, fit, genre) {
+		got = append(got, track.ID.String())
+	}
+	// The best fit, then a variety pick of another genre, then the best fit by another artist than that,
+	// and the last by another artist, as no other genre is left
+	want := []string{"rock1", "jazz1", "rock2", "rock3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("balance = %v, want %v", got, want)
+	}
+}
+
+func TestFilterByEnergyReusesTheAudioFeaturesOfTheStages(t *testing.T) {
+	liked := []string{"liked1", "liked2", "liked3"}
+
+	var fetched []string
+	p := newTestPipeline(newFeaturesSpotify(t, &fetched), liked, []string{StageAudioFeatures})
+	p.run()
+
+	fetched = nil
+	if kept := p.filterByEnergy(p.ctx, p.allTracks, 0.95, 1); len(kept) != 0 {
+		t.Errorf("filterByEnergy kept %d tracks under the floor", len(kept))
+	}
+	if len(fetched) > 0 {
+		t.Errorf("filterByEnergy fetched the audio features of %v again", fetched)
+	}
+}
+
+func TestCooldownTracksKeepToTheEnergyBounds(t *testing.T) {
+	liked := []string{"calm1", "calm2", "calm3"}
+
+	// The calm tracks have an energy of 0.2
+	tests := []struct {
+		mood                 string
+		minEnergy, maxEnergy float64
+		want                 int
+	}{
+		{"energetic", 0, 0, 3},
+		{"energetic", 0.5, 0, 0},
+		{"relaxed", 0, 0.3, 3},
+		{"relaxed", 0, 0.1, 0},
+	}
+	for _, tt := range tests {
+		p := newTestPipeline(newInstrumentalSpotify(t, true), liked, nil)
+		p.mood = tt.mood
+		p.cfg.EnergeticMinEnergy = tt.minEnergy
+		p.cfg.RelaxedMaxEnergy = tt.maxEnergy
+
+		if got := len(p.cooldownTracks(nil, 5)); got != tt.want {
+			t.Errorf("%s playlist with energy bounds %.1f and %.1f: cooldown has %d tracks, want %d",
+				tt.mood, tt.minEnergy, tt.maxEnergy, got, tt.want)
+		}
+	}
+}
+
+func TestSmallLibrariesAreRelaxedForCachedCandidates(t *testing.T) {
+	t.Setenv("PREFERENCES_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/me/tracks" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"items": [{"added_at": "2024-01-02T03:04:05Z", "track": {"id": "a"}}], "total": 3}`))
+	}))
+
+	cfg := DefaultRecommenderConfig()
+	cfg.ResultCacheTTL = time.Minute
+	cfg.RecentlyPlayedWeight = 0
+	p := newTestPipeline(client, []string{"a", "b", "c"}, nil)
+	storeCandidates(pipelineCacheKey("energetic", cfg), libraryFingerprint(client), time.Minute, p, p.userLikedSongs)
+
+	err := withCandidatePool("energetic", client, cfg, func(pool *candidatePool) error {
+		if pool.cfg.LibraryOnly {
+			t.Error("the cached candidates of a library of 3 liked songs kept LIBRARY_ONLY")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withCandidatePool returned error: %v", err)
+	}
+}
+
+func TestMinLibrarySizeZeroNeverRelaxes(t *testing.T) {
+	t.Setenv("MIN_LIBRARY_SIZE", "0")
+
+	cfg := LoadRecommenderConfig()
+	if cfg.MinLibrarySize != 0 {
+		t.Fatalf("MIN_LIBRARY_SIZE=0 gave a MinLibrarySize of %d", cfg.MinLibrarySize)
+	}
+	if relaxed := relaxForSmallLibrary(cfg, 0); relaxed.LibraryOnly != cfg.LibraryOnly {
+		t.Error("an empty library was relaxed with MIN_LIBRARY_SIZE=0")
+	}
+}
+
+func TestCheckMoodOfAllStagesSpendsTheCallBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request to %s after the call budget ran out", r.URL)
+	}))
+	t.Cleanup(server.Close)
+	client := spotify.New(&http.Client{Transport: &callBudgetTransport{base: server.Client().Transport}},
+		spotify.WithBaseURL(server.URL+"/"))
+
+	p := newTestPipeline(client, []string{"a", "b"}, nil)
+	p.cfg.MoodCheckAllStages = true
+	p.ctx, _ = withCallBudget(context.Background(), 0)
+	for _, track := range p.userLikedSongs {
+		p.trackStages[track.ID] = StageGenres
+	}
+
+	if kept := p.checkMoodOfAllStages(p.userLikedSongs); len(kept) != 2 {
+		t.Errorf("checkMoodOfAllStages kept %d tracks without audio features, want all 2", len(kept))
+	}
+}
@@ -0,0 +1,1424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// maxArtistsPerRequest is the maximum number of artists GetArtists accepts in a single call
+const maxArtistsPerRequest = 50
+
+// maxTracksPerRequest is the maximum number of tracks GetTracks accepts in a single call
+const maxTracksPerRequest = 50
+
+// maxAudioFeaturesPerRequest is the maximum number of tracks GetAudioFeatures accepts in a single call
+const maxAudioFeaturesPerRequest = 100
+
+// maxDiverseSeedArtists is the most top artists that seed recommendations with diverse seeds
+const maxDiverseSeedArtists = 3
+
+// maxCooldownCandidates is how many liked songs are analyzed when looking for cooldown tracks, one audio features call
+const maxCooldownCandidates = 100
+
+// libraryStage is the provenance of liked songs added regardless of their mood when the mood isn't strict
+const libraryStage = "library"
+
+// genreSeedStage is the provenance of the tracks the genre seed fallback recommends from outside the library
+const genreSeedStage = "genre-seeds"
+
+// cooldownStage is the provenance of the calmer tracks that wind down the end of a playlist.
+// It isn't a stage of its own; the cooldown is added after the stages ran.
+const cooldownStage = "cooldown"
+
+// recommendationPipeline holds the state shared by the stages of GetPersonalizedRecommendations
+type recommendationPipeline struct {
+	ctx    context.Context
+	client *spotify.Client
+	mood   string
+	cfg    RecommenderConfig
+
+	likedTracks  map[string]bool
+	likedAt      map[string]time.Time
+	likedArtists map[string]bool
+	topArtists   []spotify.FullArtist
+	topTracks    []spotify.FullTrack
+	// followedArtists are the artists the user follows, if UseFollowedArtists is set
+	followedArtists []spotify.FullArtist
+	userLikedSongs  []spotify.FullTrack
+	// partialLibrary is set if the details of some liked songs weren't loaded in time
+	partialLibrary bool
+	// playedAt is when the user last played the tracks they played recently, if RecentlyPlayedWeight is set
+	playedAt      map[string]time.Time
+	likedTrackIDs []spotify.ID
+
+	// Genres of the artists fetched so far, and the genres associated with the mood
+	artistGenres map[string][]string
+	moodGenres   map[string]bool
+
+	// audioFeatures are the audio features of the tracks fetched so far, nil for tracks that have none
+	audioFeatures map[spotify.ID]*spotify.AudioFeatures
+
+	// Tracks outside the liked songs that stages have explicitly allowed into the playlist
+	allowedTracks map[string]bool
+
+	// Tracks collected so far and the IDs we've already seen to avoid duplicates
+	allTracks    []spotify.FullTrack
+	seenTrackIDs map[string]bool
+
+	// The stage that added each track
+	trackStages map[spotify.ID]string
+
+	// stagesRun are the stages that ran, in order, and unavailable names the Spotify features, such as audio
+	// features, that failed while they did. They explain an empty playlist.
+	stagesRun   []string
+	unavailable []string
+
+	// outsideLibrary is set when the genre seed fallback filled the playlist from outside the library
+	outsideLibrary bool
+}
+
+// pipelineStage tries to add mood-matching tracks to the pipeline
+type pipelineStage func(p *recommendationPipeline)
+
+// pipelineStages maps each stage name to its implementation
+var pipelineStages = map[string]pipelineStage{
+	StageAudioFeatures:      (*recommendationPipeline).audioFeatureStage,
+	StageGenres:             (*recommendationPipeline).genreStage,
+	StageMoodPlaylists:      (*recommendationPipeline).moodPlaylistStage,
+	StageRecommendations:    (*recommendationPipeline).recommendationStage,
+	StageArtistTopTracks:    (*recommendationPipeline).artistTopTracksStage,
+	StageFollowedPlaylists:  (*recommendationPipeline).followedPlaylistStage,
+	StageEditorialPlaylists: (*recommendationPipeline).editorialPlaylistStage,
+	StageOnRepeat:           (*recommendationPipeline).onRepeatStage,
+	StageNeighbors:          (*recommendationPipeline).neighborStage,
+}
+
+// libraryStages are the stages that only go through the liked songs, which can run at the same time
+var libraryStages = []string{StageAudioFeatures, StageGenres}
+
+// run executes the enabled stages in order until the target size is met. With the concurrency feature, the
+// enabled library stages run first and at the same time, and the other stages only run if they came up short.
+func (p *recommendationPipeline) run() {
+	budget, _ := p.ctx.Value(callBudgetKey{}).(*callBudget)
+
+	stages := p.cfg.Stages
+	if features.Concurrency {
+		var concurrent []string
+		concurrent, stages = splitStages(stages, libraryStages)
+		if len(concurrent) > 1 {
+			p.runConcurrently(concurrent)
+		} else {
+			stages = p.cfg.Stages
+		}
+	}
+
+	for _, name := range stages {
+		if len(p.allTracks) >= p.cfg.TargetSize {
+			break
+		}
+
+		if budget != nil && budget.Exhausted() {
+			fmt.Printf("Spotify call budget of %d calls used up, skipping the remaining stages\n", budget.limit)
+			break
+		}
+		if errors.Is(p.ctx.Err(), context.Canceled) {
+			fmt.Println("Playlist creation cancelled, skipping the remaining stages")
+			break
+		}
+		if errors.Is(p.ctx.Err(), context.DeadlineExceeded) {
+			fmt.Println("Out of time, skipping the remaining stages")
+			break
+		}
+
+		stage, ok := pipelineStages[name]
+		if !ok {
+			fmt.Printf("Warning: skipping unknown stage %q\n", name)
+			continue
+		}
+		before := len(p.allTracks)
+		p.stagesRun = append(p.stagesRun, name)
+		stage(p)
+
+		for _, track := range p.allTracks[before:] {
+			p.trackStages[track.ID] = name
+		}
+	}
+}
+
+// splitStages splits stages into those in group and the rest, keeping their order
+func splitStages(stages, group []string) (in, rest []string) {
+	for _, name := range stages {
+		if slices.Contains(group, name) {
+			in = append(in, name)
+		} else {
+			rest = append(rest, name)
+		}
+	}
+	return in, rest
+}
+
+// runConcurrently runs stages at the same time, each on its own fork of the pipeline so they don't share
+// state, then adds the tracks they found in the order of the stages. Adding them through addCandidate
+// drops the tracks more than one stage found, crediting the first stage.
+func (p *recommendationPipeline) runConcurrently(stages []string) {
+	fmt.Printf("Running stages at the same time: %s\n", strings.Join(stages, ", "))
+
+	forks := make([]*recommendationPipeline, len(stages))
+	var wg sync.WaitGroup
+	for i, name := range stages {
+		fork := p.fork()
+		forks[i] = fork
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pipelineStages[name](fork)
+		}()
+	}
+	wg.Wait()
+
+	for i, name := range stages {
+		fork := forks[i]
+		p.stagesRun = append(p.stagesRun, name)
+		for _, feature := range fork.unavailable {
+			p.markUnavailable(feature)
+		}
+		maps.Copy(p.artistGenres, fork.artistGenres)
+		maps.Copy(p.allowedTracks, fork.allowedTracks)
+		if fork.audioFeatures != nil {
+			if p.audioFeatures == nil {
+				p.audioFeatures = make(map[spotify.ID]*spotify.AudioFeatures, len(fork.audioFeatures))
+			}
+			maps.Copy(p.audioFeatures, fork.audioFeatures)
+		}
+
+		before := len(p.allTracks)
+		for _, track := range fork.allTracks {
+			p.addCandidate(track)
+		}
+		for _, track := range p.allTracks[before:] {
+			p.trackStages[track.ID] = name
+		}
+	}
+}
+
+// fork returns a copy of the pipeline that a stage can run on alongside others. It shares what stages only
+// read, such as the liked songs, and has its own copy of what they change.
+func (p *recommendationPipeline) fork() *recommendationPipeline {
+	fork := *p
+	fork.artistGenres = maps.Clone(p.artistGenres)
+	fork.moodGenres = nil
+	fork.audioFeatures = maps.Clone(p.audioFeatures)
+	fork.allowedTracks = maps.Clone(p.allowedTracks)
+	fork.allTracks = nil
+	fork.seenTrackIDs = maps.Clone(p.seenTrackIDs)
+	fork.trackStages = make(map[spotify.ID]string)
+	fork.stagesRun = nil
+	fork.unavailable = nil
+	return &fork
+}
+
+// addCandidate adds a track unless it was already added or isn't in the user's library,
+// and reports whether it was added. Every stage adds its tracks through here, so the playlist
+// never has duplicates or, unless LibraryOnly is off, tracks from outside the liked songs that
+// no stage explicitly allowed.
+func (p *recommendationPipeline) addCandidate(track spotify.FullTrack) bool {
+	trackID := track.ID.String()
+	if p.seenTrackIDs[trackID] || p.cfg.LibraryOnly && !(p.likedTracks[trackID] || p.allowedTracks[trackID]) {
+		return false
+	}
+
+	p.allTracks = append(p.allTracks, track)
+	p.seenTrackIDs[trackID] = true
+	return true
+}
+
+// allowCandidate adds a track even if it isn't in the user's liked songs, for stages that
+// deliberately look beyond them. It reports whether the track was added.
+func (p *recommendationPipeline) allowCandidate(track spotify.FullTrack) bool {
+	trackID := track.ID.String()
+	if p.seenTrackIDs[trackID] {
+		return false
+	}
+
+	p.allowedTracks[trackID] = true
+	return p.addCandidate(track)
+}
+
+// addLibraryTracks adds all liked songs that weren't added yet, whatever their mood.
+// It isn't a stage; it runs after the stages when the mood isn't strict.
+func (p *recommendationPipeline) addLibraryTracks() {
+	added := 0
+	for _, track := range p.userLikedSongs {
+		if p.addCandidate(track) {
+			p.trackStages[track.ID] = libraryStage
+			added++
+		}
+	}
+	fmt.Printf("Added %d liked songs regardless of the mood\n", added)
+}
+
+// outsideLibraryByMood filters tracks that stages found by loosely mood-related searches.
+// When those tracks can come from outside the library and the mood is strict, they must match the mood by
+// their audio features or genres, as tracks of the liked songs would have to.
+func (p *recommendationPipeline) outsideLibraryByMood(tracks []spotify.FullTrack) []spotify.FullTrack {
+	if p.cfg.LibraryOnly || !p.cfg.MoodStrict {
+		return tracks
+	}
+	return p.filterByMood(tracks)
+}
+
+// audioFeatureStage adds liked songs whose audio features match the mood
+func (p *recommendationPipeline) audioFeatureStage() {
+	fmt.Println("Analyzing audio features of your liked songs to match the mood...")
+
+	// Recent likes say the most about the user's current taste, and are cheaper to analyze than the whole library
+	candidateIDs := p.likedTrackIDs
+	if p.cfg.RecentLikedTracks > 0 {
+		candidateIDs = mostRecentlyLiked(p.likedAt, p.cfg.RecentLikedTracks)
+		fmt.Printf("Analyzing your %d most recently liked songs\n", len(candidateIDs))
+	}
+
+	// Get matching track IDs based on audio features, which the steps after the stages reuse
+	audioFeatures, err := p.trackFeatures(p.ctx, candidateIDs)
+	matchingTrackIDs := tracksMatchingMood(candidateIDs, audioFeatures, p.moodThresholds())
+	if err != nil {
+		fmt.Printf("Warning: Error analyzing audio features: %v\n", err)
+		p.markUnavailable("audio features")
+		if p.cfg.EstimateFeatures {
+			p.estimatedFeatureStage(candidateIDs)
+			return
+		}
+		fmt.Println("Falling back to genre-based and playlist-based mood matching...")
+
+		// Since we can't use audio features, we'll rely more heavily on genre matching
+		// and mood-based playlists to ensure accurate mood matching
+		return
+	}
+
+	fmt.Printf("Found %d tracks that match the '%s' mood based on audio features\n", len(matchingTrackIDs), p.mood)
+
+	// Create a map for quick lookup
+	matchingTrackIDMap := make(map[string]bool)
+	for _, id := range matchingTrackIDs {
+		matchingTrackIDMap[id.String()] = true
+	}
+
+	// Add matching tracks to our collection
+	for _, track := range p.userLikedSongs {
+		if matchingTrackIDMap[track.ID.String()] {
+			p.addCandidate(track)
+		}
+	}
+
+	fmt.Printf("Added %d tracks that match the mood based on audio features\n", len(p.allTracks))
+}
+
+// mostRecentlyLiked returns the IDs of the count most recently liked songs, newest first
+func mostRecentlyLiked(likedAt map[string]time.Time, count int) []spotify.ID {
+	ids := make([]spotify.ID, 0, len(likedAt))
+	for trackID := range likedAt {
+		ids = append(ids, spotify.ID(trackID))
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := likedAt[ids[i].String()], likedAt[ids[j].String()]
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return ids[i] < ids[j]
+	})
+
+	if len(ids) > count {
+		ids = ids[:count]
+	}
+	return ids
+}
+
+// genreStage adds liked songs whose artists' genres match the mood
+func (p *recommendationPipeline) genreStage() {
+	fmt.Println("Using enhanced genre-based filtering to find mood-matching tracks...")
+
+	// Get genres that match the mood, and the chosen genre if there is one
+	moodGenres, personal := p.genreStageGenres()
+	switch {
+	case personal:
+		fmt.Printf("Using %d of your top genres that match the '%s' mood: %s\n", len(moodGenres), p.mood, strings.Join(moodGenres, ", "))
+	case p.cfg.Genre != "":
+		fmt.Printf("Using %d genres associated with the '%s' mood and the '%s' genre\n", len(moodGenres), p.mood, p.cfg.Genre)
+	default:
+		fmt.Printf("Using %d genres associated with the '%s' mood\n", len(moodGenres), p.mood)
+	}
+	genres := make(map[string]bool, len(moodGenres))
+	for _, genre := range moodGenres {
+		genres[strings.ToLower(genre)] = true
+	}
+
+	// Fetch the genres of every artist we might need up front, in batches
+	var candidates []spotify.FullTrack
+	for _, track := range p.userLikedSongs {
+		if !p.seenTrackIDs[track.ID.String()] {
+			candidates = append(candidates, track)
+		}
+	}
+	p.prefetchGenres(candidates)
+
+	// Filter tracks by genre
+	for _, track := range candidates {
+		if p.matchesGenres(track, genres) && p.addCandidate(track) {
+			if len(p.allTracks) >= p.cfg.StageTrackLimit {
+				break
+			}
+		}
+	}
+
+	fmt.Printf("Added %d tracks based on enhanced genre matching\n", len(p.allTracks))
+}
+
+// prefetchGenres fetches the genres of all artists of the given tracks into the pipeline's genre cache
+func (p *recommendationPipeline) prefetchGenres(tracks []spotify.FullTrack) {
+	var artistIDs []spotify.ID
+	for _, track := range tracks {
+		for _, artist := range track.Artists {
+			artistIDs = append(artistIDs, artist.ID)
+		}
+	}
+
+	if err := prefetchArtistGenres(p.ctx, p.client, artistIDs, p.artistGenres); err != nil {
+		fmt.Printf("Warning: Error fetching artist genres: %v\n", err)
+	}
+}
+
+// matchesMoodGenres reports whether any of the track's artists has a genre associated with the mood.
+// Artist genres must have been fetched with prefetchGenres first.
+func (p *recommendationPipeline) matchesMoodGenres(track spotify.FullTrack) bool {
+	if p.moodGenres == nil {
+		// Create a map for quick genre lookup
+		p.moodGenres = make(map[string]bool)
+		for _, genre := range GetMoodGenresForGenre(p.mood, p.cfg.Genre) {
+			p.moodGenres[strings.ToLower(genre)] = true
+		}
+	}
+	return p.matchesGenres(track, p.moodGenres)
+}
+
+// genreStageGenres returns the genres the genre stage looks for. With TopGenreWeight, those are the user's top
+// genres that match the mood's genres, and personal is set; without such top genres they're the mood's genres.
+func (p *recommendationPipeline) genreStageGenres() (genres []string, personal bool) {
+	if p.cfg.TopGenreWeight > 0 && len(p.topArtists) > 0 {
+		for genre := range p.personalMoodGenres() {
+			genres = append(genres, genre)
+		}
+		if len(genres) > 0 {
+			sort.Strings(genres)
+			return genres, true
+		}
+	}
+	return GetMoodGenresForGenre(p.mood, p.cfg.Genre), false
+}
+
+// matchesGenres reports whether any of the track's artists has one of the given lower case genres.
+// Artist genres must have been fetched with prefetchGenres first.
+func (p *recommendationPipeline) matchesGenres(track spotify.FullTrack, genres map[string]bool) bool {
+	for _, artist := range track.Artists {
+		// Check if any of the artist's genres match our mood genres
+		for _, artistGenre := range p.artistGenres[artist.ID.String()] {
+			artistGenreLower := strings.ToLower(artistGenre)
+
+			// Direct match
+			if genres[artistGenreLower] {
+				return true
+			}
+
+			// Partial match, as loose as the configured mode allows
+			for moodGenre := range genres {
+				if genreMatches(artistGenreLower, moodGenre, p.cfg.GenreMatch) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// artistTopTracksStage adds mood-matching top tracks of the artists the user likes,
+// even if the user hasn't liked those tracks themselves
+func (p *recommendationPipeline) artistTopTracksStage() {
+	fmt.Println("Looking for more songs by the artists you like...")
+
+	// Use the artists the user has liked the most songs by
+	artistSongCount := make(map[spotify.ID]int)
+	for _, track := range p.userLikedSongs {
+		for _, artist := range track.Artists {
+			artistSongCount[artist.ID]++
+		}
+	}
+
+	artistIDs := make([]spotify.ID, 0, len(artistSongCount))
+	for artistID := range artistSongCount {
+		artistIDs = append(artistIDs, artistID)
+	}
+	sort.Slice(artistIDs, func(i, j int) bool {
+		return artistSongCount[artistIDs[i]] > artistSongCount[artistIDs[j]]
+	})
+	artistIDs = artistIDs[:min(p.cfg.MaxTopTrackArtists, len(artistIDs))]
+
+	market := spotifyMarket(p.cfg.Market)
+
+	var candidates []spotify.FullTrack
+	for _, artistID := range artistIDs {
+		tracks, err := p.client.GetArtistsTopTracks(p.ctx, artistID, market)
+		if err != nil {
+			continue
+		}
+
+		for _, track := range tracks {
+			if !p.seenTrackIDs[track.ID.String()] {
+				candidates = append(candidates, track)
+			}
+		}
+	}
+
+	fmt.Printf("Found %d top tracks by %d of your artists\n", len(candidates), len(artistIDs))
+
+	matching := p.filterByMood(candidates)
+
+	for _, track := range matching {
+		p.allowCandidate(track)
+	}
+
+	fmt.Printf("Added top tracks by your artists, now have %d tracks\n", len(p.allTracks))
+}
+
+// followedPlaylistStage adds mood-matching tracks from the playlists the user owns or follows,
+// for users who curate their taste in playlists rather than liked songs. Playlists VibeCast created are left out,
+// so its earlier picks don't feed back into new playlists.
+func (p *recommendationPipeline) followedPlaylistStage() {
+	fmt.Println("Looking for songs in the playlists you follow...")
+
+	playlists, err := GetUserPlaylists(p.ctx, p.client, spotify.Limit(p.cfg.MaxFollowedPlaylists))
+	if err != nil {
+		fmt.Printf("Skipping your playlists: %v\n", err)
+		return
+	}
+
+	playlists = slices.DeleteFunc(playlists, IsVibecastPlaylist)
+	p.addPlaylistTracks(playlists)
+	fmt.Printf("Added tracks from your playlists, now have %d tracks\n", len(p.allTracks))
+}
+
+// editorialPlaylistNames are the personalized playlists Spotify makes for every user
+var editorialPlaylistNames = []string{
+	"Discover Weekly",
+	"Release Radar",
+	"Daily Mix",
+	"On Repeat",
+	"Repeat Rewind",
+}
+
+// editorialPlaylistStage adds mood-matching tracks from the personalized playlists Spotify made for the user,
+// such as Discover Weekly and Release Radar, if the user follows them
+func (p *recommendationPipeline) editorialPlaylistStage() {
+	fmt.Println("Looking for songs in your Discover Weekly and other playlists Spotify made for you...")
+
+	// Search all the playlists we can get in one request, as these are easily missed otherwise
+	playlists, err := GetUserPlaylists(p.ctx, p.client, spotify.Limit(50))
+	if err != nil {
+		fmt.Printf("Skipping Spotify's playlists: %v\n", err)
+		return
+	}
+
+	var editorial []spotify.SimplePlaylist
+	for _, playlist := range playlists {
+		if isEditorialPlaylist(playlist) {
+			editorial = append(editorial, playlist)
+		}
+	}
+
+	if len(editorial) == 0 {
+		fmt.Println("You don't follow any of the playlists Spotify made for you, such as Discover Weekly")
+		return
+	}
+
+	p.addPlaylistTracks(editorial)
+	fmt.Printf("Added tracks from Spotify's playlists for you, now have %d tracks\n", len(p.allTracks))
+}
+
+// isEditorialPlaylist reports whether the playlist is one of the personalized playlists Spotify makes
+func isEditorialPlaylist(playlist spotify.SimplePlaylist) bool {
+	if playlist.Owner.ID != "spotify" {
+		return false
+	}
+
+	for _, name := range editorialPlaylistNames {
+		// Daily Mixes are numbered, e.g. "Daily Mix 3"
+		if strings.HasPrefix(playlist.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// onRepeatPlaylistName is the name of the playlist Spotify makes of the tracks a user has played most lately
+const onRepeatPlaylistName = "On Repeat"
+
+// onRepeatStage adds the mood-matching tracks of the user's On Repeat playlist, which reflects what they
+// actually listen to rather than what they once liked. The playlist is only found if the user follows it.
+func (p *recommendationPipeline) onRepeatStage() {
+	fmt.Println("Looking for songs you've had on repeat...")
+
+	playlists, err := GetUserPlaylists(p.ctx, p.client, spotify.Limit(50))
+	if err != nil {
+		fmt.Printf("Skipping your On Repeat playlist: %v\n", err)
+		return
+	}
+
+	for _, playlist := range playlists {
+		if playlist.Owner.ID == "spotify" && playlist.Name == onRepeatPlaylistName {
+			p.addPlaylistTracks([]spotify.SimplePlaylist{playlist})
+			fmt.Printf("Added tracks you've had on repeat, now have %d tracks\n", len(p.allTracks))
+			return
+		}
+	}
+	fmt.Println("You don't follow your On Repeat playlist, so it can't be used")
+}
+
+// preferStage stably moves the tracks the stage added to the front, so they make the playlist first
+func preferStage(tracks []spotify.FullTrack, trackStages map[spotify.ID]string, stage string) {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return trackStages[tracks[i].ID] == stage && trackStages[tracks[j].ID] != stage
+	})
+}
+
+// editorialStages find tracks in playlists curated by others rather than through the user's own taste
+var editorialStages = []string{StageMoodPlaylists, StageEditorialPlaylists}
+
+// capStageShare drops the tracks the stages added beyond share of a playlist of at most size tracks, keeping the
+// first of them. If there aren't enough other tracks to fill size, fewer are kept, so they still make up no more
+// than share of the playlist.
+func capStageShare(tracks []spotify.FullTrack, trackStages map[spotify.ID]string, stages []string, share float64, size int) []spotify.FullTrack {
+	var capped int
+	for _, track := range tracks {
+		if slices.Contains(stages, trackStages[track.ID]) {
+			capped++
+		}
+	}
+	others := len(tracks) - capped
+
+	// The epsilon keeps shares such as 0.3 of 10 from rounding down
+	allowed := int(share*float64(min(size, len(tracks))) + 1e-9)
+	if share < 1 {
+		allowed = min(allowed, int(share*float64(others)/(1-share)+1e-9))
+	}
+	if capped <= allowed {
+		return tracks
+	}
+
+	kept := tracks[:0]
+	for _, track := range tracks {
+		if slices.Contains(stages, trackStages[track.ID]) {
+			if allowed == 0 {
+				continue
+			}
+			allowed--
+		}
+		kept = append(kept, track)
+	}
+	return kept
+}
+
+// cooldownTracks picks up to count liked songs that aren't in the playlist yet and match the relaxed mood,
+// to wind down the end of the playlist. Only a random sample of the library is analyzed to keep it cheap.
+func (p *recommendationPipeline) cooldownTracks(playlist []spotify.FullTrack, count int) []spotify.FullTrack {
+	inPlaylist := make(map[spotify.ID]bool, len(playlist))
+	for _, track := range playlist {
+		inPlaylist[track.ID] = true
+	}
+
+	// The cooldown is picked after the never play list was applied, so it's left out here too
+	never, err := neverPlaySet()
+	if err != nil {
+		fmt.Printf("Warning: couldn't leave the tracks on your never play list out of the cooldown: %v\n", err)
+	}
+
+	candidates := make(map[spotify.ID]spotify.FullTrack)
+	var candidateIDs []spotify.ID
+	for _, i := range rand.Perm(len(p.userLikedSongs)) {
+		if len(candidateIDs) >= maxCooldownCandidates {
+			break
+		}
+
+		track := p.userLikedSongs[i]
+		if inPlaylist[track.ID] || never[track.ID] || (p.cfg.FilterExplicit && track.Explicit) ||
+			((p.cfg.FilterAlternateVersions || p.cfg.StudioOnly) && isAlternateVersion(track.Name, p.cfg.AlternateVersionKeywords)) ||
+			(p.cfg.StudioOnly && isLiveAlbum(track.Album)) {
+			continue
+		}
+		if _, ok := candidates[track.ID]; ok {
+			continue
+		}
+		candidates[track.ID] = track
+		candidateIDs = append(candidateIDs, track.ID)
+	}
+
+	if len(candidateIDs) == 0 {
+		return nil
+	}
+
+	audioFeatures, err := p.trackFeatures(p.ctx, candidateIDs)
+	if err != nil {
+		fmt.Printf("Warning: couldn't find calmer tracks for the cooldown: %v\n", err)
+		return nil
+	}
+	calm := tracksMatchingMood(candidateIDs, audioFeatures, GetMoodThresholds("relaxed"))
+
+	cooldown := make([]spotify.FullTrack, 0, len(calm))
+	for _, id := range calm {
+		cooldown = append(cooldown, candidates[id])
+	}
+
+	// Deep work playlists stay without vocals while they wind down
+	if p.cfg.InstrumentalOnly {
+		cooldown = p.filterInstrumental(p.ctx, cooldown, p.cfg)
+	}
+
+	// The energy bounds hold for the whole playlist, so an energetic playlist with a floor doesn't wind down below it
+	if minEnergy, maxEnergy := energyBounds(p.mood, p.cfg); minEnergy > 0 || maxEnergy < 1 {
+		cooldown = p.filterByEnergy(p.ctx, cooldown, minEnergy, maxEnergy)
+	}
+
+	cooldown = cooldown[:min(count, len(cooldown))]
+	for _, track := range cooldown {
+		p.trackStages[track.ID] = cooldownStage
+	}
+	return cooldown
+}
+
+// trackFeatures returns the audio features of the tracks, by track, only fetching those the pipeline hasn't
+// fetched yet. Tracks without audio features are nil. The stages and the steps after them share what was fetched,
+// so the tracks of the audio-features stage aren't fetched again to rank or balance them.
+func (p *recommendationPipeline) trackFeatures(ctx context.Context, trackIDs []spotify.ID) (map[spotify.ID]*spotify.AudioFeatures, error) {
+	if p.audioFeatures == nil {
+		p.audioFeatures = make(map[spotify.ID]*spotify.AudioFeatures, len(trackIDs))
+	}
+
+	var missing []spotify.ID
+	for _, id := range trackIDs {
+		if _, ok := p.audioFeatures[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		fetched, err := fetchAudioFeatures(ctx, p.client, missing)
+		if err != nil {
+			return p.audioFeatures, err
+		}
+		maps.Copy(p.audioFeatures, fetched)
+	}
+	return p.audioFeatures, nil
+}
+
+// moodFit returns how well the audio features of each track fit the mood, leaving out tracks without them
+func (p *recommendationPipeline) moodFit(tracks []spotify.FullTrack) (map[spotify.ID]float64, error) {
+	ids := make([]spotify.ID, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.ID
+	}
+	audioFeatures, err := p.trackFeatures(p.ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds := p.moodThresholds()
+	fit := make(map[spotify.ID]float64, len(tracks))
+	for _, id := range ids {
+		if trackFeatures := audioFeatures[id]; trackFeatures != nil {
+			fit[id] = moodScore(trackFeatures, thresholds)
+		}
+	}
+	return fit, nil
+}
+
+// rankTracks sorts the tracks best first for the mood, by how well their audio features fit it, their popularity
+// and how recently they were released. Without audio features, the tracks are left in their order.
+func (p *recommendationPipeline) rankTracks(tracks []spotify.FullTrack) {
+	fit, err := p.moodFit(tracks)
+	if err != nil {
+		fmt.Printf("Warning: couldn't rank the tracks, keeping them shuffled: %v\n", err)
+		return
+	}
+
+	sortByRank(tracks, fit, p.likedAt, p.playedAt, p.topGenreFit(tracks), p.cfg)
+	fmt.Printf("Ranked %d tracks by mood fit, popularity and release date\n", len(tracks))
+}
+
+// sortByRank stably sorts the tracks by the weighted blend of their mood fit, popularity, recency, how recently
+// they were liked and their fit with the user's top genres, less how recently they were played, best first.
+// Recency is relative to the tracks: the newest gets 1 and the oldest 0. Tracks without a fit, a release date,
+// a like, a top genre or a recent play get 0 for it.
+func sortByRank(tracks []spotify.FullTrack, fit map[spotify.ID]float64, likedAt, playedAt map[string]time.Time, topGenre map[spotify.ID]float64, cfg RecommenderConfig) {
+	var oldest, newest time.Time
+	for _, track := range tracks {
+		released := track.Album.ReleaseDateTime()
+		if released.IsZero() {
+			continue
+		}
+		if oldest.IsZero() || released.Before(oldest) {
+			oldest = released
+		}
+		if released.After(newest) {
+			newest = released
+		}
+	}
+
+	liked := likedRecency(tracks, likedAt)
+	played := playedRecency(tracks, playedAt, cfg.RecentlyPlayedWindow, time.Now())
+	rank := make(map[spotify.ID]float64, len(tracks))
+	for _, track := range tracks {
+		recency := 0.0
+		if released := track.Album.ReleaseDateTime(); !released.IsZero() {
+			recency = 1
+			if span := newest.Sub(oldest); span > 0 {
+				recency = float64(released.Sub(oldest)) / float64(span)
+			}
+		}
+		rank[track.ID] = cfg.MoodFitWeight*fit[track.ID] +
+			cfg.PopularityWeight*float64(track.Popularity)/100 +
+			cfg.RecencyWeight*recency +
+			cfg.LikedRecencyWeight*liked[track.ID] +
+			cfg.TopGenreWeight*topGenre[track.ID] -
+			cfg.RecentlyPlayedWeight*played[track.ID]
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return rank[tracks[i].ID] > rank[tracks[j].ID]
+	})
+}
+
+// likedRecency returns how recently each of the liked tracks was liked, relative to the tracks: the latest like
+// gets 1 and the earliest 0. Tracks that weren't liked, or whose like has no date, are left out.
+func likedRecency(tracks []spotify.FullTrack, likedAt map[string]time.Time) map[spotify.ID]float64 {
+	var earliest, latest time.Time
+	for _, track := range tracks {
+		added := likedAt[track.ID.String()]
+		if added.IsZero() {
+			continue
+		}
+		if earliest.IsZero() || added.Before(earliest) {
+			earliest = added
+		}
+		if added.After(latest) {
+			latest = added
+		}
+	}
+
+	recency := make(map[spotify.ID]float64, len(tracks))
+	for _, track := range tracks {
+		added := likedAt[track.ID.String()]
+		if added.IsZero() {
+			continue
+		}
+		recency[track.ID] = 1
+		if span := latest.Sub(earliest); span > 0 {
+			recency[track.ID] = float64(added.Sub(earliest)) / float64(span)
+		}
+	}
+	return recency
+}
+
+// playedRecency returns how recently each of the played tracks was played within window: one played at now
+// gets 1, falling to 0 at the start of the window. Tracks that weren't played within it are left out.
+func playedRecency(tracks []spotify.FullTrack, playedAt map[string]time.Time, window time.Duration, now time.Time) map[spotify.ID]float64 {
+	recency := make(map[spotify.ID]float64)
+	for _, track := range tracks {
+		played := playedAt[track.ID.String()]
+		if played.IsZero() || window <= 0 {
+			continue
+		}
+		if age := now.Sub(played); age < window {
+			recency[track.ID] = 1 - math.Max(float64(age), 0)/float64(window)
+		}
+	}
+	return recency
+}
+
+// favorFreshTracks reorders shuffled tracks at random, making recently liked tracks and those in the user's top
+// genres more likely to come first and recently played ones less likely: a track liked last is
+// 1+LikedRecencyWeight times as likely to be picked first as one liked earliest or not at all, one in the top
+// genre 1+TopGenreWeight times as likely, and one played just now 1-RecentlyPlayedWeight times as likely
+func favorFreshTracks(tracks []spotify.FullTrack, likedAt, playedAt map[string]time.Time, topGenre map[spotify.ID]float64, cfg RecommenderConfig) {
+	liked := likedRecency(tracks, likedAt)
+	played := playedRecency(tracks, playedAt, cfg.RecentlyPlayedWindow, time.Now())
+
+	// Weighted random sampling without replacement: sorting by U^(1/w) picks each track with a chance
+	// proportional to its weight w. A weight of 0 puts the track last.
+	keys := make(map[spotify.ID]float64, len(tracks))
+	for _, track := range tracks {
+		weight := (1 + cfg.LikedRecencyWeight*liked[track.ID]) * (1 + cfg.TopGenreWeight*topGenre[track.ID]) *
+			(1 - cfg.RecentlyPlayedWeight*played[track.ID])
+		keys[track.ID] = math.Pow(rand.Float64(), 1/weight)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return keys[tracks[i].ID] > keys[tracks[j].ID]
+	})
+}
+
+// addPlaylistTracks adds the mood-matching tracks of the playlists, even if the user hasn't liked them
+func (p *recommendationPipeline) addPlaylistTracks(playlists []spotify.SimplePlaylist) {
+	var candidates []spotify.FullTrack
+	candidateIDs := make(map[string]bool)
+	for _, playlist := range playlists {
+		items, err := p.client.GetPlaylistItems(p.ctx, playlist.ID, spotify.Limit(100))
+		if err != nil {
+			continue
+		}
+
+		for _, item := range items.Items {
+			track := item.Track.Track
+			if track == nil || item.IsLocal {
+				continue // Episodes and local files can't be added
+			}
+
+			trackID := track.ID.String()
+			if !p.seenTrackIDs[trackID] && !candidateIDs[trackID] {
+				candidateIDs[trackID] = true
+				candidates = append(candidates, *track)
+			}
+		}
+	}
+
+	fmt.Printf("Found %d tracks in %d playlists\n", len(candidates), len(playlists))
+
+	for _, track := range p.filterByMood(candidates) {
+		p.allowCandidate(track)
+	}
+}
+
+// filterByMood keeps the tracks that match the mood, using audio features when available and artist genres otherwise
+func (p *recommendationPipeline) filterByMood(tracks []spotify.FullTrack) []spotify.FullTrack {
+	if len(tracks) == 0 {
+		return nil
+	}
+	if !p.cfg.MoodStrict {
+		return tracks
+	}
+
+	trackIDs := make([]spotify.ID, len(tracks))
+	for i, track := range tracks {
+		trackIDs[i] = track.ID
+	}
+
+	var matching []spotify.FullTrack
+
+	matchingTrackIDs, err := analyzeAudioFeaturesForMood(p.ctx, p.client, trackIDs, p.moodThresholds())
+	if err == nil {
+		matchingTrackIDMap := make(map[spotify.ID]bool)
+		for _, id := range matchingTrackIDs {
+			matchingTrackIDMap[id] = true
+		}
+
+		for _, track := range tracks {
+			if matchingTrackIDMap[track.ID] {
+				matching = append(matching, track)
+			}
+		}
+		return matching
+	}
+
+	// Without audio features, fall back to the artists' genres
+	p.prefetchGenres(tracks)
+	for _, track := range tracks {
+		if p.matchesMoodGenres(track) {
+			matching = append(matching, track)
+		}
+	}
+	return matching
+}
+
+// shuffled returns a shuffled copy of values
+func shuffled[T any](values []T) []T {
+	shuffled := append([]T(nil), values...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// getTracksInBatches gets the full tracks in as few GetTracks calls as possible.
+// Batches that fail and tracks Spotify doesn't know are left out.
+func getTracksInBatches(ctx context.Context, client *spotify.Client, ids []spotify.ID, opts ...spotify.RequestOption) []spotify.FullTrack {
+	var fullTracks []spotify.FullTrack
+	for start := 0; start < len(ids); start += maxTracksPerRequest {
+		tracks, err := client.GetTracks(ctx, ids[start:min(start+maxTracksPerRequest, len(ids))], opts...)
+		if err != nil {
+			continue
+		}
+		for _, track := range tracks {
+			if track != nil {
+				fullTracks = append(fullTracks, *track)
+			}
+		}
+	}
+	return fullTracks
+}
+
+// spotifyMarket returns the market for market-aware Spotify calls: the given market, the configured market,
+// the country of the logged in user or else the market of the access token, in that order
+func spotifyMarket(market string) string {
+	switch {
+	case market != "":
+		return market
+	case recommenderConfig.Market != "":
+		return recommenderConfig.Market
+	case authenticatedUserCountry != "":
+		return authenticatedUserCountry
+	default:
+		return spotify.MarketFromToken
+	}
+}
+
+// libraryTracks returns the liked songs together with the tracks stages have explicitly allowed
+func (p *recommendationPipeline) libraryTracks() map[string]bool {
+	if len(p.allowedTracks) == 0 {
+		return p.likedTracks
+	}
+
+	library := make(map[string]bool, len(p.likedTracks)+len(p.allowedTracks))
+	for trackID := range p.likedTracks {
+		library[trackID] = true
+	}
+	for trackID := range p.allowedTracks {
+		library[trackID] = true
+	}
+	return library
+}
+
+// prefetchArtistGenres fetches the genres of all uncached artists in batches and stores them in the cache
+func prefetchArtistGenres(ctx context.Context, client *spotify.Client, artistIDs []spotify.ID, cache map[string][]string) error {
+	// Collect the artists we don't know the genres of yet
+	var uncached []spotify.ID
+	queued := make(map[string]bool)
+	for _, id := range artistIDs {
+		artistID := id.String()
+		if _, ok := cache[artistID]; ok {
+			artistGenreCacheCounters.hits.Add(1)
+			continue
+		}
+		if queued[artistID] {
+			continue
+		}
+		queued[artistID] = true
+		uncached = append(uncached, id)
+	}
+	artistGenreCacheCounters.misses.Add(int64(len(uncached)))
+
+	if len(uncached) == 0 {
+		return nil
+	}
+	defer func() { artistGenreCacheCounters.entries.Store(int64(len(cache))) }()
+
+	fmt.Printf("Fetching genres for %d artists...\n", len(uncached))
+
+	// Get artists in batches of 50 (API limit)
+	var lastErr error
+	for i := 0; i < len(uncached); i += maxArtistsPerRequest {
+		end := min(i+maxArtistsPerRequest, len(uncached))
+
+		artists, err := client.GetArtists(ctx, uncached[i:end]...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, artist := range artists {
+			if artist != nil {
+				cache[artist.ID.String()] = artist.Genres
+			}
+		}
+	}
+
+	return lastErr
+}
+
+// moodPlaylistStage adds liked songs that appear in popular mood-based playlists
+func (p *recommendationPipeline) moodPlaylistStage() {
+	fmt.Println("Looking for tracks in popular mood-based playlists...")
+
+	// Try to get tracks from multiple mood-based playlists
+	var moodPlaylistTracks []spotify.FullTrack
+
+	// Try different search queries for the mood
+	searchQueries := getMoodPlaylistSearchQueries(p.mood)
+
+	for _, query := range searchQueries {
+		if len(moodPlaylistTracks) >= p.cfg.MoodPlaylistTrackBudget {
+			break
+		}
+
+		fmt.Printf("Searching for '%s' playlists...\n", query)
+
+		results, err := p.client.Search(p.ctx, query, spotify.SearchTypePlaylist, spotify.Limit(p.cfg.MoodPlaylistSearchLimit), spotify.Market(spotifyMarket(p.cfg.Market)))
+		if err != nil || results == nil || results.Playlists == nil || len(results.Playlists.Playlists) == 0 {
+			continue
+		}
+
+		// Get tracks from each playlist
+		for _, playlist := range results.Playlists.Playlists {
+			if len(moodPlaylistTracks) >= p.cfg.MoodPlaylistTrackBudget {
+				break
+			}
+
+			fmt.Printf("Checking playlist: %s\n", playlist.Name)
+
+			playlistTracks, err := p.client.GetPlaylistItems(p.ctx, playlist.ID)
+			if err != nil {
+				continue
+			}
+
+			// Extract full tracks
+			for _, item := range playlistTracks.Items {
+				if item.Track.Track != nil {
+					// Convert PlaylistTrack to FullTrack
+					track := item.Track.Track
+					moodPlaylistTracks = append(moodPlaylistTracks, *track)
+				}
+			}
+		}
+	}
+
+	fmt.Printf("Found %d tracks from mood-based playlists\n", len(moodPlaylistTracks))
+
+	// Filter to only include tracks in the user's library
+	for _, track := range p.outsideLibraryByMood(moodPlaylistTracks) {
+		if p.addCandidate(track) {
+			if len(p.allTracks) >= p.cfg.StageTrackLimit {
+				break
+			}
+		}
+	}
+
+	fmt.Printf("Added tracks from mood-based playlists, now have %d tracks\n", len(p.allTracks))
+}
+
+// recommendationStage adds liked songs returned by Spotify recommendations seeded from the user's taste
+func (p *recommendationPipeline) recommendationStage() {
+	fmt.Println("Using Spotify recommendations to find more tracks...")
+
+	// Create seed artists and tracks
+	var seedArtists []spotify.ID
+	var seedTracks []spotify.ID
+
+	// A chosen genre always gets a seed, so the other seeds leave room for it
+	maxSeeds := 5
+	if p.cfg.Genre != "" {
+		maxSeeds--
+	}
+
+	// Seed tracks picked for this playlist, such as the currently playing track, come first
+	for _, trackID := range p.cfg.SeedTracks[:min(maxSeeds, len(p.cfg.SeedTracks))] {
+		seedTracks = append(seedTracks, trackID)
+		fmt.Printf("Using track as seed: %s\n", trackID)
+	}
+
+	// The top 2 artists and first top tracks are tried as seeds, or with diverse seeds a random sample of all of them
+	topArtists, topTracks := p.topArtists[:min(2, len(p.topArtists))], p.topTracks
+	maxSeedArtists := 2
+	if p.cfg.DiverseSeeds {
+		topArtists, topTracks = shuffled(p.topArtists), shuffled(p.topTracks)
+		maxSeedArtists = maxDiverseSeedArtists
+	}
+
+	// Prioritize artists that are in the user's liked artists
+	for _, artist := range topArtists {
+		if len(seedArtists) >= maxSeedArtists || len(seedArtists)+len(seedTracks) >= maxSeeds {
+			break
+		}
+		if p.likedArtists[artist.ID.String()] {
+			seedArtists = append(seedArtists, artist.ID)
+			fmt.Printf("Using top artist as seed: %s (in your liked artists)\n", artist.Name)
+		} else if !p.cfg.RequireLikedSeedArtists {
+			// The results are still filtered to liked songs, so any top artist makes a reasonable seed
+			seedArtists = append(seedArtists, artist.ID)
+			fmt.Printf("Using top artist as seed: %s (not in your liked artists)\n", artist.Name)
+		}
+	}
+
+	// Followed artists take the artist seeds the top artists leave, such as for users without listening history
+	for _, artist := range shuffled(p.followedArtists) {
+		if len(seedArtists) >= maxSeedArtists || len(seedArtists)+len(seedTracks) >= maxSeeds {
+			break
+		}
+		if !slices.Contains(seedArtists, artist.ID) {
+			seedArtists = append(seedArtists, artist.ID)
+			fmt.Printf("Using followed artist as seed: %s\n", artist.Name)
+		}
+	}
+
+	// Add some top tracks if we have room
+	if room := maxSeeds - len(seedArtists) - len(seedTracks); len(topTracks) > 0 && room > 0 {
+		if !p.cfg.DiverseSeeds {
+			topTracks = topTracks[:min(room, len(topTracks))]
+		}
+		for _, track := range topTracks {
+			if len(seedArtists)+len(seedTracks) >= maxSeeds {
+				break
+			}
+			// Only use tracks that are in the user's liked songs
+			if p.likedTracks[track.ID.String()] {
+				seedTracks = append(seedTracks, track.ID)
+				fmt.Printf("Using top track as seed: %s by %s (in your liked songs)\n", track.Name, firstArtistName(track))
+			}
+		}
+	}
+
+	attrs := p.moodAttributes()
+
+	// Create seeds
+	seeds := spotify.Seeds{
+		Artists: seedArtists,
+		Tracks:  seedTracks,
+	}
+
+	// Add genre seeds if we have room (max 5 seeds total)
+	if room := 5 - len(seedArtists) - len(seedTracks); room > 0 {
+		seeds.Genres = p.genreSeeds(room)
+	}
+	if len(seeds.Artists)+len(seeds.Tracks)+len(seeds.Genres) == 0 {
+		fmt.Println("No valid seeds for recommendations, skipping them")
+		return
+	}
+
+	// Get recommendations
+	fmt.Printf("Getting recommendations with %d artist seeds, %d track seeds, and %d genre seeds\n",
+		len(seeds.Artists), len(seeds.Tracks), len(seeds.Genres))
+
+	recommendations, err := p.client.GetRecommendations(
+		p.ctx,
+		seeds,
+		attrs,
+		spotify.Limit(p.cfg.RecommendationLimit), // Request more tracks to have enough after filtering
+		spotify.Market(spotifyMarket(p.cfg.Market)),
+	)
+
+	if err == nil && recommendations != nil && len(recommendations.Tracks) > 0 {
+		fmt.Printf("Found %d initial recommendations\n", len(recommendations.Tracks))
+
+		// Get the IDs of the recommended tracks
+		recTrackIDs := make([]spotify.ID, 0, len(recommendations.Tracks))
+		for _, track := range recommendations.Tracks {
+			recTrackIDs = append(recTrackIDs, track.ID)
+		}
+
+		fullTracks := getTracksInBatches(p.ctx, p.client, recTrackIDs, spotify.Market(spotifyMarket(p.cfg.Market)))
+
+		// Add these tracks to our collection
+		for _, track := range p.outsideLibraryByMood(fullTracks) {
+			p.addCandidate(track)
+		}
+		fmt.Printf("Added %d tracks from personalized recommendations (only those in your liked songs)\n", len(p.allTracks))
+	} else if err != nil {
+		fmt.Printf("Warning: couldn't get recommendations: %v\n", err)
+		p.markUnavailable("recommendations")
+	}
+}
+
+// moodGenreSeeds returns the genre seeds that steer recommendations towards a mood
+func moodGenreSeeds(mood string) []string {
+	switch mood {
+	case "energetic":
+		return []string{"pop", "dance", "edm", "party", "house"}
+	case "relaxed":
+		return []string{"chill", "acoustic", "ambient", "jazz", "lofi"}
+	case "intense":
+		return []string{"rock", "metal", "punk", "hard-rock", "alt-rock"}
+	case "thoughtful":
+		return []string{"indie", "folk", "classical", "singer-songwriter", "ambient"}
+	default:
+		return []string{"pop", "indie", "alternative", "rock", "electronic"}
+	}
+}
+
+// genreSeeds returns up to room genre seeds for the mood, with the chosen genre first in place of the last mood
+// genre. Seeds Spotify doesn't know are dropped, as it rejects the whole request for a single unknown one.
+func (p *recommendationPipeline) genreSeeds(room int) []string {
+	// With diverse seeds, any of the mood's genres can make the cut rather than always the first ones
+	genres := moodGenreSeeds(p.mood)
+	if p.cfg.DiverseSeeds {
+		genres = shuffled(genres)
+	}
+	genres = genres[:min(room, len(genres))]
+
+	if genre := p.cfg.Genre; genre != "" {
+		chosen := []string{genre}
+		for _, g := range genres {
+			if g != genre && len(chosen) < room {
+				chosen = append(chosen, g)
+			}
+		}
+		genres = chosen
+	}
+
+	available, err := AvailableGenreSeeds(p.client)
+	if err != nil {
+		fmt.Printf("Warning: couldn't check the genre seeds, using them unchecked: %v\n", err)
+		return genres
+	}
+	genres, dropped := filterGenreSeeds(genres, available)
+	if len(dropped) > 0 {
+		fmt.Printf("Dropped genre seeds Spotify doesn't know: %s\n", strings.Join(dropped, ", "))
+	}
+	return genres
+}
+
+// genreSeedFallback is the last resort for a library too niche for the mood: when nothing else was found, it
+// adds the tracks Spotify recommends for the mood's genres and attributes alone. They're from outside the
+// library, so they're allowed in whatever LibraryOnly says, and the playlist says so.
+func (p *recommendationPipeline) genreSeedFallback() {
+	fmt.Println("None of your songs match the mood, falling back to recommendations from outside your library...")
+	p.stagesRun = append(p.stagesRun, genreSeedStage)
+
+	genres := p.genreSeeds(maxRecommendationSeeds)
+	if len(genres) == 0 {
+		fmt.Println("No valid genre seeds for the mood, skipping the fallback")
+		return
+	}
+
+	market := spotify.Market(spotifyMarket(p.cfg.Market))
+	recommendations, err := p.client.GetRecommendations(p.ctx, spotify.Seeds{Genres: genres}, p.moodAttributes(),
+		spotify.Limit(p.cfg.RecommendationLimit), market)
+	if err != nil {
+		fmt.Printf("Warning: couldn't get recommendations for the fallback: %v\n", err)
+		p.markUnavailable("recommendations")
+		return
+	}
+
+	ids := make([]spotify.ID, len(recommendations.Tracks))
+	for i, track := range recommendations.Tracks {
+		ids[i] = track.ID
+	}
+	for _, track := range getTracksInBatches(p.ctx, p.client, ids, market) {
+		if p.allowCandidate(track) {
+			p.trackStages[track.ID] = genreSeedStage
+			p.outsideLibrary = true
+		}
+	}
+	fmt.Printf("Added %d recommendations for %s from outside your library\n", len(p.allTracks), strings.Join(genres, ", "))
+}
+
+// markUnavailable notes that a Spotify feature failed, once
+func (p *recommendationPipeline) markUnavailable(feature string) {
+	if !slices.Contains(p.unavailable, feature) {
+		p.unavailable = append(p.unavailable, feature)
+	}
+}
+
+// moodAttributes returns the recommendation attributes for the mood, with more energy in a heatwave and less in a freeze
+func (p *recommendationPipeline) moodAttributes() *spotify.TrackAttributes {
+	intensity := 1.0
+	if p.cfg.Temperature != nil {
+		intensity = temperatureIntensity(*p.cfg.Temperature, p.cfg)
+		if intensity != 1 {
+			fmt.Printf("Scaling the energy of recommendations by %.2f for %.0f°C\n", intensity, *p.cfg.Temperature)
+		}
+	}
+	return moodTrackAttributes(p.mood, intensity)
+}
+
+// maxRecommendationSeeds is the most seeds Spotify accepts for a single recommendations request
+const maxRecommendationSeeds = 5
+
+// neighborStage adds the tracks Spotify recommends for the liked songs that match the mood best, asking for
+// audio features close to theirs. Like the recommendations stage, only liked songs are kept unless LibraryOnly is off.
+func (p *recommendationPipeline) neighborStage() {
+	fmt.Println("Looking for neighbors of the songs that match the mood best...")
+
+	candidateIDs := p.likedTrackIDs
+	if p.cfg.RecentLikedTracks > 0 {
+		candidateIDs = mostRecentlyLiked(p.likedAt, p.cfg.RecentLikedTracks)
+	}
+
+	best, err := p.bestMoodMatches(candidateIDs, p.cfg.NeighborSeedTracks)
+	if err != nil {
+		fmt.Printf("Skipping neighbors: %v\n", err)
+		return
+	}
+	if len(best) == 0 {
+		fmt.Println("None of your liked songs match the mood, so there are no neighbors to look for")
+		return
+	}
+
+	market := spotifyMarket(p.cfg.Market)
+	for start := 0; start < len(best); start += maxRecommendationSeeds {
+		group := best[start:min(start+maxRecommendationSeeds, len(best))]
+		seedIDs := make([]spotify.ID, len(group))
+		for i, trackFeatures := range group {
+			seedIDs[i] = trackFeatures.ID
+		}
+
+		recommendations, err := p.client.GetRecommendations(p.ctx, spotify.Seeds{Tracks: seedIDs},
+			neighborAttributes(p.moodAttributes(), group), spotify.Limit(p.cfg.RecommendationLimit), spotify.Market(market))
+		if err != nil || recommendations == nil {
+			fmt.Printf("Warning: couldn't get neighbors of %d tracks: %v\n", len(group), err)
+			continue
+		}
+
+		recTrackIDs := make([]spotify.ID, 0, len(recommendations.Tracks))
+		for _, track := range recommendations.Tracks {
+			recTrackIDs = append(recTrackIDs, track.ID)
+		}
+		for _, track := range p.outsideLibraryByMood(getTracksInBatches(p.ctx, p.client, recTrackIDs, spotify.Market(market))) {
+			p.addCandidate(track)
+		}
+	}
+
+	fmt.Printf("Added neighbors of your %d best matches, now have %d tracks\n", len(best), len(p.allTracks))
+}
+
+// bestMoodMatches returns the audio features of up to count of the tracks that match the mood, best first.
+// Equally good matches keep the order of trackIDs.
+func (p *recommendationPipeline) bestMoodMatches(trackIDs []spotify.ID, count int) ([]*spotify.AudioFeatures, error) {
+	// The audio-features stage has usually fetched the audio features of the liked songs already
+	audioFeatures, err := p.trackFeatures(p.ctx, trackIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	thresholds := p.moodThresholds()
+	var matching []*spotify.AudioFeatures
+	for _, id := range trackIDs {
+		if trackFeatures := audioFeatures[id]; trackFeatures != nil && trackMatchesMood(trackFeatures, thresholds) {
+			matching = append(matching, trackFeatures)
+		}
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		return moodScore(matching[i], thresholds) > moodScore(matching[j], thresholds)
+	})
+	return matching[:min(count, len(matching))], nil
+}
+
+// neighborAttributes narrows the mood's attributes by targeting the average audio features of the seed tracks
+func neighborAttributes(attrs *spotify.TrackAttributes, seeds []*spotify.AudioFeatures) *spotify.TrackAttributes {
+	var energy, valence, danceability, tempo float64
+	for _, trackFeatures := range seeds {
+		energy += float64(trackFeatures.Energy)
+		valence += float64(trackFeatures.Valence)
+		danceability += float64(trackFeatures.Danceability)
+		tempo += float64(trackFeatures.Tempo)
+	}
+
+	n := float64(len(seeds))
+	return attrs.TargetEnergy(energy / n).TargetValence(valence / n).TargetDanceability(danceability / n).TargetTempo(tempo / n)
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// newTestClient returns a Spotify client that sends all requests to the given handler
+func newTestClient(t *testing.T, handler http.Handler) *spotify.Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return spotify.New(server.Client(), spotify.WithBaseURL(server.URL+"/"))
+}
+
+func TestPrefetchArtistGenresBatchesRequests(t *testing.T) {
+	var mu sync.Mutex
+	var batchSizes []int
+
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/artists" {
+			http.NotFound(w, r)
+			return
+		}
+
+		ids := strings.Split(r.URL.Query().Get("ids"), ",")
+		mu.Lock()
+		batchSizes = append(batchSizes, len(ids))
+		mu.Unlock()
+
+		artists := make([]spotify.FullArtist, 0, len(ids))
+		for _, id := range ids {
+			artist := spotify.FullArtist{Genres: []string{"genre-" + id}}
+			artist.ID = spotify.ID(id)
+			artists = append(artists, artist)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"artists": artists})
+	}))
+
+	// 120 artists, with a duplicate and one that's already cached
+	var artistIDs []spotify.ID
+	for i := 0; i < 120; i++ {
+		artistIDs = append(artistIDs, spotify.ID(fmt.Sprintf("artist%d", i)))
+	}
+	artistIDs = append(artistIDs, "artist0")
+
+	cache := map[string][]string{"artist1": {"cached"}}
+
+	if err := prefetchArtistGenres(context.Background(), client, artistIDs, cache); err != nil {
+		t.Fatalf("prefetchArtistGenres returned error: %v", err)
+	}
+
+	wantSizes := []int{50, 50, 19}
+	if fmt.Sprint(batchSizes) != fmt.Sprint(wantSizes) {
+		t.Fatalf("batch sizes = %v, want %v", batchSizes, wantSizes)
+	}
+
+	if len(cache) != 120 {
+		t.Fatalf("cache has %d artists, want 120", len(cache))
+	}
+	if got := cache["artist1"]; len(got) != 1 || got[0] != "cached" {
+		t.Errorf("cached artist was refetched: %v", got)
+	}
+	if got := cache["artist119"]; len(got) != 1 || got[0] != "genre-artist119" {
+		t.Errorf("artist119 genres = %v, want [genre-artist119]", got)
+	}
+}
+
+func TestPrefetchArtistGenresSkipsFullyCached(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL)
+	}))
+
+	cache := map[string][]string{"a": {"rock"}, "b": nil}
+	if err := prefetchArtistGenres(context.Background(), client, []spotify.ID{"a", "b"}, cache); err != nil {
+		t.Fatalf("prefetchArtistGenres returned error: %v", err)
+	}
+}
+
+// fakeTrack returns the JSON of a full track by a single artist
+func fakeTrack(id string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      id,
+		"name":    "Track " + id,
+		"type":    "track",
+		"artists": []map[string]interface{}{{"id": "artist-" + id, "name": "Artist " + id}},
+	}
+}
+
+// newFakeSpotify returns a client for a fake Spotify API where every endpoint a stage uses
+// returns both the given liked tracks and tracks the user hasn't liked
+func newFakeSpotify(t *testing.T, liked []string) *spotify.Client {
+	t.Helper()
+
+	unliked := []string{"unliked1", "unliked2", "unliked3"}
+	all := append(append([]string{}, liked...), unliked...)
+
+	tracksJSON := func(ids []string) []map[string]interface{} {
+		tracks := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			tracks = append(tracks, fakeTrack(id))
+		}
+		return tracks
+	}
+
+	return newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body interface{}
+
+		switch path := r.URL.Path; {
+		case path == "/audio-features":
+			// Every track sounds energetic
+			var features []map[string]interface{}
+			for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+				features = append(features, map[string]interface{}{
+					"id": id, "energy": 0.9, "danceability": 0.8, "valence": 0.9, "tempo": 128, "acousticness": 0.1,
+				})
+			}
+			body = map[string]interface{}{"audio_features": features}
+		case path == "/artists":
+			var artists []map[string]interface{}
+			for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+				artists = append(artists, map[string]interface{}{"id": id, "genres": []string{"dance pop"}})
+			}
+			body = map[string]interface{}{"artists": artists}
+		case path == "/search":
+			body = map[string]interface{}{"playlists": map[string]interface{}{
+				"items": []map[string]interface{}{{"id": "moodlist", "name": "Mood List"}},
+			}}
+		case path == "/me/playlists":
+			body = map[string]interface{}{"items": []map[string]interface{}{
+				{"id": "mine", "name": "Discover Weekly", "owner": map[string]interface{}{"id": "spotify"}},
+			}}
+		case strings.HasPrefix(path, "/playlists/"):
+			var items []map[string]interface{}
+			for _, track := range tracksJSON(all) {
+				items = append(items, map[string]interface{}{"track": track})
+			}
+			body = map[string]interface{}{"items": items}
+		case path == "/recommendations":
+			body = map[string]interface{}{"tracks": tracksJSON(all)}
+		case path == "/tracks":
+			body = map[string]interface{}{"tracks": tracksJSON(strings.Split(r.URL.Query().Get("ids"), ","))}
+		case strings.HasSuffix(path, "/top-tracks"):
+			body = map[string]interface{}{"tracks": tracksJSON(all)}
+		case path == "/me/tracks/contains":
+			isLiked := make(map[string]bool)
+			for _, id := range liked {
+				isLiked[id] = true
+			}
+			var contains []bool
+			for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+				contains = append(contains, isLiked[id])
+			}
+			body = contains
+		case path == "/me":
+			body = map[string]interface{}{"id": "user", "country": "NL"}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+// newTestPipeline returns a pipeline for the energetic mood over the given liked tracks
+func newTestPipeline(client *spotify.Client, liked []string, stages []string) *recommendationPipeline {
+	cfg := DefaultRecommenderConfig()
+	cfg.Stages = stages
+	cfg.TargetSize = 1000
+
+	p := &recommendationPipeline{
+		ctx:           context.Background(),
+		client:        client,
+		mood:          "energetic",
+		cfg:           cfg,
+		likedTracks:   make(map[string]bool),
+		likedArtists:  make(map[string]bool),
+		artistGenres:  make(map[string][]string),
+		allowedTracks: make(map[string]bool),
+		seenTrackIDs:  make(map[string]bool),
+		trackStages:   make(map[spotify.ID]string),
+	}
+
+	for _, id := range liked {
+		p.likedTracks[id] = true
+		p.likedTrackIDs = append(p.likedTrackIDs, spotify.ID(id))
+
+		var track spotify.FullTrack
+		track.ID = spotify.ID(id)
+		track.Artists = []spotify.SimpleArtist{{ID: spotify.ID("artist-" + id)}}
+		p.userLikedSongs = append(p.userLikedSongs, track)
+	}
+
+	return p
+}
+
+func TestPipelineOnlyAddsLikedTracks(t *testing.T) {
+	liked := []string{"liked1", "liked2", "liked3", "liked4"}
+
+	// Each stage runs on its own, so every stage gets the chance to add the unliked tracks
+	stages := []string{StageAudioFeatures, StageGenres, StageMoodPlaylists, StageRecommendations}
+	for _, stage := range stages {
+		t.Run(stage, func(t *testing.T) {
+			p := newTestPipeline(newFakeSpotify(t, liked), liked, []string{stage})
+			p.run()
+
+			if len(p.allTracks) == 0 {
+				t.Fatalf("stage added no tracks")
+			}
+
+			seen := make(map[spotify.ID]bool)
+			for _, track := range p.allTracks {
+				if !p.likedTracks[track.ID.String()] {
+					t.Errorf("stage added %s, which isn't a liked song", track.ID)
+				}
+				if seen[track.ID] {
+					t.Errorf("stage added %s twice", track.ID)
+				}
+				seen[track.ID] = true
+			}
+		})
+	}
+}
+
+func TestPipelineRunsLibraryStagesConcurrently(t *testing.T) {
+	saved := features
+	defer func() { features = saved }()
+	features.Concurrency = true
+
+	liked := []string{"liked1", "liked2", "liked3", "liked4"}
+	p := newTestPipeline(newFakeSpotify(t, liked), liked, []string{StageAudioFeatures, StageMoodPlaylists, StageGenres})
+	p.run()
+
+	if len(p.allTracks) == 0 {
+		t.Fatalf("stages added no tracks")
+	}
+	seen := make(map[spotify.ID]bool)
+	for _, track := range p.allTracks {
+		if seen[track.ID] {
+			t.Errorf("stages added %s twice", track.ID)
+		}
+		seen[track.ID] = true
+		if p.trackStages[track.ID] == "" {
+			t.Errorf("%s has no stage", track.ID)
+		}
+	}
+
+	// The library stages run first, and the mood playlists only if they came up short
+	if want := []string{StageAudioFeatures, StageGenres, StageMoodPlaylists}; !slices.Equal(p.stagesRun, want) {
+		t.Errorf("stages ran as %v, want %v", p.stagesRun, want)
+	}
+}
+
+func TestPipelineKeepsTracksInLibrary(t *testing.T) {
+	liked := []string{"liked1", "liked2"}
+	p := newTestPipeline(newFakeSpotify(t, liked), liked, []string{
+		StageAudioFeatures, StageGenres, StageMoodPlaylists, StageRecommendations,
+		StageArtistTopTracks, StageFollowedPlaylists, StageEditorialPlaylists, StageOnRepeat, StageNeighbors,
+	})
+	p.run()
+
+	// Only these stages may look beyond the liked songs
+	allowing := map[string]bool{
+		StageArtistTopTracks:    true,
+		StageFollowedPlaylists:  true,
+		StageEditorialPlaylists: true,
+		StageOnRepeat:           true,
+	}
+
+	library := p.libraryTracks()
+	seen := make(map[spotify.ID]bool)
+	for _, track := range p.allTracks {
+		if !library[track.ID.String()] {
+			t.Errorf("%s was added by %s without being liked or allowed", track.ID, p.trackStages[track.ID])
+		}
+		if !p.likedTracks[track.ID.String()] && !allowing[p.trackStages[track.ID]] {
+			t.Errorf("%s isn't liked but was added by %s", track.ID, p.trackStages[track.ID])
+		}
+		if seen[track.ID] {
+			t.Errorf("%s was added twice", track.ID)
+		}
+		seen[track.ID] = true
+	}
+
+	// Every stage after the first finds nothing new, so the unliked tracks come from the artist stage
+	for _, id := range []spotify.ID{"unliked1", "unliked2", "unliked3"} {
+		if got := p.trackStages[id]; got != StageArtistTopTracks {
+			t.Errorf("%s was added by %q, want %q", id, got, StageArtistTopTracks)
+		}
+	}
+}
+
+func TestPipelineLibraryAndMoodStrictness(t *testing.T) {
+	liked := []string{"liked1", "liked2"}
+
+	tests := []struct {
+		name        string
+		libraryOnly bool
+		moodStrict  bool
+		mood        string
+		wantUnliked bool
+	}{
+		{"library only", true, true, "energetic", false},
+		{"any library, matching mood", false, true, "energetic", true},
+		// Every fake track sounds energetic, so none of them is relaxed
+		{"any library, other mood", false, true, "relaxed", false},
+		{"any library, any mood", false, false, "relaxed", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPipeline(newFakeSpotify(t, liked), liked, []string{StageRecommendations})
+			p.mood = tt.mood
+			p.cfg.LibraryOnly = tt.libraryOnly
+			p.cfg.MoodStrict = tt.moodStrict
+			p.run()
+
+			if got := p.seenTrackIDs["unliked1"]; got != tt.wantUnliked {
+				t.Errorf("unliked track added = %v, want %v", got, tt.wantUnliked)
+			}
+		})
+	}
+}
+
+func TestAddLibraryTracksIgnoresMood(t *testing.T) {
+	liked := []string{"liked1", "liked2", "liked3"}
+	p := newTestPipeline(newFakeSpotify(t, liked), liked, nil)
+	p.cfg.MoodStrict = false
+	p.addLibraryTracks()
+
+	if len(p.allTracks) != len(liked) {
+		t.Fatalf("added %d tracks, want all %d liked songs", len(p.allTracks), len(liked))
+	}
+	for _, track := range p.allTracks {
+		if got := p.trackStages[track.ID]; got != libraryStage {
+			t.Errorf("%s was added by %q, want %q", track.ID, got, libraryStage)
+		}
+	}
+}
+
+func TestMostRecentlyLiked(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	likedAt := map[string]time.Time{
+		"old":    day(1),
+		"newest": day(20),
+		"middle": day(10),
+		"newer":  day(15),
+	}
+
+	got := mostRecentlyLiked(likedAt, 3)
+	want := []spotify.ID{"newest", "newer", "middle"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mostRecentlyLiked = %v, want %v", got, want)
+	}
+
+	if got := mostRecentlyLiked(likedAt, 10); len(got) != len(likedAt) {
+		t.Errorf("asking for more than liked returned %d tracks, want %d", len(got), len(likedAt))
+	}
+}
+
+func TestSortByRank(t *testing.T) {
+	track := func(id string, popularity int, released string) spotify.FullTrack {
+		var track spotify.FullTrack
+		track.ID = spotify.ID(id)
+		track.Popularity = spotify.Numeric(popularity)
+		track.Album.ReleaseDate = released
+		track.Album.ReleaseDatePrecision = "day"
+		return track
+	}
+
+	tracks := []spotify.FullTrack{
+		track("popular", 100, "2000-01-01"),
+		track("fitting", 0, "2000-01-01"),
+		track("recent", 0, "2020-01-01"),
+	}
+	fit := map[spotify.ID]float64{"fitting": 1}
+
+	cfg := DefaultRecommenderConfig()
+	sortByRank(tracks, fit, nil, nil, nil, cfg)
+
+	var got []spotify.ID
+	for _, track := range tracks {
+		got = append(got, track.ID)
+	}
+	want := []spotify.ID{"fitting", "popular", "recent"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortByRank with the default weights = %v, want %v", got, want)
+	}
+
+	cfg.MoodFitWeight, cfg.PopularityWeight, cfg.RecencyWeight = 0, 0, 1
+	sortByRank(tracks, fit, nil, nil, nil, cfg)
+	if tracks[0].ID != "recent" {
+		t.Errorf("sortByRank weighing only recency put %s first, want recent", tracks[0].ID)
+	}
+
+	likedAt := map[string]time.Time{
+		"popular": time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"fitting": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cfg.RecencyWeight, cfg.LikedRecencyWeight = 0, 1
+	sortByRank(tracks, fit, likedAt, nil, nil, cfg)
+	if tracks[0].ID != "popular" {
+		t.Errorf("sortByRank weighing only when tracks were liked put %s first, want popular", tracks[0].ID)
+	}
+
+	// Having just played the popular track holds it back
+	playedAt := map[string]time.Time{"popular": time.Now().Add(-time.Hour)}
+	cfg.LikedRecencyWeight, cfg.RecentlyPlayedWeight = 0, 1
+	sortByRank(tracks, fit, likedAt, playedAt, nil, cfg)
+	if last := tracks[len(tracks)-1].ID; last != "popular" {
+		t.Errorf("sortByRank holding back recent plays put %s last, want popular", last)
+	}
+
+	// So does favoring the user's top genres, in which only the recent track is
+	topGenre := map[spotify.ID]float64{"recent": 1}
+	cfg.RecentlyPlayedWeight, cfg.TopGenreWeight = 0, 1
+	sortByRank(tracks, fit, nil, nil, topGenre, cfg)
+	if tracks[0].ID != "recent" {
+		t.Errorf("sortByRank weighing only top genres put %s first, want recent", tracks[0].ID)
+	}
+}
+
+// newFeaturesSpotify returns a client for a fake Spotify API of energetic audio features and dance pop artists,
+// which records the IDs of the tracks whose audio features are fetched in fetched
+func newFeaturesSpotify(t *testing.T, fetched *[]string) *spotify.Client {
+	t.Helper()
+
+	var mu sync.Mutex
+	return newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids := strings.Split(r.URL.Query().Get("ids"), ",")
+		switch r.URL.Path {
+		case "/audio-features":
+			var features []map[string]interface{}
+			mu.Lock()
+			*fetched = append(*fetched, ids...)
+			for _, id := range ids {
+				features = append(features, map[string]interface{}{
+					"id": id, "energy": 0.9, "danceability": 0.8, "valence": 0.9, "tempo": 128, "acousticness": 0.1,
+				})
+			}
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"audio_features": features})
+		case "/artists":
+			var artists []map[string]interface{}
+			for _, id := range ids {
+				artists = append(artists, map[string]interface{}{"id": id, "genres": []string{"dance pop"}})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"artists": artists})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRankingAndBalancingReuseTheAudioFeaturesOfTheStage(t *testing.T) {
+	liked := []string{"liked1", "liked2", "liked3", "liked4"}
+
+	var fetched []string
+	p := newTestPipeline(newFeaturesSpotify(t, &fetched), liked, []string{StageAudioFeatures})
+	p.cfg.Order = OrderBalanced
+	p.run()
+	if len(p.allTracks) != len(liked) {
+		t.Fatalf("the stage added %d tracks, want %d", len(p.allTracks), len(liked))
+	}
+
+	fetched = nil
+	p.rankTracks(p.allTracks)
+	p.orderTracks(p.allTracks)
+	if len(fetched) > 0 {
+		t.Errorf("ranking and balancing fetched the audio features of %v again", fetched)
+	}
+}
+
+func TestBestMoodMatchesReuseTheAudioFeaturesOfTheStage(t *testing.T) {
+	liked := []string{"liked1", "liked2", "liked3", "liked4"}
+
+	var fetched []string
+	p := newTestPipeline(newFeaturesSpotify(t, &fetched), liked, []string{StageAudioFeatures})
+	p.run()
+
+	fetched = nil
+	best, err := p.bestMoodMatches(p.likedTrackIDs, 2)
+	if err != nil {
+		t.Fatalf("bestMoodMatches returned error: %v", err)
+	}
+	if len(best) != 2 {
+		t.Errorf("bestMoodMatches returned %d tracks, want 2", len(best))
+	}
+	if len(fetched) > 0 {
+		t.Errorf("bestMoodMatches fetched the audio features of %v again", fetched)
+	}
+}
+
+func TestGenreSeedFallbackAddsTracksOutsideLibrary(t *testing.T) {
+	p := newTestPipeline(newFakeSpotify(t, nil), nil, nil)
+	p.genreSeedFallback()
+
+	if len(p.allTracks) == 0 {
+		t.Fatal("fallback added no tracks")
+	}
+	if !p.outsideLibrary {
+		t.Error("fallback didn't mark the tracks as outside the library")
+	}
+	for _, track := range p.allTracks {
+		if p.trackStages[track.ID] != genreSeedStage {
+			t.Errorf("%s has stage %q, want %q", track.ID, p.trackStages[track.ID], genreSeedStage)
+		}
+	}
+}
+
+func TestCapStageShare(t *testing.T) {
+	var tracks []spotify.FullTrack
+	trackStages := make(map[spotify.ID]string)
+	for i := range 10 {
+		var track spotify.FullTrack
+		track.ID = spotify.ID(fmt.Sprint("mood", i))
+		trackStages[track.ID] = StageMoodPlaylists
+		tracks = append(tracks, track)
+	}
+	for i := range 10 {
+		var track spotify.FullTrack
+		track.ID = spotify.ID(fmt.Sprint("liked", i))
+		trackStages[track.ID] = StageGenres
+		tracks = append(tracks, track)
+	}
+
+	count := func(tracks []spotify.FullTrack) int {
+		var n int
+		for _, track := range tracks {
+			if trackStages[track.ID] == StageMoodPlaylists {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Of a 10 track playlist, 3 may come from mood playlists, the first ones
+	capped := capStageShare(slices.Clone(tracks), trackStages, editorialStages, 0.3, 10)
+	if n := count(capped); n != 3 {
+		t.Errorf("capStageShare kept %d mood playlist tracks, want 3", n)
+	}
+	if capped[2].ID != "mood2" || capped[3].ID != "liked0" {
+		t.Errorf("capStageShare kept %v, want the first mood playlist tracks", capped[:4])
+	}
+
+	// With only 2 other tracks, at most 1 can come from mood playlists to stay under a third
+	capped = capStageShare(slices.Clone(tracks[:12]), trackStages, editorialStages, 1.0/3, 10)
+	if n := count(capped); n != 1 {
+		t.Errorf("capStageShare with few other tracks kept %d mood playlist tracks, want 1", n)
+	}
+
+	if capped := capStageShare(slices.Clone(tracks), trackStages, editorialStages, 1, 10); len(capped) != len(tracks) {
+		t.Errorf("capStageShare with a share of 1 dropped %d tracks", len(tracks)-len(capped))
+	}
+}
+
+func TestPipelineStopsWhenOutOfTime(t *testing.T) {
+	liked := []string{"liked1", "liked2"}
+	p := newTestPipeline(newFakeSpotify(t, liked), liked, []string{StageAudioFeatures, StageGenres})
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	p.ctx = ctx
+	p.run()
+
+	if len(p.stagesRun) != 0 {
+		t.Errorf("ran %v after the deadline, want no stages", p.stagesRun)
+	}
+}
+
+func TestFinishContextOutlivesTheRun(t *testing.T) {
+	runCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, budget := withCallBudget(runCtx, 10)
+
+	ctx, cancelFinish := finishContext(context.Background(), budget)
+	defer cancelFinish()
+	if ctx.Err() != nil {
+		t.Errorf("finish context is done after the run ran out of time: %v", ctx.Err())
+	}
+	if got, _ := ctx.Value(callBudgetKey{}).(*callBudget); got != budget {
+		t.Error("finish context doesn't spend the run's call budget")
+	}
+
+	creationCtx, cancelCreation := context.WithCancel(context.Background())
+	ctx, cancelFinish = finishContext(creationCtx, budget)
+	defer cancelFinish()
+	cancelCreation()
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Errorf("finish context err = %v after cancelling the creation, want context.Canceled", ctx.Err())
+	}
+}
+
+func TestBatchPastItsDeadlineStartsNoPlaylists(t *testing.T) {
+	results := createBatchPlaylists([]string{"Oslo", "Bergen"}, PlaylistOptions{Deadline: time.Now().Add(-time.Second)})
+	for _, result := range results {
+		if result.Playlist != nil || !strings.Contains(result.Error, ErrOutOfTime.Error()) {
+			t.Errorf("result for %s = %+v, want an out of time error", result.City, result)
+		}
+	}
+}
+
+func TestApplyPipelineReportFlagsPartialPlaylists(t *testing.T) {
+	result := &PlaylistResult{}
+	applyPipelineReport(result, &pipelineReport{Partial: true, StagesRun: []string{StageOnRepeat, StageAudioFeatures}})
+
+	if !result.Partial {
+		t.Error("playlist made after running out of time isn't flagged as partial")
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], StageAudioFeatures) {
+		t.Errorf("warnings = %q, want one naming the stages that ran", result.Warnings)
+	}
+
+	result = &PlaylistResult{}
+	applyPipelineReport(result, &pipelineReport{StagesRun: []string{StageOnRepeat}})
+	if result.Partial || len(result.Warnings) != 0 {
+		t.Errorf("complete run gave partial = %t and warnings %q", result.Partial, result.Warnings)
+	}
+}
+
+func TestLoadLikedSongsReportsRunningOutOfTime(t *testing.T) {
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items": [], "total": 0}`))
+	}))
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := loadLikedSongs(ctx, client, recommenderConfig); !errors.Is(err, ErrOutOfTime) {
+		t.Errorf("loading liked songs past the deadline returned %v, want ErrOutOfTime", err)
+	}
+}
+
+func TestCandidatePoolPicksDifferentTracklists(t *testing.T) {
+	var liked []string
+	for i := 0; i < 12; i++ {
+		liked = append(liked, fmt.Sprintf("liked%d", i))
+	}
+	p := newTestPipeline(nil, liked, nil)
+	p.cfg.PlaylistSize = 4
+	p.cfg.CooldownTracks = 0
+	ctx, budget := withCallBudget(context.Background(), p.cfg.CallBudget)
+
+	pool := &candidatePool{p: p, tracks: slices.Clone(p.userLikedSongs), mood: p.mood, cfg: p.cfg, ctx: ctx, budget: budget, creationCtx: context.Background()}
+	picked := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		tracks, _ := pool.pick()
+		if len(tracks) != 4 {
+			t.Fatalf("picked %d tracks, want 4", len(tracks))
+		}
+		picked[variantKey(tracks)] = true
+	}
+
+	if len(picked) < 2 {
+		t.Error("every pick from the pool was the same tracklist")
+	}
+	if !slices.EqualFunc(pool.tracks, p.userLikedSongs, func(a, b spotify.FullTrack) bool { return a.ID == b.ID }) {
+		t.Error("picking reordered the candidates of the pool")
+	}
+}
+
+func TestVariantKeyIgnoresTheOrder(t *testing.T) {
+	p := newTestPipeline(nil, []string{"a", "b", "c"}, nil)
+	reordered := []spotify.FullTrack{p.userLikedSongs[2], p.userLikedSongs[0], p.userLikedSongs[1]}
+
+	if variantKey(reordered) != variantKey(p.userLikedSongs) {
+		t.Error("the same tracks in another order got another variant key")
+	}
+	if variantKey(p.userLikedSongs[:2]) == variantKey(p.userLikedSongs) {
+		t.Error("different tracks got the same variant key")
+	}
+}
+
+func TestDiverseGenreSeedsComeFromAllMoodGenres(t *testing.T) {
+	// Without a client or cached seeds, the genre seeds are used unchecked
+	seeds := genreSeedCache.seeds
+	genreSeedCache.seeds = nil
+	t.Cleanup(func() { genreSeedCache.seeds = seeds })
+
+	p := newTestPipeline(nil, nil, nil)
+	p.mood = "energetic"
+	if got := p.genreSeeds(2); !slices.Equal(got, []string{"pop", "dance"}) {
+		t.Errorf("genreSeeds(2) = %v, want the first two genres of the mood", got)
+	}
+
+	p.cfg.DiverseSeeds = true
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		for _, genre := range p.genreSeeds(2) {
+			seen[genre] = true
+		}
+	}
+	if len(seen) <= 2 {
+		t.Errorf("diverse genre seeds only ever used %v", seen)
+	}
+}
+
+func TestTopItemsLimit(t *testing.T) {
+	cfg, err := applyLimits(DefaultRecommenderConfig(), map[string]int{"topItems": 8, "diverseTopItems": 40})
+	if err != nil {
+		t.Fatalf("applyLimits returned error: %v", err)
+	}
+	if got := topItemsLimit(cfg); got != 8 {
+		t.Errorf("topItemsLimit = %d, want 8", got)
+	}
+	cfg.DiverseSeeds = true
+	if got := topItemsLimit(cfg); got != 40 {
+		t.Errorf("topItemsLimit with diverse seeds = %d, want 40", got)
+	}
+	if _, err := applyLimits(cfg, map[string]int{"topItems": 51}); err == nil {
+		t.Error("applyLimits accepted 51 top items, more than Spotify returns")
+	}
+}
+
+func TestIsVibecastPlaylist(t *testing.T) {
+	tests := []struct {
+		description string
+		want        bool
+	}{
+		{"Sunny day vibes " + playlistMarker, true},
+		{"An older one [vibecast v0]", true},
+		{"Made by hand", false},
+		{"Not really [vibecast]", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsVibecastPlaylist(spotify.SimplePlaylist{Description: tt.description}); got != tt.want {
+			t.Errorf("IsVibecastPlaylist(%q) = %v, want %v", tt.description, got, tt.want)
+		}
+	}
+}
+
+func TestFollowedPlaylistStageLeavesOutVibecastPlaylists(t *testing.T) {
+	var mu sync.Mutex
+	var read []string
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case path == "/me/playlists":
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []map[string]interface{}{
+				{"id": "mine", "name": "Road Trip", "description": "Songs for the car"},
+				{"id": "made", "name": "VibeCast Sunny", "description": "Weather mood playlist " + playlistMarker},
+			}})
+		case strings.HasPrefix(path, "/playlists/"):
+			mu.Lock()
+			read = append(read, strings.Split(path, "/")[2])
+			mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": []interface{}{}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	p := newTestPipeline(client, nil, []string{StageFollowedPlaylists})
+	p.followedPlaylistStage()
+
+	if !slices.Equal(read, []string{"mine"}) {
+		t.Errorf("read the tracks of %v, want only the playlist VibeCast didn't create", read)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// Plan statuses
+const (
+	PlanCreated = "created"
+	PlanFailed  = "failed"
+)
+
+// PlaylistPlan is the record of how a playlist was made, written to disk for auditing and debugging
+type PlaylistPlan struct {
+	// ID names the plan's file, and is what a failed plan is resumed by
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Status is PlanCreated, or PlanFailed for a playlist whose tracks were picked but that couldn't be created
+	// or filled. Plans written before there were statuses were all created.
+	Status string `json:"status,omitempty"`
+	// Description is the description the playlist is created with, should a failed plan be resumed before the
+	// playlist was
+	Description string `json:"description,omitempty"`
+	// Error is why the playlist failed
+	Error string `json:"error,omitempty"`
+	// Playlist is the created playlist, including its mood, weather, tracks, the stage that found each
+	// track and any warnings
+	Playlist *PlaylistResult `json:"playlist"`
+	// Config is the configuration the playlist was made with
+	Config RecommenderConfig `json:"config"`
+}
+
+// WritePlaylistPlan writes the plan of a created playlist to a new JSON file in dir, creating dir if needed
+func WritePlaylistPlan(result *PlaylistResult, dir string) error {
+	if result == nil {
+		return fmt.Errorf("no playlist to write a plan for")
+	}
+
+	return writePlan(&PlaylistPlan{
+		CreatedAt: time.Now(),
+		Status:    PlanCreated,
+		Playlist:  result,
+		Config:    result.config,
+	}, dir)
+}
+
+// writePlan writes the plan to its file in dir, naming it first if it's new
+func writePlan(plan *PlaylistPlan, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create plan directory: %v", err)
+	}
+	if plan.ID != "" {
+		return writePlanFile(plan, dir, os.O_TRUNC)
+	}
+
+	// Timestamped names keep every plan, including those of regenerated playlists. New plans are only written to
+	// files that don't exist yet, numbering the name on, so plans named in the same second don't replace each other,
+	// such as the unsaved plans of failed playlists.
+	playlistID := string(plan.Playlist.ID)
+	if playlistID == "" {
+		playlistID = "unsaved"
+	}
+	name := fmt.Sprintf("%s-%s", plan.CreatedAt.Format("20060102-150405"), playlistID)
+	for n := 1; ; n++ {
+		plan.ID = name
+		if n > 1 {
+			plan.ID = fmt.Sprintf("%s-%d", name, n)
+		}
+		if err := writePlanFile(plan, dir, os.O_EXCL); !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+}
+
+// writePlanFile writes the plan to its file in dir, opened with flag on top of creating it for writing
+func writePlanFile(plan *PlaylistPlan, dir string, flag int) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode playlist plan: %v", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, plan.ID+".json"), os.O_WRONLY|os.O_CREATE|flag, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write playlist plan: %w", err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write playlist plan: %v", err)
+	}
+	return nil
+}
+
+// savePlaylistPlan writes the plan of a playlist to PLAN_DIR, if it's set.
+// A plan that can't be written doesn't fail the playlist.
+func savePlaylistPlan(result *PlaylistResult) {
+	dir := os.Getenv("PLAN_DIR")
+	if dir == "" {
+		return
+	}
+
+	if err := WritePlaylistPlan(result, dir); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// ErrPlanNotFound is returned when resuming a plan that doesn't exist
+var ErrPlanNotFound = errors.New("playlist plan not found")
+
+// errPlanNotResumable is returned when resuming a plan whose playlist didn't fail
+var errPlanNotResumable = errors.New("the playlist of this plan was created already")
+
+// planIDPattern matches the IDs plans are written with, so resuming can't read files outside PLAN_DIR
+var planIDPattern = regexp.MustCompile(`^\d{8}-\d{6}-[A-Za-z0-9]+(-\d+)?$`)
+
+// resumeStepTimeout bounds each step of resuming a plan: creating its playlist, checking its tracks and adding them
+const resumeStepTimeout = 30 * time.Second
+
+// resumable saves the plan of a playlist that failed after its tracks were picked, so it can be resumed
+// without running the recommendation pipeline again, and adds how to resume it to err.
+// Without PLAN_DIR, or if the plan can't be written, err is returned as is.
+func resumable(result *PlaylistResult, description string, err error) error {
+	dir := os.Getenv("PLAN_DIR")
+	if dir == "" {
+		return err
+	}
+
+	plan := &PlaylistPlan{
+		CreatedAt:   time.Now(),
+		Status:      PlanFailed,
+		Description: description,
+		Error:       err.Error(),
+		Playlist:    result,
+		Config:      result.config,
+	}
+	if writeErr := writePlan(plan, dir); writeErr != nil {
+		fmt.Printf("Warning: %v\n", writeErr)
+		return err
+	}
+	return fmt.Errorf("%w (the tracks were saved: POST /resume?planId=%s to try again)", err, plan.ID)
+}
+
+// readPlan reads the plan with the given ID from dir
+func readPlan(dir, planID string) (*PlaylistPlan, error) {
+	if !planIDPattern.MatchString(planID) {
+		return nil, fmt.Errorf("%w: %q", ErrPlanNotFound, planID)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, planID+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrPlanNotFound, planID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var plan PlaylistPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("invalid playlist plan %s: %v", planID, err)
+	}
+	if plan.Playlist == nil {
+		return nil, fmt.Errorf("playlist plan %s has no playlist", planID)
+	}
+	plan.ID = planID
+	return &plan, nil
+}
+
+// ResumePlaylistPlan finishes the playlist of a failed plan from its saved tracks: it creates the playlist if
+// that's where it failed, and adds the tracks that aren't in it yet. The plan is updated with how far it got.
+func ResumePlaylistPlan(client *spotify.Client, planID string) (*PlaylistResult, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+	dir := os.Getenv("PLAN_DIR")
+	if dir == "" {
+		return nil, fmt.Errorf("%w: PLAN_DIR isn't set", ErrPlanNotFound)
+	}
+
+	plan, err := readPlan(dir, planID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Status != PlanFailed {
+		return nil, errPlanNotResumable
+	}
+	result := plan.Playlist
+
+	fail := func(err error) (*PlaylistResult, error) {
+		plan.Error = err.Error()
+		if writeErr := writePlan(plan, dir); writeErr != nil {
+			fmt.Printf("Warning: %v\n", writeErr)
+		}
+		return nil, err
+	}
+
+	trackIDs := make([]spotify.ID, len(result.Tracks))
+	for i, track := range result.Tracks {
+		trackIDs[i] = track.ID
+	}
+	missing := trackIDs
+	existing := 0
+
+	// Each step gets its own time, so a long playlist doesn't leave the adding without any
+	if result.ID == "" {
+		playlist, err := createPlanPlaylist(client, plan)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("Created personalized playlist: %s (ID: %s)\n", playlist.Name, playlist.ID)
+		result.ID = playlist.ID
+		result.URL = playlist.ExternalURLs["spotify"]
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), resumeStepTimeout)
+		missing, existing, err = missingPlaylistTracks(ctx, client, result.ID, trackIDs)
+		cancel()
+		if err != nil {
+			return fail(fmt.Errorf("failed to check the playlist's tracks: %w", err))
+		}
+	}
+
+	// The playlist may have been added to since the plan failed, so the missing tracks must still fit
+	if missing, err = capPlaylistTracks(existing, missing); err != nil {
+		return fail(err)
+	}
+
+	if len(missing) > 0 {
+		fmt.Printf("Adding the %d tracks of plan %s that aren't in the playlist yet\n", len(missing), planID)
+		ctx, cancel := context.WithTimeout(context.Background(), resumeStepTimeout)
+		missing, err = addTracksAndVerify(ctx, client, result.ID, missing)
+		cancel()
+		var verifyErr *playlistVerificationError
+		switch {
+		case errors.As(err, &verifyErr):
+			fmt.Printf("Warning: %v\n", err)
+		case err != nil:
+			return fail(fmt.Errorf("failed to add tracks to playlist: %w", err))
+		}
+		if len(missing) > 0 {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("Spotify didn't add %d tracks to the playlist.", len(missing)))
+		}
+	}
+
+	plan.Status, plan.Error = PlanCreated, ""
+	if err := writePlan(plan, dir); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	return result, nil
+}
+
+// createPlanPlaylist creates the empty playlist of a plan for the current user
+func createPlanPlaylist(client *spotify.Client, plan *PlaylistPlan) (*spotify.FullPlaylist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resumeStepTimeout)
+	defer cancel()
+
+	user, err := client.CurrentUser(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current user: %v", err)
+	}
+	playlist, err := client.CreatePlaylistForUser(ctx, user.ID, plan.Playlist.Name, plan.Description, plan.Playlist.Public, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create playlist: %w", err)
+	}
+	return playlist, nil
+}
+
+// ResumePlanHandler finishes the playlist of the failed plan given by planId
+func ResumePlanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authenticatedClient == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	result, err := ResumePlaylistPlan(authenticatedClient, r.FormValue("planId"))
+	switch {
+	case errors.Is(err, ErrPlanNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errPlanNotResumable):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		if reconsent(w, r) {
+			return
+		}
+		status, message := errorResponse(err, "Failed to resume playlist")
+		http.Error(w, message, status)
+		return
+	}
+
+	renderPlaylistCreated(w, "resumed", result)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// newFakePlaylist fakes the items of a playlist with the tracks in inPlaylist, paging them like Spotify.
+// It returns the client and a function returning the tracks added to the playlist.
+func newFakePlaylist(t *testing.T, playlistID string, inPlaylist []string) (*spotify.Client, func() []string) {
+	var mu sync.Mutex
+	var added []string
+
+	client := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path != "/playlists/"+playlistID+"/tracks" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "POST" {
+			var body struct {
+				URIs []string `json:"uris"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			for _, uri := range body.URIs {
+				id := uri[len("spotify:track:"):]
+				added = append(added, id)
+				inPlaylist = append(inPlaylist, id)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"snapshot_id": "snapshot"})
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		end := min(offset+limit, len(inPlaylist))
+		var items []map[string]interface{}
+		for _, id := range inPlaylist[min(offset, end):end] {
+			items = append(items, map[string]interface{}{"track": fakeTrack(id)})
+		}
+		page := map[string]interface{}{"items": items, "total": len(inPlaylist)}
+		if end < len(inPlaylist) {
+			page["next"] = "more"
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(added)
+	}
+}
+
+func TestWritePlaylistPlanRecordsTheConfigOfThePlaylist(t *testing.T) {
+	cfg := recommenderConfig
+	cfg.PlaylistSize = 7
+	cfg.Genre = "jazz"
+
+	dir := t.TempDir()
+	if err := WritePlaylistPlan(&PlaylistResult{ID: "recorded", config: cfg}, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("plan files = %v, %v, want one", files, err)
+	}
+	plan, err := readPlan(dir, strings.TrimSuffix(filepath.Base(files[0]), ".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Config.PlaylistSize != 7 || plan.Config.Genre != "jazz" {
+		t.Errorf("plan recorded a playlist size of %d and genre %q, want those of the playlist: 7 and jazz",
+			plan.Config.PlaylistSize, plan.Config.Genre)
+	}
+}
+
+func TestFailedPlansInTheSameSecondGetTheirOwnFiles(t *testing.T) {
+	dir := t.TempDir()
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	plans := make([]*PlaylistPlan, 5)
+	for i := range plans {
+		plans[i] = &PlaylistPlan{
+			CreatedAt: createdAt,
+			Status:    PlanFailed,
+			Playlist:  &PlaylistResult{Name: fmt.Sprintf("Playlist %d", i)},
+		}
+		wg.Add(1)
+		go func(plan *PlaylistPlan) {
+			defer wg.Done()
+			if err := writePlan(plan, dir); err != nil {
+				t.Error(err)
+			}
+		}(plans[i])
+	}
+	wg.Wait()
+
+	ids := make(map[string]bool)
+	for _, plan := range plans {
+		ids[plan.ID] = true
+		read, err := readPlan(dir, plan.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read.Playlist.Name != plan.Playlist.Name {
+			t.Errorf("plan %s has playlist %q, want %q", plan.ID, read.Playlist.Name, plan.Playlist.Name)
+		}
+	}
+	if len(ids) != len(plans) {
+		t.Errorf("%d plans got %d IDs: %v", len(plans), len(ids), ids)
+	}
+}
+
+func TestResumePlaylistPlanAddsOnlyMissingTracks(t *testing.T) {
+	client, added := newFakePlaylist(t, "half", []string{"a"})
+
+	dir := t.TempDir()
+	t.Setenv("PLAN_DIR", dir)
+	plan := &PlaylistPlan{
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Status:    PlanFailed,
+		Playlist: &PlaylistResult{
+			ID:     "half",
+			Name:   "Half Done",
+			Tracks: []PlaylistTrack{{ID: "a"}, {ID: "b"}},
+		},
+	}
+	if err := writePlan(plan, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ResumePlaylistPlan(client, plan.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ID != spotify.ID("half") {
+		t.Errorf("resumed playlist %s, want half", result.ID)
+	}
+	if !slices.Equal(added(), []string{"b"}) {
+		t.Errorf("resuming added %v, want only the missing track b", added())
+	}
+
+	// The plan is done now, so it can't be resumed again
+	if _, err := ResumePlaylistPlan(client, plan.ID); !errors.Is(err, errPlanNotResumable) {
+		t.Errorf("resuming a created plan returned %v, want errPlanNotResumable", err)
+	}
+
+	if _, err := ResumePlaylistPlan(client, "../"+plan.ID); !errors.Is(err, ErrPlanNotFound) {
+		t.Errorf("resuming a plan outside PLAN_DIR returned %v, want ErrPlanNotFound", err)
+	}
+}
+
+func TestResumePlaylistPlanKeepsToThePlaylistCap(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.PageDelay = 0
+
+	var full []string
+	for i := range maxPlaylistItems - 1 {
+		full = append(full, fmt.Sprintf("t%d", i))
+	}
+	client, added := newFakePlaylist(t, "full", full)
+
+	dir := t.TempDir()
+	t.Setenv("PLAN_DIR", dir)
+	plan := &PlaylistPlan{
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Status:    PlanFailed,
+		Playlist: &PlaylistResult{
+			ID:     "full",
+			Name:   "Nearly Full",
+			Tracks: []PlaylistTrack{{ID: "new1"}, {ID: "new2"}},
+		},
+	}
+	if err := writePlan(plan, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	recommenderConfig.TruncateAtPlaylistCap = false
+	if _, err := ResumePlaylistPlan(client, plan.ID); !errors.Is(err, ErrPlaylistFull) {
+		t.Errorf("resuming into a nearly full playlist returned %v, want ErrPlaylistFull", err)
+	}
+	if len(added()) != 0 {
+		t.Errorf("resuming added %v to a playlist without room for them", added())
+	}
+
+	recommenderConfig.TruncateAtPlaylistCap = true
+	if _, err := ResumePlaylistPlan(client, plan.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := added(); !slices.Equal(got, []string{"new1"}) {
+		t.Errorf("resuming with truncation added %v, want only new1 to fill the playlist", got)
+	}
+}
+
+func TestResumePlaylistPlanChecksEveryPageOfLongPlaylists(t *testing.T) {
+	var all, done []string
+	for i := range 150 {
+		all = append(all, fmt.Sprintf("t%d", i))
+	}
+	done = slices.Clone(all[:120])
+	client, added := newFakePlaylist(t, "long", done)
+
+	dir := t.TempDir()
+	t.Setenv("PLAN_DIR", dir)
+	plan := &PlaylistPlan{
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Status:    PlanFailed,
+		Playlist:  &PlaylistResult{ID: "long", Name: "Long"},
+	}
+	for _, id := range all {
+		plan.Playlist.Tracks = append(plan.Playlist.Tracks, PlaylistTrack{ID: spotify.ID(id)})
+	}
+	if err := writePlan(plan, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ResumePlaylistPlan(client, plan.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := added(); !slices.Equal(got, all[120:]) {
+		t.Errorf("resuming added %d tracks, want only the %d past the ones already added", len(got), len(all)-120)
+	}
+}
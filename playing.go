@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// featureMoods are the moods MoodFromAudioFeatures tries, from the most to the least specific
+var featureMoods = []string{"intense", "energetic", "relaxed", "thoughtful"}
+
+// GetCurrentlyPlaying returns the track the user is listening to, or nil if nothing is playing.
+// Episodes and paused tracks count as nothing playing.
+func GetCurrentlyPlaying(client *spotify.Client) (*spotify.FullTrack, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	playing, err := client.PlayerCurrentlyPlaying(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get currently playing track: %v", err)
+	}
+
+	if playing == nil || !playing.Playing || playing.Item == nil {
+		return nil, nil
+	}
+	return playing.Item, nil
+}
+
+// MoodFromAudioFeatures returns the mood whose thresholds the audio features match,
+// or false if they don't clearly match any mood
+func MoodFromAudioFeatures(features *spotify.AudioFeatures) (string, bool) {
+	if features == nil {
+		return "", false
+	}
+
+	for _, mood := range featureMoods {
+		if matchesMood(features, GetMoodThresholds(mood)) {
+			return mood, true
+		}
+	}
+	return "", false
+}
+
+// moodForTrack returns the mood of the track's audio features, falling back to the given mood
+func moodForTrack(client *spotify.Client, track *spotify.FullTrack, fallback string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	features, err := client.GetAudioFeatures(ctx, track.ID)
+	if err != nil || len(features) == 0 {
+		fmt.Printf("Couldn't analyze the currently playing track, keeping the %s mood\n", fallback)
+		return fallback
+	}
+
+	mood, ok := MoodFromAudioFeatures(features[0])
+	if !ok {
+		fmt.Printf("The currently playing track doesn't clearly fit a mood, keeping the %s mood\n", fallback)
+		return fallback
+	}
+	return mood
+}
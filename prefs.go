@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// defaultPreferencesFile is where preferences are kept unless PREFERENCES_FILE says otherwise
+const defaultPreferencesFile = "vibecast-preferences.json"
+
+// minFreshTracks is the fewest tracks a playlist may be left with after leaving out recent tracks.
+// With fewer, the pool is exhausted and the recent tracks history starts over.
+const minFreshTracks = 10
+
+// Preferences are kept between runs in the preferences file
+type Preferences struct {
+	// RecentPlaylists are the track IDs of the most recently created playlists, oldest first
+	RecentPlaylists [][]spotify.ID `json:"recentPlaylists,omitempty"`
+	// Profiles are the named setups that can be picked when creating a playlist
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+	// NeverPlay are the tracks to leave out of every playlist
+	NeverPlay []spotify.ID `json:"neverPlay,omitempty"`
+	// LastMood is the mood of the last weather playlist, kept for MoodMemory
+	LastMood *RememberedMood `json:"lastMood,omitempty"`
+}
+
+// preferencesMu serializes reading and writing the preferences file
+var preferencesMu sync.Mutex
+
+// preferencesFile returns the path of the preferences file
+func preferencesFile() string {
+	if path := os.Getenv("PREFERENCES_FILE"); path != "" {
+		return path
+	}
+	return defaultPreferencesFile
+}
+
+// loadPreferences reads the preferences file. A missing file means no preferences were saved yet.
+func loadPreferences() (Preferences, error) {
+	var prefs Preferences
+
+	data, err := os.ReadFile(preferencesFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return prefs, nil
+	}
+	if err != nil {
+		return prefs, fmt.Errorf("failed to read preferences: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &prefs); err != nil {
+		return prefs, fmt.Errorf("failed to parse preferences: %v", err)
+	}
+	return prefs, nil
+}
+
+// updatePreferences changes the saved preferences with update.
+// The file is replaced in one step, so it's never left half written.
+func updatePreferences(update func(*Preferences)) error {
+	preferencesMu.Lock()
+	defer preferencesMu.Unlock()
+
+	prefs, err := loadPreferences()
+	if err != nil {
+		return err
+	}
+	update(&prefs)
+
+	data, err := json.MarshalIndent(prefs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode preferences: %v", err)
+	}
+
+	path := preferencesFile()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save preferences: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save preferences: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save preferences: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save preferences: %v", err)
+	}
+	return nil
+}
+
+// rememberRecentTracks records the tracks of a new playlist, keeping only the last window playlists
+func rememberRecentTracks(trackIDs []spotify.ID, window int) error {
+	return updatePreferences(func(prefs *Preferences) {
+		prefs.RecentPlaylists = append(prefs.RecentPlaylists, trackIDs)
+		if excess := len(prefs.RecentPlaylists) - window; excess > 0 {
+			prefs.RecentPlaylists = prefs.RecentPlaylists[excess:]
+		}
+	})
+}
+
+// FilterRecentTracks removes tracks that were in the recently created playlists.
+// If that leaves fewer than minFreshTracks, the pool is exhausted: the history is cleared and tracks is returned as is.
+// With readOnly, as for a preview, the history is left as it is.
+func FilterRecentTracks(tracks []spotify.FullTrack, readOnly bool) ([]spotify.FullTrack, error) {
+	prefs, err := loadPreferences()
+	if err != nil {
+		return tracks, err
+	}
+
+	recent := make(map[spotify.ID]bool)
+	for _, playlist := range prefs.RecentPlaylists {
+		for _, id := range playlist {
+			recent[id] = true
+		}
+	}
+
+	var fresh []spotify.FullTrack
+	for _, track := range tracks {
+		if !recent[track.ID] {
+			fresh = append(fresh, track)
+		}
+	}
+
+	if len(fresh) < minFreshTracks && len(fresh) < len(tracks) {
+		fmt.Printf("Only %d tracks weren't in your recent playlists, starting over with all tracks\n", len(fresh))
+		if readOnly {
+			return tracks, nil
+		}
+		return tracks, updatePreferences(func(prefs *Preferences) {
+			prefs.RecentPlaylists = nil
+		})
+	}
+
+	fmt.Printf("Left out %d tracks that were in your recent playlists\n", len(tracks)-len(fresh))
+	return fresh, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestFilterRecentTracksStartsOverWhenExhausted(t *testing.T) {
+	var tracks []spotify.FullTrack
+	var ids []spotify.ID
+	for i := 0; i < minFreshTracks; i++ {
+		var track spotify.FullTrack
+		track.ID = spotify.ID(fmt.Sprintf("track%d", i))
+		tracks = append(tracks, track)
+		ids = append(ids, track.ID)
+	}
+
+	for _, readOnly := range []bool{true, false} {
+		t.Setenv("PREFERENCES_FILE", filepath.Join(t.TempDir(), "prefs.json"))
+		if err := rememberRecentTracks(ids[:1], 5); err != nil {
+			t.Fatal(err)
+		}
+
+		// Leaving out the one recent track would leave fewer than minFreshTracks, so all tracks are kept
+		filtered, err := FilterRecentTracks(tracks, readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filtered) != len(tracks) {
+			t.Errorf("readOnly %t: kept %d tracks of an exhausted pool, want all %d", readOnly, len(filtered), len(tracks))
+		}
+
+		prefs, err := loadPreferences()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := len(prefs.RecentPlaylists) == 1; kept != readOnly {
+			t.Errorf("readOnly %t: recent playlists = %v after starting over", readOnly, prefs.RecentPlaylists)
+		}
+	}
+}
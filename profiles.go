@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile is a named setup saved in the preferences, such as a "Workout" profile with the energetic mood
+// and popular tracks first. Values given with a request take precedence over those of its profile.
+type Profile struct {
+	// Mood is used instead of the mood of the weather, if set
+	Mood string `json:"mood,omitempty"`
+	// Genre narrows the mood to an available genre seed, if set
+	Genre string `json:"genre,omitempty"`
+	// Config sets recommender options by their RecommenderConfig field names, e.g. {"Order": "popularity"}.
+	// Options it leaves out keep their configured values.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// apply returns cfg with the options the profile sets. Only the options in profileOptions and the pipeline limits
+// can be set, and every value is checked against the same bounds as its environment variable.
+func (p Profile) apply(cfg RecommenderConfig) (RecommenderConfig, error) {
+	if len(p.Config) == 0 {
+		return cfg, nil
+	}
+
+	var options map[string]json.RawMessage
+	if err := json.Unmarshal(p.Config, &options); err != nil {
+		return cfg, fmt.Errorf("invalid config: %v", err)
+	}
+
+	// Sort the names so the same config always fails on the same option
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		set, ok := findProfileOption(name)
+		if !ok {
+			return cfg, fmt.Errorf("invalid config: %s can't be set by a profile", name)
+		}
+		if err := set(&cfg, optionValue(options[name])); err != nil {
+			return cfg, fmt.Errorf("invalid config: %s: %v", name, err)
+		}
+	}
+	return cfg, nil
+}
+
+// validate checks the mood and the options of the profile
+func (p Profile) validate() error {
+	if p.Mood != "" {
+		if err := ValidateMood(p.Mood); err != nil {
+			return err
+		}
+	}
+
+	_, err := p.apply(recommenderConfig)
+	return err
+}
+
+// profileOption sets an option of a profile in cfg from its value, or returns an error if it's out of bounds
+type profileOption func(cfg *RecommenderConfig, value string) error
+
+// profileOptions are the options a profile may set besides the pipeline limits, by their RecommenderConfig field
+// names. Options of the server, such as its timeouts and logging, can only be set with environment variables.
+var profileOptions = map[string]profileOption{
+	"Stages": func(cfg *RecommenderConfig, value string) (err error) {
+		cfg.Stages, err = ParseStages(value)
+		return err
+	},
+	"Order": func(cfg *RecommenderConfig, value string) (err error) {
+		cfg.Order, err = ParseOrder(value)
+		return err
+	},
+	"Sampling": func(cfg *RecommenderConfig, value string) (err error) {
+		cfg.Sampling, err = ParseSampling(value)
+		return err
+	},
+	"GenreMatch": func(cfg *RecommenderConfig, value string) (err error) {
+		cfg.GenreMatch, err = ParseGenreMatch(value)
+		return err
+	},
+	"Market": func(cfg *RecommenderConfig, value string) error {
+		if !validMarket(value) {
+			return fmt.Errorf("%q is not a two letter country code", value)
+		}
+		cfg.Market = strings.ToUpper(value)
+		return nil
+	},
+	"MoodWeights": func(cfg *RecommenderConfig, value string) (err error) {
+		// Either an object of FeatureWeights by mood, or the format of MOOD_WEIGHTS
+		if !strings.HasPrefix(value, "{") {
+			cfg.MoodWeights, err = ParseMoodWeights(value)
+			return err
+		}
+
+		var moodWeights map[string]FeatureWeights
+		if err := json.Unmarshal([]byte(value), &moodWeights); err != nil {
+			return err
+		}
+		for mood, weights := range moodWeights {
+			if err := ValidateMood(mood); err != nil {
+				return err
+			}
+			for _, name := range featureNames {
+				if *weights.field(name) < 0 {
+					return fmt.Errorf("the %s weight of %s can't be negative", name, mood)
+				}
+			}
+		}
+		cfg.MoodWeights = moodWeights
+		return nil
+	},
+	"PlaylistNameTemplate": func(cfg *RecommenderConfig, value string) error {
+		cfg.PlaylistNameTemplate = value
+		return nil
+	},
+	"AlternateVersionKeywords": func(cfg *RecommenderConfig, value string) error {
+		cfg.AlternateVersionKeywords = nil
+		for _, keyword := range strings.Split(value, ",") {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				cfg.AlternateVersionKeywords = append(cfg.AlternateVersionKeywords, keyword)
+			}
+		}
+		return nil
+	},
+
+	"LibraryOnly":             boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.LibraryOnly }),
+	"MoodStrict":              boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.MoodStrict }),
+	"UseFollowedArtists":      boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.UseFollowedArtists }),
+	"RequireLikedSeedArtists": boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.RequireLikedSeedArtists }),
+	"DiverseSeeds":            boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.DiverseSeeds }),
+	"UseCurrentlyPlaying":     boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.UseCurrentlyPlaying }),
+	"FilterAlternateVersions": boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.FilterAlternateVersions }),
+	"StudioOnly":              boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.StudioOnly }),
+	"PrimaryArtistOnly":       boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.PrimaryArtistOnly }),
+	"AllWeatherConditions":    boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.AllWeatherConditions }),
+	"RankTracks":              boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.RankTracks }),
+	"FilterExplicit":          boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.FilterExplicit }),
+	"VerifyPlayable":          boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.VerifyPlayable }),
+	"VerifyPlaylist":          boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.VerifyPlaylist }),
+	"TagPlaylists":            boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.TagPlaylists }),
+	"TruncateAtPlaylistCap":   boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.TruncateAtPlaylistCap }),
+	"MoodCheckAllStages":      boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.MoodCheckAllStages }),
+	"EstimateFeatures":        boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.EstimateFeatures }),
+	"InstrumentalOnly":        boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.InstrumentalOnly }),
+	"GenreSeedFallback":       boolOption(func(cfg *RecommenderConfig) *bool { return &cfg.GenreSeedFallback }),
+
+	"MinLibrarySize":       intOption(parseOptionalInt, 0, func(cfg *RecommenderConfig) *int { return &cfg.MinLibrarySize }),
+	"RecentLikedTracks":    intOption(parseInt, 0, func(cfg *RecommenderConfig) *int { return &cfg.RecentLikedTracks }),
+	"NeighborSeedTracks":   intOption(parseInt, 25, func(cfg *RecommenderConfig) *int { return &cfg.NeighborSeedTracks }),
+	"MaxFollowedPlaylists": intOption(parseInt, 50, func(cfg *RecommenderConfig) *int { return &cfg.MaxFollowedPlaylists }),
+	"AvoidRecentPlaylists": intOption(parseInt, 0, func(cfg *RecommenderConfig) *int { return &cfg.AvoidRecentPlaylists }),
+	"CooldownTracks":       intOption(parseInt, 20, func(cfg *RecommenderConfig) *int { return &cfg.CooldownTracks }),
+	"CallBudget":           intOption(parseInt, 0, func(cfg *RecommenderConfig) *int { return &cfg.CallBudget }),
+	"SampleSize":           intOption(parseInt, 0, func(cfg *RecommenderConfig) *int { return &cfg.SampleSize }),
+
+	"TemperatureIntensity":   numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.TemperatureIntensity }),
+	"ComfortableTemperature": numberOption(parseFloat, 0, func(cfg *RecommenderConfig) *float64 { return &cfg.ComfortableTemperature }),
+	"MoodFitWeight":          numberOption(parseWeight, 0, func(cfg *RecommenderConfig) *float64 { return &cfg.MoodFitWeight }),
+	"PopularityWeight":       numberOption(parseWeight, 0, func(cfg *RecommenderConfig) *float64 { return &cfg.PopularityWeight }),
+	"RecencyWeight":          numberOption(parseWeight, 0, func(cfg *RecommenderConfig) *float64 { return &cfg.RecencyWeight }),
+	"LikedRecencyWeight":     numberOption(parseWeight, 0, func(cfg *RecommenderConfig) *float64 { return &cfg.LikedRecencyWeight }),
+	"TopGenreWeight":         numberOption(parseWeight, 0, func(cfg *RecommenderConfig) *float64 { return &cfg.TopGenreWeight }),
+	"RecentlyPlayedWeight":   numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.RecentlyPlayedWeight }),
+	"MoodMemory":             numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.MoodMemory }),
+	"MaxEditorialShare":      numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.MaxEditorialShare }),
+	"EnergeticMinEnergy":     numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.EnergeticMinEnergy }),
+	"RelaxedMaxEnergy":       numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.RelaxedMaxEnergy }),
+	"MinInstrumentalness":    numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.MinInstrumentalness }),
+	"MaxSpeechiness":         numberOption(parseWeight, 1, func(cfg *RecommenderConfig) *float64 { return &cfg.MaxSpeechiness }),
+
+	"DurationTolerance":    durationOption(parseDuration, func(cfg *RecommenderConfig) *time.Duration { return &cfg.DurationTolerance }),
+	"MoodMemoryWindow":     durationOption(parseDuration, func(cfg *RecommenderConfig) *time.Duration { return &cfg.MoodMemoryWindow }),
+	"RecentlyPlayedWindow": durationOption(parseDuration, func(cfg *RecommenderConfig) *time.Duration { return &cfg.RecentlyPlayedWindow }),
+	"MaxPipelineTime":      durationOption(parseOptionalDuration, func(cfg *RecommenderConfig) *time.Duration { return &cfg.MaxPipelineTime }),
+	"ResultCacheTTL":       durationOption(parseOptionalDuration, func(cfg *RecommenderConfig) *time.Duration { return &cfg.ResultCacheTTL }),
+}
+
+// findProfileOption returns the option a profile sets by the given field name. The pipeline limits are set by
+// their field names too, such as "PlaylistSize", and the durations among them as durations, such as "90s".
+func findProfileOption(name string) (profileOption, bool) {
+	if option, ok := profileOptions[name]; ok {
+		return option, true
+	}
+
+	for _, limit := range pipelineLimits {
+		if strings.ToUpper(limit.Name[:1])+limit.Name[1:] != name {
+			continue
+		}
+		return func(cfg *RecommenderConfig, value string) error {
+			var parsed int
+			if limit.duration != nil {
+				duration, err := parseOptionalDuration(value)
+				if err != nil {
+					return err
+				}
+				parsed = int(duration / time.Second)
+			} else {
+				var err error
+				if parsed, err = strconv.Atoi(value); err != nil {
+					return fmt.Errorf("%q is not a whole number", value)
+				}
+			}
+			if err := limit.check(parsed); err != nil {
+				return err
+			}
+			limit.set(cfg, parsed)
+			return nil
+		}, true
+	}
+	return nil, false
+}
+
+// boolOption is a profile option for a boolean field
+func boolOption(field func(cfg *RecommenderConfig) *bool) profileOption {
+	return func(cfg *RecommenderConfig, value string) (err error) {
+		*field(cfg), err = parseBool(value)
+		return err
+	}
+}
+
+// intOption is a profile option for a whole number field parsed with parse, up to max if it isn't 0
+func intOption(parse func(string) (int, error), max int, field func(cfg *RecommenderConfig) *int) profileOption {
+	return func(cfg *RecommenderConfig, value string) error {
+		parsed, err := parse(value)
+		if err != nil {
+			return err
+		}
+		if max > 0 && parsed > max {
+			return fmt.Errorf("%d is more than the most allowed, %d", parsed, max)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+// numberOption is a profile option for a number field parsed with parse, up to max if it isn't 0
+func numberOption(parse func(string) (float64, error), max float64, field func(cfg *RecommenderConfig) *float64) profileOption {
+	return func(cfg *RecommenderConfig, value string) error {
+		parsed, err := parse(value)
+		if err != nil {
+			return err
+		}
+		if max > 0 && parsed > max {
+			return fmt.Errorf("%v is more than the most allowed, %v", parsed, max)
+		}
+		*field(cfg) = parsed
+		return nil
+	}
+}
+
+// durationOption is a profile option for a duration field parsed with parse, such as "90s"
+func durationOption(parse func(string) (time.Duration, error), field func(cfg *RecommenderConfig) *time.Duration) profileOption {
+	return func(cfg *RecommenderConfig, value string) (err error) {
+		*field(cfg), err = parse(value)
+		return err
+	}
+}
+
+// optionValue returns the value of a profile option as its environment variable would have it: strings as they
+// are, lists joined by commas, and numbers and booleans as written
+func optionValue(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return strings.Join(list, ",")
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// loadProfile returns the saved profile with the given name
+func loadProfile(name string) (*Profile, error) {
+	prefs, err := loadPreferences()
+	if err != nil {
+		return nil, err
+	}
+
+	profile, ok := prefs.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile named %q", name)
+	}
+	return &profile, nil
+}
+
+// profileNames returns the names of the saved profiles in alphabetical order
+func profileNames() []string {
+	prefs, err := loadPreferences()
+	if err != nil {
+		fmt.Printf("Warning: couldn't load the profiles: %v\n", err)
+		return nil
+	}
+
+	names := make([]string, 0, len(prefs.Profiles))
+	for name := range prefs.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// useProfile makes the playlist use the named profile. The profile's mood and genre are only used if the
+// options don't have their own.
+func (opts *PlaylistOptions) useProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	profile, err := loadProfile(name)
+	if err != nil {
+		return err
+	}
+
+	opts.Profile = profile
+	if opts.Mood == "" {
+		opts.Mood = profile.Mood
+	}
+	if opts.Genre == "" {
+		opts.Genre = profile.Genre
+	}
+	return nil
+}
+
+// config returns the recommender configuration for the playlist, with the options of its profile if it has one
+// and then the limits it overrides
+func (opts PlaylistOptions) config() RecommenderConfig {
+	cfg := recommenderConfig
+	if opts.Profile != nil {
+		profileCfg, err := opts.Profile.apply(recommenderConfig)
+		if err != nil {
+			fmt.Printf("Warning: ignoring the options of the profile: %v\n", err)
+		} else {
+			cfg = profileCfg
+		}
+	}
+
+	// The limits are checked when the request comes in, so this only fails if that was skipped
+	limited, err := applyLimits(cfg, opts.Limits)
+	if err != nil {
+		fmt.Printf("Warning: ignoring the limits: %v\n", err)
+		return cfg
+	}
+	return limited
+}
+
+// ProfilesHandler lists the saved profiles on GET. On PUT, it saves the profiles in the body, an object of
+// profiles by name, replacing saved profiles with the same names.
+func ProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var profiles map[string]Profile
+		if err := json.NewDecoder(r.Body).Decode(&profiles); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+
+		for name, profile := range profiles {
+			if strings.TrimSpace(name) == "" {
+				writeJSONError(w, http.StatusBadRequest, "Profile names can't be empty")
+				return
+			}
+			if err := profile.validate(); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid profile %q: %v", name, err))
+				return
+			}
+			if profile.Genre != "" && !isAvailableGenre(profile.Genre) {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid profile %q: unknown genre %q", name, profile.Genre))
+				return
+			}
+		}
+
+		err := updatePreferences(func(prefs *Preferences) {
+			if prefs.Profiles == nil {
+				prefs.Profiles = make(map[string]Profile)
+			}
+			for name, profile := range profiles {
+				prefs.Profiles[name] = profile
+			}
+		})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	prefs, err := loadPreferences()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	profiles := prefs.Profiles
+	if profiles == nil {
+		profiles = map[string]Profile{}
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestProfileApply(t *testing.T) {
+	cfg := DefaultRecommenderConfig()
+	profile := Profile{Mood: "energetic", Config: json.RawMessage(`{"Order": "popularity", "TargetSize": 40}`)}
+
+	got, err := profile.apply(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Order != OrderPopularity || got.TargetSize != 40 {
+		t.Errorf("apply = order %q and target size %d, want popularity and 40", got.Order, got.TargetSize)
+	}
+	if got.CallBudget != cfg.CallBudget || cfg.Order == OrderPopularity {
+		t.Error("apply changed options the profile doesn't set, or the config it was given")
+	}
+
+	profile = Profile{Config: json.RawMessage(`{"MinDuration": "90s", "MaxEditorialShare": 0.5, "MoodWeights": "relaxed:energy=4"}`)}
+	if got, err = profile.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got.MinDuration != 90*time.Second || got.MaxEditorialShare != 0.5 || got.MoodWeights["relaxed"].Energy != 4 {
+		t.Errorf("apply = minimum duration %v, editorial share %v and mood weights %v, want 1m30s, 0.5 and an energy of 4 for relaxed",
+			got.MinDuration, got.MaxEditorialShare, got.MoodWeights)
+	}
+
+	if _, err := (Profile{Config: json.RawMessage(`{"NoSuchOption": true}`)}).apply(cfg); err == nil {
+		t.Error("apply accepted an unknown option")
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	valid := Profile{Mood: "relaxed", Config: json.RawMessage(`{"Stages": ["genres"]}`)}
+	if err := valid.validate(); err != nil {
+		t.Errorf("validate(%s) = %v", valid.Config, err)
+	}
+
+	invalid := []Profile{
+		{Mood: "sleepy"},
+		{Config: json.RawMessage(`{"Stages": ["no-such-stage"]}`)},
+		{Config: json.RawMessage(`{"Order": "random"}`)},
+		{Config: json.RawMessage(`{"TargetSize": "forty"}`)},
+		{Config: json.RawMessage(`{"PlaylistSize": 500}`)},
+		{Config: json.RawMessage(`{"MaxSongsPerArtist": 0}`)},
+		{Config: json.RawMessage(`{"RecommendationLimit": 101}`)},
+		{Config: json.RawMessage(`{"MoodWeights": {"sunny": {"Energy": 2}}}`)},
+		{Config: json.RawMessage(`{"MoodWeights": {"energetic": {"Energy": -2}}}`)},
+		{Config: json.RawMessage(`{"CooldownTracks": 60}`)},
+		{Config: json.RawMessage(`{"MaxEditorialShare": -1}`)},
+		{Config: json.RawMessage(`{"MinDuration": 90}`)},
+		{Config: json.RawMessage(`{"MaxDuration": "2h"}`)},
+		{Config: json.RawMessage(`{"CallBudget": 0}`)},
+		{Config: json.RawMessage(`{"ResultCacheTTL": "-1m"}`)},
+		{Config: json.RawMessage(`{"LogRequests": true}`)},
+	}
+	for _, profile := range invalid {
+		if err := profile.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded, want an error", profile)
+		}
+	}
+}
+
+func TestApplyLimits(t *testing.T) {
+	cfg, err := applyLimits(DefaultRecommenderConfig(), map[string]int{"maxSongsPerArtist": 2, "playlistSize": 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxSongsPerArtist != 2 || cfg.PlaylistSize != 30 {
+		t.Errorf("applyLimits = %d songs per artist and %d tracks, want 2 and 30", cfg.MaxSongsPerArtist, cfg.PlaylistSize)
+	}
+
+	cfg, err = applyLimits(DefaultRecommenderConfig(), map[string]int{"minDuration": 90, "maxDuration": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinDuration != 90*time.Second || cfg.MaxDuration != 0 {
+		t.Errorf("applyLimits = durations from %v to %v, want 1m30s and no maximum", cfg.MinDuration, cfg.MaxDuration)
+	}
+
+	for _, overrides := range []map[string]int{
+		{"maxSongsPerArtist": 0},
+		{"minDuration": -1},
+		{"maxDuration": 3601},
+		{"recommendationLimit": 101},
+		{"tracks": 10},
+	} {
+		if _, err := applyLimits(DefaultRecommenderConfig(), overrides); err == nil {
+			t.Errorf("applyLimits(%v) succeeded, want an error", overrides)
+		}
+	}
+
+	// A form value that isn't a number is rejected, even for limits that 0 turns off
+	form := url.Values{"minDuration": {"short"}}
+	if _, err := applyLimits(DefaultRecommenderConfig(), limitsFromForm(form.Get)); err == nil {
+		t.Error("applyLimits accepted a minDuration that isn't a number")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// strongStages are the stages whose tracks are kept when a playlist is regenerated.
+// Tracks from the other, fallback stages are usually weaker matches.
+var strongStages = map[string]bool{
+	StageAudioFeatures: true,
+	StageGenres:        true,
+	cooldownStage:      true,
+}
+
+// playlistRecord is what's remembered about a created playlist so its weak tracks can be regenerated
+type playlistRecord struct {
+	Name   string
+	URL    string
+	Mood   string
+	Stages map[spotify.ID]string
+}
+
+// createdPlaylists remembers the playlists created since the server started
+var createdPlaylists = struct {
+	sync.Mutex
+	records map[spotify.ID]*playlistRecord
+}{records: make(map[spotify.ID]*playlistRecord)}
+
+// rememberPlaylist records which stage found each track of a created playlist
+func rememberPlaylist(result *PlaylistResult) {
+	record := &playlistRecord{
+		Name:   result.Name,
+		URL:    result.URL,
+		Mood:   result.Mood,
+		Stages: make(map[spotify.ID]string, len(result.Tracks)),
+	}
+	for _, track := range result.Tracks {
+		record.Stages[track.ID] = track.Stage
+	}
+
+	createdPlaylists.Lock()
+	defer createdPlaylists.Unlock()
+	createdPlaylists.records[result.ID] = record
+}
+
+// isRememberedPlaylist reports whether the playlist can be regenerated
+func isRememberedPlaylist(playlistID spotify.ID) bool {
+	createdPlaylists.Lock()
+	defer createdPlaylists.Unlock()
+	return createdPlaylists.records[playlistID] != nil
+}
+
+// RegenerateWeakTracks replaces up to count of the weakest tracks of a playlist created by VibeCast.
+// Tracks found by the strong stages are kept; the others are replaced, weakest first, by tracks from
+// a new run of only the fallback stages. The playlist is updated in place, keeping the order of its tracks.
+func RegenerateWeakTracks(client *spotify.Client, playlistID spotify.ID, count int) (*PlaylistResult, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("number of tracks to regenerate must be positive")
+	}
+
+	createdPlaylists.Lock()
+	record := createdPlaylists.records[playlistID]
+	createdPlaylists.Unlock()
+	if record == nil {
+		return nil, fmt.Errorf("only playlists created since VibeCast started can be regenerated")
+	}
+
+	cfg := recommenderConfig
+	cfg.CooldownTracks = 0 // The playlist keeps its cooldown
+	cfg.Stages = nil
+	for _, stage := range recommenderConfig.Stages {
+		if !strongStages[stage] {
+			cfg.Stages = append(cfg.Stages, stage)
+		}
+	}
+	if len(cfg.Stages) == 0 {
+		return nil, fmt.Errorf("no fallback stages are enabled to find replacement tracks with")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	items, err := client.GetPlaylistItems(ctx, playlistID, spotify.Limit(100))
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get playlist tracks: %v", err)
+	}
+
+	var current []spotify.FullTrack
+	for _, item := range items.Items {
+		if item.Track.Track != nil {
+			current = append(current, *item.Track.Track)
+		}
+	}
+
+	weak := weakestTracks(current, record.Stages, count)
+	if len(weak) == 0 {
+		return nil, fmt.Errorf("the playlist has no weak tracks to regenerate")
+	}
+
+	fmt.Printf("Regenerating %d weak tracks of %s\n", len(weak), record.Name)
+
+	candidates, report, err := personalizedRecommendations(record.Mood, client, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error getting replacement tracks: %v", err)
+	}
+
+	inPlaylist := make(map[spotify.ID]bool, len(current))
+	for _, track := range current {
+		inPlaylist[track.ID] = true
+	}
+	var replacements []spotify.FullTrack
+	for _, track := range candidates {
+		if !inPlaylist[track.ID] && len(replacements) < len(weak) {
+			replacements = append(replacements, track)
+		}
+	}
+
+	// Put each replacement in the position of a weak track, weakest first
+	tracks := make([]spotify.FullTrack, len(current))
+	copy(tracks, current)
+	removed := make(map[int]bool)
+	for i, position := range weak {
+		if i < len(replacements) {
+			tracks[position] = replacements[i]
+		} else {
+			removed[position] = true
+		}
+	}
+
+	var kept []spotify.FullTrack
+	for i, track := range tracks {
+		if !removed[i] {
+			kept = append(kept, track)
+		}
+	}
+	tracks, err = capPlaylistTracks(0, kept)
+	if err != nil {
+		return nil, err
+	}
+
+	trackIDs := make([]spotify.ID, len(tracks))
+	for i, track := range tracks {
+		trackIDs[i] = track.ID
+	}
+	// The pipeline can take a while, so replacing the tracks gets its own time
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.ReplacePlaylistTracks(ctx, playlistID, trackIDs...); err != nil {
+		return nil, fmt.Errorf("failed to update playlist: %v", err)
+	}
+
+	createdPlaylists.Lock()
+	for _, track := range replacements {
+		record.Stages[track.ID] = report.TrackStages[track.ID]
+	}
+	createdPlaylists.Unlock()
+
+	result := &PlaylistResult{
+		ID:            playlistID,
+		Name:          record.Name,
+		URL:           record.URL,
+		Mood:          record.Mood,
+		TrackCount:    len(tracks),
+		ExplicitCount: countExplicitTracks(tracks),
+		Tracks:        playlistTracks(tracks),
+		config:        cfg,
+	}
+	for i := range result.Tracks {
+		result.Tracks[i].Stage = record.Stages[result.Tracks[i].ID]
+	}
+
+	if len(replacements) < len(weak) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(
+			"Only %d replacements were found, so %d weak tracks were removed without a replacement.",
+			len(replacements), len(weak)-len(replacements)))
+	}
+
+	fmt.Printf("Replaced %d tracks of %s\n", len(replacements), record.Name)
+	savePlaylistPlan(result)
+	return result, nil
+}
+
+// weakestTracks returns the positions of up to count tracks that weren't found by a strong stage, weakest first.
+// Tracks from later stages are weaker, tracks of unknown origin are the weakest, and among tracks
+// of the same stage the ones further down the playlist are weaker.
+func weakestTracks(tracks []spotify.FullTrack, stages map[spotify.ID]string, count int) []int {
+	stageOrder := make(map[string]int)
+	for i, stage := range recommenderConfig.Stages {
+		stageOrder[stage] = i
+	}
+
+	weakness := func(position int) int {
+		order, ok := stageOrder[stages[tracks[position].ID]]
+		if !ok {
+			return len(stageOrder)
+		}
+		return order
+	}
+
+	var positions []int
+	for i, track := range tracks {
+		if !strongStages[stages[track.ID]] {
+			positions = append(positions, i)
+		}
+	}
+
+	sort.SliceStable(positions, func(i, j int) bool {
+		wi, wj := weakness(positions[i]), weakness(positions[j])
+		if wi != wj {
+			return wi > wj
+		}
+		return positions[i] > positions[j]
+	})
+
+	return positions[:min(count, len(positions))]
+}
+
+// RegeneratePlaylistHandler replaces the weakest tracks of a playlist
+func RegeneratePlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authenticatedClient == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	count := 10
+	if value := r.FormValue("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid number of tracks", http.StatusBadRequest)
+			return
+		}
+		count = parsed
+	}
+
+	result, err := RegenerateWeakTracks(authenticatedClient, spotify.ID(r.FormValue("playlist_id")), count)
+	if err != nil {
+		http.Error(w, "Failed to regenerate playlist: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	renderPlaylistCreated(w, "regenerated", result)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// ErrNoRecording is returned in replay mode for requests that weren't recorded
+var ErrNoRecording = errors.New("no recorded response")
+
+// volatileParams are left out when matching requests to recordings: API keys shouldn't end up on disk,
+// and time windows change with every run
+var volatileParams = []string{"appid", "after", "before"}
+
+// recording is a response recorded to disk, along with the request it answered
+type recording struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// replayTransport answers requests with responses recorded in dir, or, when recording, sends them through base
+// and records the responses. Requests are matched by method and URL, and the same request made more than once
+// gets the responses recorded for it in order, the last one again once they run out. Request bodies aren't
+// matched, so the tracks a shuffle picks don't keep a playlist from being created.
+type replayTransport struct {
+	dir    string
+	record bool
+	base   http.RoundTripper
+
+	mu sync.Mutex
+	// calls counts the requests made for each key
+	calls map[string]int
+}
+
+// newReplayTransport returns the transport for the configured replay mode, or base if there isn't one
+func newReplayTransport(base http.RoundTripper) http.RoundTripper {
+	if recommenderConfig.ReplayDir == "" {
+		return base
+	}
+	return &replayTransport{dir: recommenderConfig.ReplayDir, record: recommenderConfig.ReplayRecord, base: base}
+}
+
+// replaying reports whether requests are answered from recordings instead of the live APIs
+func replaying() bool {
+	return recommenderConfig.ReplayDir != "" && !recommenderConfig.ReplayRecord
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := replayKey(req)
+
+	t.mu.Lock()
+	if t.calls == nil {
+		t.calls = make(map[string]int)
+	}
+	call := t.calls[key]
+	t.calls[key]++
+	t.mu.Unlock()
+
+	if t.record {
+		return t.recordResponse(req, key, call)
+	}
+	return t.replayResponse(req, key, call)
+}
+
+// recordResponse sends req through the base transport and writes the response to disk
+func (t *replayTransport) recordResponse(req *http.Request, key string, call int) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	data, err := json.MarshalIndent(recording{
+		Method: req.Method,
+		URL:    matchedURL(req.URL),
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   string(body),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(t.path(key, call), data, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to record %s %s: %w", req.Method, req.URL.Path, err)
+	}
+	return resp, nil
+}
+
+// replayResponse reads the response recorded for the call'th request with key
+func (t *replayTransport) replayResponse(req *http.Request, key string, call int) (*http.Response, error) {
+	data, err := os.ReadFile(t.path(key, call))
+	for errors.Is(err, os.ErrNotExist) && call > 0 {
+		call--
+		data, err = os.ReadFile(t.path(key, call))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w for %s %s in %s", ErrNoRecording, req.Method, matchedURL(req.URL), t.dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded recording
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %w", t.path(key, call), err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, http.StatusText(recorded.Status)),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(recorded.Body))),
+		ContentLength: int64(len(recorded.Body)),
+		Request:       req,
+	}, nil
+}
+
+// path is the file the call'th response to requests with key is recorded in
+func (t *replayTransport) path(key string, call int) string {
+	return filepath.Join(t.dir, fmt.Sprintf("%s-%d.json", key, call))
+}
+
+// replayKey identifies the requests that get the same recorded responses
+func replayKey(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + matchedURL(req.URL)))
+	return req.URL.Hostname() + "-" + hex.EncodeToString(sum[:8])
+}
+
+// matchedURL is the URL of a request without its volatile parameters, with the rest in a fixed order
+func matchedURL(u *url.URL) string {
+	query := u.Query()
+	for _, param := range volatileParams {
+		query.Del(param)
+	}
+
+	matched := *u
+	matched.RawQuery = query.Encode()
+	return matched.String()
+}
+
+// shuffleSeed seeds the shuffles of a pipeline run. Replayed runs always shuffle the same way, so they pick the
+// same tracks every time.
+func shuffleSeed() int64 {
+	if replaying() {
+		return 1
+	}
+	return time.Now().UnixNano()
+}
+
+// startReplaySession logs in with the recorded responses, so the app can be used without Spotify
+func startReplaySession() error {
+	httpClient := &http.Client{
+		Transport: &callBudgetTransport{base: &scopeTransport{base: newReplayTransport(nil)}},
+	}
+	if recommenderConfig.SpotifyTrace {
+		httpClient.Transport = &traceTransport{base: httpClient.Transport}
+	}
+	authenticatedClient = spotify.New(httpClient)
+
+	user, err := authenticatedClient.CurrentUser(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to replay the logged in user: %w", err)
+	}
+
+	fmt.Printf("Replaying %s's session from %s\n", displayName(user.User), recommenderConfig.ReplayDir)
+	authenticatedUserID = user.ID
+	authenticatedUserCountry = user.Country
+	return nil
+}
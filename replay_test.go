@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplayTransportReplaysRecordedResponses(t *testing.T) {
+	var served int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"call":%d}`, served)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	get := func(client *http.Client, url string) (string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	recorder := &http.Client{Transport: &replayTransport{dir: dir, record: true}}
+	for range 2 {
+		if _, err := get(recorder, server.URL+"/weather?q=Oslo&appid=secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Errorf("recording %s contains the API key", file.Name())
+		}
+	}
+
+	server.Close()
+	replayer := &http.Client{Transport: &replayTransport{dir: dir}}
+
+	// Responses are replayed in the order they were recorded, and the last again once they run out,
+	// whatever the API key
+	for _, want := range []string{`{"call":1}`, `{"call":2}`, `{"call":2}`} {
+		got, err := get(replayer, server.URL+"/weather?appid=other&q=Oslo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("replayed %s, want %s", got, want)
+		}
+	}
+
+	if _, err := get(replayer, server.URL+"/weather?q=Madrid"); !errors.Is(err, ErrNoRecording) {
+		t.Errorf("replaying a request that wasn't recorded returned %v, want ErrNoRecording", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// PlaylistOptions controls how a playlist is created
+type PlaylistOptions struct {
+	// Public creates the playlist as a public playlist
+	Public bool
+	// ConfirmPublic publishes the playlist even if it contains explicit tracks
+	ConfirmPublic bool
+	// Name overrides the default playlist name
+	Name string
+	// NameTemplate names the playlist by expanding placeholders such as {mood} and {city}.
+	// It's ignored if Name is set, and defaults to the configured template.
+	NameTemplate string
+	// NameVars are the values for the NameTemplate placeholders
+	NameVars PlaylistNameVars
+	// Mood overrides the mood picked from the weather or the currently playing track. It must be one of Moods.
+	Mood string
+	// Genre narrows the mood to an available genre seed, such as "electronic"
+	Genre string
+	// Market is the country code used for market-aware Spotify calls instead of the configured market or the user's country
+	Market string
+	// BlendWith is a playlist ID or link whose tracks are interleaved with the mood tracks
+	BlendWith string
+	// TargetMinutes fills the playlist to about this many minutes instead of a number of tracks, if set
+	TargetMinutes int
+	// InstrumentalOnly keeps only tracks without vocals, whatever the mood
+	InstrumentalOnly bool
+	// Deadline caps the pipeline run at this time instead of the configured MaxPipelineTime, if set
+	Deadline time.Time
+	// OutsideLibrary is set when the tracks are recommendations from outside the liked songs, which the playlist
+	// description then says instead of claiming they're liked songs
+	OutsideLibrary bool
+	// Limits override pipeline limits by name, such as "maxSongsPerArtist", within their bounds
+	Limits map[string]int
+	// Profile is the saved profile whose options the playlist is created with, if any
+	Profile *Profile
+	// pickedWith is the configuration the tracks were picked with, which the plan records. Without it, the plan
+	// records the configuration of the options.
+	pickedWith *RecommenderConfig
+}
+
+// PlaylistNameVars are the values substituted into a playlist name template. Unknown values expand to nothing.
+type PlaylistNameVars struct {
+	Mood    string
+	City    string
+	Weather string
+	Temp    *float64
+}
+
+// maxPlaylistNameLength is the longest playlist name Spotify accepts
+const maxPlaylistNameLength = 100
+
+// expandPlaylistName replaces the {mood}, {city}, {date}, {temp} and {weather} placeholders of a name template
+func expandPlaylistName(template string, vars PlaylistNameVars, now time.Time) (string, error) {
+	temp := ""
+	if vars.Temp != nil {
+		temp = fmt.Sprintf("%.0f°C", *vars.Temp)
+	}
+
+	name := strings.NewReplacer(
+		"{mood}", vars.Mood,
+		"{city}", vars.City,
+		"{date}", now.Format("Jan 02 15:04"),
+		"{temp}", temp,
+		"{weather}", vars.Weather,
+	).Replace(template)
+	name = strings.Join(strings.Fields(name), " ")
+
+	if name == "" {
+		return "", fmt.Errorf("playlist name template %q expands to an empty name", template)
+	}
+	if length := utf8.RuneCountInString(name); length > maxPlaylistNameLength {
+		return "", fmt.Errorf("playlist name %q is %d characters long, at most %d are allowed", name, length, maxPlaylistNameLength)
+	}
+	return name, nil
+}
+
+// PlaylistResult describes a playlist that was created
+type PlaylistResult struct {
+	ID         spotify.ID `json:"id"`
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	Mood       string     `json:"mood,omitempty"`
+	City       string     `json:"city,omitempty"`
+	TrackCount int        `json:"trackCount"`
+	Public     bool       `json:"public"`
+	// ExplicitCount is the number of tracks with explicit lyrics
+	ExplicitCount int `json:"explicitCount"`
+	// NeedsPublicConfirmation is set when a public playlist was created as private because it has explicit tracks
+	NeedsPublicConfirmation bool `json:"needsPublicConfirmation,omitempty"`
+	// WeatherUnavailable is set when the weather couldn't be fetched and the neutral mood was used instead
+	WeatherUnavailable bool     `json:"weatherUnavailable,omitempty"`
+	Warnings           []string `json:"warnings,omitempty"`
+	// Tracks are the tracks in the playlist, in order
+	Tracks []PlaylistTrack `json:"tracks,omitempty"`
+	// Weather is the weather the mood was chosen for, if any
+	Weather *WeatherSummary `json:"weather,omitempty"`
+	// APICalls is the number of Spotify calls the recommendation stages made
+	APICalls int `json:"apiCalls,omitempty"`
+	// MoodReason explains why the playlist got its mood, e.g. "overcast clouds + 11°C → thoughtful"
+	MoodReason string `json:"moodReason,omitempty"`
+	// NowPlaying is the track the user was listening to, which seeded the playlist and steered its mood
+	NowPlaying *PlaylistTrack `json:"nowPlaying,omitempty"`
+	// TargetMinutes is the length in minutes the playlist was filled to, if it was asked for by duration
+	TargetMinutes int `json:"targetMinutes,omitempty"`
+	// InstrumentalOnly is set when the playlist only has instrumental tracks
+	InstrumentalOnly bool `json:"instrumentalOnly,omitempty"`
+	// Partial is set when the pipeline ran out of time and the playlist was made from the tracks found until then
+	Partial bool `json:"partial,omitempty"`
+	// Stats describe what actually ended up in the playlist, if it was verified after creating it
+	Stats *PlaylistStats `json:"stats,omitempty"`
+	// config is the configuration the playlist was made with, which its plan records
+	config RecommenderConfig
+}
+
+// PlaylistStats describe the tracks of a created playlist as Spotify has them
+type PlaylistStats struct {
+	TrackCount        int     `json:"trackCount"`
+	UniqueArtists     int     `json:"uniqueArtists"`
+	AveragePopularity float64 `json:"averagePopularity"`
+	// MoodFit is how many tracks fit the mood how well, if the playlist has a mood and audio features are available
+	MoodFit *MoodFitDistribution `json:"moodFit,omitempty"`
+}
+
+// MoodFitDistribution counts the tracks of a playlist by the fraction of the mood's audio feature bounds they're within
+type MoodFitDistribution struct {
+	// Full is the number of tracks within all bounds
+	Full int `json:"full"`
+	// Partial is the number of tracks within at least half of the bounds
+	Partial int `json:"partial"`
+	// Poor is the number of tracks within fewer than half of the bounds
+	Poor int `json:"poor"`
+	// Unknown is the number of tracks without audio features
+	Unknown int `json:"unknown"`
+}
+
+// PlaylistTrack is a track in a created playlist
+type PlaylistTrack struct {
+	ID      spotify.ID `json:"id"`
+	Name    string     `json:"name"`
+	Artists []string   `json:"artists"`
+	// Stage is the pipeline stage that found the track, if known
+	Stage string `json:"stage,omitempty"`
+}
+
+// WeatherSummary is the weather a playlist was created for
+type WeatherSummary struct {
+	Description string  `json:"description"`
+	Temp        float64 `json:"temp"`
+	// Alerts are the events of the weather alerts that were active, such as "Storm warning"
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+// summarizeWeather describes the weather for a PlaylistResult
+func summarizeWeather(weather *Weather) *WeatherSummary {
+	summary := &WeatherSummary{
+		Description: weather.Weather[0].Description,
+		Temp:        weather.Main.Temp,
+	}
+	for _, alert := range weather.Alerts {
+		summary.Alerts = append(summary.Alerts, alert.Event)
+	}
+	return summary
+}
+
+// playlistTracks describes the tracks for a PlaylistResult
+func playlistTracks(tracks []spotify.FullTrack) []PlaylistTrack {
+	described := make([]PlaylistTrack, len(tracks))
+	for i, track := range tracks {
+		described[i] = PlaylistTrack{ID: track.ID, Name: track.Name}
+		for _, artist := range track.Artists {
+			described[i].Artists = append(described[i].Artists, artist.Name)
+		}
+	}
+	return described
+}
+
+// applyPipelineReport adds how the pipeline found the tracks to the result
+func applyPipelineReport(result *PlaylistResult, report *pipelineReport) {
+	for i := range result.Tracks {
+		result.Tracks[i].Stage = report.TrackStages[result.Tracks[i].ID]
+	}
+
+	result.APICalls = report.APICalls
+	if report.OutsideLibrary {
+		result.Warnings = append(result.Warnings,
+			"None of your liked songs match the mood, so the playlist is made of recommendations from outside your library.")
+	}
+	if report.BudgetExhausted {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(
+			"The Spotify call budget of %d calls was used up, so the playlist was made from the tracks found until then.",
+			report.APICalls))
+	}
+	if report.Partial {
+		result.Partial = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf(
+			"The pipeline ran out of time, so the playlist was made from the tracks found until then by %s.",
+			strings.Join(report.StagesRun, ", ")))
+	}
+}
+
+// countExplicitTracks returns the number of tracks with explicit lyrics
+func countExplicitTracks(tracks []spotify.FullTrack) int {
+	count := 0
+	for _, track := range tracks {
+		if track.Explicit {
+			count++
+		}
+	}
+	return count
+}
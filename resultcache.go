@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// pipelineCacheEntry is the outcome of a pipeline run that a repeat request can reuse
+type pipelineCacheEntry struct {
+	pipeline   *recommendationPipeline
+	candidates []spotify.FullTrack
+	// library identifies the state of the liked songs the candidates were found in
+	library  string
+	storedAt time.Time
+}
+
+// pipelineCache holds the candidates of recent pipeline runs by pipelineCacheKey
+var pipelineCache = struct {
+	sync.Mutex
+	entries map[string]pipelineCacheEntry
+}{entries: make(map[string]pipelineCacheEntry)}
+
+// pipelineCacheKey identifies a pipeline run by the user, the mood and a hash of the configuration,
+// so a run with any different option isn't served from the cache
+func pipelineCacheKey(mood string, cfg RecommenderConfig) string {
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		encoded = []byte(fmt.Sprintf("%+v", cfg))
+	}
+	hash := sha256.Sum256(encoded)
+	return authenticatedUserID + "|" + mood + "|" + hex.EncodeToString(hash[:])
+}
+
+// libraryFingerprint summarizes the liked songs by their count and the most recently liked one, which changes
+// whenever a song is liked or unliked. It returns "" if the library can't be checked.
+func libraryFingerprint(client *spotify.Client) string {
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	page, err := client.CurrentUsersTracks(ctx, spotify.Limit(1))
+	if err != nil {
+		fmt.Printf("Warning: couldn't check your liked songs for changes, not using cached results: %v\n", err)
+		return ""
+	}
+
+	fingerprint := fmt.Sprint(page.Total)
+	if len(page.Tracks) > 0 {
+		fingerprint += "|" + page.Tracks[0].ID.String() + "|" + page.Tracks[0].AddedAt
+	}
+	return fingerprint
+}
+
+// cachedCandidates returns a copy of the pipeline and candidates stored under key if they're younger than ttl
+// and were found in the same library. The caller may change the copies.
+func cachedCandidates(key, library string, ttl time.Duration) (*recommendationPipeline, []spotify.FullTrack, bool) {
+	if ttl <= 0 || library == "" {
+		return nil, nil, false
+	}
+
+	pipelineCache.Lock()
+	defer pipelineCache.Unlock()
+
+	entry, ok := pipelineCache.entries[key]
+	if !ok || time.Since(entry.storedAt) >= ttl || entry.library != library {
+		pipelineResultCacheCounters.misses.Add(1)
+		return nil, nil, false
+	}
+	pipelineResultCacheCounters.hits.Add(1)
+
+	p := *entry.pipeline
+	p.trackStages = maps.Clone(entry.pipeline.trackStages)
+	p.audioFeatures = maps.Clone(entry.pipeline.audioFeatures)
+	return &p, append([]spotify.FullTrack(nil), entry.candidates...), true
+}
+
+// storeCandidates caches the pipeline and its candidates under key, dropping the entries older than ttl
+func storeCandidates(key, library string, ttl time.Duration, p *recommendationPipeline, candidates []spotify.FullTrack) {
+	pipelineCache.Lock()
+	defer pipelineCache.Unlock()
+
+	for k, entry := range pipelineCache.entries {
+		if time.Since(entry.storedAt) >= ttl {
+			delete(pipelineCache.entries, k)
+			pipelineResultCacheCounters.evictions.Add(1)
+		}
+	}
+
+	// The caller goes on to change the pipeline's track stages, audio features and the order of the candidates
+	stored := *p
+	stored.trackStages = maps.Clone(p.trackStages)
+	stored.audioFeatures = maps.Clone(p.audioFeatures)
+	pipelineCache.entries[key] = pipelineCacheEntry{
+		pipeline:   &stored,
+		candidates: append([]spotify.FullTrack(nil), candidates...),
+		library:    library,
+		storedAt:   time.Now(),
+	}
+	pipelineResultCacheCounters.entries.Store(int64(len(pipelineCache.entries)))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestCachedCandidates(t *testing.T) {
+	cfg := DefaultRecommenderConfig()
+	key := pipelineCacheKey("relaxed", cfg)
+	p := &recommendationPipeline{
+		trackStages:   map[spotify.ID]string{"a": StageGenres},
+		audioFeatures: map[spotify.ID]*spotify.AudioFeatures{"a": {Energy: 0.5}},
+	}
+	candidates := []spotify.FullTrack{{SimpleTrack: spotify.SimpleTrack{ID: "a"}}}
+	storeCandidates(key, "library", time.Minute, p, candidates)
+
+	cached, tracks, ok := cachedCandidates(key, "library", time.Minute)
+	if !ok || len(tracks) != 1 || cached.trackStages["a"] != StageGenres {
+		t.Fatalf("cachedCandidates = %v, %v, %v, want the stored candidates", cached, tracks, ok)
+	}
+
+	// Changing what the cache returned must not change the cache
+	cached.trackStages["a"] = blendStage
+	cached.audioFeatures["b"] = nil
+	tracks[0].ID = "b"
+	if cached, tracks, _ := cachedCandidates(key, "library", time.Minute); cached.trackStages["a"] != StageGenres || len(cached.audioFeatures) != 1 || tracks[0].ID != "a" {
+		t.Error("changes to cached candidates leaked into the cache")
+	}
+
+	if _, _, ok := cachedCandidates(key, "changed library", time.Minute); ok {
+		t.Error("cachedCandidates reused candidates of a different library")
+	}
+	if _, _, ok := cachedCandidates(key, "library", 0); ok {
+		t.Error("cachedCandidates reused candidates with the cache turned off")
+	}
+
+	cfg.Order = OrderTitle
+	if _, _, ok := cachedCandidates(pipelineCacheKey("relaxed", cfg), "library", time.Minute); ok {
+		t.Error("cachedCandidates reused candidates found with other options")
+	}
+	if _, _, ok := cachedCandidates(pipelineCacheKey("energetic", DefaultRecommenderConfig()), "library", time.Minute); ok {
+		t.Error("cachedCandidates reused candidates of another mood")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// stratum returns the group a track is sampled from with SamplingStratified: the first genre of its first artist,
+// or the artist itself if its genres are unknown
+func (p *recommendationPipeline) stratum(track spotify.FullTrack) string {
+	if len(track.Artists) == 0 {
+		return ""
+	}
+	artist := track.Artists[0].ID.String()
+	if genres := p.artistGenres[artist]; len(genres) > 0 {
+		return "genre:" + genres[0]
+	}
+	return "artist:" + artist
+}
+
+// stratifyTracks orders the tracks so that every genre, or artist without a known genre, gets a turn before any
+// gets a second one, keeping the order of the tracks within each. A cut then covers as many genres as it can.
+func (p *recommendationPipeline) stratifyTracks(tracks []spotify.FullTrack) {
+	p.prefetchGenres(tracks)
+
+	groups := make(map[string][]spotify.FullTrack)
+	var keys []string
+	for _, track := range tracks {
+		key := p.stratum(track)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], track)
+	}
+
+	stratified := stratify(keys, groups)
+	copy(tracks, stratified)
+	fmt.Printf("Sampled %d tracks across %d genres and artists\n", len(tracks), len(keys))
+}
+
+// stratify takes a track from each group in turn, in the order of keys, until all groups are empty
+func stratify(keys []string, groups map[string][]spotify.FullTrack) []spotify.FullTrack {
+	var stratified []spotify.FullTrack
+	for round := 0; ; round++ {
+		added := false
+		for _, key := range keys {
+			if round < len(groups[key]) {
+				stratified = append(stratified, groups[key][round])
+				added = true
+			}
+		}
+		if !added {
+			return stratified
+		}
+	}
+}
+
+// orderTracks puts the tracks in the configured order
+func (p *recommendationPipeline) orderTracks(tracks []spotify.FullTrack) {
+	if p.cfg.Order == OrderBalanced {
+		p.balanceTracks(tracks)
+		return
+	}
+	OrderTracks(tracks, p.cfg.Order)
+}
+
+// balanceTracks orders the tracks for OrderBalanced. Turns alternate between the track that fits the mood best and
+// the best fitting track that varies the playlist, of another genre than the track before. Neither turn repeats
+// the artist of the track before if it can help it.
+// Without audio features, every track fits equally and the tracks keep their order between variety picks.
+func (p *recommendationPipeline) balanceTracks(tracks []spotify.FullTrack) {
+	p.prefetchGenres(tracks)
+
+	// The fit of tracks the pipeline already has audio features for, such as those of the audio-features stage
+	// or the ranking, takes no more Spotify calls
+	fit, err := p.moodFit(tracks)
+	if err != nil {
+		fmt.Printf("Warning: balancing the playlist by variety alone: %v\n", err)
+	}
+
+	copy(tracks, balance(tracks, fit, p.stratum))
+}
+
+// balance interleaves the tracks by mood fit and variety, as balanceTracks describes. The genre of a track is
+// given by stratum.
+func balance(tracks []spotify.FullTrack, fit map[spotify.ID]float64, stratum func(spotify.FullTrack) string) []spotify.FullTrack {
+	remaining := append([]spotify.FullTrack(nil), tracks...)
+	sort.SliceStable(remaining, func(i, j int) bool {
+		return fit[remaining[i].ID] > fit[remaining[j].ID]
+	})
+
+	sameArtist := func(a, b spotify.FullTrack) bool {
+		return len(a.Artists) > 0 && len(b.Artists) > 0 && a.Artists[0].ID == b.Artists[0].ID
+	}
+
+	balanced := make([]spotify.FullTrack, 0, len(tracks))
+	for len(remaining) > 0 {
+		// The best fit by another artist than the previous track, and on variety turns of another genre too.
+		// If no track left is, the best fit goes.
+		pick := 0
+		if n := len(balanced); n > 0 {
+			previous := balanced[n-1]
+			pick = -1
+			if n%2 == 1 {
+				pick = slices.IndexFunc(remaining, func(track spotify.FullTrack) bool {
+					return !sameArtist(track, previous) && stratum(track) != stratum(previous)
+				})
+			}
+			if pick < 0 {
+				pick = slices.IndexFunc(remaining, func(track spotify.FullTrack) bool { return !sameArtist(track, previous) })
+			}
+			pick = max(pick, 0)
+		}
+
+		balanced = append(balanced, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+	return balanced
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	spotify "github.com/zmb3/spotify/v2"
+	spotifyauth "github.com/zmb3/spotify/v2/auth"
+)
+
+// endpointScopes are the scopes Spotify endpoints that read the user's data need, by path prefix, most specific first
+var endpointScopes = []struct {
+	prefix, scope string
+}{
+	{"/v1/me/player/recently-played", spotifyauth.ScopeUserReadRecentlyPlayed},
+	{"/v1/me/player/currently-playing", spotifyauth.ScopeUserReadCurrentlyPlaying},
+	{"/v1/me/player", spotifyauth.ScopeUserReadPlaybackState},
+	{"/v1/me/top", spotifyauth.ScopeUserTopRead},
+	{"/v1/me/following", spotifyauth.ScopeUserFollowRead},
+	{"/v1/me/tracks", spotifyauth.ScopeUserLibraryRead},
+	{"/v1/me/playlists", spotifyauth.ScopePlaylistReadPrivate},
+}
+
+// requestScope returns the scope a Spotify request needs, or "" if it's unknown
+func requestScope(req *http.Request) string {
+	path := req.URL.Path
+	// Changes to playlists need the modify scopes, which every login asks for, even where reading needs another
+	if req.Method != http.MethodGet && strings.Contains(path, "/playlists") {
+		return spotifyauth.ScopePlaylistModifyPrivate
+	}
+	for _, endpoint := range endpointScopes {
+		if strings.HasPrefix(path, endpoint.prefix) {
+			return endpoint.scope
+		}
+	}
+	return ""
+}
+
+// insufficientScope reports whether Spotify turned down a call as the login didn't grant the scope it needs
+func insufficientScope(err error) bool {
+	var spotifyErr spotify.Error
+	return errors.As(err, &spotifyErr) && spotifyErr.Status == http.StatusForbidden &&
+		strings.Contains(strings.ToLower(spotifyErr.Message), "scope")
+}
+
+// askForScope reports whether an optional call failed for lack of a scope the user wasn't asked for again yet.
+// Callers then fail instead of going without, so the handler sends the user through the login to grant it.
+func askForScope(err error) bool {
+	return insufficientScope(err) && len(scopeGrants.pending()) > 0
+}
+
+// scopeGrants are the scopes Spotify turned calls down for, which the next login asks for on top of requiredScopes
+var scopeGrants = &scopeTracker{}
+
+// scopeTracker records the scopes the token lacks
+type scopeTracker struct {
+	sync.Mutex
+	// missing are the scopes calls were turned down for since the user was last asked for them
+	missing map[string]bool
+	// requested are the scopes the user was sent through the login again for
+	requested map[string]bool
+}
+
+// recordMissing records that a call was turned down for lack of scope. Scopes the user was already asked for
+// again aren't recorded, so a user who doesn't grant them isn't sent through the login over and over.
+func (s *scopeTracker) recordMissing(scope string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.requested[scope] || s.missing[scope] {
+		return
+	}
+	if s.missing == nil {
+		s.missing = make(map[string]bool)
+	}
+	s.missing[scope] = true
+	fmt.Printf("Spotify turned down a call, the login didn't grant the %s scope\n", scope)
+}
+
+// pending returns the missing scopes the user wasn't asked for again yet, sorted
+func (s *scopeTracker) pending() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return sortedScopes(s.missing)
+}
+
+// request moves the missing scopes to the requested ones, and reports whether there were any
+func (s *scopeTracker) request() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.missing) == 0 {
+		return false
+	}
+	if s.requested == nil {
+		s.requested = make(map[string]bool)
+	}
+	for scope := range s.missing {
+		s.requested[scope] = true
+	}
+	s.missing = nil
+	return true
+}
+
+// extra returns the scopes requested on top of requiredScopes, sorted
+func (s *scopeTracker) extra() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return sortedScopes(s.requested)
+}
+
+// sortedScopes returns the scopes of a set, sorted
+func sortedScopes(set map[string]bool) []string {
+	var scopes []string
+	for scope := range set {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// scopeTransport records the scope a Spotify call was turned down for with a 403 about scopes. Spotify only says
+// the scope is insufficient, so the scope is worked out from the endpoint.
+type scopeTransport struct {
+	base http.RoundTripper
+}
+
+func (t *scopeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+
+	// Put the body back for the Spotify client to decode the error from
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if strings.Contains(strings.ToLower(string(body)), "scope") {
+		if scope := requestScope(req); scope != "" {
+			scopeGrants.recordMissing(scope)
+		}
+	}
+	return resp, nil
+}
+
+// resumeRequest is a form submission that's submitted again after the user logged in with more scopes
+type resumeRequest struct {
+	Action string
+	Form   url.Values
+	Scopes []string
+}
+
+var (
+	pendingResumeMu sync.Mutex
+	// pendingResume is the form to submit again after the next login, if any
+	pendingResume *resumeRequest
+)
+
+// reconsent sends the user through the login again if Spotify turned down calls for lack of a scope, which
+// then asks for the missing scopes on top of the usual ones. The form is submitted again after the login.
+// It reports whether it did, in which case the handler shouldn't write a response of its own.
+func reconsent(w http.ResponseWriter, r *http.Request) bool {
+	scopes := scopeGrants.pending()
+	if len(scopes) == 0 {
+		return false
+	}
+
+	pendingResumeMu.Lock()
+	pendingResume = &resumeRequest{Action: r.URL.Path, Form: r.PostForm, Scopes: scopes}
+	pendingResumeMu.Unlock()
+
+	fmt.Printf("Asking to log in again to grant %s\n", strings.Join(scopes, ", "))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return true
+}
+
+// takeResume returns the form to submit again after a login, if any, and forgets it
+func takeResume() *resumeRequest {
+	pendingResumeMu.Lock()
+	defer pendingResumeMu.Unlock()
+
+	resume := pendingResume
+	pendingResume = nil
+	return resume
+}
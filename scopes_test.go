@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	spotify "github.com/zmb3/spotify/v2"
+	spotifyauth "github.com/zmb3/spotify/v2/auth"
+)
+
+func TestScopeTransportRecordsMissingScopes(t *testing.T) {
+	saved := scopeGrants
+	defer func() { scopeGrants = saved }()
+	scopeGrants = &scopeTracker{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/me/following" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"status": 403, "message": "Insufficient client scope"}}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": {"status": 403, "message": "Forbidden"}}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &scopeTransport{}}
+	for _, path := range []string{"/v1/me/following", "/v1/audio-features"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	want := []string{spotifyauth.ScopeUserFollowRead}
+	if got := scopeGrants.pending(); !slices.Equal(got, want) {
+		t.Fatalf("pending scopes = %v, want %v", got, want)
+	}
+
+	// Once the user is asked for a scope, it isn't asked for again
+	if !scopeGrants.request() {
+		t.Fatal("request found no missing scopes")
+	}
+	scopeGrants.recordMissing(spotifyauth.ScopeUserFollowRead)
+	if got := scopeGrants.pending(); len(got) != 0 {
+		t.Errorf("pending scopes after the request = %v, want none", got)
+	}
+	if got := scopeGrants.extra(); !slices.Equal(got, want) {
+		t.Errorf("extra scopes = %v, want %v", got, want)
+	}
+}
+
+func TestRequestScope(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/v1/me/playlists", spotifyauth.ScopePlaylistReadPrivate},
+		{"POST", "/v1/me/playlists", spotifyauth.ScopePlaylistModifyPrivate},
+		{"POST", "/v1/playlists/abc/tracks", spotifyauth.ScopePlaylistModifyPrivate},
+		{"GET", "/v1/me/player/recently-played", spotifyauth.ScopeUserReadRecentlyPlayed},
+		{"GET", "/v1/audio-features", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "https://api.spotify.com"+test.path, nil)
+		if got := requestScope(req); got != test.want {
+			t.Errorf("requestScope(%s %s) = %q, want %q", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestAskForScopeOnlyWhileTheUserCanBeAsked(t *testing.T) {
+	saved := scopeGrants
+	defer func() { scopeGrants = saved }()
+	scopeGrants = &scopeTracker{}
+
+	err := spotify.Error{Status: http.StatusForbidden, Message: "Insufficient client scope"}
+	if askForScope(err) {
+		t.Error("asked for a scope no call was turned down for")
+	}
+
+	scopeGrants.recordMissing(spotifyauth.ScopeUserReadRecentlyPlayed)
+	if !askForScope(fmt.Errorf("failed to get your recently played tracks: %w", err)) {
+		t.Error("didn't ask for the missing scope")
+	}
+
+	// A user who was asked already and didn't grant it goes without
+	scopeGrants.request()
+	if askForScope(err) {
+		t.Error("asked again for a scope the user was asked for")
+	}
+}
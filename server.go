@@ -1,19 +1,38 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
 
 	spotify "github.com/zmb3/spotify/v2"
 )
 
 var authenticatedClient *spotify.Client
 
+// authenticatedUserID is the Spotify ID of the logged in user
+var authenticatedUserID string
+
+// authenticatedUserCountry is the country of the logged in user, empty if Spotify didn't share it
+var authenticatedUserCountry string
+
 // Use a more secure state value
 const stateKey = "spotify-auth-state"
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	// The replayed session is logged in already
+	if replaying() {
+		http.Redirect(w, r, "/success", http.StatusSeeOther)
+		return
+	}
+
+	// Ask for the scopes Spotify turned calls down for too
+	if scopeGrants.request() {
+		auth = Auth()
+	}
+
 	// Generate a proper state string for security
 	state := stateKey
 	url := auth.AuthURL(state)
@@ -21,17 +40,59 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func StartServer() {
+// IndexHandler renders the landing page, or the app for logged in users
+func IndexHandler(w http.ResponseWriter, r *http.Request) {
+	// "/" matches every path that has no handler of its own
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Logged in users get the app itself
+	if authenticatedClient != nil {
+		serveApp(w)
+		return
+	}
+
+	renderPage(w, "index.html", nil)
+}
+
+// StartServer registers the handlers and serves until the server fails
+func StartServer() error {
+	http.HandleFunc("/", IndexHandler)
 	http.HandleFunc("/login", LoginHandler)
 	http.HandleFunc("/callback", CallbackHandler)
 	http.HandleFunc("/success", SuccessHandler)
-	http.HandleFunc("/create-playlist-weather", CreatePlaylistHandlerByWeather)
-	http.HandleFunc("/create-playlist-genre", CreatePlaylistHandlerByGenre)
-	fmt.Println("Server started on http://localhost:8081 - Visit /login to begin")
-	// Add error handling for server
-	if err := http.ListenAndServe(":8081", nil); err != nil {
-		log.Fatal("Server error:", err)
+	// Only MaxConcurrentCreations requests create playlists at a time
+	http.HandleFunc("/create-playlist-weather", oneCreationAtATime(CreatePlaylistHandlerByWeather))
+	http.HandleFunc("/create-playlist-genre", oneCreationAtATime(CreatePlaylistHandlerByGenre))
+	http.HandleFunc("/create-playlist-overlap", oneCreationAtATime(CreatePlaylistHandlerFromPlaylist))
+	http.HandleFunc("/publish-playlist", PublishPlaylistHandler)
+	http.HandleFunc("/import", oneCreationAtATime(ImportHandler))
+	http.HandleFunc("/regenerate-playlist", oneCreationAtATime(RegeneratePlaylistHandler))
+	http.HandleFunc("/resume", oneCreationAtATime(ResumePlanHandler))
+	http.HandleFunc("/card", SummaryCardHandler)
+	http.HandleFunc("/cancel", CancelHandler)
+	http.HandleFunc("/api/playlists/batch", oneCreationAtATime(BatchPlaylistsHandler))
+	http.HandleFunc("/api/last-playlist", LastPlaylistHandler)
+	http.HandleFunc("/api/mood-preview", MoodPreviewHandler)
+	// Previews run the whole pipeline too, so they count as creations
+	http.HandleFunc("/api/preview", oneCreationAtATime(PlaylistPreviewHandler))
+	http.HandleFunc("/api/variants", oneCreationAtATime(PlaylistVariantsHandler))
+	http.HandleFunc("/api/variants/commit", oneCreationAtATime(PlaylistVariantCommitHandler))
+	http.HandleFunc("/api/mood-from-weather", MoodFromWeatherHandler)
+	http.HandleFunc("/api/profiles", ProfilesHandler)
+	http.HandleFunc("/api/never-play", NeverPlayHandler)
+	http.HandleFunc("/api/stats", TasteStatsHandler)
+	http.HandleFunc("/admin/cache-stats", CacheStatsHandler)
+	http.HandleFunc("/health", HealthHandler)
+	var handler http.Handler = http.DefaultServeMux
+	if recommenderConfig.LogRequests {
+		handler = logRequests(handler)
 	}
+
+	fmt.Println("Server started on http://localhost:8081 - Visit it in your browser to begin")
+	return http.ListenAndServe(":8081", handler)
 }
 
 func CreatePlaylistHandlerByWeather(w http.ResponseWriter, r *http.Request) {
@@ -41,60 +102,209 @@ func CreatePlaylistHandlerByWeather(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if authenticatedClient != nil {
-		CreatePlaylistWeather(authenticatedClient)
-		html := `
-		<!DOCTYPE html>
-		<html>
-		<head>
-			<style>
-				body {
-					font-family: 'Circular', Helvetica, Arial, sans-serif;
-					background-color: #121212;
-					color: white;
-					text-align: center;
-					padding: 40px;
-					max-width: 600px;
-					margin: 0 auto;
-				}
-				h1 {
-					color: #1DB954;
-					font-size: 32px;
-					margin-bottom: 20px;
-				}
-				p {
-					font-size: 18px;
-					margin-bottom: 30px;
-				}
-				.success-icon {
-					font-size: 64px;
-					color: #1DB954;
-					margin-bottom: 20px;
-				}
-				.back-link {
-					color: #1DB954;
-					text-decoration: none;
-					font-weight: bold;
-					display: inline-block;
-					margin-top: 20px;
-				}
-				.back-link:hover {
-					text-decoration: underline;
-				}
-			</style>
-		</head>
-		<body>
-			<div class="success-icon">✓</div>
-			<h1>Playlist Created!</h1>
-			<p>Your weather-based playlist has been successfully added to your Spotify account.</p>
-		</body>
-		</html>
-		`
-		fmt.Fprint(w, html)
+		city := cityQuery(normalizeCity(r.FormValue("city")))
+		lat, lon := r.FormValue("lat"), r.FormValue("lon")
+		opts := playlistOptionsFromForm(r)
+		if err := opts.useProfile(strings.TrimSpace(r.FormValue("profile"))); err != nil {
+			http.Error(w, "Invalid profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.Mood != "" {
+			if err := ValidateMood(opts.Mood); err != nil {
+				http.Error(w, "Invalid mood: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if opts.Genre != "" && !isAvailableGenre(opts.Genre) {
+			http.Error(w, "Please choose one of the available genres", http.StatusBadRequest)
+			return
+		}
+		if opts.BlendWith != "" {
+			if _, err := ParsePlaylistID(opts.BlendWith); err != nil {
+				http.Error(w, "Invalid playlist to blend with: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if opts.TargetMinutes < 0 {
+			http.Error(w, fmt.Sprintf("The length must be from 1 to %d minutes", maxTargetMinutes), http.StatusBadRequest)
+			return
+		}
+		if _, err := applyLimits(recommenderConfig, opts.Limits); err != nil {
+			http.Error(w, "Invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cities := ParseCityList(r.FormValue("cities"))
+		if pick := r.FormValue("pick"); len(cities) > 0 && pick != "" && pick != PickMostExtreme {
+			http.Error(w, fmt.Sprintf("Unknown way to pick a city %q, expected %s", pick, PickMostExtreme), http.StatusBadRequest)
+			return
+		}
+
+		var result *PlaylistResult
+		var err error
+
+		switch {
+		case len(cities) > 0:
+			// Several cities were given, so the one with the most extreme weather is picked
+			result, err = createPlaylistForMostExtremeCity(cities, opts)
+		case lat != "" && lon != "":
+			// A location was picked explicitly, so no geocoding is needed
+			latitude, latErr := strconv.ParseFloat(lat, 64)
+			longitude, lonErr := strconv.ParseFloat(lon, 64)
+			if latErr != nil || lonErr != nil {
+				http.Error(w, "Invalid coordinates", http.StatusBadRequest)
+				return
+			}
+
+			opts.NameVars.City = r.FormValue("place")
+			result, err = createPlaylistForCoords(latitude, longitude, opts)
+		case city != "" && isZip(city):
+			// Postal codes aren't ambiguous, so no geocoding is needed
+			result, err = createPlaylistForZip(city, opts)
+		case city != "":
+			locations, geoErr := GeocodeCity(city)
+			if errors.Is(geoErr, ErrWeatherCircuitOpen) {
+				// The weather service is down, so the weather of the city couldn't be fetched either
+				opts.NameVars.City = city
+				result, err = createPlaylistWithoutWeather(authenticatedClient, geoErr, opts)
+				break
+			}
+			if errors.Is(geoErr, ErrCityNotFound) && len(recommenderConfig.FallbackCities) > 0 {
+				result, err = createPlaylistForFallbackCity(city, geoErr, opts)
+				break
+			}
+			if errors.Is(geoErr, ErrCityNotFound) {
+				http.Error(w, "City not found: "+city, http.StatusNotFound)
+				return
+			}
+			if geoErr != nil {
+				http.Error(w, "Failed to look up city: "+geoErr.Error(), http.StatusBadGateway)
+				return
+			}
+
+			// Let the user pick if the name matches more than one place
+			if len(locations) > 1 {
+				renderLocationPicker(w, city, locations, opts)
+				return
+			}
+
+			opts.NameVars.City = locations[0].Name
+			result, err = createPlaylistForCoords(locations[0].Lat, locations[0].Lon, opts)
+		default:
+			// No city given, so ask for one in the terminal
+			result, err = CreatePlaylistWeather(authenticatedClient, opts)
+		}
+
+		if err != nil {
+			if reconsent(w, r) {
+				return
+			}
+			status, message := errorResponse(err, "Failed to create playlist")
+			http.Error(w, message, status)
+			return
+		}
+
+		renderPlaylistCreated(w, "weather-based", result)
 	} else {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	}
 }
 
+// createPlaylistForCoords creates a weather-based playlist for the weather at the given coordinates
+func createPlaylistForCoords(lat, lon float64, opts PlaylistOptions) (*PlaylistResult, error) {
+	return createPlaylistForFetchedWeather(func() (*Weather, error) { return GetWeatherByCoords(lat, lon) }, opts)
+}
+
+// createPlaylistForMostExtremeCity creates a weather-based playlist for whichever of the cities has the most
+// extreme weather, falling back to the fallback cities or a neutral playlist if none of their weather can be fetched
+func createPlaylistForMostExtremeCity(cities []string, opts PlaylistOptions) (*PlaylistResult, error) {
+	weather, err := MostExtremeWeather(cities)
+	if err != nil {
+		return createPlaylistForFallbackCity(strings.Join(cities, ", "), err, opts)
+	}
+	return createPlaylistForFetchedWeather(func() (*Weather, error) { return weather, nil }, opts)
+}
+
+// isZip reports whether a location entered by the user is a postal code
+func isZip(input string) bool {
+	_, _, ok := ParseZip(input)
+	return ok
+}
+
+// createPlaylistForZip creates a weather-based playlist for the weather at a postal code.
+// The playlist is named after the place the weather API reports for the code.
+func createPlaylistForZip(input string, opts PlaylistOptions) (*PlaylistResult, error) {
+	zip, country, _ := ParseZip(input)
+	return createPlaylistForFetchedWeather(func() (*Weather, error) { return GetWeatherByZip(zip, country) }, opts)
+}
+
+// createPlaylistForFetchedWeather creates a weather-based playlist for the weather returned by fetch,
+// falling back to the fallback cities or a neutral playlist if it keeps failing
+func createPlaylistForFetchedWeather(fetch func() (*Weather, error), opts PlaylistOptions) (*PlaylistResult, error) {
+	weather, err := GetWeatherWithRetry(fetch)
+	if err != nil {
+		place := opts.NameVars.City
+		if place == "" {
+			place = "the location"
+		}
+		return createPlaylistForFallbackCity(place, err, opts)
+	}
+
+	if opts.NameVars.City == "" {
+		opts.NameVars.City = weather.Name
+	}
+	return CreatePlaylistForWeather(authenticatedClient, weather, MoodFromWeather(weather), opts)
+}
+
+// createPlaylistForFallbackCity creates a weather-based playlist for the first of the configured fallback cities
+// whose weather can be fetched, for when the weather of place couldn't be. Without any, the playlist is neutral.
+func createPlaylistForFallbackCity(place string, weatherErr error, opts PlaylistOptions) (*PlaylistResult, error) {
+	// While the weather service is down, the fallback cities would fail just the same
+	if errors.Is(weatherErr, ErrWeatherCircuitOpen) {
+		return createPlaylistWithoutWeather(authenticatedClient, weatherErr, opts)
+	}
+
+	fmt.Println("Error getting weather data:", weatherErr)
+	weather, err := GetFallbackWeather(place)
+	if err != nil {
+		return createPlaylistWithoutWeather(authenticatedClient, err, opts)
+	}
+
+	opts.NameVars.City = weather.Name
+	result, err := CreatePlaylistForWeather(authenticatedClient, weather, MoodFromWeather(weather), opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Warnings = append(result.Warnings, fmt.Sprintf("The weather of %s couldn't be fetched, so the weather in %s was used instead.", place, weather.Name))
+	return result, nil
+}
+
+// locationChoice is a location the user can pick on the location picker
+type locationChoice struct {
+	Lat, Lon string
+	Name     string
+	Label    string
+}
+
+// renderLocationPicker shows the locations matching an ambiguous city name so the user can pick one
+func renderLocationPicker(w http.ResponseWriter, city string, locations []Location, opts PlaylistOptions) {
+	choices := make([]locationChoice, len(locations))
+	for i, location := range locations {
+		choices[i] = locationChoice{
+			Lat:   strconv.FormatFloat(location.Lat, 'f', -1, 64),
+			Lon:   strconv.FormatFloat(location.Lon, 'f', -1, 64),
+			Name:  location.Name,
+			Label: location.String(),
+		}
+	}
+
+	renderPage(w, "locations.html", struct {
+		City      string
+		Locations []locationChoice
+		Options   PlaylistOptions
+	}{city, choices, opts})
+}
+
 func CreatePlaylistHandlerByGenre(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -102,55 +312,53 @@ func CreatePlaylistHandlerByGenre(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if authenticatedClient != nil {
-		CreatePlaylistGenre(authenticatedClient)
-		html := `
-		<!DOCTYPE html>
-		<html>
-		<head>
-			<style>
-				body {
-					font-family: 'Circular', Helvetica, Arial, sans-serif;
-					background-color: #121212;
-					color: white;
-					text-align: center;
-					padding: 40px;
-					max-width: 600px;
-					margin: 0 auto;
-				}
-				h1 {
-					color: #1DB954;
-					font-size: 32px;
-					margin-bottom: 20px;
-				}
-				p {
-					font-size: 18px;
-					margin-bottom: 30px;
-				}
-				.success-icon {
-					font-size: 64px;
-					color: #1DB954;
-					margin-bottom: 20px;
-				}
-				.back-link {
-					color: #1DB954;
-					text-decoration: none;
-					font-weight: bold;
-					display: inline-block;
-					margin-top: 20px;
-				}
-				.back-link:hover {
-					text-decoration: underline;
-				}
-			</style>
-		</head>
-		<body>
-			<div class="success-icon">✓</div>
-			<h1>Playlist Created!</h1>
-			<p>Your genre-based playlist has been successfully added to your Spotify account.</p>
-		</body>
-		</html>
-		`
-		fmt.Fprint(w, html)
+		genre := r.FormValue("genre")
+		if !isAvailableGenre(genre) {
+			http.Error(w, "Please choose one of the available genres", http.StatusBadRequest)
+			return
+		}
+
+		// Without a size, the playlist size of the profile and limits is used
+		size := 0
+		if value := r.FormValue("size"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Invalid playlist size", http.StatusBadRequest)
+				return
+			}
+			size = parsed
+		}
+
+		likedOnly := r.FormValue("liked_only") != ""
+
+		// Genre playlists take their mood from the genre, the one chosen or the profile, and never from the weather
+		opts := playlistOptionsFromForm(r)
+		if err := opts.useProfile(strings.TrimSpace(r.FormValue("profile"))); err != nil {
+			http.Error(w, "Invalid profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.Mood != "" {
+			if err := ValidateMood(opts.Mood); err != nil {
+				http.Error(w, "Invalid mood: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if _, err := applyLimits(recommenderConfig, opts.Limits); err != nil {
+			http.Error(w, "Invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := CreateGenrePlaylist(authenticatedClient, genre, size, likedOnly, opts)
+		if err != nil {
+			if reconsent(w, r) {
+				return
+			}
+			status, message := errorResponse(err, "Failed to create playlist")
+			http.Error(w, message, status)
+			return
+		}
+
+		renderPlaylistCreated(w, "genre-based", result)
 	} else {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	}
@@ -172,8 +380,16 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create authenticated client
-	authenticatedClient = spotify.New(auth.Client(r.Context(), token))
+	// Create authenticated client, counting calls against the budget of the request they're made for
+	httpClient := auth.Client(r.Context(), token)
+	// and recording the scopes calls are turned down for, and the responses when recording a session to replay
+	httpClient.Transport = &callBudgetTransport{base: &scopeTransport{base: newReplayTransport(httpClient.Transport)}}
+	if recommenderConfig.SpotifyTrace {
+		httpClient.Transport = &traceTransport{base: httpClient.Transport}
+	}
+
+	// Retry rate limited requests after the delay Spotify asks for
+	authenticatedClient = spotify.New(httpClient, spotify.WithRetry(true))
 
 	// Verify client works by getting current user
 	user, err := authenticatedClient.CurrentUser(r.Context())
@@ -182,7 +398,15 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Printf("Logged in as %s (%s)\n", user.DisplayName, user.ID)
+	fmt.Printf("Logged in as %s (%s)\n", displayName(user.User), user.ID)
+	authenticatedUserID = user.ID
+	authenticatedUserCountry = user.Country
+
+	// Pick up where the user left off if they were sent to log in again for more scopes
+	if resume := takeResume(); resume != nil {
+		renderPage(w, "resume.html", resume)
+		return
+	}
 
 	// Redirect to success page
 	http.Redirect(w, r, "/success", http.StatusSeeOther)
@@ -194,65 +418,96 @@ func SuccessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	html := `
-    <!DOCTYPE html>
-    <html>
-    <head>
-        <style>
-            body {
-                font-family: 'Circular', Helvetica, Arial, sans-serif;
-                background-color: #121212;
-                color: white;
-                text-align: center;
-                padding: 40px;
-                max-width: 600px;
-                margin: 0 auto;
-            }
-            h1 {
-                color: #1DB954;
-                font-size: 32px;
-                margin-bottom: 20px;
-            }
-            p {
-                font-size: 18px;
-                margin-bottom: 30px;
-            }
-            button {
-                background-color: #1DB954;
-                color: white;
-                border: none;
-                padding: 16px 32px;
-                font-size: 16px;
-                font-weight: bold;
-                border-radius: 30px;
-                cursor: pointer;
-                transition: background-color 0.3s;
-            }
-            button:hover {
-                background-color: #1ed760;
-                transform: scale(1.05);
-            }
-			.buttons {
-				display: flex;
-				justify-content: center;
-				gap: 2em;
-			}
-        </style>
-    </head>
-    <body>
-        <h1>Successfully logged in!</h1>
-        <p>Click the button below to create a weather-based playlist:</p>
-		<div class="buttons">
-        <form method="POST" action="/create-playlist-weather">
-            <button type="submit">Create Playlist By Weather</button>
-        </form>
-		<form method="POST" action="/create-playlist-genre">
-			<button type="submit">Create Playlist by Genre</button>
-		</form>
-		</div>
-    </body>
-    </html>
-    `
-
-	fmt.Fprint(w, html)
+	renderPage(w, "success.html", struct {
+		Moods    []string
+		Genres   []string
+		Profiles []string
+	}{Moods, uniqueGenres(GetAvailableGenres(authenticatedClient)), profileNames()})
+}
+
+// playlistOptionsFromForm reads the playlist visibility and name template from a submitted form
+func playlistOptionsFromForm(r *http.Request) PlaylistOptions {
+	// An invalid length is turned into -1, for the handler to reject
+	targetMinutes := 0
+	if value := strings.TrimSpace(r.FormValue("target_minutes")); value != "" {
+		targetMinutes = -1
+		if parsed, err := strconv.Atoi(value); err == nil && parsed > 0 && parsed <= maxTargetMinutes {
+			targetMinutes = parsed
+		}
+	}
+
+	return PlaylistOptions{
+		Public:           r.FormValue("public") != "",
+		ConfirmPublic:    r.FormValue("confirm_public") != "",
+		NameTemplate:     strings.TrimSpace(r.FormValue("name_template")),
+		Mood:             strings.ToLower(strings.TrimSpace(r.FormValue("mood"))),
+		Genre:            strings.TrimSpace(r.FormValue("mood_genre")),
+		BlendWith:        strings.TrimSpace(r.FormValue("blend_with")),
+		TargetMinutes:    targetMinutes,
+		Limits:           limitsFromForm(r.FormValue),
+		InstrumentalOnly: r.FormValue("instrumental_only") != "",
+	}
+}
+
+// renderPlaylistCreated shows the created playlist along with any warnings.
+// If a public playlist was held back because of explicit tracks, it asks the user to confirm publishing it.
+func renderPlaylistCreated(w http.ResponseWriter, kind string, result *PlaylistResult) {
+	data := struct {
+		Kind        string
+		Result      *PlaylistResult
+		Detailed    bool
+		Regenerable bool
+	}{kind, result, recommenderConfig.DetailedSuccessPage, isRememberedPlaylist(result.ID)}
+	rememberResult(result)
+
+	renderPage(w, "playlist-created.html", data)
+}
+
+// PublishPlaylistHandler makes a playlist public after the user confirmed publishing its explicit content
+func PublishPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if authenticatedClient == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	playlistID := r.FormValue("playlist_id")
+	if playlistID == "" {
+		http.Error(w, "Missing playlist", http.StatusBadRequest)
+		return
+	}
+
+	if err := authenticatedClient.ChangePlaylistAccess(r.Context(), spotify.ID(playlistID), true); err != nil {
+		http.Error(w, "Failed to publish playlist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/success", http.StatusSeeOther)
+}
+
+// uniqueGenres returns the genres without duplicates, keeping their order
+func uniqueGenres(genres []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, genre := range genres {
+		if !seen[genre] {
+			seen[genre] = true
+			unique = append(unique, genre)
+		}
+	}
+	return unique
+}
+
+// isAvailableGenre reports whether the genre is one the user can pick from
+func isAvailableGenre(genre string) bool {
+	for _, available := range GetAvailableGenres(authenticatedClient) {
+		if genre == available {
+			return true
+		}
+	}
+	return false
 }
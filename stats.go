@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// maxStatsAudioFeatures is how many liked songs the average audio features are taken over, the most recently
+// liked first, which keeps the number of calls down for large libraries
+const maxStatsAudioFeatures = 500
+
+// maxStatsTopItems is how many top genres and artists the taste statistics list
+const maxStatsTopItems = 10
+
+// TasteStats describe the user's taste from their liked songs
+type TasteStats struct {
+	TrackCount int `json:"trackCount"`
+	// TopGenres are the most common genres of the songs' artists, with how many songs have them
+	TopGenres []GenreCount `json:"topGenres"`
+	// TopArtists are the artists with the most liked songs, counting only each song's first artist
+	TopArtists []ArtistCount `json:"topArtists"`
+	// UniqueArtists is how many different artists the songs are by, and ArtistDiversity that relative to the
+	// number of songs: 1 means no artist has more than one song
+	UniqueArtists   int     `json:"uniqueArtists"`
+	ArtistDiversity float64 `json:"artistDiversity"`
+	// Decades counts the songs by the decade they were released in, such as "1990s"
+	Decades map[string]int `json:"decades"`
+	// AudioFeatures are the average audio features of up to maxStatsAudioFeatures songs, if Spotify gives them out
+	AudioFeatures *AverageAudioFeatures `json:"audioFeatures,omitempty"`
+	// Partial is set if not all liked songs could be loaded in time, so the statistics only cover some of them.
+	// Partial statistics aren't kept, so they're computed again next time.
+	Partial    bool      `json:"partial,omitempty"`
+	ComputedAt time.Time `json:"computedAt"`
+}
+
+// GenreCount is how many liked songs have a genre
+type GenreCount struct {
+	Genre string `json:"genre"`
+	Count int    `json:"count"`
+}
+
+// ArtistCount is how many liked songs are by an artist
+type ArtistCount struct {
+	Artist string `json:"artist"`
+	Count  int    `json:"count"`
+}
+
+// AverageAudioFeatures are the average audio features of a number of tracks
+type AverageAudioFeatures struct {
+	Tracks           int     `json:"tracks"`
+	Energy           float64 `json:"energy"`
+	Danceability     float64 `json:"danceability"`
+	Valence          float64 `json:"valence"`
+	Tempo            float64 `json:"tempo"`
+	Acousticness     float64 `json:"acousticness"`
+	Instrumentalness float64 `json:"instrumentalness"`
+}
+
+// tasteStatsCache holds the statistics of the library they were computed for, as identified by
+// libraryFingerprint, so they're only computed again once a song is liked or unliked
+var tasteStatsCache struct {
+	sync.Mutex
+	library string
+	stats   *TasteStats
+}
+
+// ComputeTasteStats computes the statistics of all of the user's liked songs, whatever SAMPLE_SIZE says. The liked
+// songs and their artists' genres are reused from a cached pipeline run over the whole library if there is one.
+func ComputeTasteStats(client *spotify.Client) (*TasteStats, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
+	}
+
+	library := libraryFingerprint(client)
+	tasteStatsCache.Lock()
+	defer tasteStatsCache.Unlock()
+	if library != "" && tasteStatsCache.library == library {
+		tasteStatsCacheCounters.hits.Add(1)
+		return tasteStatsCache.stats, nil
+	}
+	tasteStatsCacheCounters.misses.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), recommenderConfig.LibraryTimeout)
+	defer cancel()
+
+	partial := false
+	songs, likedAt, artistGenres := cachedLibrary(library)
+	if songs == nil {
+		cfg := recommenderConfig
+		cfg.SampleSize = 0
+		liked, err := loadLikedSongs(ctx, client, cfg)
+		if err != nil {
+			return nil, err
+		}
+		songs, likedAt, artistGenres = liked.songs, liked.likedAt, make(map[string][]string)
+		partial = liked.partial
+	}
+
+	var artistIDs []spotify.ID
+	for _, track := range songs {
+		for _, artist := range track.Artists {
+			artistIDs = append(artistIDs, artist.ID)
+		}
+	}
+	if err := prefetchArtistGenres(ctx, client, artistIDs, artistGenres); err != nil {
+		fmt.Printf("Warning: the top genres leave out some artists: %v\n", err)
+	}
+
+	stats := tasteStats(songs, artistGenres)
+	stats.AudioFeatures = averageAudioFeatures(ctx, client, recentlyLiked(songs, likedAt, maxStatsAudioFeatures))
+	stats.Partial = partial
+
+	if library != "" && !partial {
+		tasteStatsCache.library, tasteStatsCache.stats = library, stats
+		tasteStatsCacheCounters.entries.Store(1)
+	}
+	return stats, nil
+}
+
+// cachedLibrary returns the liked songs, when they were liked and their artists' genres from a cached pipeline
+// run that loaded the whole library, or nil if there is none. Runs over a sample or that ran out of time to load
+// every song aren't reused.
+func cachedLibrary(library string) ([]spotify.FullTrack, map[string]time.Time, map[string][]string) {
+	if library == "" {
+		return nil, nil, nil
+	}
+
+	pipelineCache.Lock()
+	defer pipelineCache.Unlock()
+
+	for _, entry := range pipelineCache.entries {
+		p := entry.pipeline
+		if entry.library == library && p.cfg.SampleSize == 0 && !p.partialLibrary && len(p.userLikedSongs) > 0 {
+			return p.userLikedSongs, p.likedAt, maps.Clone(p.artistGenres)
+		}
+	}
+	return nil, nil, nil
+}
+
+// tasteStats counts the genres, artists and decades of the songs, given their artists' genres
+func tasteStats(songs []spotify.FullTrack, artistGenres map[string][]string) *TasteStats {
+	stats := &TasteStats{
+		TrackCount: len(songs),
+		Decades:    make(map[string]int),
+		ComputedAt: time.Now(),
+	}
+
+	genres := make(map[string]int)
+	artists := make(map[spotify.ID]int)
+	artistNames := make(map[spotify.ID]string)
+	for _, track := range songs {
+		// A song counts once for each of its genres, however many of its artists have it
+		trackGenres := make(map[string]bool)
+		for _, artist := range track.Artists {
+			for _, genre := range artistGenres[artist.ID.String()] {
+				trackGenres[genre] = true
+			}
+		}
+		for genre := range trackGenres {
+			genres[genre]++
+		}
+
+		if len(track.Artists) > 0 {
+			artist := track.Artists[0]
+			artists[artist.ID]++
+			artistNames[artist.ID] = artist.Name
+		}
+
+		if released := track.Album.ReleaseDateTime(); track.Album.ReleaseDate != "" && !released.IsZero() {
+			stats.Decades[fmt.Sprintf("%ds", released.Year()/10*10)]++
+		}
+	}
+
+	for genre, count := range genres {
+		stats.TopGenres = append(stats.TopGenres, GenreCount{Genre: genre, Count: count})
+	}
+	sort.Slice(stats.TopGenres, func(i, j int) bool {
+		a, b := stats.TopGenres[i], stats.TopGenres[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Genre < b.Genre)
+	})
+	stats.TopGenres = stats.TopGenres[:min(maxStatsTopItems, len(stats.TopGenres))]
+
+	for id, count := range artists {
+		stats.TopArtists = append(stats.TopArtists, ArtistCount{Artist: artistNames[id], Count: count})
+	}
+	sort.Slice(stats.TopArtists, func(i, j int) bool {
+		a, b := stats.TopArtists[i], stats.TopArtists[j]
+		return a.Count > b.Count || (a.Count == b.Count && a.Artist < b.Artist)
+	})
+	stats.TopArtists = stats.TopArtists[:min(maxStatsTopItems, len(stats.TopArtists))]
+
+	stats.UniqueArtists = len(artists)
+	if len(songs) > 0 {
+		stats.ArtistDiversity = float64(len(artists)) / float64(len(songs))
+	}
+	return stats
+}
+
+// recentlyLiked returns the IDs of up to count of the songs, the most recently liked first
+func recentlyLiked(songs []spotify.FullTrack, likedAt map[string]time.Time, count int) []spotify.ID {
+	sorted := append([]spotify.FullTrack(nil), songs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return likedAt[sorted[i].ID.String()].After(likedAt[sorted[j].ID.String()])
+	})
+
+	ids := make([]spotify.ID, 0, min(count, len(sorted)))
+	for _, track := range sorted[:min(count, len(sorted))] {
+		ids = append(ids, track.ID)
+	}
+	return ids
+}
+
+// averageAudioFeatures averages the audio features of the tracks, or returns nil if Spotify won't give them out
+func averageAudioFeatures(ctx context.Context, client *spotify.Client, trackIDs []spotify.ID) *AverageAudioFeatures {
+	average := &AverageAudioFeatures{}
+	for start := 0; start < len(trackIDs); start += maxAudioFeaturesPerRequest {
+		audioFeatures, err := client.GetAudioFeatures(ctx, trackIDs[start:min(start+maxAudioFeaturesPerRequest, len(trackIDs))]...)
+		if err != nil {
+			fmt.Printf("Warning: leaving the audio features out of the taste statistics: %v\n", err)
+			return nil
+		}
+		for _, features := range audioFeatures {
+			if features == nil {
+				continue
+			}
+			average.Tracks++
+			average.Energy += float64(features.Energy)
+			average.Danceability += float64(features.Danceability)
+			average.Valence += float64(features.Valence)
+			average.Tempo += float64(features.Tempo)
+			average.Acousticness += float64(features.Acousticness)
+			average.Instrumentalness += float64(features.Instrumentalness)
+		}
+	}
+	if average.Tracks == 0 {
+		return nil
+	}
+
+	n := float64(average.Tracks)
+	average.Energy /= n
+	average.Danceability /= n
+	average.Valence /= n
+	average.Tempo /= n
+	average.Acousticness /= n
+	average.Instrumentalness /= n
+	return average
+}
+
+// TasteStatsHandler returns statistics of the logged in user's liked songs: their top genres and artists,
+// artist diversity, decades and average audio features
+func TasteStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	stats, err := ComputeTasteStats(authenticatedClient)
+	if err != nil {
+		status, message := errorResponse(err, "Failed to compute your taste statistics")
+		writeJSONError(w, status, message)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
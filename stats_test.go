@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestTasteStats(t *testing.T) {
+	track := func(id, artist, released string) spotify.FullTrack {
+		var track spotify.FullTrack
+		track.ID = spotify.ID(id)
+		track.Artists = []spotify.SimpleArtist{{ID: spotify.ID(artist), Name: "Artist " + artist}}
+		track.Album.ReleaseDate = released
+		track.Album.ReleaseDatePrecision = "year"
+		return track
+	}
+	songs := []spotify.FullTrack{
+		track("1", "a", "1994"),
+		track("2", "a", "1999"),
+		track("3", "b", "2012"),
+		track("4", "c", ""),
+	}
+	artistGenres := map[string][]string{
+		"a": {"grunge", "rock"},
+		"b": {"rock"},
+	}
+
+	stats := tasteStats(songs, artistGenres)
+
+	wantGenres := []GenreCount{{"rock", 3}, {"grunge", 2}}
+	if !reflect.DeepEqual(stats.TopGenres, wantGenres) {
+		t.Errorf("TopGenres = %v, want %v", stats.TopGenres, wantGenres)
+	}
+	if stats.TopArtists[0] != (ArtistCount{"Artist a", 2}) {
+		t.Errorf("TopArtists[0] = %v, want Artist a with 2 songs", stats.TopArtists[0])
+	}
+	if stats.UniqueArtists != 3 || stats.ArtistDiversity != 0.75 {
+		t.Errorf("UniqueArtists, ArtistDiversity = %d, %v, want 3, 0.75", stats.UniqueArtists, stats.ArtistDiversity)
+	}
+	wantDecades := map[string]int{"1990s": 2, "2010s": 1}
+	if !reflect.DeepEqual(stats.Decades, wantDecades) {
+		t.Errorf("Decades = %v, want %v", stats.Decades, wantDecades)
+	}
+}
+
+func TestPlaylistStatsCountsEveryPage(t *testing.T) {
+	var ids []string
+	for i := range 150 {
+		ids = append(ids, fmt.Sprintf("t%d", i))
+	}
+	client, _ := newFakePlaylist(t, "long", ids)
+
+	stats, err := playlistStats(context.Background(), client, "long", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TrackCount != 150 || stats.UniqueArtists != 150 {
+		t.Errorf("stats of 150 tracks by 150 artists = %d tracks by %d artists", stats.TrackCount, stats.UniqueArtists)
+	}
+}
+
+func TestCachedLibraryOnlyReusesWholeLibraries(t *testing.T) {
+	songs := []spotify.FullTrack{{SimpleTrack: spotify.SimpleTrack{ID: "a"}}}
+	store := func(mood, library string, configure func(cfg *RecommenderConfig, p *recommendationPipeline)) {
+		cfg := DefaultRecommenderConfig()
+		p := &recommendationPipeline{userLikedSongs: songs}
+		configure(&cfg, p)
+		p.cfg = cfg
+		storeCandidates(pipelineCacheKey(mood, cfg), library, time.Minute, p, nil)
+	}
+
+	store("relaxed", "sampled", func(cfg *RecommenderConfig, p *recommendationPipeline) { cfg.SampleSize = 100 })
+	store("energetic", "timed out", func(cfg *RecommenderConfig, p *recommendationPipeline) { p.partialLibrary = true })
+	store("intense", "whole", func(cfg *RecommenderConfig, p *recommendationPipeline) { cfg.SampleSize = 0 })
+
+	for _, library := range []string{"sampled", "timed out"} {
+		if got, _, _ := cachedLibrary(library); got != nil {
+			t.Errorf("reused the liked songs of a %s library", library)
+		}
+	}
+	if got, _, _ := cachedLibrary("whole"); len(got) != 1 {
+		t.Errorf("didn't reuse the liked songs of a whole library, got %d songs", len(got))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// templateFiles are the HTML pages. Every page defines the "style" and "content" of templates/layout.html.
+//
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+// pages are the parsed pages by file name, such as "index.html"
+var pages = parsePages("index.html", "locations.html", "success.html", "import.html", "playlist-created.html", "resume.html")
+
+// parsePages parses each page together with the layout. It panics on an invalid template, so a broken page
+// is caught when the server starts rather than when the page is requested.
+func parsePages(names ...string) map[string]*template.Template {
+	funcs := template.FuncMap{
+		"join": func(values []string) string { return strings.Join(values, ", ") },
+	}
+
+	parsed := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		parsed[name] = template.Must(template.New(name).Funcs(funcs).ParseFS(templateFiles, "templates/layout.html", "templates/"+name))
+	}
+	return parsed
+}
+
+// renderPage writes a page with the given data
+func renderPage(w http.ResponseWriter, name string, data interface{}) {
+	page, ok := pages[name]
+	if !ok {
+		http.Error(w, "Page not found", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := page.ExecuteTemplate(w, "layout", data); err != nil {
+		fmt.Printf("Failed to render %s: %v\n", name, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// maxTargetMinutes is the longest playlist that can be asked for by duration
+const maxTargetMinutes = 600
+
+// fitDuration picks tracks until their total length is within tolerance of target, instead of a fixed number
+// of tracks. Tracks are taken in order, skipping those that would run over, except that a later track that
+// finishes the playlist close to the target is preferred, so it doesn't end on a track cut short by the
+// end of the commute. The picked tracks keep their order.
+func fitDuration(tracks []spotify.FullTrack, target, tolerance time.Duration) []spotify.FullTrack {
+	picked := make([]bool, len(tracks))
+	var total time.Duration
+	for target-total > tolerance {
+		remaining := target - total
+
+		next, finish := -1, -1
+		for i, track := range tracks {
+			length := track.TimeDuration()
+			if picked[i] || length <= 0 || length > remaining+tolerance {
+				continue
+			}
+			if next < 0 {
+				next = i
+			}
+			// Of the tracks that end the playlist within the tolerance, the one closest to it wins
+			if gap := (remaining - length).Abs(); gap <= tolerance && (finish < 0 || gap < (remaining-tracks[finish].TimeDuration()).Abs()) {
+				finish = i
+			}
+		}
+
+		if finish >= 0 {
+			next = finish
+		}
+		if next < 0 {
+			break
+		}
+		picked[next] = true
+		total += tracks[next].TimeDuration()
+	}
+
+	var fitted []spotify.FullTrack
+	for i, track := range tracks {
+		if picked[i] {
+			fitted = append(fitted, track)
+		}
+	}
+
+	if (target - total).Abs() > tolerance {
+		fmt.Printf("Warning: the playlist lasts %s, the tracks that match the mood can't fill %s\n",
+			total.Round(time.Second), target)
+	} else {
+		fmt.Printf("Picked %d tracks lasting %s for a %s playlist\n", len(fitted), total.Round(time.Second), target)
+	}
+	return fitted
+}
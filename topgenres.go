@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// computeTopGenres counts how many of the artists have each genre, in lower case
+func computeTopGenres(artists []spotify.FullArtist) map[string]int {
+	genres := make(map[string]int)
+	for _, artist := range artists {
+		for _, genre := range artist.Genres {
+			genres[strings.ToLower(genre)]++
+		}
+	}
+	return genres
+}
+
+// personalMoodGenres returns the user's top genres that match the mood's genres, weighted by how many of the
+// top artists have them: the most common gets 1. For a metalhead, "energetic" gets metal genres rather than
+// generic dance.
+func (p *recommendationPipeline) personalMoodGenres() map[string]float64 {
+	topGenres := computeTopGenres(p.topArtists)
+	moodGenres := GetMoodGenresForGenre(p.mood, p.cfg.Genre)
+
+	personal := make(map[string]float64)
+	most := 0
+	for genre, count := range topGenres {
+		for _, moodGenre := range moodGenres {
+			moodGenre = strings.ToLower(moodGenre)
+			if genre == moodGenre || genreMatches(genre, moodGenre, p.cfg.GenreMatch) {
+				personal[genre] = float64(count)
+				most = max(most, count)
+				break
+			}
+		}
+	}
+
+	for genre := range personal {
+		personal[genre] /= float64(most)
+	}
+	return personal
+}
+
+// topGenreFit returns how well each track's artists match the user's top genres for the mood, from 0 to 1.
+// Tracks without such genres are left out, as are all tracks if TopGenreWeight is off.
+func (p *recommendationPipeline) topGenreFit(tracks []spotify.FullTrack) map[spotify.ID]float64 {
+	if p.cfg.TopGenreWeight == 0 || len(p.topArtists) == 0 {
+		return nil
+	}
+
+	personal := p.personalMoodGenres()
+	if len(personal) == 0 {
+		return nil
+	}
+	p.prefetchGenres(tracks)
+
+	fit := make(map[spotify.ID]float64)
+	for _, track := range tracks {
+		for _, artist := range track.Artists {
+			for _, genre := range p.artistGenres[artist.ID.String()] {
+				if weight := personal[strings.ToLower(genre)]; weight > fit[track.ID] {
+					fit[track.ID] = weight
+				}
+			}
+		}
+	}
+	return fit
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestPersonalMoodGenres(t *testing.T) {
+	artist := func(genres ...string) spotify.FullArtist {
+		var artist spotify.FullArtist
+		artist.Genres = genres
+		return artist
+	}
+	topArtists := []spotify.FullArtist{
+		artist("metal", "thrash"),
+		artist("Metal"),
+		artist("pop"),
+	}
+
+	got := computeTopGenres(topArtists)
+	want := map[string]int{"metal": 2, "thrash": 1, "pop": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("computeTopGenres = %v, want %v", got, want)
+	}
+
+	// Only the top genres that suit the mood count, the most common the most
+	p := &recommendationPipeline{mood: "intense", cfg: DefaultRecommenderConfig(), topArtists: topArtists}
+	personal := p.personalMoodGenres()
+	wantPersonal := map[string]float64{"metal": 1, "thrash": 0.5}
+	if !reflect.DeepEqual(personal, wantPersonal) {
+		t.Errorf("personalMoodGenres for intense = %v, want %v", personal, wantPersonal)
+	}
+}
+
+func TestGenreStageNarrowsToTopGenresOfTheMood(t *testing.T) {
+	var metalhead spotify.FullArtist
+	metalhead.Genres = []string{"metal"}
+	var popFan spotify.FullArtist
+	popFan.Genres = []string{"pop"}
+
+	tests := []struct {
+		name       string
+		topArtists []spotify.FullArtist
+		weight     float64
+		want       int
+	}{
+		{"top genres that match the mood", []spotify.FullArtist{metalhead}, 1, 1},
+		{"no top genres that match the mood", []spotify.FullArtist{popFan}, 1, 2},
+		{"weight off", []spotify.FullArtist{metalhead}, 0, 2},
+	}
+	for _, tt := range tests {
+		p := newTestPipeline(nil, []string{"metal1", "punk1"}, []string{StageGenres})
+		p.mood = "intense"
+		p.cfg.TopGenreWeight = tt.weight
+		p.topArtists = tt.topArtists
+		p.artistGenres["artist-metal1"] = []string{"metal"}
+		p.artistGenres["artist-punk1"] = []string{"punk"}
+
+		p.genreStage()
+		if len(p.allTracks) != tt.want {
+			t.Errorf("%s: genre stage added %d tracks, want %d", tt.name, len(p.allTracks), tt.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+// appPage is the single page app for logged in users. It talks to the JSON API with fetch, so creating
+// a playlist doesn't reload the page.
+//
+//go:embed ui/index.html
+var appPage []byte
+
+// serveApp writes the single page app
+func serveApp(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(appPage); err != nil {
+		fmt.Printf("Failed to write app page: %v\n", err)
+	}
+}
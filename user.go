@@ -2,43 +2,92 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"regexp"
+	"strings"
 	"time"
 
 	spotify "github.com/zmb3/spotify/v2"
 )
 
-func SearchSpotify(searchQuery string, client *spotify.Client) {
-	ctx := context.Background()
-	results, err := client.Search(ctx, searchQuery, spotify.SearchTypeTrack)
-	handleError(err)
+// SearchSpotify searches for tracks and prints the results. The search is cancelled when ctx is done
+// or the configured Spotify timeout passes.
+func SearchSpotify(ctx context.Context, searchQuery string, client *spotify.Client) ([]spotify.FullTrack, error) {
+	ctx, cancel := context.WithTimeout(ctx, recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	results, err := client.Search(ctx, searchQuery, spotify.SearchTypeTrack, spotify.Market(spotifyMarket("")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for %q: %v", searchQuery, err)
+	}
+
+	if results.Tracks == nil {
+		return nil, nil
+	}
 
 	fmt.Println("Tracks:")
 	for _, item := range results.Tracks.Tracks {
+		if len(item.Artists) == 0 {
+			continue
+		}
 		fmt.Println("Found:", item.Name, "by", item.Artists[0].Name, "(Album:", item.Album.Name, ")")
 	}
+	return results.Tracks.Tracks, nil
 }
 
-func GetUserPlaylists(client *spotify.Client) {
-	ctx := context.Background()
-	playlists, err := client.CurrentUsersPlaylists(ctx)
-	handleError(err)
+// GetUserPlaylists gets and prints the current user's playlists. The request is cancelled when ctx is done
+// or the configured Spotify timeout passes.
+func GetUserPlaylists(ctx context.Context, client *spotify.Client, opts ...spotify.RequestOption) ([]spotify.SimplePlaylist, error) {
+	ctx, cancel := context.WithTimeout(ctx, recommenderConfig.SpotifyTimeout)
+	defer cancel()
+
+	playlists, err := client.CurrentUsersPlaylists(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get playlists: %v", err)
+	}
 
 	fmt.Println("Playlists:")
 	for _, playlist := range playlists.Playlists {
 		fmt.Println(playlist.Name)
 	}
+	return playlists.Playlists, nil
 }
 
 func GetSpotifyRecommendations(mood string, client *spotify.Client) ([]spotify.FullTrack, error) {
 	// Use the personalized recommendations
-	return GetPersonalizedRecommendations(mood, client)
+	return GetPersonalizedRecommendations(mood, client, recommenderConfig)
+}
+
+// displayName returns the name to greet a user by. Some accounts have no display name, so it falls back to their ID.
+func displayName(user spotify.User) string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	return user.ID
 }
 
-func CreatePlaylistAndAddTracks(client *spotify.Client, tracks []spotify.FullTrack) error {
+// CreatePlaylistAndAddTracks creates a playlist with the given tracks for the current user.
+// A public playlist with explicit tracks is created as private unless opts.ConfirmPublic is set.
+func CreatePlaylistAndAddTracks(client *spotify.Client, tracks []spotify.FullTrack, opts PlaylistOptions) (*PlaylistResult, error) {
 	if len(tracks) == 0 {
-		return fmt.Errorf("no tracks provided to add to playlist")
+		return nil, fmt.Errorf("no tracks provided to add to playlist")
+	}
+
+	playlistName := fmt.Sprintf("Your Personalized Weather Mood Playlist - %s", time.Now().Format("Jan 02 15:04"))
+	nameTemplate := opts.NameTemplate
+	if nameTemplate == "" {
+		nameTemplate = recommenderConfig.PlaylistNameTemplate
+	}
+	switch {
+	case opts.Name != "":
+		playlistName = opts.Name
+	case nameTemplate != "":
+		name, err := expandPlaylistName(nameTemplate, opts.NameVars, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		playlistName = name
 	}
 
 	// Create a context with timeout
@@ -48,27 +97,74 @@ func CreatePlaylistAndAddTracks(client *spotify.Client, tracks []spotify.FullTra
 	// Get the current user
 	user, err := client.CurrentUser(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get current user: %v", err)
+		return nil, fmt.Errorf("failed to get current user: %v", err)
+	}
+	fmt.Printf("Creating personalized playlist for user: %s (%s)\n", displayName(user.User), user.ID)
+
+	// Make sure every track can actually be played where the user lives
+	if recommenderConfig.VerifyPlayable {
+		tracks, err = playableTracks(ctx, client, tracks, spotifyMarket(opts.Market))
+		if err != nil {
+			return nil, err
+		}
+		if len(tracks) == 0 {
+			return nil, fmt.Errorf("none of the tracks are playable in your country")
+		}
 	}
-	fmt.Printf("Creating personalized playlist for user: %s (%s)\n", user.DisplayName, user.ID)
+
+	tracks, err = capPlaylistTracks(0, tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PlaylistResult{
+		Name:          playlistName,
+		TrackCount:    len(tracks),
+		ExplicitCount: countExplicitTracks(tracks),
+		Tracks:        playlistTracks(tracks),
+		config:        opts.config(),
+	}
+	if opts.pickedWith != nil {
+		result.config = *opts.pickedWith
+	}
+
+	// Don't silently publish explicit content; ask for confirmation first
+	public := opts.Public
+	if public && result.ExplicitCount > 0 && !opts.ConfirmPublic {
+		public = false
+		result.NeedsPublicConfirmation = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf(
+			"The playlist contains %d explicit tracks, so it was created as private. Confirm to make it public anyway.",
+			result.ExplicitCount))
+	}
+	result.Public = public
 
 	// Create a playlist for the user
-	playlistName := fmt.Sprintf("Your Personalized Weather Mood Playlist - %s", time.Now().Format("Jan 02 15:04"))
-	playlistDescription := fmt.Sprintf("Generated by VibeCast. Playlist with %d songs you've explicitly liked, matched to your current mood using genre analysis and mood-based playlists. Max 5 songs per artist for variety.", len(tracks))
+	playlistDescription := fmt.Sprintf("Generated by VibeCast. Playlist with %d songs you've explicitly liked, matched to your current mood using genre analysis and mood-based playlists. Max %d songs per artist for variety.", len(tracks), opts.config().MaxSongsPerArtist)
+	if opts.OutsideLibrary {
+		playlistDescription = fmt.Sprintf("Generated by VibeCast. Outside your library: none of your liked songs matched your current mood, so these %d songs are recommendations for its genres.", len(tracks))
+	}
+	if recommenderConfig.TagPlaylists {
+		playlistDescription += " " + playlistMarker
+	}
 
 	playlist, err := client.CreatePlaylistForUser(
 		ctx,
 		user.ID,
 		playlistName,
 		playlistDescription,
-		false,
+		public,
 		false,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to create playlist: %v", err)
+		return nil, resumable(result, playlistDescription, fmt.Errorf("failed to create playlist: %w", err))
 	}
 	fmt.Printf("Created personalized playlist: %s (ID: %s)\n", playlist.Name, playlist.ID)
 
+	result.ID = playlist.ID
+	result.Name = playlist.Name
+	result.URL = playlist.ExternalURLs["spotify"]
+
 	// Convert tracks to track IDs
 	trackIDs := make([]spotify.ID, len(tracks))
 	for i, track := range tracks {
@@ -77,16 +173,271 @@ func CreatePlaylistAndAddTracks(client *spotify.Client, tracks []spotify.FullTra
 
 	// Add tracks to the playlist
 	fmt.Printf("Adding %d personalized tracks to playlist (all songs you've explicitly liked, matched to the current mood)\n", len(trackIDs))
-	_, err = client.AddTracksToPlaylist(ctx, playlist.ID, trackIDs...)
-	if err != nil {
-		return fmt.Errorf("failed to add tracks to playlist: %v", err)
+	missing, err := addTracksAndVerify(ctx, client, playlist.ID, trackIDs)
+	var verifyErr *playlistVerificationError
+	switch {
+	case errors.As(err, &verifyErr):
+		fmt.Printf("Warning: %v\n", err)
+	case err != nil:
+		return nil, resumable(result, playlistDescription, fmt.Errorf("failed to add tracks to playlist: %w", err))
+	}
+	if len(missing) > 0 {
+		reportMissingTracks(result, tracks, missing)
+	}
+
+	// Check what actually landed in the playlist, rather than what was meant to
+	if recommenderConfig.VerifyPlaylist {
+		stats, err := playlistStats(ctx, client, playlist.ID, opts.NameVars.Mood)
+		if err != nil {
+			fmt.Printf("Warning: couldn't verify the playlist: %v\n", err)
+		} else {
+			result.Stats = stats
+			printPlaylistStats(stats)
+			if stats.TrackCount != result.TrackCount {
+				result.Warnings = append(result.Warnings, fmt.Sprintf(
+					"The playlist has %d tracks, but %d were added.", stats.TrackCount, result.TrackCount))
+			}
+		}
 	}
 
 	fmt.Println("Successfully added personalized tracks to playlist!")
+	if window := recommenderConfig.AvoidRecentPlaylists; window > 0 {
+		if err := rememberRecentTracks(trackIDs, window); err != nil {
+			fmt.Printf("Warning: couldn't remember the playlist's tracks: %v\n", err)
+		}
+	}
+	for _, warning := range result.Warnings {
+		fmt.Println("Warning:", warning)
+	}
+	return result, nil
+}
+
+// playlistMarker is put at the end of the description of created playlists, so they can be told apart from the
+// user's own playlists whatever they're named. The version only changes if the format of the playlists does.
+const playlistMarker = "[vibecast v1]"
+
+// playlistMarkerPattern matches the marker of any version
+var playlistMarkerPattern = regexp.MustCompile(`\[vibecast v\d+\]`)
+
+// IsVibecastPlaylist reports whether a playlist was created by VibeCast, by the marker in its description
+func IsVibecastPlaylist(p spotify.SimplePlaylist) bool {
+	return playlistMarkerPattern.MatchString(p.Description)
+}
+
+// maxPlaylistItems is the most tracks a Spotify playlist can have
+const maxPlaylistItems = 10000
+
+// capPlaylistTracks checks that a playlist with existing tracks has room for tracks. If it hasn't, the tracks
+// that don't fit are left out with TruncateAtPlaylistCap, and otherwise an ErrPlaylistFull error is returned.
+func capPlaylistTracks[T any](existing int, tracks []T) ([]T, error) {
+	room := max(maxPlaylistItems-existing, 0)
+	if len(tracks) <= room {
+		return tracks, nil
+	}
+
+	if !recommenderConfig.TruncateAtPlaylistCap {
+		return nil, fmt.Errorf("%w: adding %d tracks to its %d would exceed Spotify's limit of %d",
+			ErrPlaylistFull, len(tracks), existing, maxPlaylistItems)
+	}
+	fmt.Printf("Warning: only adding %d of the %d tracks, as Spotify playlists can't have more than %d\n",
+		room, len(tracks), maxPlaylistItems)
+	return tracks[:room], nil
+}
+
+// playlistVerificationError is returned when the tracks were added but it couldn't be checked that all of them were
+type playlistVerificationError struct {
+	err error
+}
+
+func (e *playlistVerificationError) Error() string {
+	return fmt.Sprintf("couldn't check that all tracks were added: %v", e.err)
+}
+
+func (e *playlistVerificationError) Unwrap() error {
+	return e.err
+}
+
+// addTracksAndVerify adds the tracks to the playlist and checks that all of them made it, as Spotify can accept
+// the request while leaving some tracks out. Missing tracks are added once more; those still missing are returned.
+func addTracksAndVerify(ctx context.Context, client *spotify.Client, playlistID spotify.ID, trackIDs []spotify.ID) ([]spotify.ID, error) {
+	if err := addPlaylistTracks(ctx, client, playlistID, trackIDs); err != nil {
+		return nil, err
+	}
+
+	missing, _, err := missingPlaylistTracks(ctx, client, playlistID, trackIDs)
+	if err != nil || len(missing) == 0 {
+		return nil, err
+	}
+
+	fmt.Printf("%d tracks weren't added to the playlist, adding them again\n", len(missing))
+	if err := addPlaylistTracks(ctx, client, playlistID, missing); err != nil {
+		return missing, nil
+	}
+	missing, _, err = missingPlaylistTracks(ctx, client, playlistID, missing)
+	return missing, err
+}
+
+// addPlaylistTracks adds the tracks to the playlist, as many at a time as Spotify takes
+func addPlaylistTracks(ctx context.Context, client *spotify.Client, playlistID spotify.ID, trackIDs []spotify.ID) error {
+	for start := 0; start < len(trackIDs); start += maxPlaylistItemsPerRequest {
+		batch := trackIDs[start:min(start+maxPlaylistItemsPerRequest, len(trackIDs))]
+		if _, err := client.AddTracksToPlaylist(ctx, playlistID, batch...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func CreatePlaylistWeather(client *spotify.Client) {
+// missingPlaylistTracks returns the tracks that aren't in the playlist, and how many tracks the playlist has,
+// paging through all of its items
+func missingPlaylistTracks(ctx context.Context, client *spotify.Client, playlistID spotify.ID, trackIDs []spotify.ID) ([]spotify.ID, int, error) {
+	tracks, err := getAllPlaylistTracks(ctx, client, playlistID)
+	if err != nil {
+		return nil, 0, &playlistVerificationError{err}
+	}
+
+	inPlaylist := make(map[spotify.ID]bool, len(tracks))
+	for _, track := range tracks {
+		inPlaylist[track.ID] = true
+	}
+
+	var missing []spotify.ID
+	for _, id := range trackIDs {
+		if !inPlaylist[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing, len(tracks), nil
+}
+
+// playlistStats fetches the tracks of the playlist and describes them. The mood fit is only computed for a mood,
+// and left out if audio features aren't available.
+func playlistStats(ctx context.Context, client *spotify.Client, playlistID spotify.ID, mood string) (*PlaylistStats, error) {
+	tracks, err := getAllPlaylistTracks(ctx, client, playlistID)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &PlaylistStats{}
+	artists := make(map[spotify.ID]bool)
+	var ids []spotify.ID
+	popularity := 0
+	for _, track := range tracks {
+		stats.TrackCount++
+		popularity += int(track.Popularity)
+		ids = append(ids, track.ID)
+		for _, artist := range track.Artists {
+			artists[artist.ID] = true
+		}
+	}
+	stats.UniqueArtists = len(artists)
+	if stats.TrackCount > 0 {
+		stats.AveragePopularity = float64(popularity) / float64(stats.TrackCount)
+	}
+
+	if mood == "" || len(ids) == 0 {
+		return stats, nil
+	}
+	var audioFeatures []*spotify.AudioFeatures
+	for start := 0; start < len(ids); start += maxAudioFeaturesPerRequest {
+		batch, err := client.GetAudioFeatures(ctx, ids[start:min(start+maxAudioFeaturesPerRequest, len(ids))]...)
+		if err != nil {
+			fmt.Printf("Warning: leaving the mood fit out of the playlist stats, audio features unavailable: %v\n", err)
+			return stats, nil
+		}
+		audioFeatures = append(audioFeatures, batch...)
+	}
+
+	thresholds := GetMoodThresholds(mood)
+	fit := &MoodFitDistribution{}
+	for _, trackFeatures := range audioFeatures {
+		if trackFeatures == nil {
+			fit.Unknown++
+			continue
+		}
+
+		switch score := moodScore(trackFeatures, thresholds); {
+		case score == 1:
+			fit.Full++
+		case score >= 0.5:
+			fit.Partial++
+		default:
+			fit.Poor++
+		}
+	}
+	stats.MoodFit = fit
+	return stats, nil
+}
+
+// printPlaylistStats logs the stats of a created playlist
+func printPlaylistStats(stats *PlaylistStats) {
+	fmt.Printf("Verified the playlist: %d tracks by %d artists, %.0f average popularity\n",
+		stats.TrackCount, stats.UniqueArtists, stats.AveragePopularity)
+	if fit := stats.MoodFit; fit != nil {
+		fmt.Printf("Mood fit: %d full, %d partial, %d poor, %d unknown\n", fit.Full, fit.Partial, fit.Poor, fit.Unknown)
+	}
+}
+
+// reportMissingTracks leaves the tracks that couldn't be added out of the result, and names them in a warning
+func reportMissingTracks(result *PlaylistResult, tracks []spotify.FullTrack, missing []spotify.ID) {
+	isMissing := make(map[spotify.ID]bool, len(missing))
+	for _, id := range missing {
+		isMissing[id] = true
+	}
+
+	var added []spotify.FullTrack
+	var names []string
+	for _, track := range tracks {
+		if isMissing[track.ID] {
+			names = append(names, fmt.Sprintf("%s by %s", track.Name, firstArtistName(track)))
+		} else {
+			added = append(added, track)
+		}
+	}
+
+	result.TrackCount = len(added)
+	result.ExplicitCount = countExplicitTracks(added)
+	result.Tracks = playlistTracks(added)
+	result.Warnings = append(result.Warnings, fmt.Sprintf("Spotify didn't add %d tracks to the playlist: %s.", len(names), strings.Join(names, "; ")))
+}
+
+// playableTracks re-fetches the tracks for the market and drops the ones that can't be played there.
+// Tracks are only dropped if Spotify says they aren't playable.
+func playableTracks(ctx context.Context, client *spotify.Client, tracks []spotify.FullTrack, market string) ([]spotify.FullTrack, error) {
+	playable := make(map[spotify.ID]bool, len(tracks))
+	for i := 0; i < len(tracks); i += maxTracksPerRequest {
+		end := min(i+maxTracksPerRequest, len(tracks))
+
+		ids := make([]spotify.ID, 0, end-i)
+		for _, track := range tracks[i:end] {
+			ids = append(ids, track.ID)
+		}
+
+		fullTracks, err := client.GetTracks(ctx, ids, spotify.Market(market))
+		if err != nil {
+			return nil, fmt.Errorf("failed to check track availability: %v", err)
+		}
+
+		for j, track := range fullTracks {
+			// Missing tracks aren't available at all
+			playable[ids[j]] = track != nil && (track.IsPlayable == nil || *track.IsPlayable)
+		}
+	}
+
+	var kept []spotify.FullTrack
+	for _, track := range tracks {
+		if playable[track.ID] {
+			kept = append(kept, track)
+		}
+	}
+
+	if dropped := len(tracks) - len(kept); dropped > 0 {
+		fmt.Printf("Dropped %d tracks that aren't playable in your country\n", dropped)
+	}
+	return kept, nil
+}
+
+func CreatePlaylistWeather(client *spotify.Client, opts PlaylistOptions) (*PlaylistResult, error) {
 	fmt.Println("\n=== Creating Your Personalized Weather-Based Playlist ===")
 
 	// Get user info for personalization
@@ -95,60 +446,205 @@ func CreatePlaylistWeather(client *spotify.Client) {
 
 	user, err := client.CurrentUser(ctx)
 	if err == nil {
-		fmt.Printf("Hello %s! Let's create a weather based playlist tailored to your music taste.\n", user.DisplayName)
+		fmt.Printf("Hello %s! Let's create a weather based playlist tailored to your music taste.\n", displayName(user.User))
+	}
+
+	city, err := promptCity()
+	if err != nil {
+		return nil, err
 	}
 
 	// Get weather and mood
-	weather, mood := GetWeatherAndMood()
+	weather, mood := GetWeatherAndMood(city)
+	if len(weather.Weather) == 0 {
+		return createPlaylistWithoutWeather(client, fmt.Errorf("no weather data available"), opts)
+	}
+
+	return CreatePlaylistForWeather(client, weather, mood, opts)
+}
 
+// CreatePlaylistForWeather creates a personalized playlist matching already fetched weather and its mood
+func CreatePlaylistForWeather(client *spotify.Client, weather *Weather, mood string, opts PlaylistOptions) (*PlaylistResult, error) {
 	if weather == nil || len(weather.Weather) == 0 {
-		fmt.Println("Error: Weather data is incomplete")
-		return
+		return nil, fmt.Errorf("weather data is incomplete")
+	}
+	if err := ValidateMood(mood); err != nil {
+		return nil, err
+	}
+	reason := WeatherMoodReason(weather, mood)
+	if opts.Mood != "" {
+		if err := ValidateMood(opts.Mood); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Using the chosen %s mood instead of the %s mood of the weather\n", opts.Mood, mood)
+		reason = fmt.Sprintf("you chose %s over %s", opts.Mood, reason)
+		mood = opts.Mood
 	}
 
 	fmt.Printf("Weather: %.2f°C and %s\n", weather.Main.Temp, weather.Weather[0].Description)
 	fmt.Printf("Mood selected based on weather: %s\n", mood)
+
+	opts.NameVars.Weather = weather.Weather[0].Description
+	opts.NameVars.Temp = &weather.Main.Temp
+
+	// What the user is listening to right now says more about their mood than the weather
+	cfg := opts.config()
+	cfg.Temperature = &weather.Main.Temp
+
+	// Ease into a new weather mood rather than swinging from the last one
+	if cfg.MoodMemory > 0 && opts.Mood == "" {
+		if previous := previousWeatherMood(cfg.MoodMemoryWindow); previous != "" && previous != mood {
+			cfg.PreviousMood = previous
+			reason = fmt.Sprintf("%s, eased in from %s", reason, previous)
+		}
+	}
+	var nowPlaying *spotify.FullTrack
+	if cfg.UseCurrentlyPlaying {
+		track, err := GetCurrentlyPlaying(client)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		} else if track != nil {
+			nowPlaying = track
+			fmt.Printf("Continuing the vibe of %s\n", track.Name)
+			if opts.Mood == "" {
+				if trackMood := moodForTrack(client, track, mood); trackMood != mood {
+					reason = fmt.Sprintf("%s is playing → %s, over %s", track.Name, trackMood, reason)
+					mood = trackMood
+				}
+			}
+			cfg.SeedTracks = []spotify.ID{track.ID}
+		}
+	}
+
+	result, err := createMoodPlaylist(client, mood, cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result.MoodReason = reason
+	fmt.Printf("Why this mood: %s\n", reason)
+
+	if nowPlaying != nil {
+		result.NowPlaying = &playlistTracks([]spotify.FullTrack{*nowPlaying})[0]
+	}
+
+	result.Weather = summarizeWeather(weather)
+	if cfg.MoodMemory > 0 {
+		if err := rememberWeatherMood(mood); err != nil {
+			fmt.Printf("Warning: couldn't remember the mood: %v\n", err)
+		}
+	}
+	savePlaylistPlan(result)
+	return result, nil
+}
+
+// createPlaylistWithoutWeather creates a neutral playlist, or one for the chosen mood, when the weather couldn't be
+// fetched, and says so in the result rather than passing it off as a weather-based mood
+func createPlaylistWithoutWeather(client *spotify.Client, weatherErr error, opts PlaylistOptions) (*PlaylistResult, error) {
+	mood := "neutral"
+	if opts.Mood != "" {
+		if err := ValidateMood(opts.Mood); err != nil {
+			return nil, err
+		}
+		mood = opts.Mood
+	}
+	fmt.Printf("Weather unavailable (%v), falling back to the %s mood\n", weatherErr, mood)
+
+	result, err := createMoodPlaylist(client, mood, opts.config(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result.WeatherUnavailable = true
+	result.Warnings = append(result.Warnings, fmt.Sprintf("The weather couldn't be fetched, so a playlist for a %s mood was created instead.", mood))
+	savePlaylistPlan(result)
+	return result, nil
+}
+
+// createMoodPlaylist creates a personalized playlist of liked songs matching the mood
+func createMoodPlaylist(client *spotify.Client, mood string, cfg RecommenderConfig, opts PlaylistOptions) (*PlaylistResult, error) {
 	fmt.Println("Analyzing your music taste to create personalized recommendations...")
 	fmt.Println("IMPORTANT: This playlist will ONLY include songs you've explicitly liked on Spotify!")
 	fmt.Println("Using genre analysis and mood-based playlists to ensure songs match the current mood.")
-	fmt.Println("Creating a playlist with up to 50 tracks, all from your liked songs...")
-	fmt.Println("For variety, no artist will have more than 5 songs in the playlist.")
+	fmt.Printf("Creating a playlist with up to %d tracks, all from your liked songs...\n", cfg.PlaylistSize)
+	fmt.Printf("For variety, no artist will have more than %d songs in the playlist.\n", cfg.MaxSongsPerArtist)
+
+	if opts.Genre != "" {
+		cfg.Genre = opts.Genre
+	}
+	if opts.Market != "" {
+		cfg.Market = opts.Market
+	}
+	if opts.TargetMinutes > 0 {
+		cfg.TargetDuration = time.Duration(opts.TargetMinutes) * time.Minute
+	}
+	if opts.InstrumentalOnly {
+		cfg.InstrumentalOnly = true
+	}
+	if !opts.Deadline.IsZero() {
+		cfg.MaxPipelineTime = max(time.Until(opts.Deadline), time.Nanosecond)
+	}
 
 	// Get personalized recommendations
-	tracks, err := GetSpotifyRecommendations(mood, client)
+	tracks, report, err := personalizedRecommendations(mood, client, cfg)
 	if err != nil {
-		fmt.Printf("Error getting recommendations: %v\n", err)
-		return
+		return nil, fmt.Errorf("error getting recommendations: %w", err)
 	}
 
 	if len(tracks) == 0 {
-		fmt.Println("No tracks were recommended. Try again with a different mood or city.")
 		fmt.Println("TIP: Like more songs on Spotify to get better recommendations!")
-		return
+		return nil, fmt.Errorf("no tracks were recommended, try again with a different mood or city")
+	}
+
+	if opts.BlendWith != "" {
+		tracks, err = blendWithPlaylist(client, tracks, opts.BlendWith, report)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	fmt.Println("\nRecommended tracks for your personalized playlist:")
-	fmt.Printf("(All tracks below are songs you've explicitly liked that match the '%s' mood, with max 5 songs per artist)\n", mood)
+	fmt.Printf("(All tracks below are songs you've explicitly liked that match the '%s' mood, with max %d songs per artist)\n", mood, cfg.MaxSongsPerArtist)
 	for i, track := range tracks {
 		fmt.Printf("%d. %s by %s\n", i+1, track.Name, track.Artists[0].Name)
 	}
 
 	// Create the playlist
-	err = CreatePlaylistAndAddTracks(client, tracks)
+	opts.NameVars.Mood = mood
+	opts.OutsideLibrary = report.OutsideLibrary
+	opts.pickedWith = &cfg
+	result, err := CreatePlaylistAndAddTracks(client, tracks, opts)
 	if err != nil {
-		fmt.Printf("Error creating playlist: %v\n", err)
-		return
+		return nil, fmt.Errorf("error creating playlist: %v", err)
 	}
 
 	fmt.Println("\n✅ Your personalized weather-based playlist has been created successfully!")
 	fmt.Printf("The playlist contains %d tracks, ALL songs you've explicitly liked on Spotify.\n", len(tracks))
 	fmt.Printf("All songs match the '%s' mood based on genre analysis and mood-based playlists.\n", mood)
-	fmt.Println("For variety, no artist has more than 5 songs in the playlist.")
+	fmt.Printf("For variety, no artist has more than %d songs in the playlist.\n", cfg.MaxSongsPerArtist)
 	fmt.Println("This ensures the playlist perfectly matches your music taste while providing variety.")
 	fmt.Println("Check your Spotify account to listen to your new playlist.")
+	result.Mood = mood
+	result.City = opts.NameVars.City
+	result.TargetMinutes = opts.TargetMinutes
+	result.InstrumentalOnly = cfg.InstrumentalOnly
+	applyPipelineReport(result, report)
+	rememberPlaylist(result)
+	return result, nil
 }
 
+// GetAvailableGenres returns the genres Spotify accepts as recommendation seeds,
+// falling back to a built-in list if they can't be fetched
 func GetAvailableGenres(client *spotify.Client) []string {
+	seeds, err := AvailableGenreSeeds(client)
+	if err == nil && len(seeds) > 0 {
+		return seeds
+	}
+
+	if err != nil {
+		fmt.Printf("Warning: using built-in genre list: %v\n", err)
+	}
+
 	availableGenres := []string{
 		// Energetic mood genres
 		"dance", "edm", "electro", "house", "techno", "trance", "dubstep",
@@ -170,72 +666,103 @@ func GetAvailableGenres(client *spotify.Client) []string {
 	return availableGenres
 }
 
-func CreatePlaylistGenre(client *spotify.Client) {
-	fmt.Println("\n=== Creating Your Personalized Genre-Based Playlist ===")
-	fmt.Println("For the sake of my insanity, the logic is the same as the weather playlist, but from genre to mood.")
-	// Get user info for personalization
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// maxRecommendations is the maximum number of tracks GetRecommendations returns in a single call
+const maxRecommendations = 100
 
-	user, err := client.CurrentUser(ctx)
-	if err == nil {
-		fmt.Printf("Hello %s! Let's create a genre based playlist tailored to your music taste.\n", user.DisplayName)
+// genrePlaylistMood returns the mood of a genre playlist: the one chosen in opts, or else the mood of the genre.
+// The chosen mood is checked by the handler taking it.
+func genrePlaylistMood(genre string, opts PlaylistOptions) string {
+	if opts.Mood == "" {
+		return GetMoodFromGenre(genre)
+	}
+	return opts.Mood
+}
+
+// CreateGenrePlaylist creates a playlist seeded purely from a genre, using the audio attributes of the genre's mood,
+// or of the mood in opts if one was chosen. It never needs the weather.
+// If likedOnly is set, only recommendations that are in the user's liked songs are kept.
+// A size of 0 uses the playlist size of the profile and limits in opts, which also cap the songs per artist,
+// the durations and how many recommendations are asked for.
+func CreateGenrePlaylist(client *spotify.Client, genre string, size int, likedOnly bool, opts PlaylistOptions) (*PlaylistResult, error) {
+	if client == nil {
+		return nil, ErrSpotifyClientNil
 	}
-	var genre string
-	fmt.Println("Available Genres:")
-	genres := GetAvailableGenres(client)
 
-	for i, g := range genres {
-		fmt.Printf("%d. %s\n", i+1, g)
+	cfg := opts.config()
+	if size == 0 {
+		size = cfg.PlaylistSize
+	}
+	if size < 0 || size > maxRecommendations {
+		return nil, fmt.Errorf("playlist size must be between 1 and %d", maxRecommendations)
 	}
-	fmt.Print("Enter the number of the genre you'd like to create a playlist for: ")
-	fmt.Scanln(&genre)
 
-	genreNum, err := strconv.Atoi(genre)
-	if genreNum < 1 || genreNum > len(genres) {
-		fmt.Println("Error: Invalid genre number selected")
-		return
+	mood := genrePlaylistMood(genre, opts)
+	fmt.Printf("\n=== Creating a '%s' playlist with the '%s' mood ===\n", genre, mood)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Most recommendations won't be liked songs, so ask for as many as allowed when filtering
+	limit := size
+	if likedOnly {
+		limit = max(size, cfg.RecommendationLimit)
 	}
 
+	recommendations, err := client.GetRecommendations(
+		ctx,
+		spotify.Seeds{Genres: []string{genre}},
+		moodTrackAttributes(mood, 1),
+		spotify.Limit(limit),
+		spotify.Market(spotifyMarket(opts.Market)),
+	)
 	if err != nil {
-		fmt.Println("Error converting input to number:", err)
-		return
+		return nil, fmt.Errorf("failed to get recommendations: %v", err)
 	}
 
-	selectedGenre := genres[genreNum-1]
-	fmt.Println("Selected genre:", selectedGenre)
+	tracks := make([]spotify.FullTrack, 0, len(recommendations.Tracks))
+	for _, track := range recommendations.Tracks {
+		tracks = append(tracks, spotify.FullTrack{SimpleTrack: track})
+	}
+	fmt.Printf("Found %d recommendations for '%s'\n", len(tracks), genre)
+
+	if likedOnly {
+		likedTracks, err := GetUserLikedTracks(client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get liked songs: %w", err)
+		}
+		tracks = FilterTracksByLikedSongs(tracks, likedTracks)
+	}
 
-	mood := GetMoodFromGenre(selectedGenre)
+	if cfg.FilterExplicit {
+		tracks = FilterExplicitTracks(tracks)
+	}
 
-	tracks, err := GetSpotifyRecommendations(mood, client)
-	if err != nil {
-		fmt.Printf("Error getting recommendations: %v\n", err)
-		return
+	if neverPlayed, err := FilterNeverPlayTracks(tracks); err != nil {
+		fmt.Printf("Warning: couldn't leave out the tracks on your never play list: %v\n", err)
+	} else {
+		tracks = neverPlayed
 	}
 
+	if cfg.MinDuration > 0 || cfg.MaxDuration > 0 {
+		tracks = FilterByDuration(tracks, int(cfg.MinDuration.Milliseconds()), int(cfg.MaxDuration.Milliseconds()))
+	}
+	tracks = LimitSongsPerArtist(tracks, cfg.MaxSongsPerArtist, cfg.PrimaryArtistOnly)
+
 	if len(tracks) == 0 {
-		fmt.Println("No tracks were recommended. Try again with a different genre.")
-		fmt.Println("TIP: Like more songs on Spotify to get better recommendations!")
-		return
+		return nil, fmt.Errorf("no tracks were recommended for '%s', try again with a different genre", genre)
 	}
 
-	fmt.Println("\nRecommended tracks for your personalized playlist:")
-	fmt.Printf("(All tracks below are songs you've explicitly liked that match the '%s' genre, with max 5 songs per artist)\n", selectedGenre)
-	for i, track := range tracks {
-		fmt.Printf("%d. %s by %s\n", i+1, track.Name, track.Artists[0].Name)
+	if len(tracks) > size {
+		tracks = tracks[:size]
 	}
 
-	err = CreatePlaylistAndAddTracks(client, tracks)
+	opts.NameVars.Mood = mood
+	result, err := CreatePlaylistAndAddTracks(client, tracks, opts)
 	if err != nil {
-		fmt.Printf("Error creating playlist: %v\n", err)
-		return
+		return nil, err
 	}
 
-	fmt.Println("\n✅ Your personalized genre-based playlist has been created successfully!")
-	fmt.Printf("The playlist contains %d tracks, ALL songs you've explicitly liked on Spotify.\n", len(tracks))
-	fmt.Printf("All songs match the '%s' genre based on genre analysis and genre-based playlists.\n", selectedGenre)
-	fmt.Println("For variety, no artist has more than 5 songs in the playlist.")
-	fmt.Println("This ensures the playlist perfectly matches your music taste while providing variety.")
-	fmt.Println("Check your Spotify account to listen to your new playlist.")
-
+	result.Mood = mood
+	savePlaylistPlan(result)
+	return result, nil
 }
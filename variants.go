@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// defaultPlaylistVariants and maxPlaylistVariants are how many variants are picked if the request doesn't say,
+// and at most
+const (
+	defaultPlaylistVariants = 3
+	maxPlaylistVariants     = 5
+)
+
+// PlaylistVariants are candidate tracklists for the same weather and mood, to pick one of them to create
+type PlaylistVariants struct {
+	MoodPreviewResponse
+	Variants [][]PlaylistTrack `json:"variants"`
+}
+
+// pendingVariants are the variants last picked for a user, which one of can be created
+type pendingVariants struct {
+	preview MoodPreviewResponse
+	genre   string
+	limits  map[string]int
+	cfg     RecommenderConfig
+	tracks  [][]spotify.FullTrack
+	reports []*pipelineReport
+}
+
+// playlistVariants holds the pending variants of each logged in user
+var playlistVariants = struct {
+	sync.Mutex
+	pending map[string]*pendingVariants
+}{pending: make(map[string]*pendingVariants)}
+
+// pickVariants runs the pipeline once for the mood and picks up to count distinct tracklists from its candidates
+func pickVariants(mood string, cfg RecommenderConfig, count int) ([][]spotify.FullTrack, []*pipelineReport, error) {
+	var variants [][]spotify.FullTrack
+	var reports []*pipelineReport
+	seen := make(map[string]bool)
+
+	err := withCandidatePool(mood, authenticatedClient, cfg, func(pool *candidatePool) error {
+		// A small pool can have fewer distinct tracklists than asked for, so give up after twice as many picks
+		for attempt := 0; attempt < 2*count && len(variants) < count; attempt++ {
+			tracks, report := pool.pick()
+
+			key := variantKey(tracks)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			variants = append(variants, tracks)
+			reports = append(reports, report)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return variants, reports, nil
+}
+
+// variantKey identifies a tracklist by the IDs of its tracks. They're sorted, as the same tracks in another
+// order aren't a different variant to pick from.
+func variantKey(tracks []spotify.FullTrack) string {
+	ids := make([]string, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.ID.String()
+	}
+	slices.Sort(ids)
+	return strings.Join(ids, ",")
+}
+
+// PlaylistVariantsHandler returns a few distinct tracklists a weather playlist for a city could have, as a dry run.
+// The count query parameter sets how many. One of them can then be created with PlaylistVariantCommitHandler.
+func PlaylistVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	count := defaultPlaylistVariants
+	if value := r.URL.Query().Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPlaylistVariants {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The count must be from 1 to %d", maxPlaylistVariants))
+			return
+		}
+		count = parsed
+	}
+
+	req, ok := decodePreviewRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Genre != "" && !isAvailableGenre(req.Genre) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unknown genre %q", req.Genre))
+		return
+	}
+
+	preview, err := previewMood(req)
+	if err != nil {
+		writeJSONError(w, weatherErrorStatus(err), "Failed to get the weather: "+err.Error())
+		return
+	}
+
+	cfg, _ := applyLimits(recommenderConfig, req.Limits)
+	cfg.Genre = req.Genre
+	cfg.DryRun = true
+	variants, reports, err := pickVariants(preview.Mood, cfg, count)
+	if err != nil {
+		status, message := errorResponse(err, "Failed to pick tracks")
+		writeJSONError(w, status, message)
+		return
+	}
+
+	response := PlaylistVariants{MoodPreviewResponse: *preview}
+	for i, tracks := range variants {
+		described := playlistTracks(tracks)
+		for j := range described {
+			described[j].Stage = reports[i].TrackStages[described[j].ID]
+		}
+		response.Variants = append(response.Variants, described)
+	}
+
+	playlistVariants.Lock()
+	playlistVariants.pending[authenticatedUserID] = &pendingVariants{
+		preview: *preview,
+		genre:   req.Genre,
+		limits:  req.Limits,
+		cfg:     cfg,
+		tracks:  variants,
+		reports: reports,
+	}
+	playlistVariants.Unlock()
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// VariantCommitRequest picks one of the pending variants to create as a playlist
+type VariantCommitRequest struct {
+	// Index is the position of the variant in the variants response, starting at 0
+	Index  int  `json:"index"`
+	Public bool `json:"public,omitempty"`
+}
+
+// PlaylistVariantCommitHandler creates the playlist of one of the variants last returned by PlaylistVariantsHandler
+func PlaylistVariantCommitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if authenticatedClient == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	var req VariantCommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+
+	playlistVariants.Lock()
+	pending := playlistVariants.pending[authenticatedUserID]
+	playlistVariants.Unlock()
+	if pending == nil {
+		writeJSONError(w, http.StatusNotFound, "No variants to pick from, ask for some at /api/variants first")
+		return
+	}
+	if req.Index < 0 || req.Index >= len(pending.tracks) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The index must be from 0 to %d", len(pending.tracks)-1))
+		return
+	}
+
+	preview := pending.preview
+	temp := preview.Weather.Temp
+	opts := PlaylistOptions{
+		Public: req.Public,
+		Genre:  pending.genre,
+		Limits: pending.limits,
+		NameVars: PlaylistNameVars{
+			Mood:    preview.Mood,
+			City:    preview.City,
+			Weather: preview.Weather.Description,
+			Temp:    &temp,
+		},
+	}
+
+	opts.OutsideLibrary = pending.reports[req.Index].OutsideLibrary
+	opts.pickedWith = &pending.cfg
+	result, err := CreatePlaylistAndAddTracks(authenticatedClient, pending.tracks[req.Index], opts)
+	if err != nil {
+		status, message := errorResponse(err, "Failed to create playlist")
+		writeJSONError(w, status, message)
+		return
+	}
+
+	result.Mood = preview.Mood
+	result.City = preview.City
+	result.Weather = preview.Weather
+	result.MoodReason = preview.Reason
+	applyPipelineReport(result, pending.reports[req.Index])
+	rememberPlaylist(result)
+	rememberResult(result)
+
+	// A variant is only created once
+	playlistVariants.Lock()
+	if playlistVariants.pending[authenticatedUserID] == pending {
+		delete(playlistVariants.pending, authenticatedUserID)
+	}
+	playlistVariants.Unlock()
+
+	writeJSON(w, http.StatusOK, result)
+}
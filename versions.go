@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+// defaultAlternateVersionKeywords mark a track as a live, remixed or remastered version
+var defaultAlternateVersionKeywords = []string{"live", "remix", "remastered", "remaster"}
+
+// maxStudioLiveness is the liveness above which Spotify is confident a track was recorded live
+const maxStudioLiveness = 0.8
+
+// versionSuffixPattern finds the parts of a track name that describe its version:
+// anything in parentheses or brackets, and anything after a " - ", such as "Song - Live at Wembley"
+var versionSuffixPattern = regexp.MustCompile(`\(([^)]*)\)|\[([^\]]*)\]| - (.*)$`)
+
+// isAlternateVersion reports whether the track name says it's a live, remixed or otherwise alternate version.
+// Only the version parts of the name are checked, so songs merely called "Live Forever" are kept.
+func isAlternateVersion(name string, keywords []string) bool {
+	for _, match := range versionSuffixPattern.FindAllStringSubmatch(name, -1) {
+		suffix := strings.ToLower(match[1] + match[2] + match[3])
+		for _, keyword := range keywords {
+			if containsWord(suffix, strings.ToLower(keyword)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsWord reports whether word appears in text as a whole word
+func containsWord(text, word string) bool {
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+	}) {
+		if field == word {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterAlternateVersions removes live, remixed and remastered versions of songs. Tracks are dropped if
+// their name marks them as such, or if their audio features say they were most likely recorded live.
+// If audio features aren't available, only the names are checked.
+func FilterAlternateVersions(client *spotify.Client, tracks []spotify.FullTrack, keywords []string) []spotify.FullTrack {
+	var named []spotify.FullTrack
+	for _, track := range tracks {
+		if !isAlternateVersion(track.Name, keywords) {
+			named = append(named, track)
+		}
+	}
+
+	live := liveTrackIDs(client, named)
+
+	var filtered []spotify.FullTrack
+	for _, track := range named {
+		if !live[track.ID] {
+			filtered = append(filtered, track)
+		}
+	}
+
+	if removed := len(tracks) - len(filtered); removed > 0 {
+		fmt.Printf("Removed %d live, remixed or remastered versions\n", removed)
+	}
+	return filtered
+}
+
+// liveAlbumPrefixes start the names of live albums, such as "Live at Wembley Stadium"
+var liveAlbumPrefixes = []string{"live at ", "live in ", "live from ", "live on "}
+
+// isLiveAlbum reports whether the album's name says it's a live album. Spotify's album type doesn't tell live
+// albums apart, so the name is all there is: a live version part, such as "Hits (Live)", a name starting like
+// "Live at", or an unplugged session.
+func isLiveAlbum(album spotify.SimpleAlbum) bool {
+	name := strings.ToLower(album.Name)
+	for _, prefix := range liveAlbumPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return containsWord(name, "unplugged") || isAlternateVersion(album.Name, []string{"live"})
+}
+
+// FilterLiveAlbums removes the tracks of live albums, which are often live versions with studio names
+func FilterLiveAlbums(tracks []spotify.FullTrack) []spotify.FullTrack {
+	filtered := make([]spotify.FullTrack, 0, len(tracks))
+	for _, track := range tracks {
+		if !isLiveAlbum(track.Album) {
+			filtered = append(filtered, track)
+		}
+	}
+
+	if removed := len(tracks) - len(filtered); removed > 0 {
+		fmt.Printf("Removed %d tracks of live albums\n", removed)
+	}
+	return filtered
+}
+
+// liveTrackIDs returns the tracks whose audio features say they were recorded live
+func liveTrackIDs(client *spotify.Client, tracks []spotify.FullTrack) map[spotify.ID]bool {
+	live := make(map[spotify.ID]bool)
+	if client == nil {
+		return live
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// Get audio features in batches of 100 (API limit)
+	for i := 0; i < len(tracks); i += 100 {
+		end := min(i+100, len(tracks))
+
+		ids := make([]spotify.ID, 0, end-i)
+		for _, track := range tracks[i:end] {
+			ids = append(ids, track.ID)
+		}
+
+		features, err := client.GetAudioFeatures(ctx, ids...)
+		if err != nil {
+			fmt.Printf("Warning: checking track names only, audio features unavailable: %v\n", err)
+			return live
+		}
+
+		for j, feature := range features {
+			if feature != nil && feature.Liveness > maxStudioLiveness {
+				live[ids[j]] = true
+			}
+		}
+	}
+
+	return live
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	spotify "github.com/zmb3/spotify/v2"
+)
+
+func TestIsLiveAlbum(t *testing.T) {
+	tests := []struct {
+		album string
+		want  bool
+	}{
+		{"Live at Wembley Stadium", true},
+		{"LIVE IN TOKYO", true},
+		{"Hits (Live)", true},
+		{"MTV Unplugged in New York", true},
+		{"Live Through This", false},
+		{"Alive", false},
+		{"Delivered", false},
+		{"Greatest Hits", false},
+	}
+	for _, tt := range tests {
+		if got := isLiveAlbum(spotify.SimpleAlbum{Name: tt.album}); got != tt.want {
+			t.Errorf("isLiveAlbum(%q) = %v, want %v", tt.album, got, tt.want)
+		}
+	}
+}
+
+func TestFilterLiveAlbums(t *testing.T) {
+	var tracks []spotify.FullTrack
+	for id, album := range map[string]string{"studio": "Nevermind", "live": "Live at Reading", "unplugged": "MTV Unplugged in New York"} {
+		track := spotify.FullTrack{Album: spotify.SimpleAlbum{Name: album}}
+		track.ID = spotify.ID(id)
+		tracks = append(tracks, track)
+	}
+
+	filtered := FilterLiveAlbums(tracks)
+	if len(filtered) != 1 || filtered[0].ID != "studio" {
+		t.Errorf("FilterLiveAlbums kept %v, want only the studio album's track", filtered)
+	}
+	if len(FilterLiveAlbums(nil)) != 0 {
+		t.Error("FilterLiveAlbums(nil) returned tracks")
+	}
+}
+
+func TestCooldownTracksLeaveOutLiveAlbumsWhenStudioOnly(t *testing.T) {
+	liked := []string{"studio1", "live1", "studio2"}
+	p := newTestPipeline(newInstrumentalSpotify(t, true), liked, nil)
+	p.cfg.StudioOnly = true
+	p.userLikedSongs[1].Album.Name = "Live at the Apollo"
+
+	cooldown := p.cooldownTracks(nil, 3)
+	if len(cooldown) != 2 {
+		t.Fatalf("cooldown has %d tracks, want the 2 studio ones", len(cooldown))
+	}
+	for _, track := range cooldown {
+		if track.ID == "live1" {
+			t.Error("cooldown of a studio only playlist has a track of a live album")
+		}
+	}
+}
@@ -2,42 +2,479 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
 )
 
 type Weather struct {
+	// Name is the name of the place the weather is for
+	Name  string `json:"name"`
+	Coord struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"coord"`
 	Main struct {
 		Temp float64 `json:"temp"`
 	} `json:"main"`
-	Weather []struct {
-		Description string `json:"description"`
-	} `json:"weather"`
+	Weather []WeatherCondition `json:"weather"`
+	// Alerts are the active weather alerts, only fetched when weather alerts are enabled
+	Alerts []WeatherAlert `json:"alerts,omitempty"`
+}
+
+// WeatherCondition describes the weather, e.g. "light rain". Descriptions follow OpenWeatherMap, whose
+// descriptions the mood rules match; other providers describe their conditions the same way.
+type WeatherCondition struct {
+	Description string `json:"description"`
+}
+
+// WeatherAlert is an active weather alert from the OpenWeatherMap One Call API
+type WeatherAlert struct {
+	SenderName  string `json:"sender_name"`
+	Event       string `json:"event"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+	Description string `json:"description"`
+}
+
+// Location is a place returned by the OpenWeatherMap geocoding API
+type Location struct {
+	Name    string  `json:"name"`
+	State   string  `json:"state,omitempty"`
+	Country string  `json:"country"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+// String returns a human readable name for the location, e.g. "Paris, Texas, US"
+func (l Location) String() string {
+	parts := []string{l.Name}
+	if l.State != "" {
+		parts = append(parts, l.State)
+	}
+	if l.Country != "" {
+		parts = append(parts, l.Country)
+	}
+	return strings.Join(parts, ", ")
 }
 
 func GetWeather(city string) (*Weather, error) {
-	apiKey := os.Getenv("WEATHER_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("WEATHER_API_KEY environment variable not set")
+	return fetchWeather(url.Values{"q": {cityQuery(normalizeCity(city))}})
+}
+
+// normalizeCity cleans up a city name entered by the user: surrounding and repeated whitespace is dropped,
+// and a trailing two-letter country code, as in "Amsterdam,NL", is split off and upper-cased.
+// The city keeps the case it was typed in, so it can be shown back to the user.
+func normalizeCity(input string) (city, countryCode string) {
+	city = strings.Join(strings.Fields(input), " ")
+	if i := strings.LastIndex(city, ","); i >= 0 {
+		code := strings.TrimSpace(city[i+1:])
+		if len(code) == 2 && isLetters(code) {
+			city, countryCode = strings.TrimSpace(city[:i]), strings.ToUpper(code)
+		}
+	}
+	return city, countryCode
+}
+
+// isLetters reports whether s only contains ASCII letters
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// cityQuery joins a normalized city and country code back into the "City,CC" form the weather APIs take
+func cityQuery(city, countryCode string) string {
+	if countryCode == "" {
+		return city
+	}
+	return city + "," + countryCode
+}
+
+// cityCacheKey identifies a normalized city regardless of how it was capitalized
+func cityCacheKey(city, countryCode string) string {
+	return strings.ToLower(cityQuery(city, countryCode))
+}
+
+// GetWeatherByZip gets the current weather for a postal code in a country, given as an ISO 3166 code such as "US"
+func GetWeatherByZip(zip, country string) (*Weather, error) {
+	return fetchWeather(url.Values{"zip": {zip + "," + country}})
+}
+
+// Postal codes are recognized as numeric codes, optionally with a ZIP+4 extension and a country,
+// or as any code containing a digit followed by a country, such as "SW1A 1AA, GB"
+var (
+	numericZipPattern = regexp.MustCompile(`^(\d{3,10}(?:-\d{4})?)(?:\s*,\s*([A-Za-z]{2}))?$`)
+	zipCountryPattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9 -]{1,9})\s*,\s*([A-Za-z]{2})$`)
+)
+
+// ParseZip reports whether a location entered by the user is a postal code rather than a city name.
+// Codes without a country are in the configured default country.
+func ParseZip(input string) (zip, country string, ok bool) {
+	input = strings.TrimSpace(input)
+
+	match := numericZipPattern.FindStringSubmatch(input)
+	if match == nil {
+		match = zipCountryPattern.FindStringSubmatch(input)
+		if match == nil || !strings.ContainsAny(match[1], "0123456789") {
+			return "", "", false
+		}
+	}
+
+	country = strings.ToUpper(match[2])
+	if country == "" {
+		country = recommenderConfig.DefaultCountry
+	}
+	return strings.TrimSpace(match[1]), country, true
+}
+
+// GetWeatherForInput gets the weather for a city name or postal code entered by the user
+func GetWeatherForInput(input string) (*Weather, error) {
+	if zip, country, ok := ParseZip(input); ok {
+		return GetWeatherByZip(zip, country)
+	}
+	return GetWeather(input)
+}
+
+// GetWeatherByCoords gets the current weather at the given coordinates
+func GetWeatherByCoords(lat, lon float64) (*Weather, error) {
+	return fetchWeather(url.Values{
+		"lat": {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon": {strconv.FormatFloat(lon, 'f', -1, 64)},
+	})
+}
+
+// permanentWeatherError reports whether retrying a weather request that failed with err can't help
+func permanentWeatherError(err error) bool {
+	return errors.Is(err, ErrCityNotFound) || errors.Is(err, ErrWeatherAPIKey) || errors.Is(err, ErrWeatherCircuitOpen)
+}
+
+// GetWeatherWithRetry calls fetch until it succeeds, retrying up to the configured number of times
+// with a doubling delay so a brief weather API outage doesn't cost the playlist its mood
+func GetWeatherWithRetry(fetch func() (*Weather, error)) (*Weather, error) {
+	delay := recommenderConfig.WeatherRetryDelay
+
+	weather, err := fetch()
+	for attempt := 1; err != nil && !permanentWeatherError(err) && attempt <= recommenderConfig.WeatherRetries; attempt++ {
+		fmt.Printf("Weather request failed (%v), retrying in %s (%d/%d)\n", err, delay, attempt, recommenderConfig.WeatherRetries)
+		time.Sleep(delay)
+		delay *= 2
+
+		weather, err = fetch()
+	}
+
+	return weather, err
+}
+
+// WeatherProvider gets the weather from a weather service
+type WeatherProvider interface {
+	// CurrentWeather gets the current weather for a city name ("q"), a postal code with its country
+	// ("zip", e.g. "10115,DE") or coordinates ("lat" and "lon")
+	CurrentWeather(params url.Values) (*Weather, error)
+	// Geocode looks up the locations matching a city name
+	Geocode(query string) ([]Location, error)
+}
+
+// weatherHTTPClient sends the requests of every weather provider
+var weatherHTTPClient = http.DefaultClient
+
+// weatherProvider returns the provider to get the weather from: OpenWeatherMap if WEATHER_API_KEY is set,
+// and otherwise Open-Meteo, which needs no key
+func weatherProvider() WeatherProvider {
+	if keys := weatherKeys.order(os.Getenv("WEATHER_API_KEY")); len(keys) > 0 {
+		return openWeatherMap{keys: keys}
 	}
+	return openMeteo{}
+}
+
+// keyRotator hands out the OpenWeatherMap API keys in WEATHER_API_KEY, a comma-separated list, taking turns
+// as WeatherKeyRotation says. It's safe for concurrent use.
+type keyRotator struct {
+	mu sync.Mutex
+	// value is the WEATHER_API_KEY the keys were parsed from
+	value string
+	keys  []string
+	next  int
+}
+
+var weatherKeys = &keyRotator{}
+
+// order returns the keys in the order a request should try them: the key whose turn it is first, and the rest
+// in turn should it be rate limited
+func (r *keyRotator) order(value string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if value != r.value {
+		r.value, r.keys, r.next = value, nil, 0
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				r.keys = append(r.keys, key)
+			}
+		}
+	}
+	if len(r.keys) == 0 {
+		return nil
+	}
+
+	keys := append(append([]string(nil), r.keys[r.next:]...), r.keys[:r.next]...)
+	if recommenderConfig.WeatherKeyRotation != KeyRotationFailover {
+		r.next = (r.next + 1) % len(r.keys)
+	}
+	return keys
+}
+
+// rateLimited moves on from key if it's the key whose turn it is
+func (r *keyRotator) rateLimited(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	url := fmt.Sprintf("http://api.openweathermap.org/data/2.5/weather?q=%s&appid=%s&units=metric", city, apiKey)
-	resp, err := http.Get(url)
+	if len(r.keys) > 0 && r.keys[r.next] == key {
+		r.next = (r.next + 1) % len(r.keys)
+	}
+}
+
+// openWeatherMap gets the weather from OpenWeatherMap
+type openWeatherMap struct {
+	// keys are the API keys to try, in order
+	keys []string
+}
+
+// get sends a request to an OpenWeatherMap endpoint, trying the next key if the API rate limits a key
+func (o openWeatherMap) get(endpoint string, params url.Values) (*http.Response, error) {
+	for i, key := range o.keys {
+		params.Set("appid", key)
+		resp, err := weatherHTTPClient.Get(endpoint + "?" + params.Encode())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || i == len(o.keys)-1 {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		weatherKeys.rateLimited(key)
+		fmt.Printf("Weather API key %d of %d is rate limited, trying the next\n", i+1, len(o.keys))
+	}
+	return nil, ErrWeatherAPIKey
+}
+
+// CurrentWeather queries the current weather endpoint with the given location parameters
+func (o openWeatherMap) CurrentWeather(params url.Values) (*Weather, error) {
+	params.Set("units", "metric")
+
+	resp, err := o.get("http://api.openweathermap.org/data/2.5/weather", params)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: the weather API doesn't know %s", ErrCityNotFound, weatherLocation(params))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("weather API returned status %d", resp.StatusCode)
+	}
+
 	var weather Weather
 
 	if err := json.NewDecoder(resp.Body).Decode(&weather); err != nil {
 		return nil, err
 	}
-
 	return &weather, nil
 }
 
+// Geocode looks up the locations matching a city name with the OpenWeatherMap geocoding API
+func (o openWeatherMap) Geocode(query string) ([]Location, error) {
+	params := url.Values{
+		"q":     {query},
+		"limit": {"5"},
+	}
+
+	resp, err := o.get("http://api.openweathermap.org/geo/1.0/direct", params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geocoding API returned status %d", resp.StatusCode)
+	}
+
+	var locations []Location
+	if err := json.NewDecoder(resp.Body).Decode(&locations); err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// fetchWeather gets the current weather for the given location parameters from the weather provider
+func fetchWeather(params url.Values) (*Weather, error) {
+	if err := weatherBreaker.allow(); err != nil {
+		return nil, err
+	}
+	weather, err := weatherProvider().CurrentWeather(params)
+	weatherBreaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Alerts are nice to have, so the weather is still used without them
+	if recommenderConfig.WeatherAlerts {
+		alerts, err := GetWeatherAlerts(weather.Coord.Lat, weather.Coord.Lon)
+		if err != nil {
+			fmt.Printf("Warning: couldn't get weather alerts: %v\n", err)
+		}
+		weather.Alerts = alerts
+	}
+
+	return weather, nil
+}
+
+// weatherLocation describes the location of a weather request for error messages
+func weatherLocation(params url.Values) string {
+	switch {
+	case params.Get("q") != "":
+		return params.Get("q")
+	case params.Get("zip") != "":
+		return params.Get("zip")
+	}
+	return params.Get("lat") + ", " + params.Get("lon")
+}
+
+// GetWeatherAlerts gets the active weather alerts at the given coordinates from the One Call API.
+// One Call has its own subscription and rate limits, so it's only used when weather alerts are enabled.
+func GetWeatherAlerts(lat, lon float64) ([]WeatherAlert, error) {
+	keys := weatherKeys.order(os.Getenv("WEATHER_API_KEY"))
+	if len(keys) == 0 {
+		return nil, ErrWeatherAPIKey
+	}
+
+	params := url.Values{
+		"lat":     {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"lon":     {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"exclude": {"current,minutely,hourly,daily"},
+	}
+
+	if err := weatherBreaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := openWeatherMap{keys: keys}.get("https://api.openweathermap.org/data/3.0/onecall", params)
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		err = fmt.Errorf("one call API returned status %d", resp.StatusCode)
+	}
+	weatherBreaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("one call API returned status %d", resp.StatusCode)
+	}
+
+	var oneCall struct {
+		Alerts []WeatherAlert `json:"alerts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&oneCall); err != nil {
+		return nil, err
+	}
+
+	return oneCall.Alerts, nil
+}
+
+// GeocodeCity looks up the locations matching a city name, so ambiguous names can be resolved by the user
+func GeocodeCity(query string) ([]Location, error) {
+	city, countryCode := normalizeCity(query)
+	key := cityCacheKey(city, countryCode)
+	if locations, ok := geocodeCache.get(key); ok {
+		return locations, nil
+	}
+
+	// Geocoding goes to the same weather service, so it's skipped while that's down
+	if err := weatherBreaker.allow(); err != nil {
+		return nil, err
+	}
+	results, err := weatherProvider().Geocode(cityQuery(city, countryCode))
+	weatherBreaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+
+	// The API can return the same place more than once, so only keep distinct locations
+	var locations []Location
+	seen := make(map[string]bool)
+	for _, location := range results {
+		key := location.String()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		locations = append(locations, location)
+	}
+
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCityNotFound, cityQuery(city, countryCode))
+	}
+	geocodeCache.put(key, locations)
+	return locations, nil
+}
+
+// maxGeocodeCacheEntries bounds the geocoding cache, since every city typed in adds an entry
+const maxGeocodeCacheEntries = 256
+
+// locationCache remembers the locations a city name was geocoded to. Places don't move, so entries don't expire.
+// It's safe for concurrent use.
+type locationCache struct {
+	mu        sync.Mutex
+	locations map[string][]Location
+}
+
+var geocodeCache = &locationCache{locations: make(map[string][]Location)}
+
+func (c *locationCache) get(key string) ([]Location, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	locations, ok := c.locations[key]
+	if ok {
+		geocodeCacheCounters.hits.Add(1)
+	} else {
+		geocodeCacheCounters.misses.Add(1)
+	}
+	return locations, ok
+}
+
+func (c *locationCache) put(key string, locations []Location) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.locations[key]; !ok && len(c.locations) >= maxGeocodeCacheEntries {
+		// Any entry will do, looking a city up again is cheap
+		for old := range c.locations {
+			delete(c.locations, old)
+			geocodeCacheCounters.evictions.Add(1)
+			break
+		}
+	}
+	c.locations[key] = locations
+	geocodeCacheCounters.entries.Store(int64(len(c.locations)))
+}
+
 func GetMoodFromWeather(city string) string {
 	weather, err := GetWeather(city)
 	if err != nil {
@@ -45,45 +482,191 @@ func GetMoodFromWeather(city string) string {
 		return "neutral" // Default mood on error
 	}
 
+	return MoodFromWeather(weather)
+}
+
+// weatherMoodRule maps a weather description to a mood
+type weatherMoodRule struct {
+	Description string
+	Mood        string
+}
+
+// weatherMoodRules are checked in order of priority, so when the weather has several conditions, such as mist
+// and rain, the first rule matching any of them wins. Weather matching none of them gets the neutral mood.
+var weatherMoodRules = []weatherMoodRule{
+	{Description: "thunderstorm", Mood: "intense"},
+	{Description: "light rain", Mood: "relaxed"},
+	{Description: "overcast clouds", Mood: "thoughtful"},
+	{Description: "clear sky", Mood: "energetic"},
+}
+
+// MoodFromWeather picks the mood for already fetched weather data
+func MoodFromWeather(weather *Weather) string {
+	mood, rule := MatchWeatherMood(weather)
+	fmt.Printf("Mood %s chosen by rule: %s (%s)\n", mood, rule, WeatherMoodReason(weather, mood))
+	return mood
+}
+
+// MatchWeatherMood picks the mood for weather data and describes the rule that chose it
+func MatchWeatherMood(weather *Weather) (mood, rule string) {
 	if weather == nil || len(weather.Weather) == 0 {
-		fmt.Println("No weather data available")
-		return "neutral"
+		return "neutral", "no weather data"
 	}
 
-	description := weather.Weather[0].Description
-	fmt.Println("Weather description:", description)
+	// Dramatic weather sets the mood, whatever the sky looks like
+	if len(weather.Alerts) > 0 {
+		return recommenderConfig.AlertMood, fmt.Sprintf("weather alert %q is active", weather.Alerts[0].Event)
+	}
 
-	switch {
-	case description == "clear sky":
-		return "energetic"
-	case description == "overcast clouds":
-		return "thoughtful"
-	case description == "light rain":
-		return "relaxed"
-	case description == "thunderstorm":
-		return "intense"
-	default:
-		return "neutral"
+	// The first condition is the main one, and the only one looked at unless all of them are
+	conditions := weather.Weather[:1]
+	if recommenderConfig.AllWeatherConditions {
+		conditions = weather.Weather
+	}
+	for _, r := range weatherMoodRules {
+		for _, condition := range conditions {
+			if condition.Description == r.Description {
+				return r.Mood, fmt.Sprintf("description is %q", r.Description)
+			}
+		}
 	}
+
+	descriptions := make([]string, len(conditions))
+	for i, condition := range conditions {
+		descriptions[i] = fmt.Sprintf("%q", condition.Description)
+	}
+	return "neutral", fmt.Sprintf("no rule for description %s", strings.Join(descriptions, " or "))
+}
+
+// WeatherMoodReason explains in a few words why the weather got its mood, e.g. "overcast clouds + 11°C → thoughtful"
+func WeatherMoodReason(weather *Weather, mood string) string {
+	if weather == nil || len(weather.Weather) == 0 {
+		return "no weather data → " + mood
+	}
+	if len(weather.Alerts) > 0 {
+		return fmt.Sprintf("%s alert → %s", weather.Alerts[0].Event, mood)
+	}
+	return fmt.Sprintf("%s + %.0f°C → %s", weather.Weather[0].Description, weather.Main.Temp, mood)
+}
+
+// errNoCity is returned when no city was given and there's no terminal to ask for one
+var errNoCity = errors.New("no city given: enter a city, or set DEFAULT_CITY to run without a terminal")
+
+// stdinIsTerminal reports whether stdin is an interactive terminal. In a container or under systemd stdin is
+// usually closed or /dev/null, and prompting on it would block or read nothing. /dev/null is a character device
+// too, so this asks the terminal driver rather than checking the file mode.
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
 }
 
-func GetWeatherAndMood() (*Weather, string) {
+// promptCity asks for a city in the terminal. Without a terminal, the configured default city is used instead.
+func promptCity() (string, error) {
+	if !stdinIsTerminal() {
+		if recommenderConfig.DefaultCity == "" {
+			return "", errNoCity
+		}
+		fmt.Printf("No terminal to ask for a city, using %s\n", recommenderConfig.DefaultCity)
+		return recommenderConfig.DefaultCity, nil
+	}
+
 	var city string
-	fmt.Println("Enter city: ")
+	fmt.Println("Enter city or postal code: ")
 	fmt.Scanln(&city)
+	return city, nil
+}
 
-	weather, err := GetWeather(city)
+func GetWeatherAndMood(city string) (*Weather, string) {
+	weather, err := GetWeatherWithRetry(func() (*Weather, error) { return GetWeatherForInput(city) })
+	if err == nil && (weather == nil || len(weather.Weather) == 0) {
+		err = fmt.Errorf("no weather data available for %s", city)
+	}
+
+	// Try the fallback cities before giving up on the weather
 	if err != nil {
 		fmt.Println("Error getting weather data:", err)
-		return &Weather{}, "neutral"
+		weather, err = GetFallbackWeather(city)
+		if err != nil {
+			fmt.Println(err)
+			return &Weather{}, "neutral"
+		}
 	}
 
-	// Check if weather data is valid
-	if weather == nil || len(weather.Weather) == 0 {
-		fmt.Println("No weather data available for", city)
-		return &Weather{}, "neutral"
+	mood := MoodFromWeather(weather)
+	return weather, mood
+}
+
+// ParseCityList splits a list of cities or postal codes. They're separated by semicolons, as a city can have
+// a country after a comma, e.g. "10115, DE".
+func ParseCityList(value string) []string {
+	var cities []string
+	for _, city := range strings.Split(value, ";") {
+		if city = strings.TrimSpace(city); city != "" {
+			cities = append(cities, city)
+		}
 	}
+	return cities
+}
 
-	mood := GetMoodFromWeather(city)
-	return weather, mood
+// PickMostExtreme picks the city with the most extreme weather from a list of cities
+const PickMostExtreme = "mostExtreme"
+
+// weatherExtremity scores how far weather is from neutral. Active alerts count most, then the mood by how
+// strong it is, then how far the temperature is from comfortable.
+func weatherExtremity(weather *Weather) float64 {
+	score := math.Abs(weather.Main.Temp-recommenderConfig.ComfortableTemperature) / temperatureIntensitySpan
+	if len(weather.Alerts) > 0 {
+		score += 4
+	}
+
+	switch mood, _ := MatchWeatherMood(weather); mood {
+	case "intense":
+		score += 2
+	case "neutral":
+	default:
+		score++
+	}
+	return score
+}
+
+// MostExtremeWeather gets the weather of every city and returns the most extreme one.
+// Cities whose weather can't be fetched are skipped.
+func MostExtremeWeather(cities []string) (*Weather, error) {
+	var extreme *Weather
+	best := -1.0
+	for _, city := range cities {
+		weather, err := GetWeatherWithRetry(func() (*Weather, error) { return GetWeatherForInput(city) })
+		if err != nil || weather == nil || len(weather.Weather) == 0 {
+			fmt.Printf("Skipping %s, its weather couldn't be fetched: %v\n", city, err)
+			continue
+		}
+
+		score := weatherExtremity(weather)
+		fmt.Printf("%s: %s at %.0f°C scores %.2f\n", city, weather.Weather[0].Description, weather.Main.Temp, score)
+		if score > best {
+			extreme, best = weather, score
+		}
+	}
+
+	if extreme == nil {
+		return nil, fmt.Errorf("the weather of none of the %d cities could be fetched", len(cities))
+	}
+	fmt.Printf("Picked %s for the most extreme weather\n", extreme.Name)
+	return extreme, nil
+}
+
+// GetFallbackWeather gets the weather of the first of the configured fallback cities that resolves,
+// for when the weather of city couldn't be found
+func GetFallbackWeather(city string) (*Weather, error) {
+	for _, fallback := range recommenderConfig.FallbackCities {
+		weather, err := GetWeatherForInput(fallback)
+		if err == nil && (weather == nil || len(weather.Weather) == 0) {
+			err = errors.New("the weather API returned no weather")
+		}
+		if err == nil {
+			fmt.Printf("Using the weather in %s instead of %s\n", fallback, city)
+			return weather, nil
+		}
+		fmt.Printf("No weather data for fallback city %s either: %v\n", fallback, err)
+	}
+	return nil, fmt.Errorf("no weather data for %s or any fallback city, using the neutral mood", city)
 }
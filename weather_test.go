@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMatchWeatherMood(t *testing.T) {
+	tests := []struct {
+		id          int
+		description string
+		temp        float64
+		want        string
+	}{
+		// 2xx thunderstorm: only the plain thunderstorm has a rule
+		{211, "thunderstorm", 18, "intense"},
+		{211, "thunderstorm", -2, "intense"},
+		{200, "thunderstorm with light rain", 18, "neutral"},
+		{212, "heavy thunderstorm", 18, "neutral"},
+
+		// 3xx drizzle
+		{300, "light intensity drizzle", 12, "neutral"},
+		{311, "drizzle rain", 12, "neutral"},
+
+		// 5xx rain: only light rain has a rule
+		{500, "light rain", 12, "relaxed"},
+		{500, "light rain", 35, "relaxed"},
+		{501, "moderate rain", 12, "neutral"},
+		{511, "freezing rain", -1, "neutral"},
+
+		// 6xx snow
+		{600, "light snow", -3, "neutral"},
+		{602, "heavy snow", -10, "neutral"},
+
+		// 7xx atmosphere
+		{701, "mist", 8, "neutral"},
+		{741, "fog", 8, "neutral"},
+		{781, "tornado", 25, "neutral"},
+
+		// 800 clear and the 80x clouds on either side of the boundary
+		{800, "clear sky", 25, "energetic"},
+		{800, "clear sky", -15, "energetic"},
+		{800, "clear sky", 45, "energetic"},
+		{801, "few clouds", 25, "neutral"},
+		{803, "broken clouds", 15, "neutral"},
+		{804, "overcast clouds", 11, "thoughtful"},
+		{804, "overcast clouds", 30, "thoughtful"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d %s %.0f°C", test.id, test.description, test.temp), func(t *testing.T) {
+			// Decode the weather the way the OpenWeatherMap API returns it
+			var weather Weather
+			response := fmt.Sprintf(`{"name":"Test","main":{"temp":%g},"weather":[{"id":%d,"description":%q}]}`,
+				test.temp, test.id, test.description)
+			if err := json.Unmarshal([]byte(response), &weather); err != nil {
+				t.Fatal(err)
+			}
+
+			if mood, rule := MatchWeatherMood(&weather); mood != test.want {
+				t.Errorf("MatchWeatherMood = %s (%s), want %s", mood, rule, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchWeatherMoodWithSeveralConditions(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+
+	var weather Weather
+	response := `{"weather":[{"id":701,"description":"mist"},{"id":500,"description":"light rain"},{"id":211,"description":"thunderstorm"}]}`
+	if err := json.Unmarshal([]byte(response), &weather); err != nil {
+		t.Fatal(err)
+	}
+
+	// The thunderstorm outranks the rain, even though it comes last
+	recommenderConfig.AllWeatherConditions = true
+	if mood, rule := MatchWeatherMood(&weather); mood != "intense" {
+		t.Errorf("MatchWeatherMood with all conditions = %s (%s), want intense", mood, rule)
+	}
+
+	// Only the mist counts otherwise, which has no rule
+	recommenderConfig.AllWeatherConditions = false
+	if mood, rule := MatchWeatherMood(&weather); mood != "neutral" {
+		t.Errorf("MatchWeatherMood with the main condition = %s (%s), want neutral", mood, rule)
+	}
+}
+
+func TestMatchWeatherMoodWithoutRules(t *testing.T) {
+	if mood, _ := MatchWeatherMood(nil); mood != "neutral" {
+		t.Errorf("MatchWeatherMood without weather = %s, want neutral", mood)
+	}
+	if mood, _ := MatchWeatherMood(&Weather{}); mood != "neutral" {
+		t.Errorf("MatchWeatherMood without conditions = %s, want neutral", mood)
+	}
+
+	// An active alert overrides any condition
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.AlertMood = "intense"
+
+	var weather Weather
+	if err := json.Unmarshal([]byte(`{"weather":[{"id":800,"description":"clear sky"}]}`), &weather); err != nil {
+		t.Fatal(err)
+	}
+	weather.Alerts = []WeatherAlert{{Event: "Storm warning"}}
+	if mood, _ := MatchWeatherMood(&weather); mood != "intense" {
+		t.Errorf("MatchWeatherMood with an alert = %s, want intense", mood)
+	}
+}
+
+func TestWeatherExtremity(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.ComfortableTemperature = 20
+	recommenderConfig.AlertMood = "intense"
+
+	weather := func(description string, temp float64, alerts ...WeatherAlert) *Weather {
+		var w Weather
+		response := fmt.Sprintf(`{"main":{"temp":%g},"weather":[{"description":%q}]}`, temp, description)
+		if err := json.Unmarshal([]byte(response), &w); err != nil {
+			t.Fatal(err)
+		}
+		w.Alerts = alerts
+		return &w
+	}
+
+	// From most to least extreme
+	ordered := []*Weather{
+		weather("few clouds", 20, WeatherAlert{Event: "Heat warning"}),
+		weather("thunderstorm", 20),
+		weather("clear sky", 35),
+		weather("clear sky", 20),
+		weather("few clouds", 5),
+		weather("few clouds", 15),
+		weather("few clouds", 20),
+	}
+	for i := 1; i < len(ordered); i++ {
+		prev, next := weatherExtremity(ordered[i-1]), weatherExtremity(ordered[i])
+		if prev <= next {
+			t.Errorf("%s at %.0f°C scores %.2f, not more than %s at %.0f°C with %.2f",
+				ordered[i-1].Weather[0].Description, ordered[i-1].Main.Temp, prev,
+				ordered[i].Weather[0].Description, ordered[i].Main.Temp, next)
+		}
+	}
+}
+
+func TestParseCityList(t *testing.T) {
+	got := ParseCityList(" Oslo ;10115, DE;; Madrid")
+	want := []string{"Oslo", "10115, DE", "Madrid"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ParseCityList = %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeCity(t *testing.T) {
+	tests := []struct {
+		input, city, country string
+	}{
+		{"  amsterdam ", "amsterdam", ""},
+		{"Amsterdam,NL", "Amsterdam", "NL"},
+		{"Amsterdam , nl ", "Amsterdam", "NL"},
+		{"new  york   city", "new york city", ""},
+		{"Washington, D.C.", "Washington, D.C.", ""},
+		{"Paris, Texas, US", "Paris, Texas", "US"},
+		{"Oslo,N0", "Oslo,N0", ""},
+		{"   ", "", ""},
+	}
+
+	for _, tt := range tests {
+		city, country := normalizeCity(tt.input)
+		if city != tt.city || country != tt.country {
+			t.Errorf("normalizeCity(%q) = %q, %q, want %q, %q", tt.input, city, country, tt.city, tt.country)
+		}
+	}
+}
+
+func TestCityCacheKeyIgnoresFormatting(t *testing.T) {
+	want := cityCacheKey(normalizeCity("Amsterdam,NL"))
+	for _, input := range []string{"  amsterdam, nl", "AMSTERDAM ,NL", "Amsterdam,  nl  "} {
+		if got := cityCacheKey(normalizeCity(input)); got != want {
+			t.Errorf("cityCacheKey for %q = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestLocationCacheEvictsWhenFull(t *testing.T) {
+	cache := &locationCache{locations: make(map[string][]Location)}
+	for i := range maxGeocodeCacheEntries + 1 {
+		cache.put(fmt.Sprint("city", i), []Location{{Name: fmt.Sprint("City ", i)}})
+	}
+
+	if len(cache.locations) != maxGeocodeCacheEntries {
+		t.Errorf("cache holds %d entries, want %d", len(cache.locations), maxGeocodeCacheEntries)
+	}
+	if _, ok := cache.get(fmt.Sprint("city", maxGeocodeCacheEntries)); !ok {
+		t.Error("the newest entry was evicted")
+	}
+}
+
+func TestWMOCodesMatchMoodRules(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{0, "energetic"},
+		{1, "neutral"},
+		{3, "thoughtful"},
+		{61, "relaxed"},
+		{63, "neutral"},
+		{95, "intense"},
+		{99, "neutral"},
+		{42, "neutral"},
+	}
+
+	for _, test := range tests {
+		weather := &Weather{Weather: []WeatherCondition{{Description: wmoDescription(test.code)}}}
+		if mood, rule := MatchWeatherMood(weather); mood != test.want {
+			t.Errorf("WMO code %d: MatchWeatherMood = %s (%s), want %s", test.code, mood, rule, test.want)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+	recommenderConfig.WeatherBreakerThreshold = 2
+	recommenderConfig.WeatherBreakerCooldown = time.Hour
+
+	outage := errors.New("status 500")
+	b := &circuitBreaker{}
+
+	// An unknown city isn't an outage
+	b.record(outage)
+	b.record(ErrCityNotFound)
+	b.record(outage)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow after failures that aren't in a row = %v, want nil", err)
+	}
+
+	b.record(outage)
+	if err := b.allow(); !errors.Is(err, ErrWeatherCircuitOpen) {
+		t.Fatalf("allow after 2 failures in a row = %v, want ErrWeatherCircuitOpen", err)
+	}
+
+	// Once the cooldown has passed, one request finds out if the service is back
+	b.openUntil = time.Now().Add(-time.Second)
+	if err := b.allow(); err != nil {
+		t.Fatalf("allow after the cooldown = %v, want nil", err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrWeatherCircuitOpen) {
+		t.Errorf("second allow while half-open = %v, want ErrWeatherCircuitOpen", err)
+	}
+	b.record(nil)
+	if state := b.status().State; state != BreakerClosed {
+		t.Errorf("state after a successful probe = %s, want %s", state, BreakerClosed)
+	}
+}
+
+func TestKeyRotator(t *testing.T) {
+	saved := recommenderConfig
+	defer func() { recommenderConfig = saved }()
+
+	rotator := &keyRotator{}
+	recommenderConfig.WeatherKeyRotation = KeyRotationRoundRobin
+	for _, want := range []string{"[a b c]", "[b c a]", "[c a b]", "[a b c]"} {
+		if got := fmt.Sprint(rotator.order(" a, b ,,c")); got != want {
+			t.Errorf("round-robin order = %s, want %s", got, want)
+		}
+	}
+
+	rotator = &keyRotator{}
+	recommenderConfig.WeatherKeyRotation = KeyRotationFailover
+	rotator.order("a,b")
+	if got := fmt.Sprint(rotator.order("a,b")); got != "[a b]" {
+		t.Errorf("failover order = %s, want the first key until it's rate limited", got)
+	}
+	rotator.rateLimited("a")
+	if got := fmt.Sprint(rotator.order("a,b")); got != "[b a]" {
+		t.Errorf("failover order after a was rate limited = %s, want [b a]", got)
+	}
+}
+
+// weatherTransport answers weather API requests with a handler, whatever their host
+type weatherTransport struct {
+	handler http.HandlerFunc
+}
+
+func (t weatherTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.handler(recorder, req)
+	return recorder.Result(), nil
+}
+
+func TestOpenWeatherMapTriesNextKeyWhenRateLimited(t *testing.T) {
+	saved := weatherHTTPClient
+	defer func() { weatherHTTPClient = saved }()
+
+	var tried []string
+	weatherHTTPClient = &http.Client{Transport: weatherTransport{func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("appid")
+		tried = append(tried, key)
+		if key == "limited" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"name": "Oslo", "weather": [{"description": "clear sky"}]}`)
+	}}}
+
+	weather, err := openWeatherMap{keys: []string{"limited", "fresh"}}.CurrentWeather(url.Values{"q": {"Oslo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weather.Name != "Oslo" {
+		t.Errorf("got the weather for %q, want Oslo", weather.Name)
+	}
+	if fmt.Sprint(tried) != "[limited fresh]" {
+		t.Errorf("tried keys %v, want [limited fresh]", tried)
+	}
+}
+
+func TestWeatherHandlerReportsFailedCreationForFoundCity(t *testing.T) {
+	savedConfig, savedClient, savedHTTP := recommenderConfig, authenticatedClient, weatherHTTPClient
+	defer func() {
+		recommenderConfig, authenticatedClient, weatherHTTPClient = savedConfig, savedClient, savedHTTP
+	}()
+	recommenderConfig.WeatherRetries = 0
+	recommenderConfig.WeatherBreakerCooldown = 0
+
+	// The city is found, but its weather isn't, and without liked songs the neutral playlist fails too
+	geocodeCache.put(cityCacheKey("Oslo", ""), []Location{{Name: "Oslo", Lat: 59.91, Lon: 10.75}})
+	weatherHTTPClient = &http.Client{Transport: weatherTransport{func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}}}
+	authenticatedClient = newFakeSpotify(t, nil)
+
+	recorder := httptest.NewRecorder()
+	CreatePlaylistHandlerByWeather(recorder, httptest.NewRequest("POST", "/create-playlist-weather?city=Oslo", nil))
+
+	if recorder.Code == http.StatusOK {
+		t.Errorf("failed creation responded with %d, want an error", recorder.Code)
+	}
+}
+
+func TestGeocodeCitySkipsTheWeatherServiceWhileItsDown(t *testing.T) {
+	savedConfig, savedBreaker, savedHTTP := recommenderConfig, weatherBreaker, weatherHTTPClient
+	defer func() { recommenderConfig, weatherBreaker, weatherHTTPClient = savedConfig, savedBreaker, savedHTTP }()
+	recommenderConfig.WeatherBreakerThreshold = 1
+	recommenderConfig.WeatherBreakerCooldown = time.Hour
+	weatherBreaker = &circuitBreaker{}
+
+	calls := 0
+	weatherHTTPClient = &http.Client{Transport: weatherTransport{func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}}}
+
+	if _, err := GeocodeCity("Atlantis Down"); err == nil {
+		t.Fatal("geocoding during an outage succeeded")
+	}
+	if _, err := GeocodeCity("Atlantis Down"); !errors.Is(err, ErrWeatherCircuitOpen) {
+		t.Errorf("geocoding once the breaker opened returned %v, want ErrWeatherCircuitOpen", err)
+	}
+	if calls != 1 {
+		t.Errorf("called the weather service %d times, want 1", calls)
+	}
+}
+
+func TestWeatherHandlerTriesFallbackCitiesForUnknownCity(t *testing.T) {
+	savedConfig, savedClient, savedHTTP := recommenderConfig, authenticatedClient, weatherHTTPClient
+	defer func() {
+		recommenderConfig, authenticatedClient, weatherHTTPClient = savedConfig, savedClient, savedHTTP
+	}()
+	recommenderConfig.WeatherRetries = 0
+	recommenderConfig.WeatherBreakerCooldown = 0
+	recommenderConfig.FallbackCities = []string{"Lisbon"}
+
+	// The entered city doesn't exist, so the weather of the fallback city is asked for
+	var asked []string
+	weatherHTTPClient = &http.Client{Transport: weatherTransport{func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		asked = append(asked, name)
+		if name == "Atlantis" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{}})
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}}}
+	authenticatedClient = newFakeSpotify(t, nil)
+
+	recorder := httptest.NewRecorder()
+	CreatePlaylistHandlerByWeather(recorder, httptest.NewRequest("POST", "/create-playlist-weather?city=Atlantis", nil))
+
+	if recorder.Code == http.StatusNotFound {
+		t.Errorf("unknown city responded with %d, want the fallback cities to be tried", recorder.Code)
+	}
+	if !slices.Contains(asked, "Lisbon") {
+		t.Errorf("asked the weather service for %v, want the fallback city Lisbon", asked)
+	}
+}
+
+func TestPromptCityWithoutTerminal(t *testing.T) {
+	savedConfig, savedStdin := recommenderConfig, os.Stdin
+	defer func() { recommenderConfig, os.Stdin = savedConfig, savedStdin }()
+
+	// /dev/null is a character device, as under systemd or docker without -i, but not a terminal
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdin = devNull
+
+	recommenderConfig.DefaultCity = ""
+	if _, err := promptCity(); !errors.Is(err, errNoCity) {
+		t.Errorf("promptCity without a terminal or default city returned %v, want errNoCity", err)
+	}
+
+	recommenderConfig.DefaultCity = "Oslo"
+	if city, err := promptCity(); err != nil || city != "Oslo" {
+		t.Errorf("promptCity without a terminal = %q, %v, want the default city Oslo", city, err)
+	}
+}